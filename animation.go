@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// defaultAnimationDelay is how long frames of animations are shown, in
+	// milliseconds, when they don't set a delay.
+	defaultAnimationDelay = 100
+	// defaultAnimationSize is the longest side of animations that don't set
+	// a size. GIFs get large fast, and review animations don't need more.
+	defaultAnimationSize = 480
+	// maxAnimationSize is the largest size animations can set.
+	maxAnimationSize = 2048
+)
+
+// Animate implements the Animator interface. It decodes the frames one at a
+// time, scaling each down before the next is decoded, so a single decode
+// slot is held for the whole animation, and encodes them as a looping GIF.
+func (c *ImagingCropper) Animate(ctx context.Context, open func(filename string) (io.ReadCloser, error), w io.Writer, op AnimationOperation) error {
+	size := op.Size
+	if size == 0 {
+		size = defaultAnimationSize
+	}
+	delay := op.Delay
+	if delay == 0 {
+		delay = defaultAnimationDelay
+	}
+
+	release, err := c.Decodes.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	anim := &gif.GIF{}
+	var canvas image.Rectangle
+	for i, filename := range op.Filenames {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f, err := open(filename)
+		if err != nil {
+			return err
+		}
+		src, err := c.decode(ctx, f, filename)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode frame %s: %w", filename, err)
+		}
+		var frame image.Image = imaging.Fit(src, size, size, imaging.Lanczos)
+		if i == 0 {
+			canvas = frame.Bounds()
+		} else if frame.Bounds().Size() != canvas.Size() {
+			// Frames of another aspect ratio, such as a portrait still in
+			// a landscape burst, are letterboxed to the first one.
+			frame = imaging.PasteCenter(imaging.New(canvas.Dx(), canvas.Dy(), color.Black), imaging.Fit(frame, canvas.Dx(), canvas.Dy(), imaging.Lanczos))
+		}
+		paletted := image.NewPaletted(canvas, palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, canvas, frame, frame.Bounds().Min)
+		anim.Image = append(anim.Image, paletted)
+		anim.Delay = append(anim.Delay, max(1, (delay+5)/10))
+	}
+	if err := gif.EncodeAll(w, anim); err != nil {
+		return fmt.Errorf("failed to encode animation: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"os/signal"
+
+	"github.com/rs/zerolog/log"
+)
+
+type applyCmd struct {
+	RootDir        string `arg:"" help:"Root directory the operations' filenames are relative to"`
+	OperationsFile string `arg:"" help:"JSONL file with one operation per line, or - to read from stdin" default:"-"`
+	ShellOut       bool   `help:"Print a shell script of cp and ImageMagick convert commands equivalent to the operations instead of executing them"`
+	ContactSheet   string `help:"Write a JPEG contact sheet of the planned crops, outlined on thumbnails of their sources, to this path instead of executing the operations" type:"path"`
+	Checkpoint     string `help:"Record the operations that completed in this file, so an interrupted run can be continued with --resume" type:"path"`
+	Resume         bool   `help:"Skip the operations that --checkpoint records as completed by an earlier run, instead of starting the checkpoint over"`
+
+	Log  logFlags  `embed:""`
+	Exec execFlags `embed:""`
+}
+
+func (cmd *applyCmd) Run() error {
+	closeLog, err := cmd.Log.setup()
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	ctx = log.Logger.WithContext(ctx)
+
+	executor, err := cmd.Exec.newExecutor(cmd.RootDir)
+	if err != nil {
+		return err
+	}
+	defer executor.Close()
+
+	r, err := openInput(cmd.OperationsFile)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var readErr error
+	ops := func(yield func(Operation) bool) {
+		for op, err := range readOperations(r) {
+			if err != nil {
+				readErr = err
+				return
+			}
+			if !yield(op) {
+				return
+			}
+		}
+	}
+
+	if cmd.Resume && cmd.Checkpoint == "" {
+		return errors.New("--resume needs --checkpoint to know what completed")
+	}
+	if cmd.Resume && cmd.Exec.OutputZipByType {
+		return errors.New("--resume can't be combined with --output-zip-by-type, whose archives are written over by every run")
+	}
+	if cmd.ShellOut && cmd.ContactSheet != "" {
+		return errors.New("--shell-out can't be combined with --contact-sheet")
+	}
+	if cmd.ContactSheet != "" {
+		return errors.Join(readErr, writeContactSheet(ctx, executor, cmd.ContactSheet, ops))
+	}
+	if cmd.ShellOut {
+		return errors.Join(readErr, executor.WriteShellScript(ctx, os.Stdout, ops))
+	}
+	if cmd.Checkpoint != "" {
+		checkpoint, err := openCheckpoint(cmd.Checkpoint, cmd.Resume, executor.modes())
+		if err != nil {
+			return err
+		}
+		defer checkpoint.Close()
+		executor.Checkpoint = checkpoint
+	}
+	execErr := executor.ExecSeq(ctx, ops)
+	return errors.Join(readErr, execErr)
+}
+
+// writeContactSheet writes the contact sheet of ops to path. A sheet with
+// only some cells missing is kept, but an empty file is removed again.
+func writeContactSheet(ctx context.Context, executor *OperationExecutor, path string, ops iter.Seq[Operation]) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create contact sheet: %w", err)
+	}
+	sheetErr := executor.WriteContactSheet(ctx, f, ops)
+	if err := f.Close(); err != nil {
+		sheetErr = errors.Join(sheetErr, fmt.Errorf("failed to write contact sheet: %w", err))
+	}
+	if info, err := os.Stat(path); err == nil && info.Size() == 0 {
+		os.Remove(path)
+	}
+	return sheetErr
+}
+
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// readOperations decodes JSONL operations from r one line at a time, so
+// the whole input never has to be held in memory. Blank lines and comment
+// lines, starting with # or //, are skipped.
+// Malformed lines are yielded as errors prefixed with their line number,
+// and iteration continues past them as long as the caller keeps going.
+// Read errors end the iteration.
+func readOperations(r io.Reader) iter.Seq2[Operation, error] {
+	return func(yield func(Operation, error) bool) {
+		for line, err := range readOperationLines(r) {
+			if !yield(line.Operation, err) {
+				return
+			}
+		}
+	}
+}
+
+// isBlankOrComment reports whether line of an operations file has no
+// operation: it's blank, or a comment annotating the file that starts
+// with # or //.
+func isBlankOrComment(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	return len(line) == 0 || bytes.HasPrefix(line, []byte("#")) || bytes.HasPrefix(line, []byte("//"))
+}
+
+// operationLine is an operation along with the line it was read from.
+type operationLine struct {
+	Line      int
+	Operation Operation
+}
+
+// readOperationLines is like readOperations, but also yields the line
+// number of each operation.
+func readOperationLines(r io.Reader) iter.Seq2[operationLine, error] {
+	return func(yield func(operationLine, error) bool) {
+		br := bufio.NewReader(r)
+		for lineNo := 1; ; lineNo++ {
+			line, err := br.ReadBytes('\n')
+			if !isBlankOrComment(line) {
+				var op Operation
+				if err := json.Unmarshal(line, &op); err != nil {
+					if !yield(operationLine{Line: lineNo}, fmt.Errorf("line %d: %w", lineNo, err)) {
+						return
+					}
+				} else if !yield(operationLine{Line: lineNo, Operation: op}, nil) {
+					return
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				yield(operationLine{}, fmt.Errorf("failed to read operations: %w", err))
+				return
+			}
+		}
+	}
+}
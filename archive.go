@@ -0,0 +1,311 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sourceArchive is a zip archive served as a read-only root. Its images are
+// listed and read in place, without extracting it. Filenames are relative
+// to the root of the archive, like those of a directory root.
+type sourceArchive struct {
+	path   string
+	reader *zip.ReadCloser
+	// modTime is when the archive itself was modified, since its entries
+	// can't change without it changing.
+	modTime time.Time
+}
+
+// isArchiveRoot reports whether root is a zip archive instead of a
+// directory.
+func isArchiveRoot(root string) bool {
+	if !strings.EqualFold(filepath.Ext(root), ".zip") {
+		return false
+	}
+	info, err := os.Stat(root)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// archiveOutputDir returns the output directory of the archive at path,
+// which is placed next to it.
+func archiveOutputDir(path string) string {
+	return filepath.Join(filepath.Dir(path), "output")
+}
+
+func openSourceArchive(path string) (*sourceArchive, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive %s: %w", path, err)
+	}
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive %s: %w", path, err)
+	}
+	return &sourceArchive{path: path, reader: reader, modTime: info.ModTime()}, nil
+}
+
+func (a *sourceArchive) Close() error {
+	return a.reader.Close()
+}
+
+// httpFS returns the archive as a file system for serving its files. Like
+// http.Dir, names are cleaned first, so ".." can't escape the root.
+func (a *sourceArchive) httpFS() http.FileSystem {
+	return archiveHTTPFS{http.FS(a.reader)}
+}
+
+type archiveHTTPFS struct {
+	http.FileSystem
+}
+
+func (f archiveHTTPFS) Open(name string) (http.File, error) {
+	return f.FileSystem.Open(path.Clean("/" + name))
+}
+
+// entryName converts name, relative to the root of the archive, to the
+// name of its entry, rejecting names that would escape the archive.
+func entryName(name string) (string, error) {
+	entry := path.Clean(filepath.ToSlash(name))
+	if !fs.ValidPath(entry) {
+		return "", fmt.Errorf("invalid source filename %q", name)
+	}
+	return entry, nil
+}
+
+// stream opens the file name for reading from the start. It can only seek
+// forward, which is all reading an image header takes.
+func (a *sourceArchive) stream(name string) (io.ReadSeekCloser, error) {
+	entry, err := entryName(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := a.reader.Open(entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s in archive %s: %w", name, a.path, err)
+	}
+	return &forwardSeeker{ReadCloser: f}, nil
+}
+
+// Open reads the file name into memory, since entries are compressed and
+// can't be seeked.
+func (a *sourceArchive) Open(name string) (io.ReadSeekCloser, error) {
+	f, err := a.stream(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s in archive %s: %w", name, a.path, err)
+	}
+	return nopSeekCloser{bytes.NewReader(data)}, nil
+}
+
+// Stat returns the file info of the file name.
+func (a *sourceArchive) Stat(name string) (fs.FileInfo, error) {
+	entry, err := entryName(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Stat(a.reader, entry)
+}
+
+// state returns the state of every listing of the archive, which only
+// changes with the archive itself.
+func (a *sourceArchive) state() listingState {
+	return listingState{entries: len(a.reader.File), latest: a.modTime}
+}
+
+// walkImages is walkImages for the archive.
+func (a *sourceArchive) walkImages(opts WalkOptions) (Directory, error) {
+	var files []FileInfo
+	var skipped SkippedFiles
+	sidecars := sidecarIndex{}
+	if err := fs.WalkDir(a.reader, ".", func(entry string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath := filepath.FromSlash(entry)
+		if d.IsDir() {
+			if isArchiveMetadataDir(d.Name()) || !opts.withinDepth(relPath) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		file, reason, err := a.fileInfo(relPath, d, opts)
+		if err != nil {
+			return err
+		}
+		if reason != notSkipped {
+			if reason == skipUnsupported && isSidecarFile(relPath) {
+				sidecars.add(relPath)
+			}
+			skipped.add(reason)
+			return nil
+		}
+		files = append(files, file)
+		return nil
+	}); err != nil {
+		return Directory{}, fmt.Errorf("failed to read archive %s: %w", a.path, err)
+	}
+
+	sidecars.attach(files)
+	readImageInfosFrom(a.stream, files, opts)
+	skipped.countCorrupt(files)
+
+	return Directory{
+		Name:    a.name(),
+		Files:   files,
+		Skipped: &skipped,
+	}, nil
+}
+
+// listDirectory is listDirectory for the archive.
+func (a *sourceArchive) listDirectory(dir string, opts WalkOptions) (Directory, error) {
+	relDir := filepath.FromSlash(strings.Trim(dir, "/"))
+	if relDir != "" && !filepath.IsLocal(relDir) {
+		return Directory{}, fmt.Errorf("invalid directory %q", dir)
+	}
+	if relDir != "" && !opts.withinDepth(relDir) {
+		return Directory{}, fmt.Errorf("directory %q is deeper than the maximum depth of %d", dir, opts.MaxDepth)
+	}
+	entry, err := entryName(relDir)
+	if err != nil {
+		return Directory{}, err
+	}
+	entries, err := fs.ReadDir(a.reader, entry)
+	if err != nil {
+		return Directory{}, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	var dirs, files []FileInfo
+	var skipped SkippedFiles
+	sidecars := sidecarIndex{}
+	for _, d := range entries {
+		relPath := filepath.Join(relDir, d.Name())
+		if d.IsDir() {
+			if !isArchiveMetadataDir(d.Name()) && opts.withinDepth(relPath) {
+				dirs = append(dirs, FileInfo{Name: relPath, IsDir: true})
+			}
+			continue
+		}
+		file, reason, err := a.fileInfo(relPath, d, opts)
+		if err != nil {
+			return Directory{}, err
+		}
+		if reason != notSkipped {
+			if reason == skipUnsupported && isSidecarFile(relPath) {
+				sidecars.add(relPath)
+			}
+			skipped.add(reason)
+			continue
+		}
+		files = append(files, file)
+	}
+	sidecars.attach(files)
+	readImageInfosFrom(a.stream, files, opts)
+	skipped.countCorrupt(files)
+
+	name := a.name()
+	if relDir != "" {
+		name = filepath.Base(relDir)
+	}
+	return Directory{
+		Name:       name,
+		Files:      append(dirs, files...),
+		Navigation: newNavigation(a.name(), relDir),
+		Skipped:    &skipped,
+	}, nil
+}
+
+// fileInfo returns the listing entry of the file d at relPath, or why it's
+// left out of listings.
+func (a *sourceArchive) fileInfo(relPath string, d fs.DirEntry, opts WalkOptions) (FileInfo, skipReason, error) {
+	if reason := opts.skips(relPath); reason != notSkipped {
+		return FileInfo{}, reason, nil
+	}
+	info, err := d.Info()
+	if err != nil {
+		return FileInfo{}, notSkipped, fmt.Errorf("failed to get file info: %w", err)
+	}
+	if !opts.settled(info.ModTime()) {
+		return FileInfo{}, skipRecent, nil
+	}
+	return FileInfo{
+		Name:       relPath,
+		SizeBytes:  info.Size(),
+		ModifiedAt: info.ModTime(),
+		// Archives don't record creation times.
+		CreatedAt: info.ModTime(),
+	}, notSkipped, nil
+}
+
+// isArchiveMetadataDir reports whether name is a directory archivers add
+// for their own metadata, such as the resource forks macOS stores as
+// ._IMG_0001.JPG files, which look like images but aren't.
+func isArchiveMetadataDir(name string) bool {
+	return name == "__MACOSX"
+}
+
+// name is the name of the root, the archive's name without its extension.
+func (a *sourceArchive) name() string {
+	base := filepath.Base(a.path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// forwardSeeker makes a stream seekable forward from its current position,
+// by reading and discarding what's skipped.
+type forwardSeeker struct {
+	io.ReadCloser
+	pos int64
+}
+
+func (s *forwardSeeker) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+func (s *forwardSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		offset -= s.pos
+	case io.SeekCurrent:
+	default:
+		return s.pos, errors.New("archive entries can't be seeked from their end")
+	}
+	if offset < 0 {
+		return s.pos, errors.New("archive entries can only be seeked forward")
+	}
+	n, err := io.CopyN(io.Discard, s.ReadCloser, offset)
+	s.pos += n
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return s.pos, err
+}
+
+// hash is hashFile for the file name.
+func (a *sourceArchive) hash(name string, h hash.Hash) (string, error) {
+	f, err := a.stream(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash %s in archive %s: %w", name, a.path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
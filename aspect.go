@@ -0,0 +1,39 @@
+package main
+
+// defaultPanoramaRatio is the ratio of the long side to the short side from
+// which images are panoramas, when WalkOptions doesn't set one.
+const defaultPanoramaRatio = 2
+
+// Aspect classes of listed images, for laying out grids before the images
+// load.
+const (
+	AspectSquare    = "square"
+	AspectLandscape = "landscape"
+	AspectPortrait  = "portrait"
+	// AspectPanorama is for images much wider than tall, or much taller
+	// than wide, in either orientation.
+	AspectPanorama = "panorama"
+)
+
+// aspectClass returns the aspect class of img from its displayed
+// dimensions, or an empty string when they aren't known.
+func (o WalkOptions) aspectClass(img ImageInfo) string {
+	if img.Width <= 0 || img.Height <= 0 {
+		return ""
+	}
+	long, short := float64(max(img.Width, img.Height)), float64(min(img.Width, img.Height))
+	panorama := o.PanoramaRatio
+	if panorama <= 0 {
+		panorama = defaultPanoramaRatio
+	}
+	switch ratio := long / short; {
+	case ratio >= panorama:
+		return AspectPanorama
+	case ratio <= 1+o.SquareTolerance:
+		return AspectSquare
+	case img.Width > img.Height:
+		return AspectLandscape
+	default:
+		return AspectPortrait
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// bandwidthChunk is the most a throttled reader returns per read, which
+// keeps concurrent responses interleaved instead of one large read
+// reserving the limiter for seconds.
+const bandwidthChunk = 32 * 1024
+
+// bandwidthLimiter paces reads so that all readers sharing it together stay
+// under a byte rate.
+type bandwidthLimiter struct {
+	bytesPerSecond float64
+
+	mu sync.Mutex
+	// next is when the bandwidth reserved so far is used up.
+	next time.Time
+}
+
+// newBandwidthLimiter returns a limiter for bytesPerSecond, or nil (no
+// limit) when it's not positive.
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{bytesPerSecond: float64(bytesPerSecond)}
+}
+
+// wait blocks until n more bytes may be sent.
+func (l *bandwidthLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.bytesPerSecond * float64(time.Second)))
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// Reader returns r throttled by the limiter. It closes r when it's closed,
+// if r is an io.Closer. A nil limiter returns r unchanged.
+func (l *bandwidthLimiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &throttledReader{r: r, limiter: l}
+}
+
+type throttledReader struct {
+	r       io.Reader
+	limiter *bandwidthLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunk {
+		p = p[:bandwidthChunk]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.limiter.wait(n)
+	}
+	return n, err
+}
+
+func (t *throttledReader) Close() error {
+	if closer, ok := t.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
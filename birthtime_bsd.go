@@ -0,0 +1,18 @@
+//go:build darwin || freebsd || netbsd
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// birthTime returns the creation time recorded in info's stat data.
+func birthTime(_ string, info fs.FileInfo) (t time.Time, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Birthtimespec.Unix()), true
+}
@@ -0,0 +1,23 @@
+//go:build linux
+
+package main
+
+import (
+	"io/fs"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// birthTime returns the creation time of the file at path, read with
+// statx. ok is false on file systems and kernels that don't record it.
+func birthTime(path string, _ fs.FileInfo) (t time.Time, ok bool) {
+	var st unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, 0, unix.STATX_BTIME, &st); err != nil {
+		return time.Time{}, false
+	}
+	if st.Mask&unix.STATX_BTIME == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Btime.Sec, int64(st.Btime.Nsec)), true
+}
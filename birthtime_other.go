@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !windows
+
+package main
+
+import (
+	"io/fs"
+	"time"
+)
+
+// birthTime is not supported on this platform.
+func birthTime(_ string, _ fs.FileInfo) (t time.Time, ok bool) {
+	return time.Time{}, false
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// birthTime returns the creation time recorded in info's file attributes.
+func birthTime(_ string, info fs.FileInfo) (t time.Time, ok bool) {
+	attrs, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, attrs.CreationTime.Nanoseconds()), true
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// blankSize is the longest side images are scaled down to before checking
+// whether they're blank. Noise and compression artifacts average out at
+// this size, while anything in the frame still shows.
+const blankSize = 64
+
+// blankDeviation is the standard deviation of every channel, out of 255,
+// below which an image counts as blank: black or white frames, or any
+// other nearly uniform color.
+const blankDeviation = 4
+
+// isBlank reports whether img is nearly uniform, such as the black frames
+// at the start of video extracts or overexposed timelapse frames.
+func isBlank(img image.Image) bool {
+	small := imaging.Fit(img, blankSize, blankSize, imaging.Box)
+	n := float64(small.Bounds().Dx() * small.Bounds().Dy())
+	if n == 0 {
+		return false
+	}
+	var sum, sumSquares [3]float64
+	for i := 0; i < len(small.Pix); i += 4 {
+		for c := range 3 {
+			v := float64(small.Pix[i+c])
+			sum[c] += v
+			sumSquares[c] += v * v
+		}
+	}
+	for c := range 3 {
+		mean := sum[c] / n
+		if math.Sqrt(max(sumSquares[c]/n-mean*mean, 0)) >= blankDeviation {
+			return false
+		}
+	}
+	return true
+}
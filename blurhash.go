@@ -0,0 +1,128 @@
+package main
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// blurhashSize is the longest side images are scaled down to before their
+// blurhash is computed. A blurhash keeps a handful of frequencies, which
+// this many pixels already hold.
+const blurhashSize = 32
+
+// blurhashComponents is the number of horizontal and vertical frequencies
+// of a blurhash along the longer and shorter side of the image.
+const (
+	blurhashLongComponents  = 4
+	blurhashShortComponents = 3
+)
+
+const blurhashDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurhashSource scales img down for blurhash, so the full decode can be
+// dropped before the header's orientation is known.
+func blurhashSource(img image.Image) *image.NRGBA {
+	return imaging.Fit(img, blurhashSize, blurhashSize, imaging.Box)
+}
+
+// blurhash encodes img as a blurhash (https://blurha.sh), a string of about
+// 30 characters that frontends decode into a blurred placeholder of it.
+func blurhash(img image.Image) string {
+	src := imaging.Clone(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w == 0 || h == 0 {
+		return ""
+	}
+	cx, cy := blurhashLongComponents, blurhashShortComponents
+	if h > w {
+		cx, cy = cy, cx
+	}
+
+	// Every pixel is weighed by the cosine of each frequency, in linear
+	// light.
+	linear := make([][3]float64, w*h)
+	for y := range h {
+		for x := range w {
+			i := y*src.Stride + x*4
+			linear[y*w+x] = [3]float64{srgbToLinear(src.Pix[i]), srgbToLinear(src.Pix[i+1]), srgbToLinear(src.Pix[i+2])}
+		}
+	}
+	factors := make([][3]float64, 0, cx*cy)
+	for j := range cy {
+		for i := range cx {
+			var f [3]float64
+			for y := range h {
+				by := math.Cos(math.Pi * float64(j) * float64(y) / float64(h))
+				for x := range w {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) * by
+					for c := range 3 {
+						f[c] += basis * linear[y*w+x][c]
+					}
+				}
+			}
+			scale := 2.0
+			if i == 0 && j == 0 {
+				scale = 1
+			}
+			for c := range 3 {
+				f[c] *= scale / float64(w*h)
+			}
+			factors = append(factors, f)
+		}
+	}
+
+	var b strings.Builder
+	encodeBase83(&b, (cx-1)+(cy-1)*9, 1)
+	dc, ac := factors[0], factors[1:]
+	maxAC := 1.0
+	if len(ac) > 0 {
+		var actual float64
+		for _, f := range ac {
+			actual = max(actual, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+		}
+		quantized := min(max(int(math.Floor(actual*166-0.5)), 0), 82)
+		maxAC = float64(quantized+1) / 166
+		encodeBase83(&b, quantized, 1)
+	} else {
+		encodeBase83(&b, 0, 1)
+	}
+	encodeBase83(&b, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range ac {
+		quantize := func(v float64) int {
+			return min(max(int(math.Floor(signedPow(v/maxAC, 0.5)*9+9.5)), 0), 18)
+		}
+		encodeBase83(&b, quantize(f[0])*19*19+quantize(f[1])*19+quantize(f[2]), 2)
+	}
+	return b.String()
+}
+
+// encodeBase83 writes value as length digits of the base 83 of blurhash.
+func encodeBase83(b *strings.Builder, value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		digit := value / int(math.Pow(83, float64(i))) % 83
+		b.WriteByte(blurhashDigits[digit])
+	}
+}
+
+func srgbToLinear(v uint8) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	c := min(max(v, 0), 1)
+	if c <= 0.0031308 {
+		return int(c*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(c, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signedPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"net/http"
 	"os/exec"
 	"runtime"
+	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
 func openBrowser(url string) error {
@@ -21,3 +27,47 @@ func openBrowser(url string) error {
 	args = append(args, url)
 	return exec.Command(cmd, args...).Start()
 }
+
+// browserReadyTimeout bounds how long openBrowserWhenReady waits for the
+// index page before opening the browser anyway.
+const browserReadyTimeout = 5 * time.Second
+
+// openBrowserWhenReady waits for delay and then until url serves its index
+// page, so the browser doesn't open on a blank tab while the server is
+// still starting, and opens it. It blocks, and should be run in its own
+// goroutine when called from a listen hook, which runs before requests are
+// served.
+func openBrowserWhenReady(ctx context.Context, url string, delay time.Duration) error {
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	readyCtx, cancel := context.WithTimeout(ctx, browserReadyTimeout)
+	defer cancel()
+	for readyCtx.Err() == nil {
+		req, err := http.NewRequestWithContext(readyCtx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-readyCtx.Done():
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if errors.Is(readyCtx.Err(), context.DeadlineExceeded) {
+		log.Ctx(ctx).Warn().Str("url", url).Msg("server isn't serving the index page yet, opening the browser anyway")
+	}
+	return openBrowser(url)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// checkpointEntry is a line of a checkpoint file, recording an operation
+// that completed. Only the ID is read back; the rest is for people reading
+// the file.
+type checkpointEntry struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	Filename    string    `json:"filename"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// Checkpoint records the operations of a batch that completed in an
+// append-only JSONL file, so a run that was interrupted can be resumed
+// without redoing them. Operations are identified by a hash of their JSON,
+// which doesn't depend on whether their output exists.
+type Checkpoint struct {
+	path string
+	// done holds the IDs of the operations completed by earlier runs.
+	done map[string]bool
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openCheckpoint opens the checkpoint file at path for recording. With
+// resume, the operations it already records are kept and reported as
+// done; without, it's started over.
+func openCheckpoint(path string, resume bool, modes outputModes) (*Checkpoint, error) {
+	c := &Checkpoint{path: path, done: map[string]bool{}}
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+		flag = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	f, err := modes.openFile(path, flag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint %s: %w", path, err)
+	}
+	c.f = f
+	return c, nil
+}
+
+// load reads the IDs recorded in the file. A missing file records none.
+func (c *Checkpoint) load() error {
+	f, err := os.Open(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open checkpoint %s: %w", c.path, err)
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		var entry checkpointEntry
+		// Skip lines that can't be parsed, e.g. one cut short by a crash.
+		if json.Unmarshal(line, &entry) == nil && entry.ID != "" {
+			c.done[entry.ID] = true
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read checkpoint %s: %w", c.path, err)
+		}
+	}
+}
+
+// checkpointIDOf identifies op across runs by the hash of its JSON, which
+// covers everything that decides its output.
+func checkpointIDOf(op Operation) (string, error) {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode operation: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Done reports whether an earlier run completed the operation with the
+// given ID. A nil checkpoint has none.
+func (c *Checkpoint) Done(id string) bool {
+	return c != nil && c.done[id]
+}
+
+// Record appends op, with the given ID, to the file as completed. It's
+// synced right away, so the record survives the run being killed or the
+// machine going down. A nil checkpoint records nothing.
+func (c *Checkpoint) Record(id string, op Operation) error {
+	if c == nil {
+		return nil
+	}
+	line, err := json.Marshal(checkpointEntry{ID: id, Type: op.Type(), Filename: op.Filename(), CompletedAt: time.Now()})
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint entry: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write checkpoint %s: %w", c.path, err)
+	}
+	if err := c.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync checkpoint %s: %w", c.path, err)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (c *Checkpoint) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.f.Close()
+}
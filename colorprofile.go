@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// Color spaces outputs can be converted to.
+const (
+	// ColorSpaceKeep leaves pixels as they're stored in the source.
+	ColorSpaceKeep = "keep"
+	// ColorSpaceSRGB converts pixels from the profile embedded in the
+	// source to sRGB.
+	ColorSpaceSRGB = "srgb"
+)
+
+// iccProfileSignature starts the APP2 segments of JPEGs that hold an ICC
+// profile, followed by the sequence number of the chunk and the number of
+// chunks, since profiles can be larger than a segment.
+const iccProfileSignature = "ICC_PROFILE\x00"
+
+// embeddedICCProfile returns the ICC profile embedded in the JPEG or PNG in
+// data, or nil when it has none.
+func embeddedICCProfile(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return jpegICCProfile(data)
+	case bytes.HasPrefix(data, []byte(pngSignature)):
+		return pngICCProfile(data)
+	}
+	return nil, nil
+}
+
+// jpegICCProfile reassembles the ICC profile from the APP2 segments of the
+// JPEG in data.
+func jpegICCProfile(data []byte) ([]byte, error) {
+	var chunks [][]byte
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			break
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			pos++
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			pos += 2
+			continue
+		}
+		if marker == 0xDA {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			break
+		}
+		payload := data[pos+4 : end]
+		if marker == 0xE2 && bytes.HasPrefix(payload, []byte(iccProfileSignature)) && len(payload) >= len(iccProfileSignature)+2 {
+			seq, count := int(payload[len(iccProfileSignature)]), int(payload[len(iccProfileSignature)+1])
+			if chunks == nil {
+				chunks = make([][]byte, count)
+			}
+			if seq < 1 || seq > len(chunks) || count != len(chunks) {
+				return nil, errors.New("malformed ICC profile chunks")
+			}
+			chunks[seq-1] = payload[len(iccProfileSignature)+2:]
+		}
+		pos = end
+	}
+	var profile []byte
+	for _, chunk := range chunks {
+		if chunk == nil {
+			return nil, errors.New("missing ICC profile chunk")
+		}
+		profile = append(profile, chunk...)
+	}
+	return profile, nil
+}
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// pngICCProfile returns the profile of the iCCP chunk of the PNG in data,
+// which is compressed after its name.
+func pngICCProfile(data []byte) ([]byte, error) {
+	for pos := len(pngSignature); pos+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		end := pos + 8 + length
+		if length < 0 || end > len(data) {
+			break
+		}
+		switch typ {
+		case "iCCP":
+			chunk := data[pos+8 : end]
+			name := bytes.IndexByte(chunk, 0)
+			if name < 0 || name+2 > len(chunk) {
+				return nil, errors.New("malformed iCCP chunk")
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(chunk[name+2:]))
+			if err != nil {
+				return nil, fmt.Errorf("failed to decompress ICC profile: %w", err)
+			}
+			defer zr.Close()
+			return io.ReadAll(zr)
+		case "IDAT", "IEND":
+			// The profile must precede the image data.
+			return nil, nil
+		}
+		// Skip the chunk and its CRC.
+		pos = end + 4
+	}
+	return nil, nil
+}
+
+// toneCurve maps an encoded channel value between 0 and 1 to linear light.
+type toneCurve func(v float64) float64
+
+// iccProfile is an RGB matrix/TRC profile, the kind cameras, phones and
+// displays embed: a tone curve per channel and the XYZ colorants of the
+// primaries, adapted to the D50 white of the profile connection space.
+type iccProfile struct {
+	curves    [3]toneCurve
+	colorants [3][3]float64
+}
+
+// parseICCProfile parses the RGB matrix/TRC profile in data. Profiles that
+// describe colors with lookup tables instead, such as those of CMYK
+// printers, aren't supported.
+func parseICCProfile(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, errors.New("not an ICC profile")
+	}
+	if space := string(data[16:20]); space != "RGB " {
+		return nil, fmt.Errorf("unsupported profile color space %q", space)
+	}
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := range count {
+		entry := 132 + i*12
+		if entry+12 > len(data) {
+			return nil, errors.New("truncated ICC tag table")
+		}
+		offset := int(binary.BigEndian.Uint32(data[entry+4:]))
+		size := int(binary.BigEndian.Uint32(data[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(data) {
+			return nil, errors.New("ICC tag out of range")
+		}
+		tags[string(data[entry:entry+4])] = data[offset : offset+size]
+	}
+
+	var p iccProfile
+	for i, channel := range []string{"r", "g", "b"} {
+		xyz, ok := tags[channel+"XYZ"]
+		if !ok {
+			return nil, errors.New("profile has no colorants, only matrix/TRC profiles are supported")
+		}
+		if len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, fmt.Errorf("malformed %sXYZ tag", channel)
+		}
+		for j := range 3 {
+			p.colorants[i][j] = s15Fixed16(xyz[8+j*4:])
+		}
+		trc, ok := tags[channel+"TRC"]
+		if !ok {
+			return nil, errors.New("profile has no tone curves, only matrix/TRC profiles are supported")
+		}
+		curve, err := parseToneCurve(trc)
+		if err != nil {
+			return nil, fmt.Errorf("malformed %sTRC tag: %w", channel, err)
+		}
+		p.curves[i] = curve
+	}
+	return &p, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// parseToneCurve parses a curv tag, a gamma or a table of samples, or a
+// para tag, one of the parametric functions of the ICC specification.
+func parseToneCurve(tag []byte) (toneCurve, error) {
+	if len(tag) < 12 {
+		return nil, errors.New("too short")
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if len(tag) < 12+n*2 {
+			return nil, errors.New("truncated curve")
+		}
+		switch n {
+		case 0:
+			return func(v float64) float64 { return v }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(v float64) float64 { return math.Pow(v, gamma) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+i*2:])) / 65535
+		}
+		return func(v float64) float64 {
+			// Samples are evenly spaced, and interpolated between.
+			x := v * float64(n-1)
+			i := min(int(x), n-2)
+			return table[i] + (table[i+1]-table[i])*(x-float64(i))
+		}, nil
+	case "para":
+		fn := int(binary.BigEndian.Uint16(tag[8:]))
+		counts := []int{1, 3, 4, 5, 7}
+		if fn >= len(counts) || len(tag) < 12+counts[fn]*4 {
+			return nil, fmt.Errorf("unsupported parametric curve %d", fn)
+		}
+		// Every function is a special case of the last one: (aX+b)^g + e
+		// from d on, and cX + f below.
+		params := make([]float64, counts[fn])
+		for i := range params {
+			params[i] = s15Fixed16(tag[12+i*4:])
+		}
+		g, a, b, c, d, e, f := params[0], 1.0, 0.0, 0.0, math.Inf(-1), 0.0, 0.0
+		switch fn {
+		case 1:
+			a, b = params[1], params[2]
+			d = -b / a
+		case 2:
+			a, b, e, f = params[1], params[2], params[3], params[3]
+			d = -b / a
+		case 3:
+			a, b, c, d = params[1], params[2], params[3], params[4]
+		case 4:
+			a, b, c, d, e, f = params[1], params[2], params[3], params[4], params[5], params[6]
+		}
+		return func(v float64) float64 {
+			if v >= d {
+				return math.Pow(max(a*v+b, 0), g) + e
+			}
+			return c*v + f
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported curve type %q", tag[:4])
+}
+
+// xyzD50ToLinearSRGB converts XYZ colors relative to D50, the white of the
+// profile connection space, to linear sRGB, adapted to its D65 white with
+// the Bradford transform.
+var xyzD50ToLinearSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// srgbColorants are the D50 colorants of the sRGB profile, to recognize
+// sources that are sRGB already.
+var srgbColorants = [3][3]float64{
+	{0.4360747, 0.2225045, 0.0139322},
+	{0.3850649, 0.7168786, 0.0971045},
+	{0.1430804, 0.0606169, 0.7141733},
+}
+
+// isSRGB reports whether the profile describes sRGB, so converting to it
+// would change nothing beyond rounding.
+func (p *iccProfile) isSRGB() bool {
+	for i := range 3 {
+		for j := range 3 {
+			if math.Abs(p.colorants[i][j]-srgbColorants[i][j]) > 0.002 {
+				return false
+			}
+		}
+		for _, v := range []uint8{5, 50, 128, 200} {
+			if math.Abs(p.curves[i](float64(v)/255)-srgbToLinear(v)) > 0.002 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// srgbEncodeSteps is the resolution of the table linear light is encoded
+// to sRGB with, fine enough that every 8-bit value is reachable.
+const srgbEncodeSteps = 4096
+
+// convertToSRGB returns img converted from the profile p to sRGB. Colors
+// outside of sRGB, like the most saturated ones of Display P3, are
+// clipped to its gamut.
+func (p *iccProfile) convertToSRGB(img image.Image) *image.NRGBA {
+	// The source's primaries are converted to XYZ and on to linear sRGB
+	// with a single matrix.
+	var m [3][3]float64
+	for i := range 3 {
+		for j := range 3 {
+			for k := range 3 {
+				m[i][j] += xyzD50ToLinearSRGB[i][k] * p.colorants[j][k]
+			}
+		}
+	}
+	var decode [3][256]float64
+	for ch := range 3 {
+		for v := range 256 {
+			decode[ch][v] = p.curves[ch](float64(v) / 255)
+		}
+	}
+	var encode [srgbEncodeSteps + 1]uint8
+	for i := range encode {
+		encode[i] = uint8(linearToSRGB(float64(i) / srgbEncodeSteps))
+	}
+
+	out := imaging.Clone(img)
+	for i := 0; i+3 < len(out.Pix); i += 4 {
+		r, g, b := decode[0][out.Pix[i]], decode[1][out.Pix[i+1]], decode[2][out.Pix[i+2]]
+		for ch := range 3 {
+			linear := m[ch][0]*r + m[ch][1]*g + m[ch][2]*b
+			out.Pix[i+ch] = encode[int(math.Round(min(max(linear, 0), 1)*srgbEncodeSteps))]
+		}
+	}
+	return out
+}
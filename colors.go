@@ -0,0 +1,77 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// averageColor returns the average color of img as a "#rrggbb" hex string.
+func averageColor(img image.Image) string {
+	// A box filter down to a single pixel averages every pixel of the image.
+	c := imaging.Resize(img, 1, 1, imaging.Box).NRGBAAt(0, 0)
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// grayscaleSaturation is the saturation below which a color sorts as gray
+// rather than by its hue, which is meaningless for nearly gray colors.
+const grayscaleSaturation = 0.1
+
+// compareColors orders "#rrggbb" colors so that similar hues are next to
+// each other: chromatic colors by hue, then by lightness, followed by grays
+// from dark to light and finally missing colors.
+func compareColors(a, b string) int {
+	ha, sa, la, okA := hsl(a)
+	hb, sb, lb, okB := hsl(b)
+	switch {
+	case !okA || !okB:
+		// Missing colors go last.
+		return -cmp.Compare(boolInt(okA), boolInt(okB))
+	case (sa < grayscaleSaturation) != (sb < grayscaleSaturation):
+		return cmp.Compare(boolInt(sa < grayscaleSaturation), boolInt(sb < grayscaleSaturation))
+	case sa >= grayscaleSaturation:
+		// Bucket hues in 15 degree steps, so lightness orders colors whose
+		// hues are barely different.
+		if c := cmp.Compare(math.Floor(ha/15), math.Floor(hb/15)); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(la, lb)
+}
+
+// hsl parses a "#rrggbb" color into its hue in degrees, saturation and
+// lightness.
+func hsl(hex string) (h, s, l float64, ok bool) {
+	var c color.NRGBA
+	if _, err := fmt.Sscanf(hex, "#%02x%02x%02x", &c.R, &c.G, &c.B); err != nil {
+		return 0, 0, 0, false
+	}
+	r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+	hi, lo := max(r, g, b), min(r, g, b)
+	l = (hi + lo) / 2
+	if hi == lo {
+		return 0, 0, l, true
+	}
+	d := hi - lo
+	s = d / (1 - math.Abs(2*l-1))
+	switch hi {
+	case r:
+		h = math.Mod((g-b)/d+6, 6)
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	return h * 60, s, l, true
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/disintegration/imaging"
+)
+
+// Layouts of comparison images.
+const (
+	// CompareSideBySide places the images next to each other at the same
+	// height.
+	CompareSideBySide = "side"
+	// CompareStacked places the images above each other at the same width.
+	CompareStacked = "stack"
+)
+
+// comparison opens the images at pathA and pathB, oriented according to
+// policy, and composites them into one image in the given layout. Both are
+// scaled to the same height (or width when stacked), which is at most size
+// and never larger than the smaller of the two, so neither is upscaled and
+// detail can be compared at the same scale.
+func comparison(pathA, pathB string, policy OrientationPolicy, layout string, size int) (image.Image, error) {
+	a, err := imaging.Open(pathA, imaging.AutoOrientation(policy.applies()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image %s: %w", pathA, err)
+	}
+	b, err := imaging.Open(pathB, imaging.AutoOrientation(policy.applies()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image %s: %w", pathB, err)
+	}
+
+	if layout == CompareStacked {
+		width := min(size, a.Bounds().Dx(), b.Bounds().Dx())
+		a = imaging.Resize(a, width, 0, imaging.Lanczos)
+		b = imaging.Resize(b, width, 0, imaging.Lanczos)
+		canvas := imaging.New(width, a.Bounds().Dy()+b.Bounds().Dy(), color.Black)
+		canvas = imaging.Paste(canvas, a, image.Pt(0, 0))
+		return imaging.Paste(canvas, b, image.Pt(0, a.Bounds().Dy())), nil
+	}
+
+	height := min(size, a.Bounds().Dy(), b.Bounds().Dy())
+	a = imaging.Resize(a, 0, height, imaging.Lanczos)
+	b = imaging.Resize(b, 0, height, imaging.Lanczos)
+	canvas := imaging.New(a.Bounds().Dx()+b.Bounds().Dx(), height, color.Black)
+	canvas = imaging.Paste(canvas, a, image.Pt(0, 0))
+	return imaging.Paste(canvas, b, image.Pt(a.Bounds().Dx(), 0)), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ConflictPolicy decides what happens to an operation that would write the
+// same output as an earlier one of its batch, such as two identical crops
+// of a file.
+type ConflictPolicy string
+
+const (
+	// ConflictOverwrite executes it anyway with a warning, so the later
+	// operation's output replaces the earlier one's.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictDedupe skips it, keeping the earlier operation's output.
+	ConflictDedupe ConflictPolicy = "dedupe"
+	// ConflictError fails the batch.
+	ConflictError ConflictPolicy = "error"
+	// ConflictRename numbers its output, e.g. IMG_0001-2.jpg, so both are
+	// kept.
+	ConflictRename ConflictPolicy = "rename"
+)
+
+// outputClaims tracks the outputs claimed by the operations of a batch so
+// far, to find the ones that conflict.
+type outputClaims struct {
+	policy ConflictPolicy
+	// paths maps each claimed output to the source of the operation that
+	// claimed it.
+	paths map[string]string
+}
+
+func newOutputClaims(policy ConflictPolicy) *outputClaims {
+	return &outputClaims{policy: policy, paths: map[string]string{}}
+}
+
+// claim resolves the outputs of op against those claimed before it
+// according to the policy, and claims them. It returns op as it should be
+// executed, which is renamed under ConflictRename and keeps its plan for
+// r, and false when it should be skipped. Operations that fail to plan are
+// left to fail when they're executed.
+func (c *outputClaims) claim(ctx context.Context, r OperationExecutor, op Operation) (Operation, bool, error) {
+	for {
+		planned, destPath, err := r.plan(op)
+		if op.planned == nil {
+			op.planned = &operationPlan{op: planned, destPath: destPath, err: err}
+		}
+		if err != nil || destPath == "" {
+			return op, true, nil
+		}
+		outputs := r.outputPaths(planned, destPath)
+		i := slices.IndexFunc(outputs, func(output string) bool {
+			_, ok := c.paths[output]
+			return ok
+		})
+		if i < 0 {
+			for _, output := range outputs {
+				c.paths[output] = op.Filename()
+			}
+			return op, true, nil
+		}
+
+		conflict := outputs[i]
+		if op.Crop != nil && (r.CropIDs.Scope == "" || r.CropIDs.Scope == "crop") && c.paths[conflict] != op.Filename() {
+			log.Ctx(ctx).Warn().Str("filename", op.Filename()).Str("other", c.paths[conflict]).
+				Msg("crops of files with the same name get the same output name, set --hash-scope=path to tell them apart")
+		}
+		policy := c.policy
+		if r.NormalizeNames && c.paths[conflict] != op.Filename() {
+			// Different sources only get the same name by being
+			// normalized, and neither should replace the other.
+			policy = ConflictRename
+		}
+		switch policy {
+		case ConflictDedupe:
+			log.Ctx(ctx).Info().Str("filename", op.Filename()).Str("output", conflict).Msg("skipping, an earlier operation writes the same output")
+			return op, false, nil
+		case ConflictError:
+			return op, false, fmt.Errorf("%s operation of %s writes %s, like the earlier operation of %s; use --on-conflict to dedupe or rename such outputs",
+				op.Type(), op.Filename(), conflict, c.paths[conflict])
+		case ConflictRename:
+			if op.conflict == 0 {
+				op.conflict = 1
+			}
+			// Numbered outputs can conflict as well, with those of
+			// operations that were numbered or named so before.
+			op.conflict++
+			op.planned = nil
+		default:
+			log.Ctx(ctx).Warn().Str("filename", op.Filename()).Str("output", conflict).Msg("overwriting the output of an earlier operation")
+			return op, true, nil
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"iter"
+	"math"
+
+	"github.com/disintegration/imaging"
+	"github.com/rs/zerolog/log"
+	"github.com/sourcegraph/conc/pool"
+)
+
+// contactSheetCellSize is the size of the square cell each crop of a
+// contact sheet is drawn in.
+const contactSheetCellSize = 320
+
+// contactSheetOutline is the color crop rectangles are outlined with,
+// which stands out against most photos.
+var contactSheetOutline = color.NRGBA{R: 255, G: 59, B: 48, A: 255}
+
+// WriteContactSheet writes a JPEG to w with a cell for every crop of ops:
+// a thumbnail of its source, with the area the crop keeps outlined and the
+// rest dimmed, like the cropper would cut it. Other operations have no
+// rectangle to show and are left out. Nothing is executed or written
+// besides the sheet, so crops can be reviewed before they're applied.
+func (r OperationExecutor) WriteContactSheet(ctx context.Context, w io.Writer, ops iter.Seq[Operation]) error {
+	if r.Archive != nil {
+		return errors.New("contact sheets are not supported when the root is an archive")
+	}
+	cropper, ok := r.Cropper.(*ImagingCropper)
+	if !ok {
+		return fmt.Errorf("cropper %T doesn't support contact sheets", r.Cropper)
+	}
+
+	var crops []CropOperation
+	var planErrs []error
+	for op := range ops {
+		if op.Crop == nil {
+			log.Ctx(ctx).Debug().Str("filename", op.Filename()).Str("type", op.Type()).Msg("leaving operation without a crop out of the contact sheet")
+			continue
+		}
+		if isRemoteSource(op.Crop.Filename) {
+			log.Ctx(ctx).Warn().Str("filename", op.Filename()).Msg("leaving crop of a remote source out of the contact sheet")
+			continue
+		}
+		planned, destPath, err := r.plan(op)
+		if err != nil {
+			planErrs = append(planErrs, err)
+			continue
+		}
+		if destPath == "" {
+			log.Ctx(ctx).Warn().Str("filename", op.Filename()).Msg("leaving tiny crop out of the contact sheet")
+			continue
+		}
+		crops = append(crops, *planned.Crop)
+	}
+	if len(crops) == 0 {
+		return errors.Join(append(planErrs, errors.New("no crops to draw on a contact sheet"))...)
+	}
+
+	cells := make([]image.Image, len(crops))
+	errs := make([]error, len(crops))
+	concurrency := r.Concurrency
+	if concurrency <= 0 {
+		concurrency = math.MaxInt
+	}
+	p := pool.New().WithMaxGoroutines(min(concurrency, len(crops)))
+	for i, op := range crops {
+		p.Go(func() {
+			cells[i], errs[i] = r.contactSheetCell(ctx, cropper, op)
+		})
+	}
+	p.Wait()
+
+	columns := max(1, int(math.Ceil(math.Sqrt(float64(len(crops))))))
+	rows := (len(crops) + columns - 1) / columns
+	sheet := imaging.New(columns*contactSheetCellSize, rows*contactSheetCellSize, color.Black)
+	for i, cell := range cells {
+		if cell == nil {
+			continue
+		}
+		bounds := cell.Bounds()
+		x := (i%columns)*contactSheetCellSize + (contactSheetCellSize-bounds.Dx())/2
+		y := (i/columns)*contactSheetCellSize + (contactSheetCellSize-bounds.Dy())/2
+		sheet = imaging.Paste(sheet, cell, image.Pt(x, y))
+	}
+	if err := imaging.Encode(w, sheet, imaging.JPEG, imaging.JPEGQuality(85)); err != nil {
+		return fmt.Errorf("failed to encode contact sheet: %w", err)
+	}
+	log.Ctx(ctx).Info().Int("crops", len(crops)).Int("columns", columns).Int("rows", rows).Msg("wrote contact sheet")
+	return errors.Join(append(planErrs, errs...)...)
+}
+
+// contactSheetCell returns the thumbnail of the source of op with the
+// rectangle it crops outlined. The rectangle is computed on the source's
+// full size, so clamping, bleed and rounding show as they'll be applied.
+func (r OperationExecutor) contactSheetCell(ctx context.Context, cropper *ImagingCropper, op CropOperation) (image.Image, error) {
+	sourcePath, err := r.sourcePath(op.Filename)
+	if err != nil {
+		return nil, err
+	}
+	thumb, original, err := thumbnail(ctx, sourcePath, contactSheetCellSize, cropper.Orientation, true)
+	if err != nil {
+		return nil, err
+	}
+	bounds := op.bounds(original.X, original.Y)
+	rect, err := cropper.cropRect(ctx, op, bounds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to crop %s: %w", op.Filename, err)
+	}
+	if op.Rotate != 0 {
+		// The thumbnail is rotated like the source would be, and scaled
+		// back down to fit the cell.
+		thumb = imaging.Fit(imaging.Rotate(thumb, op.Rotate, color.Black), contactSheetCellSize, contactSheetCellSize, imaging.Lanczos)
+	}
+
+	cell := imaging.Clone(thumb)
+	scale := float64(cell.Bounds().Dx()) / float64(bounds.Dx())
+	outline := image.Rect(
+		int(float64(rect.Min.X)*scale), int(float64(rect.Min.Y)*scale),
+		int(math.Ceil(float64(rect.Max.X)*scale)), int(math.Ceil(float64(rect.Max.Y)*scale)),
+	)
+	// Everything the crop cuts away is dimmed.
+	dim := image.NewUniform(color.NRGBA{A: 140})
+	cellBounds := cell.Bounds()
+	for _, cut := range []image.Rectangle{
+		image.Rect(cellBounds.Min.X, cellBounds.Min.Y, cellBounds.Max.X, outline.Min.Y),
+		image.Rect(cellBounds.Min.X, outline.Max.Y, cellBounds.Max.X, cellBounds.Max.Y),
+		image.Rect(cellBounds.Min.X, outline.Min.Y, outline.Min.X, outline.Max.Y),
+		image.Rect(outline.Max.X, outline.Min.Y, cellBounds.Max.X, outline.Max.Y),
+	} {
+		draw.Draw(cell, cut.Intersect(cellBounds), dim, image.Point{}, draw.Over)
+	}
+	drawOutline(cell, outline, contactSheetOutline, 2)
+	return drawLabel(cell, fmt.Sprintf("%s %dx%d", op.Filename, rect.Dx(), rect.Dy())), nil
+}
+
+// drawOutline draws the border of rect onto img, width pixels thick on its
+// inside. Parts of it outside img are left out.
+func drawOutline(img draw.Image, rect image.Rectangle, c color.Color, width int) {
+	src := image.NewUniform(c)
+	bounds := img.Bounds()
+	for _, edge := range []image.Rectangle{
+		image.Rect(rect.Min.X, rect.Min.Y, rect.Max.X, rect.Min.Y+width),
+		image.Rect(rect.Min.X, rect.Max.Y-width, rect.Max.X, rect.Max.Y),
+		image.Rect(rect.Min.X, rect.Min.Y, rect.Min.X+width, rect.Max.Y),
+		image.Rect(rect.Max.X-width, rect.Min.Y, rect.Max.X, rect.Max.Y),
+	} {
+		draw.Draw(img, edge.Intersect(bounds), src, image.Point{}, draw.Src)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"image"
+	"sync"
+)
+
+// cropClampedHeader is set on /api/save responses to the number of crops
+// that extended past their image and were shrunk to fit.
+const cropClampedHeader = "X-Crop-Clamped"
+
+func newPixelRect(r image.Rectangle) pixelRect {
+	return pixelRect{X: r.Min.X, Y: r.Min.Y, Width: r.Dx(), Height: r.Dy()}
+}
+
+// CropClamp describes a crop that extended past the image bounds and was
+// shrunk to fit them.
+type CropClamp struct {
+	Filename string `json:"filename"`
+	// Requested and Clamped are in pixels of the oriented image.
+	Requested pixelRect `json:"requested"`
+	Clamped   pixelRect `json:"clamped"`
+	// Lost is the fraction of the requested area that was cut off.
+	Lost float64 `json:"lost"`
+}
+
+func newCropClamp(filename string, requested, clamped image.Rectangle) CropClamp {
+	area := requested.Dx() * requested.Dy()
+	return CropClamp{
+		Filename:  filename,
+		Requested: newPixelRect(requested),
+		Clamped:   newPixelRect(clamped),
+		Lost:      1 - float64(clamped.Dx()*clamped.Dy())/float64(area),
+	}
+}
+
+type cropClampsKey struct{}
+
+// cropClamps collects the crops clamped while executing operations under a
+// context, so they can be reported back to whoever asked for them.
+type cropClamps struct {
+	mu     sync.Mutex
+	clamps []CropClamp
+}
+
+// withCropClamps returns a context that collects crop clamps reported under
+// it.
+func withCropClamps(ctx context.Context) (context.Context, *cropClamps) {
+	clamps := &cropClamps{}
+	return context.WithValue(ctx, cropClampsKey{}, clamps), clamps
+}
+
+// reportCropClamp adds clamp to the collector of ctx, if it has one.
+func reportCropClamp(ctx context.Context, clamp CropClamp) {
+	clamps, ok := ctx.Value(cropClampsKey{}).(*cropClamps)
+	if !ok {
+		return
+	}
+	clamps.mu.Lock()
+	defer clamps.mu.Unlock()
+	clamps.clamps = append(clamps.clamps, clamp)
+}
+
+func (c *cropClamps) list() []CropClamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clamps
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+// CropIDConfig selects the hash function and encoding used for crop IDs.
+// The zero value produces full-length hex MD5 IDs.
+type CropIDConfig struct {
+	// Algorithm is one of md5 (default), sha256 or crc32.
+	Algorithm string
+	// Encoding is hex (default) or base32. Base32 IDs are lowercase and
+	// unpadded, so they're shorter and safe in URLs.
+	Encoding string
+	// Length truncates the encoded ID to this many characters; 0 keeps it whole.
+	Length int
+	// Scope decides what identifies a crop besides its rectangle: crop
+	// (default) uses the rectangle only, path adds the source's relative
+	// path and content adds the source's content hash. Output names only
+	// carry the source's base name, so without a source in the ID, equal
+	// crops of same-named files in different folders get the same name.
+	Scope string
+	// Precision is the number of decimals the crop's coordinates are
+	// rounded to before they're hashed; 0 uses 2, like Crop.String. More
+	// decimals tell apart crops that differ by less than a hundredth of the
+	// image, but a crop nudged by a rounding error in the frontend then
+	// gets a new name instead of replacing its earlier output.
+	Precision int
+}
+
+// defaultCropIDPrecision is the number of decimals of crop coordinates
+// hashed into IDs when CropIDConfig.Precision is unset.
+const defaultCropIDPrecision = 2
+
+// maxCropIDPrecision is the most decimals that are hashed. Float64
+// coordinates between 0 and 1 hold about 16 significant digits, and the
+// rest would be noise.
+const maxCropIDPrecision = 15
+
+func (c CropIDConfig) Validate() error {
+	switch c.Algorithm {
+	case "", "md5", "sha256", "crc32":
+	default:
+		return fmt.Errorf("unsupported hash algorithm %q", c.Algorithm)
+	}
+	switch c.Encoding {
+	case "", "hex", "base32":
+	default:
+		return fmt.Errorf("unsupported hash encoding %q", c.Encoding)
+	}
+	switch c.Scope {
+	case "", "crop", "path", "content":
+	default:
+		return fmt.Errorf("unsupported hash scope %q", c.Scope)
+	}
+	if c.Length < 0 {
+		return fmt.Errorf("hash length must not be negative, got %d", c.Length)
+	}
+	if c.Precision < 0 || c.Precision > maxCropIDPrecision {
+		return fmt.Errorf("hash precision must be between 1 and %d, got %d", maxCropIDPrecision, c.Precision)
+	}
+	return nil
+}
+
+// ID returns the identifier of crop under this configuration.
+func (c CropIDConfig) ID(crop Crop) string {
+	return c.SourceID(crop, "")
+}
+
+// SourceID returns the identifier of crop of the source identified by
+// source, which is the path or content hash selected by Scope. An empty
+// source gives the same ID as ID.
+func (c CropIDConfig) SourceID(crop Crop, source string) string {
+	precision := c.Precision
+	if precision == 0 {
+		precision = defaultCropIDPrecision
+	}
+	data := []byte(crop.format(precision))
+	if source != "" {
+		data = append([]byte(source+"\n"), data...)
+	}
+
+	var sum []byte
+	switch c.Algorithm {
+	case "sha256":
+		s := sha256.Sum256(data)
+		sum = s[:]
+	case "crc32":
+		sum = binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(data))
+	default:
+		s := md5.Sum(data)
+		sum = s[:]
+	}
+
+	var id string
+	switch c.Encoding {
+	case "base32":
+		id = strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum))
+	default:
+		id = hex.EncodeToString(sum)
+	}
+
+	if c.Length > 0 && c.Length < len(id) {
+		id = id[:c.Length]
+	}
+	return id
+}
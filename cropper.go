@@ -1,30 +1,164 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"fmt"
 	"image"
+	"image/color"
 	"io"
+	"math"
+	"time"
 
 	"github.com/disintegration/imaging"
+	"github.com/rs/zerolog/log"
 )
 
 // ImagingCropper is an implementation of the Cropper interface
-// using the disintegration/imaging library
-type ImagingCropper struct{}
+// using the disintegration/imaging library.
+//
+// One instance is shared by every worker of an executor, so its fields
+// must not be modified once it's in use, and its methods must not keep
+// per-call state on it.
+type ImagingCropper struct {
+	// Quality is the JPEG encoding quality (1-100).
+	Quality int
+	// Format is the format cropped images are encoded to.
+	Format OutputFormat
+	// Faces detects faces for auto crops focused on faces. When nil, such
+	// crops fail.
+	Faces *FaceDetector
+	// Decodes caps how many images are decoded and held in memory at once,
+	// independently of how many operations run in parallel. Nil means no
+	// limit.
+	Decodes decodeSemaphore
+	// Strict rejects crops that extend past the image bounds instead of
+	// shrinking them to fit.
+	Strict bool
+	// Fill is the color the parts of crops that extend past the image
+	// bounds are filled with, so they keep their requested size. Nil
+	// shrinks such crops to fit instead.
+	Fill color.Color
+	// Orientation decides whether images are rotated according to their
+	// EXIF orientation before being processed.
+	Orientation OrientationPolicy
+	// DPI is the density recorded in the JFIF header of JPEG outputs, which
+	// print software uses to size them. Zero leaves it unset, which is
+	// usually read as 72 DPI.
+	DPI int
+	// Lenient retries images the decoder rejects after repairing their
+	// header, such as JPEGs with unknown markers, instead of failing them.
+	Lenient bool
+	// RoundTo rounds the width and height of crops and autocrops to a
+	// multiple of this many pixels, e.g. 2 for video encoders that need even
+	// dimensions. Zero or one keeps crops exact.
+	RoundTo int
+	// SnapGrid moves the edges of crops and autocrops to the nearest
+	// multiple of this many pixels from the top-left corner of the image,
+	// e.g. 16 to cut the tiles of a sprite sheet, so both their position
+	// and size are aligned. Zero or one keeps crops exact.
+	SnapGrid int
+	// MaxFileSize is the largest size in bytes of JPEG crops, autocrops and
+	// responsive variants that don't set their own. Outputs larger than it
+	// at their quality are encoded at the highest lower quality that fits.
+	// Zero leaves sizes up to the quality.
+	MaxFileSize int64
+	// Subsampling is the chroma subsampling of JPEG outputs. Encoders that
+	// only support 4:2:0 use it regardless.
+	Subsampling ChromaSubsampling
+	// Filter is the resampling filter resized, responsive and downscaled
+	// outputs are scaled with.
+	Filter imaging.ResampleFilter
+	// ConvertToSRGB converts decoded images from the ICC profile embedded
+	// in them to sRGB, so outputs, which carry no profile, look the same
+	// in browsers and viewers that assume sRGB. Images without a profile
+	// are taken to be sRGB already.
+	ConvertToSRGB bool
+}
+
+// decodeSemaphore bounds the number of decoded images in flight. A decoded
+// bitmap is kept until its result is encoded, so a slot is held for the
+// whole decode-process-encode step.
+type decodeSemaphore chan struct{}
+
+// newDecodeSemaphore returns a semaphore allowing n concurrent decodes, or
+// nil (no limit) when n is not positive.
+func newDecodeSemaphore(n int) decodeSemaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(decodeSemaphore, n)
+}
+
+// acquire waits for a free decode slot and returns a function that
+// releases it.
+func (s decodeSemaphore) acquire(ctx context.Context) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	select {
+	case s <- struct{}{}:
+		return func() { <-s }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
 
 // Crop implements the Cropper interface using the imaging library.
 // It reads an image from r, crops it according to the specified dimensions,
-// and writes the result to w.
-func (c *ImagingCropper) Crop(ctx context.Context, r io.Reader, w io.Writer, crop Crop) error {
+// and writes the result to w in the operation's format, or the cropper's
+// format when the operation doesn't set one.
+func (c *ImagingCropper) Crop(ctx context.Context, r io.Reader, w io.Writer, op CropOperation) error {
+	_, err := c.CropTimed(ctx, r, w, op)
+	return err
+}
+
+// CropTimed implements the TimedCropper interface. It's like Crop, but
+// also reports how long each phase took.
+func (c *ImagingCropper) CropTimed(ctx context.Context, r io.Reader, w io.Writer, op CropOperation) (CropTimings, error) {
+	var timings CropTimings
+
+	start := time.Now()
+	release, err := c.Decodes.acquire(ctx)
+	if err != nil {
+		return timings, err
+	}
+	defer release()
+	timings.Wait = time.Since(start)
+
 	// Decode the image from the reader
-	src, err := imaging.Decode(r, imaging.AutoOrientation(true))
+	start = time.Now()
+	src, err := c.decode(ctx, r, op.Filename)
 	if err != nil {
-		return fmt.Errorf("failed to decode image: %w", err)
+		return timings, err
 	}
+	timings.Decode = time.Since(start)
 
-	// Get the dimensions of the original image
-	bounds := src.Bounds()
+	// Rotate and crop the image
+	start = time.Now()
+	if op.Rotate != 0 {
+		src = imaging.Rotate(src, op.Rotate, color.Black)
+	}
+	cropRect, err := c.cropRect(ctx, op, src.Bounds())
+	if err != nil {
+		return timings, err
+	}
+	croppedImg := c.crop(src, cropRect)
+	timings.Crop = time.Since(start)
+
+	// Encode and write the cropped image
+	start = time.Now()
+	err = c.encodeCapped(ctx, w, croppedImg, op.Format, op.Quality, cmp.Or(op.MaxFileSize, c.MaxFileSize))
+	timings.Encode = time.Since(start)
+	return timings, err
+}
+
+// cropRect converts the relative crop of op to pixels of an image with the
+// given bounds, shrinking it to fit (unless Strict or Fill is set),
+// growing it by the bleed and rounding it as configured.
+func (c *ImagingCropper) cropRect(ctx context.Context, op CropOperation, bounds image.Rectangle) (image.Rectangle, error) {
+	crop := op.Crop
 	imgWidth := bounds.Dx()
 	imgHeight := bounds.Dy()
 
@@ -36,7 +170,7 @@ func (c *ImagingCropper) Crop(ctx context.Context, r io.Reader, w io.Writer, cro
 
 	// Ensure crop rectangle is valid and within image bounds
 	if width <= 0 || height <= 0 {
-		return fmt.Errorf("invalid crop dimensions: width=%d, height=%d", width, height)
+		return image.Rectangle{}, fmt.Errorf("invalid crop dimensions: width=%d, height=%d", width, height)
 	}
 
 	// Create the crop rectangle
@@ -45,20 +179,405 @@ func (c *ImagingCropper) Crop(ctx context.Context, r io.Reader, w io.Writer, cro
 	// Ensure crop rectangle is within image bounds
 	if !cropRect.In(bounds) {
 		// Adjust crop rectangle to fit within image bounds
-		cropRect = cropRect.Intersect(bounds)
-		if cropRect.Empty() {
-			return fmt.Errorf("crop rectangle is outside image bounds")
+		clamped := cropRect.Intersect(bounds)
+		if clamped.Empty() {
+			return image.Rectangle{}, fmt.Errorf("crop rectangle is outside image bounds")
+		}
+		if c.Strict {
+			return image.Rectangle{}, fmt.Errorf("crop rectangle %v extends past image bounds %v", cropRect, bounds)
+		}
+		if c.Fill != nil {
+			log.Ctx(ctx).Debug().
+				Str("filename", op.Filename).
+				Str("requested", cropRect.String()).
+				Str("bounds", bounds.String()).
+				Msg("crop extends past image bounds, filling the rest")
+			return c.grow(cropRect, op.Bleed, bounds.Union(cropRect))
+		}
+		log.Ctx(ctx).Warn().
+			Str("filename", op.Filename).
+			Str("requested", cropRect.String()).
+			Str("clamped", clamped.String()).
+			Str("bounds", bounds.String()).
+			Msg("crop extends past image bounds, shrinking it to fit")
+		reportCropClamp(ctx, newCropClamp(op.Filename, cropRect, clamped))
+		cropRect = clamped
+	}
+
+	return c.grow(cropRect, op.Bleed, bounds)
+}
+
+// grow grows rect by the bleed and rounds it, both within area. Bleed past
+// the area doesn't exist, so it's clamped without a warning, even with
+// Strict.
+func (c *ImagingCropper) grow(rect image.Rectangle, bleed float64, area image.Rectangle) (image.Rectangle, error) {
+	if bleed > 0 {
+		pixels := int(bleed * float64(min(rect.Dx(), rect.Dy())))
+		rect = rect.Inset(-pixels).Intersect(area)
+	}
+	return c.round(rect, area)
+}
+
+// crop returns the part of img within rect. Parts of rect past the image
+// bounds, which are only left in when Fill is set, are filled with it.
+func (c *ImagingCropper) crop(img image.Image, rect image.Rectangle) image.Image {
+	if rect.In(img.Bounds()) {
+		return imaging.Crop(img, rect)
+	}
+	inside := rect.Intersect(img.Bounds())
+	canvas := imaging.New(rect.Dx(), rect.Dy(), c.Fill)
+	return imaging.Paste(canvas, imaging.Crop(img, inside), inside.Min.Sub(rect.Min))
+}
+
+// FitPadded implements the Resizer interface. It scales the image read from r
+// to fit within the operation's width x height, centers it on a canvas of
+// exactly that size filled with background, and writes the result to w.
+func (c *ImagingCropper) FitPadded(ctx context.Context, r io.Reader, w io.Writer, op ResizeOperation, background color.Color) error {
+	width, height := op.Width, op.Height
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("invalid target dimensions: width=%d, height=%d", width, height)
+	}
+
+	release, err := c.Decodes.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	src, err := c.decode(ctx, r, op.Filename)
+	if err != nil {
+		return err
+	}
+
+	fitted := imaging.Fit(src, width, height, c.Filter)
+	canvas := imaging.New(width, height, background)
+	return c.encode(w, imaging.PasteCenter(canvas, fitted), op.Format, 0)
+}
+
+// ResizeWidths implements the ResponsiveResizer interface. It decodes the
+// image read from r once and scales it to each of the operation's widths,
+// keeping its aspect ratio. Widths past the image's keep its size.
+func (c *ImagingCropper) ResizeWidths(ctx context.Context, r io.Reader, ws []io.Writer, op ResponsiveOperation) error {
+	if len(ws) != len(op.Widths) {
+		return fmt.Errorf("got %d writers for %d widths", len(ws), len(op.Widths))
+	}
+
+	release, err := c.Decodes.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	src, err := c.decode(ctx, r, op.Filename)
+	if err != nil {
+		return err
+	}
+
+	for i, width := range op.Widths {
+		img := src
+		if width < src.Bounds().Dx() {
+			img = imaging.Resize(src, width, 0, c.Filter)
+		}
+		if err := c.encodeCapped(ctx, ws[i], img, op.Format, op.Quality, c.MaxFileSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Downscale implements the Downscaler interface. It scales the image read
+// from r down to fit in a maxDimension x maxDimension box and encodes it in
+// format.
+func (c *ImagingCropper) Downscale(ctx context.Context, r io.Reader, w io.Writer, filename string, maxDimension int, format OutputFormat) error {
+	release, err := c.Decodes.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	src, err := c.decode(ctx, r, filename)
+	if err != nil {
+		return err
+	}
+	return c.encode(w, imaging.Fit(src, maxDimension, maxDimension, c.Filter), format, 0)
+}
+
+// Straighten implements the Straightener interface. It rotates the image
+// read from r by the operation's angle and crops it to the largest
+// rectangle without empty corners.
+func (c *ImagingCropper) Straighten(ctx context.Context, r io.Reader, w io.Writer, op StraightenOperation) error {
+	release, err := c.Decodes.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	src, err := c.decode(ctx, r, op.Filename)
+	if err != nil {
+		return err
+	}
+	return c.encode(w, straighten(src, op.Angle), op.Format, 0)
+}
+
+// AutoCrop implements the AutoCropper interface. It crops the largest
+// rectangle with the operation's aspect ratio, centered on the largest face
+// when the focus is "face" and one is found, or on the image center.
+func (c *ImagingCropper) AutoCrop(ctx context.Context, r io.Reader, w io.Writer, op AutoCropOperation) error {
+	if op.Focus == FocusFace && c.Faces == nil {
+		return fmt.Errorf("face focused crops require a face cascade, set one with --face-cascade")
+	}
+
+	release, err := c.Decodes.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	src, err := c.decode(ctx, r, op.Filename)
+	if err != nil {
+		return err
+	}
+
+	bounds := src.Bounds()
+	center := rectCenter(bounds)
+	switch op.Focus {
+	case FocusFace:
+		if face, ok := c.Faces.LargestFace(src); ok {
+			center = rectCenter(face)
+		} else {
+			log.Ctx(ctx).Debug().Str("filename", op.Filename).Msg("no face found, cropping the center")
+		}
+	case FocusSaliency:
+		center = salientCenter(src, op.Aspect)
+	}
+
+	cropRect, err := c.round(aspectCrop(bounds, op.Aspect, center), bounds)
+	if err != nil {
+		return err
+	}
+	return c.encodeCapped(ctx, w, imaging.Crop(src, cropRect), op.Format, op.Quality, c.MaxFileSize)
+}
+
+// round snaps rect to SnapGrid and rounds its size to a multiple of
+// RoundTo, shifting it to stay inside bounds.
+func (c *ImagingCropper) round(rect, bounds image.Rectangle) (image.Rectangle, error) {
+	if c.SnapGrid > 1 {
+		x0, x1 := snapSpan(rect.Min.X, rect.Max.X, bounds.Min.X, bounds.Max.X, c.SnapGrid)
+		y0, y1 := snapSpan(rect.Min.Y, rect.Max.Y, bounds.Min.Y, bounds.Max.Y, c.SnapGrid)
+		if x1 <= x0 || y1 <= y0 {
+			return rect, fmt.Errorf("crop of %dx%d doesn't fit a cell of the %d pixel grid inside the image", rect.Dx(), rect.Dy(), c.SnapGrid)
+		}
+		rect = image.Rect(x0, y0, x1, y1)
+	}
+	if c.RoundTo <= 1 {
+		return rect, nil
+	}
+	x, width := roundSpan(rect.Min.X, rect.Dx(), bounds.Min.X, bounds.Max.X, c.RoundTo)
+	y, height := roundSpan(rect.Min.Y, rect.Dy(), bounds.Min.Y, bounds.Max.Y, c.RoundTo)
+	if width == 0 || height == 0 {
+		return rect, fmt.Errorf("crop of %dx%d is too small to round to a multiple of %d pixels", rect.Dx(), rect.Dy(), c.RoundTo)
+	}
+	return image.Rect(x, y, x+width, y+height), nil
+}
+
+// roundSpan rounds the span [start, start+size) to the nearest multiple of
+// multiple, growing it to the right or shifting it left to stay within
+// [lo, hi), and rounding down when it doesn't fit.
+func roundSpan(start, size, lo, hi, multiple int) (int, int) {
+	rounded := (size + multiple/2) / multiple * multiple
+	if rounded > hi-lo {
+		rounded = size / multiple * multiple
+	}
+	start = min(start, hi-rounded)
+	return max(start, lo), rounded
+}
+
+// snapSpan moves start and end to the nearest multiples of grid within
+// [lo, hi], keeping at least one cell between them. It returns an empty
+// span when no cell fits.
+func snapSpan(start, end, lo, hi, grid int) (int, int) {
+	multiple := func(v int, round func(float64) float64) int {
+		return int(round(float64(v)/float64(grid))) * grid
+	}
+	start = max(multiple(start, math.Round), multiple(lo, math.Ceil))
+	end = min(multiple(end, math.Round), multiple(hi, math.Floor))
+	if end <= start {
+		end = start + grid
+		if end > hi {
+			return start, start
+		}
+	}
+	return start, end
+}
+
+func (c *ImagingCropper) decode(ctx context.Context, r io.Reader, filename string) (image.Image, error) {
+	if !c.Lenient && !c.ConvertToSRGB {
+		img, err := imaging.Decode(r, imaging.AutoOrientation(c.Orientation.applies()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image: %w", err)
+		}
+		return img, nil
+	}
+
+	// The source is read once and kept, so it can be decoded again and its
+	// profile read.
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(c.Orientation.applies()))
+	if err != nil && c.Lenient {
+		var lenientErr error
+		if img, lenientErr = decodeLenient(data, c.Orientation.applies()); lenientErr == nil {
+			log.Ctx(ctx).Warn().Err(err).Str("filename", filename).Msg("decoded malformed image leniently")
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if c.ConvertToSRGB {
+		img = convertToSRGB(ctx, img, data, filename)
+	}
+	return img, nil
+}
+
+// convertToSRGB converts img, decoded from data, from the profile that's
+// embedded in data to sRGB. Images without a profile, or with one that's
+// sRGB already, are returned as is, and so are those with profiles that
+// can't be converted, with a warning.
+func convertToSRGB(ctx context.Context, img image.Image, data []byte, filename string) image.Image {
+	icc, err := embeddedICCProfile(data)
+	if err == nil && icc == nil {
+		return img
+	}
+	var profile *iccProfile
+	if err == nil {
+		profile, err = parseICCProfile(icc)
+	}
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("filename", filename).Msg("leaving image with an unsupported color profile unconverted")
+		return img
+	}
+	if profile.isSRGB() {
+		return img
+	}
+	log.Ctx(ctx).Debug().Str("filename", filename).Msg("converting image to sRGB")
+	return profile.convertToSRGB(img)
+}
+
+// encode writes img to w in format, falling back to the cropper's format
+// when format is empty.
+func (c *ImagingCropper) encode(w io.Writer, img image.Image, format OutputFormat, quality int) error {
+	if format == "" {
+		format = c.Format
+	}
+	if quality == 0 {
+		quality = c.Quality
+	}
+	if format.imagingFormat() != imaging.JPEG {
+		return imaging.Encode(w, img, format.imagingFormat())
+	}
+	if c.DPI == 0 {
+		return encodeJPEG(w, img, quality, c.Subsampling)
+	}
+
+	data, err := c.encodeJPEGBytes(img, quality)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// encodeJPEGBytes encodes img as a JPEG of the given quality, with the
+// cropper's density.
+func (c *ImagingCropper) encodeJPEGBytes(img image.Image, quality int) ([]byte, error) {
+	var b bytes.Buffer
+	if err := encodeJPEG(&b, img, quality, c.Subsampling); err != nil {
+		return nil, err
+	}
+	if c.DPI == 0 {
+		return b.Bytes(), nil
+	}
+	data, err := withJFIFDensity(b.Bytes(), c.DPI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set JPEG density: %w", err)
+	}
+	return data, nil
+}
+
+// encodeCapped is like encode, but keeps JPEGs within maxSize bytes by
+// binary searching the highest quality up to the requested one whose
+// output fits. Sizes grow with the quality, so that takes about 7 encodes
+// of img for outputs over the limit, and a single one for those under it.
+// Outputs that don't fit even at quality 1, and lossless formats over the
+// limit, fail. A maxSize of zero encodes like encode.
+func (c *ImagingCropper) encodeCapped(ctx context.Context, w io.Writer, img image.Image, format OutputFormat, quality int, maxSize int64) error {
+	if maxSize <= 0 {
+		return c.encode(w, img, format, quality)
+	}
+	if format == "" {
+		format = c.Format
+	}
+	if quality == 0 {
+		quality = c.Quality
+	}
+	if format.imagingFormat() != imaging.JPEG {
+		var b bytes.Buffer
+		if err := imaging.Encode(&b, img, format.imagingFormat()); err != nil {
+			return err
+		}
+		if int64(b.Len()) > maxSize {
+			return fmt.Errorf("%s output is %d bytes, over the max file size of %d bytes, and has no quality to lower", format, b.Len(), maxSize)
 		}
+		_, err := w.Write(b.Bytes())
+		return err
 	}
 
-	// Crop the image
-	croppedImg := imaging.Crop(src, cropRect)
+	data, err := c.encodeJPEGBytes(img, quality)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > maxSize {
+		// The best fit so far stays nil until a quality fits.
+		var fit []byte
+		low, high := 1, quality-1
+		for low <= high {
+			mid := (low + high) / 2
+			candidate, err := c.encodeJPEGBytes(img, mid)
+			if err != nil {
+				return err
+			}
+			if int64(len(candidate)) <= maxSize {
+				fit, quality = candidate, mid
+				low = mid + 1
+			} else {
+				high = mid - 1
+			}
+		}
+		if fit == nil {
+			return fmt.Errorf("output doesn't fit the max file size of %d bytes even at quality 1", maxSize)
+		}
+		data = fit
+		log.Ctx(ctx).Debug().Int("quality", quality).Int("size", len(data)).Int64("max_file_size", maxSize).Msg("lowered quality to fit the max file size")
+	}
+	_, err = w.Write(data)
+	return err
+}
 
-	// Encode and write the cropped image with high quality
-	return imaging.Encode(w, croppedImg, imaging.JPEG, imaging.JPEGQuality(90))
+// Extension returns the file extension of the images produced by Crop.
+func (c *ImagingCropper) Extension() string {
+	return c.Format.Extension()
 }
 
 // NewImagingCropper creates a new instance of ImagingCropper
+// that encodes high quality JPEGs
 func NewImagingCropper() *ImagingCropper {
-	return &ImagingCropper{}
+	return &ImagingCropper{
+		Quality:     90,
+		Format:      FormatJPEG,
+		Subsampling: Subsampling420,
+		Filter:      imaging.Lanczos,
+	}
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// TestCropConcurrent runs crops in parallel on one shared cropper, the way
+// the executor's workers use it. Run it with -race to catch shared state;
+// mixing different crops also catches state leaking between calls.
+func TestCropConcurrent(t *testing.T) {
+	src, err := syntheticImage(imaging.JPEG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cropper := NewImagingCropper()
+	cropper.Decodes = newDecodeSemaphore(4)
+	cropper.DPI = 300
+	cropper.MaxFileSize = 4096
+
+	crops := []CropOperation{
+		{Crop: Crop{X: 0, Y: 0, Width: 0.5, Height: 0.5}},
+		{Crop: Crop{X: 0.25, Y: 0.25, Width: 0.5, Height: 0.75}, Quality: 70},
+		{Crop: Crop{X: 0.5, Y: 0.1, Width: 0.5, Height: 0.25}, Format: FormatPNG},
+		{Crop: Crop{X: 0.1, Y: 0.1, Width: 0.6, Height: 0.6}, Rotate: 5},
+	}
+	want := make([][]byte, len(crops))
+	for i, op := range crops {
+		var b bytes.Buffer
+		if err := cropper.Crop(context.Background(), bytes.NewReader(src), &b, op); err != nil {
+			t.Fatalf("crop %d: %v", i, err)
+		}
+		want[i] = b.Bytes()
+	}
+
+	var wg sync.WaitGroup
+	for i := range 64 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			op := crops[i%len(crops)]
+			var b bytes.Buffer
+			if err := cropper.Crop(context.Background(), bytes.NewReader(src), &b, op); err != nil {
+				t.Errorf("crop %d: %v", i, err)
+				return
+			}
+			if !bytes.Equal(b.Bytes(), want[i%len(crops)]) {
+				t.Errorf("crop %d differs from the same crop run alone", i)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// CropPreset is a named aspect ratio offered in the frontend's crop menu.
+type CropPreset struct {
+	Name string `json:"name"`
+	// Aspect is the width/height ratio of the crop, e.g. 1.7778 for 16:9.
+	Aspect float64 `json:"aspect"`
+}
+
+// loadCropPresets reads a JSON array of crop presets and checks that every
+// preset has a unique name and a positive aspect ratio.
+func loadCropPresets(path string) ([]CropPreset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read presets file %s: %w", path, err)
+	}
+	var presets []CropPreset
+	if err := json.Unmarshal(data, &presets); err != nil {
+		return nil, fmt.Errorf("failed to parse presets file %s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+	for i, preset := range presets {
+		if preset.Name == "" {
+			return nil, fmt.Errorf("preset %d in %s is missing a name", i+1, path)
+		}
+		if seen[preset.Name] {
+			return nil, fmt.Errorf("preset %d in %s: duplicate name %q", i+1, path, preset.Name)
+		}
+		if preset.Aspect <= 0 {
+			return nil, fmt.Errorf("preset %q in %s: invalid aspect ratio %v", preset.Name, path, preset.Aspect)
+		}
+		seen[preset.Name] = true
+	}
+	return presets, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Directories inside the queue directory that batches move through.
+const (
+	queueProcessingDir = "processing"
+	queueDoneDir       = "done"
+	queueFailedDir     = "failed"
+)
+
+// batchOwnerExt is the extension of the file next to a claimed batch in
+// the processing directory that records which daemon is running it.
+const batchOwnerExt = ".owner"
+
+// batchOwner identifies the daemon running a batch.
+type batchOwner struct {
+	Host string `json:"host"`
+	PID  int    `json:"pid"`
+}
+
+// currentBatchOwner returns the owner of the batches this process claims.
+func currentBatchOwner() batchOwner {
+	host, _ := os.Hostname()
+	return batchOwner{Host: host, PID: os.Getpid()}
+}
+
+// gone reports whether the daemon that owns a batch is known to have
+// stopped: it ran on this machine and its process isn't running. Owners on
+// other machines can't be checked and are taken to be running.
+func (o batchOwner) gone() bool {
+	host, _ := os.Hostname()
+	return o.Host == host && o.PID != os.Getpid() && !processAlive(o.PID)
+}
+
+type daemonCmd struct {
+	RootDir  string        `arg:"" help:"Root directory the operations' filenames are relative to"`
+	QueueDir string        `arg:"" help:"Directory that batches of operations are dropped into as JSONL files with a .jsonl extension" type:"existingdir"`
+	Interval time.Duration `help:"How often the queue directory is checked for new batches" default:"2s"`
+
+	Log  logFlags  `embed:""`
+	Exec execFlags `embed:""`
+}
+
+// Run executes the batches dropped into the queue directory as they
+// arrive, oldest name first, until it's interrupted. Each batch is claimed
+// by moving it to the processing directory, so several daemons can share a
+// queue, and then moved to done or, when any of its operations failed, to
+// failed along with a .error file saying why.
+func (cmd *daemonCmd) Run() error {
+	closeLog, err := cmd.Log.setup()
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	// Services are usually stopped with SIGTERM rather than an interrupt.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	ctx = log.Logger.WithContext(ctx)
+
+	if cmd.Interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %s", cmd.Interval)
+	}
+	executor, err := cmd.Exec.newExecutor(cmd.RootDir)
+	if err != nil {
+		return err
+	}
+	defer executor.Close()
+	for _, dir := range []string{queueProcessingDir, queueDoneDir, queueFailedDir} {
+		if err := os.MkdirAll(filepath.Join(cmd.QueueDir, dir), defaultDirMode); err != nil {
+			return fmt.Errorf("failed to create queue directory: %w", err)
+		}
+	}
+	if err := cmd.requeueProcessing(ctx); err != nil {
+		return err
+	}
+
+	log.Ctx(ctx).Info().Str("queue", cmd.QueueDir).Str("output", executor.OutputDir).Msg("waiting for batches")
+	ticker := time.NewTicker(cmd.Interval)
+	defer ticker.Stop()
+	for {
+		batches, err := cmd.queuedBatches()
+		if err != nil {
+			return err
+		}
+		for _, name := range batches {
+			if ctx.Err() != nil {
+				break
+			}
+			cmd.processBatch(ctx, executor, name)
+		}
+		select {
+		case <-ctx.Done():
+			log.Ctx(ctx).Info().Msg("stopped waiting for batches")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// queuedBatches returns the names of the batches in the queue directory,
+// in order. Hidden files are left alone, so producers can write a batch
+// under a hidden or other name and rename it once it's complete.
+func (cmd *daemonCmd) queuedBatches() ([]string, error) {
+	entries, err := os.ReadDir(cmd.QueueDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue directory: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && !strings.HasPrefix(name, ".") && strings.EqualFold(filepath.Ext(name), ".jsonl") {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// requeueProcessing moves batches left in the processing directory by a
+// daemon that was killed back into the queue, so they're run again.
+// Batches whose owner may still be running them, such as another daemon
+// sharing the queue, are left alone.
+func (cmd *daemonCmd) requeueProcessing(ctx context.Context) error {
+	processing := filepath.Join(cmd.QueueDir, queueProcessingDir)
+	entries, err := os.ReadDir(processing)
+	if err != nil {
+		return fmt.Errorf("failed to read queue directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		ownerPath := filepath.Join(processing, name)
+		if batch, ok := strings.CutSuffix(name, batchOwnerExt); ok {
+			// The owner of a batch that was never claimed, or was already
+			// moved aside, only blocks the next batch of that name.
+			if _, err := os.Stat(filepath.Join(processing, batch)); errors.Is(err, fs.ErrNotExist) && cmd.ownerGone(ownerPath) {
+				os.Remove(ownerPath)
+			}
+			continue
+		}
+		ownerPath += batchOwnerExt
+		if !cmd.ownerGone(ownerPath) {
+			log.Ctx(ctx).Info().Str("batch", name).Msg("leaving batch claimed by a running daemon")
+			continue
+		}
+		if err := os.Rename(filepath.Join(processing, name), filepath.Join(cmd.QueueDir, name)); err != nil {
+			return fmt.Errorf("failed to requeue batch %s: %w", name, err)
+		}
+		os.Remove(ownerPath)
+		log.Ctx(ctx).Warn().Str("batch", name).Msg("requeued batch left over from an earlier run")
+	}
+	return nil
+}
+
+// ownerGone reports whether the daemon recorded in the owner file at path
+// has stopped. Batches without a readable owner were left by a daemon that
+// stopped between claiming them and recording itself.
+func (cmd *daemonCmd) ownerGone(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return true
+	}
+	var owner batchOwner
+	if err := json.Unmarshal(data, &owner); err != nil {
+		return true
+	}
+	return owner.gone()
+}
+
+// claimBatch claims the batch with the given name by recording this daemon
+// as its owner and moving it to the processing directory. It returns the
+// path of the claimed batch, or an error when it's claimed by another
+// daemon or no longer queued.
+func (cmd *daemonCmd) claimBatch(name string) (string, error) {
+	claimed := filepath.Join(cmd.QueueDir, queueProcessingDir, name)
+	// The owner is recorded first and exclusively, so a daemon starting up
+	// never sees a claimed batch without its owner.
+	owner, err := json.Marshal(currentBatchOwner())
+	if err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(claimed+batchOwnerExt, os.O_WRONLY|os.O_CREATE|os.O_EXCL, defaultFileMode)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(owner)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(filepath.Join(cmd.QueueDir, name), claimed)
+	}
+	if err != nil {
+		os.Remove(claimed + batchOwnerExt)
+		return "", err
+	}
+	return claimed, nil
+}
+
+// processBatch claims the batch with the given name and executes it.
+// Failures are logged, and recorded next to the failed batch, rather than
+// returned, so one bad batch doesn't stop the daemon.
+func (cmd *daemonCmd) processBatch(ctx context.Context, executor *OperationExecutor, name string) {
+	logger := log.Ctx(ctx).With().Str("batch", name).Logger()
+	claimed, err := cmd.claimBatch(name)
+	if err != nil {
+		// Another daemon sharing the queue may have claimed it first.
+		logger.Debug().Err(err).Msg("failed to claim batch")
+		return
+	}
+	defer os.Remove(claimed + batchOwnerExt)
+	logger.Info().Msg("executing batch")
+
+	start := time.Now()
+	err = execBatch(ctx, executor, claimed)
+	if ctx.Err() != nil {
+		// The batch was cut short by the daemon stopping, and is put back
+		// to run again next time.
+		if err := os.Rename(claimed, filepath.Join(cmd.QueueDir, name)); err != nil {
+			logger.Error().Err(err).Msg("failed to requeue interrupted batch")
+		}
+		return
+	}
+
+	dest := queueDoneDir
+	if err != nil {
+		dest = queueFailedDir
+		logger.Error().Err(err).Msg("batch failed")
+		errPath := filepath.Join(cmd.QueueDir, queueFailedDir, name+".error")
+		if err := os.WriteFile(errPath, []byte(err.Error()+"\n"), defaultFileMode); err != nil {
+			logger.Error().Err(err).Msg("failed to record why the batch failed")
+		}
+	} else {
+		logger.Info().Dur("took", time.Since(start)).Msg("executed batch")
+	}
+	if err := os.Rename(claimed, filepath.Join(cmd.QueueDir, dest, name)); err != nil {
+		logger.Error().Err(err).Msg("failed to move batch aside")
+	}
+}
+
+// execBatch executes the operations of the JSONL file at path.
+func execBatch(ctx context.Context, executor *OperationExecutor, path string) error {
+	r, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer r.Close()
+
+	var readErr error
+	ops := func(yield func(Operation) bool) {
+		for op, err := range readOperations(r) {
+			if err != nil {
+				readErr = err
+				return
+			}
+			if !yield(op) {
+				return
+			}
+		}
+	}
+	execErr := executor.ExecSeq(ctx, ops)
+	return errors.Join(readErr, execErr)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dirSettingsFile is the name of the file that holds the crop settings of a
+// directory and its subdirectories.
+const dirSettingsFile = ".pickemall.json"
+
+// DirSettings are the defaults for crops of the images in a directory,
+// such as 1:1 for a folder of product shots. They're read from a
+// .pickemall.json file in the directory, and cascade to subdirectories,
+// which override them field by field with their own file.
+type DirSettings struct {
+	// Aspect is the width/height ratio the frontend's crop tool starts with.
+	Aspect float64 `json:"aspect,omitempty"`
+	// Quality is the JPEG quality of crops that don't set one.
+	Quality int `json:"quality,omitempty"`
+	// Format is the output format of crops that don't set one.
+	Format OutputFormat `json:"format,omitempty"`
+}
+
+// Validate checks that the settings are in range. Zero values are unset.
+func (s DirSettings) Validate() error {
+	if s.Aspect < 0 {
+		return fmt.Errorf("invalid aspect ratio %v", s.Aspect)
+	}
+	if s.Quality < 0 || s.Quality > 100 {
+		return fmt.Errorf("quality must be between 1 and 100, got %d", s.Quality)
+	}
+	return s.Format.Validate()
+}
+
+// merge returns s with the fields set in child replacing its own.
+func (s DirSettings) merge(child DirSettings) DirSettings {
+	if child.Aspect != 0 {
+		s.Aspect = child.Aspect
+	}
+	if child.Quality != 0 {
+		s.Quality = child.Quality
+	}
+	if child.Format != "" {
+		s.Format = child.Format
+	}
+	return s
+}
+
+// apply fills in the quality and format of crops and autocrops that don't
+// set them. Other operations are returned unchanged.
+func (s DirSettings) apply(op Operation) Operation {
+	switch {
+	case op.Crop != nil:
+		crop := *op.Crop
+		crop.Format = cmp.Or(crop.Format, s.Format)
+		crop.Quality = cmp.Or(crop.Quality, s.Quality)
+		op.Crop = &crop
+	case op.AutoCrop != nil:
+		autoCrop := *op.AutoCrop
+		autoCrop.Format = cmp.Or(autoCrop.Format, s.Format)
+		autoCrop.Quality = cmp.Or(autoCrop.Quality, s.Quality)
+		op.AutoCrop = &autoCrop
+	}
+	return op
+}
+
+// loadDirSettings returns the settings in effect for dir, relative to
+// rootDir, by merging the settings files from rootDir down to dir. Files
+// above rootDir aren't read.
+func loadDirSettings(rootDir, dir string) (DirSettings, error) {
+	var settings DirSettings
+	for _, path := range dirSettingsPaths(rootDir, dir) {
+		own, err := readDirSettings(path)
+		if err != nil {
+			return DirSettings{}, err
+		}
+		settings = settings.merge(own)
+	}
+	return settings, nil
+}
+
+// dirSettingsModTime returns the modification time of the newest settings
+// file in effect for dir, relative to rootDir, or the zero time when there
+// are none.
+func dirSettingsModTime(rootDir, dir string) time.Time {
+	var latest time.Time
+	for _, path := range dirSettingsPaths(rootDir, dir) {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// dirSettingsPaths returns the paths of the settings files that apply to
+// dir, relative to rootDir, from rootDir down to dir.
+func dirSettingsPaths(rootDir, dir string) []string {
+	dirs := []string{rootDir}
+	if dir = filepath.Clean(dir); dir != "." {
+		for _, segment := range strings.Split(filepath.ToSlash(dir), "/") {
+			dirs = append(dirs, filepath.Join(dirs[len(dirs)-1], segment))
+		}
+	}
+	paths := make([]string, len(dirs))
+	for i, dir := range dirs {
+		paths[i] = filepath.Join(dir, dirSettingsFile)
+	}
+	return paths
+}
+
+// readDirSettings reads a settings file. A missing file has no settings.
+func readDirSettings(path string) (DirSettings, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return DirSettings{}, nil
+	} else if err != nil {
+		return DirSettings{}, fmt.Errorf("failed to read directory settings %s: %w", path, err)
+	}
+	var settings DirSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return DirSettings{}, fmt.Errorf("failed to parse directory settings %s: %w", path, err)
+	}
+	if err := settings.Validate(); err != nil {
+		return DirSettings{}, fmt.Errorf("invalid directory settings %s: %w", path, err)
+	}
+	return settings, nil
+}
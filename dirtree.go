@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+)
+
+// DirTree is a folder in the directory tree returned by /api/tree.
+type DirTree struct {
+	Name string `json:"name"`
+	// Path is the slash-separated path relative to the root, usable with
+	// /api/ls?dir=. It's empty for the root itself.
+	Path string `json:"path"`
+	// Images is the number of images directly in the folder.
+	Images int `json:"images"`
+	// Total is the number of images in the folder and all its subfolders.
+	Total    int        `json:"total"`
+	Children []*DirTree `json:"children"`
+}
+
+// buildDirTree walks rootPath and returns its folders with image counts,
+// leaving out the excluded directory and those below the maximum depth of
+// opts. Only directory entries are inspected, no image is
+// opened, so it's cheap even for large trees.
+func buildDirTree(rootPath string, opts WalkOptions) (*DirTree, error) {
+	excluded := opts.excludedDir()
+	root := &DirTree{Name: filepath.Base(rootPath), Children: []*DirTree{}}
+	nodes := map[string]*DirTree{".": root}
+
+	if err := filepath.WalkDir(rootPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(rootPath, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %w", err)
+		}
+		if relPath == "." {
+			return nil
+		}
+
+		parent := nodes[filepath.Dir(relPath)]
+		if d.IsDir() && (excluded != "" && canonicalPath(path) == excluded || !opts.withinDepth(relPath)) {
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			node := &DirTree{Name: d.Name(), Path: filepath.ToSlash(relPath), Children: []*DirTree{}}
+			parent.Children = append(parent.Children, node)
+			nodes[relPath] = node
+		} else if opts.listable(path) {
+			parent.Images++
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	root.sumTotals()
+	return root, nil
+}
+
+func (t *DirTree) sumTotals() int {
+	t.Total = t.Images
+	for _, child := range t.Children {
+		t.Total += child.sumTotals()
+	}
+	return t.Total
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var errorPageTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Code}} {{.Status}} - pickemall</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 36rem; margin: 15vh auto; padding: 0 1rem; color: #222; }
+h1 { font-size: 1.5rem; margin-bottom: .5rem; }
+p { color: #555; }
+</style>
+</head>
+<body>
+<h1>{{.Code}} {{.Status}}</h1>
+<p>{{.Message}}</p>
+<p><a href="/">Back to pickemall</a></p>
+</body>
+</html>
+`))
+
+// wantsHTML reports whether the request comes from a browser navigation
+// rather than the frontend's fetch calls, which accept JSON or anything.
+func wantsHTML(c *fiber.Ctx) bool {
+	return c.Accepts(fiber.MIMEApplicationJSON, fiber.MIMETextHTML) == fiber.MIMETextHTML
+}
+
+// sendErrorPage responds with a minimal HTML page describing the error.
+func sendErrorPage(c *fiber.Ctx, code int, message string) error {
+	var b bytes.Buffer
+	if err := errorPageTemplate.Execute(&b, struct {
+		Code    int
+		Status  string
+		Message string
+	}{code, http.StatusText(code), message}); err != nil {
+		return err
+	}
+	c.Type("html", "utf-8")
+	return c.Status(code).Send(b.Bytes())
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	exifTagMake         uint16 = 0x010f
+	exifTagModel        uint16 = 0x0110
+	exifTagOrientation  uint16 = 0x0112
+	exifTagDateTime     uint16 = 0x0132
+	exifTagDateTimeOrig uint16 = 0x9003
+	exifTagFocalLength  uint16 = 0x920a
+	exifTagLensMake     uint16 = 0xa433
+	exifTagLensModel    uint16 = 0xa434
+	exifTagExifIFDPtr   uint16 = 0x8769
+	exifTagGPSIFDPtr    uint16 = 0x8825
+	exifHeaderSignature        = "Exif\x00\x00"
+)
+
+// exifData holds the tags found in the IFDs of an EXIF (TIFF) block.
+type exifData struct {
+	// IFD0 holds tags of the main image, such as orientation and camera model.
+	IFD0 map[uint16]any
+	// Exif holds tags of the Exif sub-IFD, such as capture date and lens.
+	Exif map[uint16]any
+	// GPS holds tags of the GPS sub-IFD.
+	GPS map[uint16]any
+}
+
+// Orientation returns the EXIF orientation (1-8), or 1 when it is missing.
+func (e *exifData) Orientation() int {
+	if e == nil {
+		return 1
+	}
+	if v, ok := e.IFD0[exifTagOrientation].([]uint16); ok && len(v) > 0 && v[0] >= 1 && v[0] <= 8 {
+		return int(v[0])
+	}
+	return 1
+}
+
+// TakenAt returns the original capture time, falling back to the DateTime
+// tag of IFD0 when it is missing. EXIF dates carry no time zone,
+// so the wall clock time is returned in UTC.
+func (e *exifData) TakenAt() (time.Time, bool) {
+	if e == nil {
+		return time.Time{}, false
+	}
+	for _, v := range []any{e.Exif[exifTagDateTimeOrig], e.IFD0[exifTagDateTime]} {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if t, err := time.Parse("2006:01:02 15:04:05", s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Camera returns the camera make and model, such as "Canon EOS R5", or an
+// empty string when neither is recorded. Models that already start with the
+// make, as many do, aren't prefixed again.
+func (e *exifData) Camera() string {
+	if e == nil {
+		return ""
+	}
+	maker, _ := e.IFD0[exifTagMake].(string)
+	model, _ := e.IFD0[exifTagModel].(string)
+	maker, model = strings.TrimSpace(maker), strings.TrimSpace(model)
+	switch {
+	case maker == "":
+		return model
+	case model == "":
+		return maker
+	case strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)):
+		return model
+	default:
+		return maker + " " + model
+	}
+}
+
+// Lens returns the lens model, such as "RF24-105mm F4 L IS USM", or an
+// empty string when it isn't recorded, as with most compact cameras and
+// phones. Like with Camera, the lens make is only prefixed when the model
+// doesn't already start with it.
+func (e *exifData) Lens() string {
+	if e == nil {
+		return ""
+	}
+	maker, _ := e.Exif[exifTagLensMake].(string)
+	model, _ := e.Exif[exifTagLensModel].(string)
+	maker, model = strings.TrimSpace(maker), strings.TrimSpace(model)
+	switch {
+	case model == "":
+		return ""
+	case maker == "", strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)):
+		return model
+	default:
+		return maker + " " + model
+	}
+}
+
+// FocalLength returns the actual focal length in millimeters, rounded to
+// a tenth so the same zoom setting always reads the same, or 0 when it
+// isn't recorded.
+func (e *exifData) FocalLength() float64 {
+	if e == nil {
+		return 0
+	}
+	v, ok := e.Exif[exifTagFocalLength].([]exifRational)
+	if !ok || len(v) == 0 || v[0].Float() <= 0 {
+		return 0
+	}
+	return math.Round(v[0].Float()*10) / 10
+}
+
+// orientationSwapsAxes reports whether the given EXIF orientation implies a
+// 90 or 270 degree rotation, i.e. width and height are swapped on display.
+func orientationSwapsAxes(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// parseEXIF parses the payload of a JPEG APP1 segment, including the
+// "Exif\0\0" signature.
+func parseEXIF(payload []byte) (*exifData, error) {
+	if !bytes.HasPrefix(payload, []byte(exifHeaderSignature)) {
+		return nil, errors.New("missing exif signature")
+	}
+	tiff := payload[len(exifHeaderSignature):]
+	if len(tiff) < 8 {
+		return nil, errors.New("exif block too short")
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid tiff byte order %q", tiff[:2])
+	}
+
+	p := exifParser{data: tiff, order: order}
+	ifd0, err := p.readIFD(order.Uint32(tiff[4:8]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IFD0: %w", err)
+	}
+
+	data := &exifData{IFD0: ifd0}
+	if offset, ok := firstUint32(ifd0[exifTagExifIFDPtr]); ok {
+		if data.Exif, err = p.readIFD(offset); err != nil {
+			return nil, fmt.Errorf("failed to read exif IFD: %w", err)
+		}
+	}
+	if offset, ok := firstUint32(ifd0[exifTagGPSIFDPtr]); ok {
+		if data.GPS, err = p.readIFD(offset); err != nil {
+			return nil, fmt.Errorf("failed to read gps IFD: %w", err)
+		}
+	}
+	return data, nil
+}
+
+type exifParser struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// exifTypeSizes maps TIFF field types to their size in bytes.
+var exifTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+func (p exifParser) readIFD(offset uint32) (map[uint16]any, error) {
+	if uint64(offset)+2 > uint64(len(p.data)) {
+		return nil, errors.New("IFD offset out of range")
+	}
+	count := uint32(p.order.Uint16(p.data[offset:]))
+	entries := offset + 2
+	if uint64(entries)+uint64(count)*12 > uint64(len(p.data)) {
+		return nil, errors.New("IFD entries out of range")
+	}
+
+	tags := make(map[uint16]any, count)
+	for i := uint32(0); i < count; i++ {
+		entry := p.data[entries+i*12 : entries+i*12+12]
+		tag := p.order.Uint16(entry[0:2])
+		typ := p.order.Uint16(entry[2:4])
+		n := p.order.Uint32(entry[4:8])
+
+		size, ok := exifTypeSizes[typ]
+		if !ok {
+			continue
+		}
+		total := uint64(size) * uint64(n)
+		var raw []byte
+		if total <= 4 {
+			raw = entry[8 : 8+total]
+		} else {
+			valueOffset := uint64(p.order.Uint32(entry[8:12]))
+			if valueOffset+total > uint64(len(p.data)) {
+				continue
+			}
+			raw = p.data[valueOffset : valueOffset+total]
+		}
+		tags[tag] = p.decodeValue(typ, n, raw)
+	}
+	return tags, nil
+}
+
+// decodeValue converts a raw TIFF value into a Go value: ASCII becomes a
+// string, rationals become []exifRational and integer types become slices
+// of the matching Go integer type.
+func (p exifParser) decodeValue(typ uint16, n uint32, raw []byte) any {
+	switch typ {
+	case 2:
+		return string(bytes.TrimRight(raw, "\x00 "))
+	case 3:
+		v := make([]uint16, n)
+		for i := range v {
+			v[i] = p.order.Uint16(raw[i*2:])
+		}
+		return v
+	case 4:
+		v := make([]uint32, n)
+		for i := range v {
+			v[i] = p.order.Uint32(raw[i*4:])
+		}
+		return v
+	case 5, 10:
+		v := make([]exifRational, n)
+		for i := range v {
+			num := p.order.Uint32(raw[i*8:])
+			den := p.order.Uint32(raw[i*8+4:])
+			if typ == 10 {
+				v[i] = exifRational{Num: int64(int32(num)), Den: int64(int32(den))}
+			} else {
+				v[i] = exifRational{Num: int64(num), Den: int64(den)}
+			}
+		}
+		return v
+	case 8:
+		v := make([]int16, n)
+		for i := range v {
+			v[i] = int16(p.order.Uint16(raw[i*2:]))
+		}
+		return v
+	case 9:
+		v := make([]int32, n)
+		for i := range v {
+			v[i] = int32(p.order.Uint32(raw[i*4:]))
+		}
+		return v
+	default:
+		return bytes.Clone(raw)
+	}
+}
+
+type exifRational struct {
+	Num int64
+	Den int64
+}
+
+func (r exifRational) Float() float64 {
+	if r.Den == 0 {
+		return 0
+	}
+	return float64(r.Num) / float64(r.Den)
+}
+
+func firstUint32(v any) (uint32, bool) {
+	switch v := v.(type) {
+	case []uint32:
+		if len(v) > 0 {
+			return v[0], true
+		}
+	case []uint16:
+		if len(v) > 0 {
+			return uint32(v[0]), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// exportIndexFile is the name of the index written to the output directory
+// when OperationExecutor.Index is set.
+const exportIndexFile = "index.json"
+
+// exportIndexEntry describes one exported file for gallery generators.
+type exportIndexEntry struct {
+	// File is the slash-separated path of the output relative to the output directory.
+	File string `json:"file"`
+	// Source is the operation filename the output was made from.
+	Source    string `json:"source"`
+	Operation string `json:"operation"`
+	// Label is the label of the operation, if any.
+	Label string `json:"label,omitempty"`
+	// Meta is the client metadata of the operation, if any.
+	Meta   map[string]any `json:"meta,omitempty"`
+	Width  int            `json:"width,omitempty"`
+	Height int            `json:"height,omitempty"`
+	// Size is the size of the output in bytes.
+	Size int64 `json:"size"`
+}
+
+// newExportIndexEntry describes the output of op written to outputPath,
+// reading its dimensions from the file header.
+func newExportIndexEntry(outputDir, outputPath string, op Operation, policy OrientationPolicy) (exportIndexEntry, error) {
+	relPath, err := filepath.Rel(outputDir, outputPath)
+	if err != nil {
+		return exportIndexEntry{}, fmt.Errorf("failed to get relative path: %w", err)
+	}
+	entry := exportIndexEntry{
+		File:      filepath.ToSlash(relPath),
+		Source:    op.Filename(),
+		Operation: op.Type(),
+		Label:     op.Label,
+		Meta:      op.Meta,
+	}
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return exportIndexEntry{}, fmt.Errorf("failed to stat output %s: %w", outputPath, err)
+	}
+	entry.Size = info.Size()
+	if op.Metadata != nil || isVideoFile(outputPath) {
+		// Metadata dumps and videos aren't images.
+		return entry, nil
+	}
+	entry.Width, entry.Height, err = imageDimensions(outputPath, policy)
+	if err != nil {
+		return exportIndexEntry{}, err
+	}
+	return entry, nil
+}
+
+// imageDimensions returns the display dimensions of an image file. JPEGs
+// are oriented according to policy, like in the file listing.
+func imageDimensions(path string, policy OrientationPolicy) (int, int, error) {
+	if info, err := readJPEGInfo(path); err == nil {
+		img := newImageInfo(info, policy)
+		return img.Width, img.Height, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read image dimensions of %s: %w", path, err)
+	}
+	return config.Width, config.Height, nil
+}
+
+// writeExportIndex writes the entries, sorted by file, to index.json in
+// outputDir, replacing any previous index.
+func writeExportIndex(outputDir string, entries []exportIndexEntry, modes outputModes) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].File < entries[j].File
+	})
+	data, err := json.MarshalIndent(struct {
+		Files []exportIndexEntry `json:"files"`
+	}{entries}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode export index: %w", err)
+	}
+	if err := modes.writeFile(filepath.Join(outputDir, exportIndexFile), data); err != nil {
+		return fmt.Errorf("failed to write export index: %w", err)
+	}
+	return nil
+}
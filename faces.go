@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+
+	"github.com/disintegration/imaging"
+	pigo "github.com/esimov/pigo/core"
+)
+
+// faceDetectionSize is the longest side images are scaled down to before
+// running face detection. Faces in portraits are large enough to be found
+// at this size, and detection time grows with the pixel count.
+const faceDetectionSize = 640
+
+// FaceDetector finds faces in images using a pigo cascade.
+type FaceDetector struct {
+	classifier *pigo.Pigo
+}
+
+// LoadFaceDetector reads a pigo face cascade, such as the "facefinder" file
+// shipped in the pigo repository.
+func LoadFaceDetector(cascadePath string) (*FaceDetector, error) {
+	cascade, err := os.ReadFile(cascadePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read face cascade %s: %w", cascadePath, err)
+	}
+	classifier, err := pigo.NewPigo().Unpack(cascade)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load face cascade %s: %w", cascadePath, err)
+	}
+	return &FaceDetector{classifier: classifier}, nil
+}
+
+// LargestFace returns the bounding square of the largest face found in img,
+// in img's coordinates. ok is false when no face is found.
+func (d *FaceDetector) LargestFace(img image.Image) (face image.Rectangle, ok bool) {
+	bounds := img.Bounds()
+	scale := 1.0
+	small := imaging.Clone(img)
+	if longest := max(bounds.Dx(), bounds.Dy()); longest > faceDetectionSize {
+		scale = float64(longest) / faceDetectionSize
+		small = imaging.Fit(img, faceDetectionSize, faceDetectionSize, imaging.Linear)
+	}
+	gray := imaging.Grayscale(small)
+
+	rows, cols := gray.Bounds().Dy(), gray.Bounds().Dx()
+	pixels := make([]uint8, rows*cols)
+	for y := range rows {
+		for x := range cols {
+			pixels[y*cols+x] = gray.Pix[y*gray.Stride+x*4]
+		}
+	}
+
+	detections := d.classifier.RunCascade(pigo.CascadeParams{
+		MinSize:     20,
+		MaxSize:     max(rows, cols),
+		ShiftFactor: 0.1,
+		ScaleFactor: 1.1,
+		ImageParams: pigo.ImageParams{
+			Pixels: pixels,
+			Rows:   rows,
+			Cols:   cols,
+			Dim:    cols,
+		},
+	}, 0)
+	detections = d.classifier.ClusterDetections(detections, 0.2)
+
+	var best *pigo.Detection
+	for i, det := range detections {
+		// Scores below this are mostly false positives on textured areas.
+		if det.Q < 5 {
+			continue
+		}
+		if best == nil || det.Scale > best.Scale {
+			best = &detections[i]
+		}
+	}
+	if best == nil {
+		return image.Rectangle{}, false
+	}
+
+	half := float64(best.Scale) / 2
+	face = image.Rect(
+		int((float64(best.Col)-half)*scale),
+		int((float64(best.Row)-half)*scale),
+		int((float64(best.Col)+half)*scale),
+		int((float64(best.Row)+half)*scale),
+	).Add(bounds.Min)
+	return face.Intersect(bounds), true
+}
+
+// aspectCrop returns the largest rectangle with the given width/height
+// aspect ratio that fits in bounds, centered on center as far as the bounds
+// allow.
+func aspectCrop(bounds image.Rectangle, aspect float64, center image.Point) image.Rectangle {
+	width, height := bounds.Dx(), bounds.Dy()
+	if float64(width)/float64(height) > aspect {
+		width = max(1, int(float64(height)*aspect))
+	} else {
+		height = max(1, int(float64(width)/aspect))
+	}
+
+	x := min(max(center.X-width/2, bounds.Min.X), bounds.Max.X-width)
+	y := min(max(center.Y-height/2, bounds.Min.Y), bounds.Max.Y-height)
+	return image.Rect(x, y, x+width, y+height)
+}
+
+func rectCenter(r image.Rectangle) image.Point {
+	return image.Pt((r.Min.X+r.Max.X)/2, (r.Min.Y+r.Max.Y)/2)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileList is a fixed set of files to list instead of walking the root,
+// for when the files to review are chosen by another program.
+type FileList struct {
+	// paths are the listed files, relative to the root, in the order of
+	// the list.
+	paths []string
+	files map[string]bool
+	// dirs holds every directory with a listed file somewhere below it.
+	dirs map[string]bool
+}
+
+// readFileList reads the list of files at path: paths relative to the root,
+// slash-separated, one per line. Blank lines and lines starting with # are
+// skipped, and paths that are listed again are only listed once.
+func readFileList(path string) (*FileList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file list: %w", err)
+	}
+	defer f.Close()
+
+	l := &FileList{files: map[string]bool{}, dirs: map[string]bool{}}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		relPath := filepath.Clean(filepath.FromSlash(line))
+		if !filepath.IsLocal(relPath) {
+			return nil, fmt.Errorf("invalid path %q on line %d of file list %s, expected a path relative to the root", line, n, path)
+		}
+		if l.files[relPath] {
+			continue
+		}
+		l.paths = append(l.paths, relPath)
+		l.files[relPath] = true
+		for dir := filepath.Dir(relPath); dir != "."; dir = filepath.Dir(dir) {
+			l.dirs[dir] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read file list: %w", err)
+	}
+	return l, nil
+}
+
+// Len returns the number of listed files.
+func (l *FileList) Len() int {
+	return len(l.paths)
+}
+
+// Contains reports whether the file at relPath, relative to the root, is
+// listed. Every file is in a nil list.
+func (l *FileList) Contains(relPath string) bool {
+	return l == nil || l.files[filepath.Clean(relPath)]
+}
+
+// containsDir reports whether the directory at relDir, relative to the
+// root, has listed files somewhere below it.
+func (l *FileList) containsDir(relDir string) bool {
+	return l == nil || l.dirs[filepath.Clean(relDir)]
+}
+
+// findImages is findImages for the listed files: each is statted rather
+// than found by walking the root. Files that don't exist are counted as
+// missing, and the sidecars of images are looked up next to them.
+func (l *FileList) findImages(rootPath string, opts WalkOptions) ([]FileInfo, SkippedFiles, error) {
+	var files []FileInfo
+	var skipped SkippedFiles
+	sidecars := sidecarIndex{}
+	for _, relPath := range l.paths {
+		if reason := opts.skips(relPath); reason != notSkipped {
+			if reason == skipUnsupported && isSidecarFile(relPath) {
+				sidecars.add(relPath)
+			}
+			skipped.add(reason)
+			continue
+		}
+		path := filepath.Join(rootPath, relPath)
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) || err == nil && !info.Mode().IsRegular() {
+			skipped.add(skipMissing)
+			continue
+		} else if err != nil {
+			return nil, SkippedFiles{}, fmt.Errorf("failed to get file info: %w", err)
+		}
+		if !opts.settled(info.ModTime()) {
+			skipped.add(skipRecent)
+			continue
+		}
+		for _, name := range sidecarNames(relPath) {
+			if _, err := os.Stat(filepath.Join(rootPath, name)); err == nil {
+				sidecars.add(name)
+			}
+		}
+		files = append(files, FileInfo{
+			Name:       relPath,
+			SizeBytes:  info.Size(),
+			ModifiedAt: info.ModTime(),
+			CreatedAt:  createdAt(path, info),
+		})
+	}
+	sidecars.attach(files)
+	return files, skipped, nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/rs/zerolog/log"
+)
+
+// outputPreset bundles the output-control settings behind a --preset name.
+type outputPreset struct {
+	Quality     int
+	Format      OutputFormat
+	Subsampling ChromaSubsampling
+	Filter      imaging.ResampleFilter
+}
+
+var outputPresets = map[string]outputPreset{
+	"none":    {Quality: 90, Format: FormatJPEG, Subsampling: Subsampling420, Filter: imaging.Lanczos},
+	"web":     {Quality: 80, Format: FormatJPEG, Subsampling: Subsampling420, Filter: imaging.CatmullRom},
+	"print":   {Quality: 95, Format: FormatJPEG, Subsampling: Subsampling444, Filter: imaging.Lanczos},
+	"archive": {Quality: 100, Format: FormatPNG, Subsampling: Subsampling444, Filter: imaging.Lanczos},
+}
+
+// walkFlags are the flags shared by every command that lists images.
+type walkFlags struct {
+	WalkConcurrency int           `help:"Number of image headers to read in parallel when listing (default: number of CPUs)"`
+	SkipGenerated   bool          `help:"Leave out files that look like crop outputs (names ending in a -<hex hash> suffix) when listing"`
+	MinAge          time.Duration `help:"Leave out files modified more recently than this, e.g. 30s, so uploads still being written aren't listed"`
+	ValidateImages  bool          `help:"Fully decode every listed image to flag files that are corrupt or truncated past their header (slow on large trees)"`
+	Colors          bool          `help:"Compute the average color of every listed image, for sort=color (slow on large trees)"`
+	Sharpness       bool          `help:"Estimate the sharpness of every listed image, for sort=sharpness (slow on large trees)"`
+	DetectBlank     bool          `help:"Detect listed images that are nearly uniform, like black or white frames of timelapses and video extracts, for blank=false (slow on large trees)"`
+	Blurhash        bool          `help:"Compute a blurhash of every listed image, for frontends to show as a blurred placeholder while it loads (slow on large trees)"`
+	MaxDepth        int           `help:"Only list images this many directory levels deep: 1 is the root only, 2 includes its subdirectories, and so on (default: no limit)" default:"0"`
+	SquareTolerance float64       `help:"How far the ratio of an image's long side to its short side can be above 1 for its aspect_class to be square, e.g. 0.05 for 5%" default:"0.05"`
+	PanoramaRatio   float64       `help:"Ratio of an image's long side to its short side from which its aspect_class is panorama" default:"2"`
+	Videos          bool          `help:"Also list videos (mp4, mov, m4v, webm, mkv and avi) with a poster of their first frame, extracted with ffmpeg; they can only be picked"`
+	FFmpeg          string        `help:"ffmpeg executable that extracts the posters of --videos" default:"ffmpeg" name:"ffmpeg"`
+}
+
+func (f walkFlags) options() WalkOptions {
+	return WalkOptions{
+		Concurrency:     f.WalkConcurrency,
+		SkipGenerated:   f.SkipGenerated,
+		MinAge:          f.MinAge,
+		ValidateImages:  f.ValidateImages,
+		Colors:          f.Colors,
+		Sharpness:       f.Sharpness,
+		Blurhash:        f.Blurhash,
+		DetectBlank:     f.DetectBlank,
+		MaxDepth:        f.MaxDepth,
+		SquareTolerance: f.SquareTolerance,
+		PanoramaRatio:   f.PanoramaRatio,
+	}
+}
+
+// videoPosters returns the posters videos are listed with, or nil when
+// videos aren't listed.
+func (f walkFlags) videoPosters() (*VideoPosters, error) {
+	if !f.Videos {
+		return nil, nil
+	}
+	return newVideoPosters(f.FFmpeg)
+}
+
+// execFlags are the flags shared by every command that executes operations.
+type execFlags struct {
+	Preset          string  `help:"Named output preset: web (JPEG q80, 4:2:0, catmullrom), print (JPEG q95, 4:4:4 with -tags turbojpeg, lanczos) or archive (lossless PNG, lanczos); none is JPEG q90, 4:2:0, lanczos. Explicit --quality, --crop-format, --chroma-subsampling and --resample-filter override it." enum:"none,web,print,archive" default:"none"`
+	Quality         int     `help:"JPEG quality for cropped images (1-100, default 90)"`
+	Subsampling     string  `help:"Chroma subsampling of JPEG outputs: 420, 422 or 444 (full color resolution); other than 420 needs a build with -tags turbojpeg, and is encoded as 420 with a warning otherwise (default 420)" name:"chroma-subsampling"`
+	ResampleFilter  string  `help:"Filter resized, responsive and downscaled outputs are scaled with: lanczos (sharpest), catmullrom, linear, box or nearest (default lanczos)"`
+	MaxFileSize     int64   `help:"Largest size in bytes of cropped images, e.g. 512000 for platforms that cap uploads at 500KB; larger JPEGs are encoded at the highest quality up to --quality that fits, and fail when none does (default: no limit)" default:"0"`
+	Concurrency     int     `help:"Number of operations to execute in parallel (default: number of CPUs)"`
+	Sequential      bool    `help:"Execute operations one at a time in the order they were given, ignoring --concurrency and priorities, for reproducible logs and outputs"`
+	FailFast        bool    `help:"Stop at the first operation that fails, skipping the rest of the batch and cancelling those still running, instead of executing the others anyway"`
+	MaxDecodes      int     `help:"Maximum number of images decoded in memory at once, independently of --concurrency; with serve, previews and thumbnails count too, so browsing during a save doesn't add to its load (default: no limit)"`
+	CropFormat      string  `help:"Output format for cropped images: jpeg or png (default jpeg)"`
+	StrictCrops     bool    `help:"Fail crops that extend past the image bounds instead of shrinking them with a warning"`
+	CropFill        string  `help:"Fill the parts of crops that extend past the image bounds with this color, e.g. #000000, so they keep their requested size instead of being shrunk to fit"`
+	RoundDimensions int     `help:"Round the width and height of crops to a multiple of this many pixels, e.g. 2 for video tools that need even dimensions (default: exact crops)" default:"0"`
+	SnapGrid        int     `help:"Snap the edges of crops to the nearest multiple of this many pixels from the image's top-left corner, e.g. 16 to extract aligned tiles and sprites; unlike --round-dimensions their position is aligned too (default: exact crops)" default:"0"`
+	Orientation     string  `help:"How EXIF orientation is handled for listed dimensions, viewed images and crops: exif (rotate as the camera recorded) or ignore (use images as stored)" enum:"exif,ignore" default:"exif"`
+	PreserveFormat  bool    `help:"Encode crops in the format of their source (PNG stays PNG) unless the operation sets one"`
+	MinCropSize     float64 `help:"Smallest crop width and height, relative to the image (e.g. 0.02 for 2%), below which a crop is treated as an accidental selection (0 disables the check)" default:"0"`
+	TinyCrops       string  `help:"What to do with crops below --min-crop-size: reject (fail with an error) or ignore (skip with a warning)" enum:"reject,ignore" default:"reject"`
+	OnConflict      string  `help:"What to do with operations of a batch that would write the same output as an earlier one: overwrite (with a warning), dedupe (skip them), error (fail the batch) or rename (number their output)" enum:"overwrite,dedupe,error,rename" default:"overwrite"`
+	Progress        bool    `help:"Show a progress bar with the operation count, throughput and ETA while executing, instead of a log line per operation, when the output is a terminal" default:"true"`
+	DPI             int     `help:"Record this density in dots per inch in the JFIF header of JPEG outputs, e.g. 300 for print (default: unset, read as 72 by most software)" default:"0"`
+	ColorSpace      string  `help:"Color space of outputs: keep (pixels as stored in the source) or srgb (converted from the ICC profile embedded in the source, e.g. Display P3, so they look right on standard displays)" enum:"keep,srgb" default:"keep"`
+	DedupeSimilar   bool    `help:"Skip the operations of sources that look like another source of the batch, by perceptual hash, keeping one of each group of near duplicates, e.g. missed shots of a burst"`
+	SimilarDistance int     `help:"Number of bits out of 64 by which the perceptual hashes of sources may differ for --dedupe-similar to count them as near duplicates; higher catches more, and more false positives" default:"10"`
+	DedupeKeep      string  `help:"Which source of a group of near duplicates --dedupe-similar keeps: first (in the batch) or largest (most pixels)" enum:"first,largest" default:"first"`
+	LenientDecode   bool    `help:"Retry JPEGs that fail to decode or list after repairing their header (stray bytes, unknown markers, missing end marker), logging every file that needed it"`
+
+	OutputPrefix      string        `help:"Relative path inside the output directory to write outputs under, e.g. selects/2023"`
+	FavoritesDir      string        `help:"Directory inside the output directory that favorite picks are written to" default:"favorites"`
+	CropKeepsOriginal bool          `help:"Also copy the source of every crop and autocrop to the output, as if it was picked, so both the full frame and the crop are delivered"`
+	RenamePattern     string        `help:"Name picked files after their position in the batch, e.g. wedding-{n:3} for wedding-001.jpg; {n} is the counter and :3 pads it to 3 digits"`
+	RenameStart       int           `help:"Number of the first pick named by --rename-pattern" default:"1"`
+	Flatten           bool          `help:"Write picked files directly into the output directory instead of mirroring their subdirectories"`
+	NormalizeNames    bool          `help:"Lowercase output file and directory names and replace spaces and other special characters with dashes, e.g. my-photo-1.jpg for My Photo (1).JPG"`
+	PadColor          string        `help:"Background color used to pad resized images that don't specify one" default:"#ffffff"`
+	Provenance        bool          `help:"Write a <output>.json sidecar next to each crop with the source dimensions and crop rectangle"`
+	Incremental       bool          `help:"Skip operations whose output already exists and is newer than the source"`
+	Index             bool          `help:"Write an index.json to the output directory listing every output with its dimensions and source"`
+	HTMLIndex         bool          `help:"Write an index.html gallery of the images in the output directory, with thumbnails, so it can be shared as is"`
+	OutputZipByType   bool          `help:"Write outputs into one zip archive per operation type (crops.zip, picks.zip, ...) in the output directory"`
+	MaxOutputSize     int64         `help:"Stop once the outputs of a run would exceed this many bytes in total; the output that doesn't fit isn't written and the remaining operations are skipped (default: no limit)" default:"0"`
+	FileMode          string        `help:"Permissions of output files as octal, e.g. 0664 for group-writable files on a shared server; applied regardless of the umask (default: 0644 reduced by the umask)"`
+	DirMode           string        `help:"Permissions of the directories created for outputs as octal, e.g. 0775; applied regardless of the umask (default: 0755 reduced by the umask)"`
+	TempDir           string        `help:"Directory outputs are staged in before being moved into place (default: next to each output)" type:"existingdir"`
+	ResumableCopy     bool          `help:"Keep partial copies of picked files when a copy fails and continue them on the next run, verified by a checksum of the source; useful for large files on unreliable network shares"`
+	MaxPickDimension  int           `help:"Downscale picked images whose width or height exceeds this many pixels to fit, instead of copying them; smaller ones are still copied as is (default: no limit)" default:"0"`
+	IncludeSidecars   bool          `help:"Also copy the .xmp and .json sidecars of picked images, named like IMG_0001.xmp or IMG_0001.jpg.xmp, next to them"`
+	Companions        []string      `help:"Also copy the files with these extensions and the same name as picked images next to them, e.g. mov,cr2 for the videos of live photos and the RAWs of RAW+JPEG pairs" name:"companion-extensions"`
+	SlowOpThreshold   time.Duration `help:"Log a warning with the filename, type and duration of every operation that takes longer than this, e.g. 5s, to find pathologically slow files (default: disabled)"`
+	History           bool          `help:"Record every crop in a history log in the output directory, so earlier crops of a file can be looked up and reapplied"`
+	FaceCascade       string        `help:"Pigo face cascade file (such as cascade/facefinder from the pigo repository) that enables face focused autocrop operations" type:"existingfile"`
+
+	AllowRemote    bool          `help:"Allow operation filenames to be http(s) URLs that are downloaded before processing"`
+	RemoteHosts    []string      `help:"Only download remote sources from these hosts (default: any host)"`
+	RemoteTimeout  time.Duration `help:"Timeout for downloading a remote source" default:"30s"`
+	RemoteMaxSize  int64         `help:"Maximum size in bytes of a remote source" default:"52428800"`
+	RemoteUser     string        `help:"Username for basic auth when downloading remote sources" env:"PICKEMALL_REMOTE_USER"`
+	RemotePassword string        `help:"Password for basic auth when downloading remote sources; prefer the environment variable, which keeps it out of the process list" env:"PICKEMALL_REMOTE_PASSWORD"`
+
+	OutputS3       string `help:"Upload outputs to this S3 bucket, under the prefix it names if any, instead of writing them to the output directory, e.g. s3://deliveries/wedding" placeholder:"s3://BUCKET/PREFIX" name:"output-s3"`
+	S3Endpoint     string `help:"URL of an S3 compatible store to upload to, such as http://localhost:9000 for MinIO (default: AWS)" env:"PICKEMALL_S3_ENDPOINT" name:"s3-endpoint"`
+	S3Region       string `help:"Region of the S3 bucket" default:"us-east-1" env:"AWS_REGION" name:"s3-region"`
+	S3AccessKey    string `help:"Access key ID for uploading to S3" env:"AWS_ACCESS_KEY_ID" name:"s3-access-key"`
+	S3SecretKey    string `help:"Secret access key for uploading to S3; prefer the environment variable, which keeps it out of the process list" env:"AWS_SECRET_ACCESS_KEY" name:"s3-secret-key"`
+	S3SessionToken string `help:"Session token for uploading to S3 with temporary credentials" env:"AWS_SESSION_TOKEN" name:"s3-session-token"`
+
+	HashAlgo      string `help:"Hash used for the crop suffix in output filenames: md5, sha256 or crc32" enum:"md5,sha256,crc32" default:"md5"`
+	HashEncoding  string `help:"Encoding of the crop suffix: hex or base32 (shorter, lowercase)" enum:"hex,base32" default:"hex"`
+	HashLength    int    `help:"Truncate the crop suffix to this many characters (0 keeps the full hash)" default:"0"`
+	HashScope     string `help:"What the crop suffix identifies besides the crop rectangle: crop (nothing else), path (the source's relative path) or content (the source's content)" enum:"crop,path,content" default:"crop"`
+	HashPrecision int    `help:"Number of decimals of crop coordinates hashed into the crop suffix; more tell apart crops that differ by less than a hundredth of the image, but rename every crop" default:"2"`
+}
+
+func (f execFlags) newExecutor(rootDir string) (*OperationExecutor, error) {
+	preset := outputPresets[f.Preset]
+	if f.Quality != 0 {
+		if f.Quality < 1 || f.Quality > 100 {
+			return nil, fmt.Errorf("quality must be between 1 and 100, got %d", f.Quality)
+		}
+		preset.Quality = f.Quality
+	}
+	if f.CropFormat != "" {
+		format, err := ParseOutputFormat(f.CropFormat)
+		if err != nil {
+			return nil, err
+		}
+		preset.Format = format
+	}
+	// Presets fall back to the 4:2:0 that the standard library encoder
+	// writes, and only an explicit --chroma-subsampling it can't honor is
+	// warned about.
+	if !jpegSubsampling {
+		preset.Subsampling = Subsampling420
+	}
+	if f.Subsampling != "" {
+		subsampling, err := ParseChromaSubsampling(f.Subsampling)
+		if err != nil {
+			return nil, err
+		}
+		if subsampling != Subsampling420 && !jpegSubsampling {
+			log.Warn().Str("subsampling", string(subsampling)).Msg("chroma subsampling other than 420 needs a build with -tags turbojpeg, encoding JPEGs as 420")
+		}
+		preset.Subsampling = subsampling
+	}
+	if f.ResampleFilter != "" {
+		filter, err := parseResampleFilter(f.ResampleFilter)
+		if err != nil {
+			return nil, err
+		}
+		preset.Filter = filter
+	}
+
+	if f.OutputPrefix != "" && !filepath.IsLocal(f.OutputPrefix) {
+		return nil, fmt.Errorf("output prefix %q must be a relative path inside the output directory", f.OutputPrefix)
+	}
+	if !filepath.IsLocal(f.FavoritesDir) {
+		return nil, fmt.Errorf("favorites directory %q must be a relative path inside the output directory", f.FavoritesDir)
+	}
+
+	padColor, err := parseColor(f.PadColor)
+	if err != nil {
+		return nil, err
+	}
+
+	// A zero CropIDConfig.Precision means the default, so an explicit
+	// --hash-precision=0 would silently hash 2 decimals.
+	if f.HashPrecision < 1 || f.HashPrecision > maxCropIDPrecision {
+		return nil, fmt.Errorf("hash precision must be between 1 and %d, got %d", maxCropIDPrecision, f.HashPrecision)
+	}
+	cropIDs := CropIDConfig{
+		Algorithm: f.HashAlgo,
+		Encoding:  f.HashEncoding,
+		Length:    f.HashLength,
+		Scope:     f.HashScope,
+		Precision: f.HashPrecision,
+	}
+	if err := cropIDs.Validate(); err != nil {
+		return nil, err
+	}
+
+	cropper := NewImagingCropper()
+	cropper.Quality = preset.Quality
+	cropper.Format = preset.Format
+	cropper.Subsampling = preset.Subsampling
+	cropper.Filter = preset.Filter
+	if f.MaxFileSize < 0 {
+		return nil, fmt.Errorf("max file size must not be negative, got %d", f.MaxFileSize)
+	}
+	cropper.MaxFileSize = f.MaxFileSize
+	cropper.Decodes = newDecodeSemaphore(f.MaxDecodes)
+	cropper.Strict = f.StrictCrops
+	if f.CropFill != "" {
+		if f.StrictCrops {
+			return nil, fmt.Errorf("--crop-fill can't be combined with --strict-crops, which fails the crops it would fill")
+		}
+		if cropper.Fill, err = parseColor(f.CropFill); err != nil {
+			return nil, err
+		}
+	}
+	cropper.Lenient = f.LenientDecode
+	cropper.ConvertToSRGB = f.ColorSpace == ColorSpaceSRGB
+	if f.DPI < 0 || f.DPI > 0xFFFF {
+		return nil, fmt.Errorf("dpi must be between 1 and 65535, got %d", f.DPI)
+	}
+	cropper.DPI = f.DPI
+	if f.SimilarDistance < 0 || f.SimilarDistance > 64 {
+		return nil, fmt.Errorf("similar distance must be between 0 and 64, got %d", f.SimilarDistance)
+	}
+	if f.RoundDimensions < 0 {
+		return nil, fmt.Errorf("round dimensions must not be negative, got %d", f.RoundDimensions)
+	}
+	cropper.RoundTo = f.RoundDimensions
+	if f.SnapGrid < 0 {
+		return nil, fmt.Errorf("snap grid must not be negative, got %d", f.SnapGrid)
+	}
+	if f.SnapGrid > 1 && f.RoundDimensions > 1 && f.SnapGrid%f.RoundDimensions != 0 {
+		return nil, fmt.Errorf("snap grid of %d pixels must be a multiple of --round-dimensions %d, or rounding would move crops off the grid", f.SnapGrid, f.RoundDimensions)
+	}
+	cropper.SnapGrid = f.SnapGrid
+	orientation, err := ParseOrientationPolicy(f.Orientation)
+	if err != nil {
+		return nil, err
+	}
+	cropper.Orientation = orientation
+	if f.FaceCascade != "" {
+		faces, err := LoadFaceDetector(f.FaceCascade)
+		if err != nil {
+			return nil, err
+		}
+		cropper.Faces = faces
+	}
+
+	var remote *RemoteFetcher
+	if f.AllowRemote {
+		// Credentials go with every download, so they must not be handed to
+		// whatever host an operation names.
+		if f.RemoteUser != "" && len(f.RemoteHosts) == 0 {
+			return nil, fmt.Errorf("--remote-user needs --remote-hosts to limit which hosts receive the credentials")
+		}
+		remote = &RemoteFetcher{
+			AllowedHosts: f.RemoteHosts,
+			Timeout:      f.RemoteTimeout,
+			MaxSize:      f.RemoteMaxSize,
+			Username:     f.RemoteUser,
+			Password:     f.RemotePassword,
+		}
+	}
+
+	if f.OutputZipByType && (f.Index || f.HTMLIndex || f.Incremental) {
+		return nil, fmt.Errorf("--output-zip-by-type can't be combined with --index, --html-index or --incremental, which need outputs as files")
+	}
+	if f.OutputZipByType && f.MaxOutputSize > 0 {
+		return nil, fmt.Errorf("--output-zip-by-type can't be combined with --max-output-size, since compressed entry sizes are only known once they're in the archive")
+	}
+
+	var output OutputBackend
+	if f.OutputS3 != "" {
+		if f.OutputZipByType || f.Index || f.HTMLIndex || f.Incremental || f.History || f.MaxOutputSize > 0 || f.ResumableCopy {
+			return nil, fmt.Errorf("--output-s3 can't be combined with --output-zip-by-type, --index, --html-index, --incremental, --history, --max-output-size or --resumable-copy, which need outputs as files")
+		}
+		bucket, prefix, err := ParseS3URL(f.OutputS3)
+		if err != nil {
+			return nil, err
+		}
+		if f.S3AccessKey == "" || f.S3SecretKey == "" {
+			return nil, fmt.Errorf("--output-s3 needs credentials, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		output = &S3Output{
+			Bucket:          bucket,
+			Prefix:          prefix,
+			Region:          f.S3Region,
+			Endpoint:        f.S3Endpoint,
+			AccessKeyID:     f.S3AccessKey,
+			SecretAccessKey: f.S3SecretKey,
+			SessionToken:    f.S3SessionToken,
+		}
+	}
+
+	var rename *RenamePattern
+	if f.RenamePattern != "" {
+		if rename, err = ParseRenamePattern(f.RenamePattern, f.RenameStart); err != nil {
+			return nil, err
+		}
+	}
+
+	if f.MaxPickDimension < 0 {
+		return nil, fmt.Errorf("max pick dimension must not be negative, got %d", f.MaxPickDimension)
+	}
+	if f.MinCropSize < 0 || f.MinCropSize >= 1 {
+		return nil, fmt.Errorf("min crop size must be between 0 and 1, got %v", f.MinCropSize)
+	}
+
+	var modes outputModes
+	if modes.file, err = parseMode(f.FileMode); err != nil {
+		return nil, fmt.Errorf("--file-mode: %w", err)
+	}
+	if modes.dir, err = parseMode(f.DirMode); err != nil {
+		return nil, fmt.Errorf("--dir-mode: %w", err)
+	}
+	companions, err := parseCompanionExtensions(f.Companions)
+	if err != nil {
+		return nil, err
+	}
+
+	outputDir := filepath.Join(rootDir, "output")
+	var archive *sourceArchive
+	if isArchiveRoot(rootDir) {
+		if archive, err = openSourceArchive(rootDir); err != nil {
+			return nil, err
+		}
+		outputDir = archiveOutputDir(rootDir)
+	}
+	var history *CropHistory
+	if f.History {
+		history = &CropHistory{Path: filepath.Join(outputDir, cropHistoryFile), Root: outputDir, modes: modes}
+	}
+
+	return &OperationExecutor{
+		BaseDir:           rootDir,
+		OutputDir:         outputDir,
+		OutputPrefix:      f.OutputPrefix,
+		FavoritesDir:      f.FavoritesDir,
+		Flatten:           f.Flatten,
+		NormalizeNames:    f.NormalizeNames,
+		Concurrency:       f.Concurrency,
+		Sequential:        f.Sequential,
+		FailFast:          f.FailFast,
+		Cropper:           cropper,
+		CropIDs:           cropIDs,
+		Provenance:        f.Provenance,
+		Remote:            remote,
+		Archive:           archive,
+		PadColor:          padColor,
+		Incremental:       f.Incremental,
+		Index:             f.Index,
+		IncludeSidecars:   f.IncludeSidecars,
+		Companions:        companions,
+		OnConflict:        ConflictPolicy(f.OnConflict),
+		Progress:          f.Progress && terminal.interactive,
+		HTMLIndex:         f.HTMLIndex,
+		PreserveFormat:    f.PreserveFormat,
+		History:           history,
+		Orientation:       orientation,
+		ZipByType:         f.OutputZipByType,
+		Output:            output,
+		TempDir:           f.TempDir,
+		FileMode:          modes.file,
+		DirMode:           modes.dir,
+		MinCropSize:       f.MinCropSize,
+		MaxOutputSize:     f.MaxOutputSize,
+		CropKeepsOriginal: f.CropKeepsOriginal,
+		ResumableCopy:     f.ResumableCopy,
+		Rename:            rename,
+		IgnoreTinyCrops:   f.TinyCrops == "ignore",
+		SlowOpThreshold:   f.SlowOpThreshold,
+		MaxPickDimension:  f.MaxPickDimension,
+		DedupeSimilar:     f.DedupeSimilar,
+		SimilarDistance:   f.SimilarDistance,
+		DedupeKeepLargest: f.DedupeKeep == "largest",
+	}, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// OutputFormat is an image format the cropper can encode to.
+type OutputFormat string
+
+const (
+	FormatJPEG OutputFormat = "jpeg"
+	FormatPNG  OutputFormat = "png"
+)
+
+// supportedOutputFormats lists every format the cropper can encode to.
+var supportedOutputFormats = []OutputFormat{FormatJPEG, FormatPNG}
+
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	switch strings.ToLower(s) {
+	case "jpeg", "jpg":
+		return FormatJPEG, nil
+	case "png":
+		return FormatPNG, nil
+	default:
+		return "", fmt.Errorf("unsupported output format %q", s)
+	}
+}
+
+// extensionFormat returns the output format of a file named name, as told
+// by its extension. Every listed image extension, .jpe and .jfif included,
+// is a JPEG.
+func extensionFormat(name string) (OutputFormat, error) {
+	if isImageFile(name) {
+		return FormatJPEG, nil
+	}
+	return ParseOutputFormat(strings.TrimPrefix(filepath.Ext(name), "."))
+}
+
+// Validate checks that f is empty or a supported format.
+func (f OutputFormat) Validate() error {
+	switch f {
+	case "", FormatJPEG, FormatPNG:
+		return nil
+	default:
+		return fmt.Errorf("unsupported output format %q, expected jpeg or png", string(f))
+	}
+}
+
+// Extension returns the file extension, including the dot, used for files in this format.
+func (f OutputFormat) Extension() string {
+	switch f {
+	case FormatPNG:
+		return ".png"
+	default:
+		return ".jpg"
+	}
+}
+
+func (f OutputFormat) imagingFormat() imaging.Format {
+	switch f {
+	case FormatPNG:
+		return imaging.PNG
+	default:
+		return imaging.JPEG
+	}
+}
+
+// ChromaSubsampling is the resolution color is stored at in JPEG outputs,
+// relative to brightness.
+type ChromaSubsampling string
+
+const (
+	// Subsampling420 halves the color resolution both ways, the default
+	// of most encoders.
+	Subsampling420 ChromaSubsampling = "420"
+	// Subsampling422 halves the color resolution horizontally.
+	Subsampling422 ChromaSubsampling = "422"
+	// Subsampling444 keeps color at full resolution, for sharp colored
+	// edges in print and text.
+	Subsampling444 ChromaSubsampling = "444"
+)
+
+func ParseChromaSubsampling(s string) (ChromaSubsampling, error) {
+	switch strings.NewReplacer(":", "", " ", "").Replace(s) {
+	case "420":
+		return Subsampling420, nil
+	case "422":
+		return Subsampling422, nil
+	case "444":
+		return Subsampling444, nil
+	default:
+		return "", fmt.Errorf("unsupported chroma subsampling %q, expected 420, 422 or 444", s)
+	}
+}
+
+// lumaSamplingFactors returns the horizontal and vertical sampling factors
+// of the brightness component relative to the color components.
+func (s ChromaSubsampling) lumaSamplingFactors() (int, int) {
+	switch s {
+	case Subsampling444:
+		return 1, 1
+	case Subsampling422:
+		return 2, 1
+	default:
+		return 2, 2
+	}
+}
+
+// resampleFilters are the filters outputs can be scaled with, by name.
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"lanczos":    imaging.Lanczos,
+	"catmullrom": imaging.CatmullRom,
+	"linear":     imaging.Linear,
+	"box":        imaging.Box,
+	"nearest":    imaging.NearestNeighbor,
+}
+
+func parseResampleFilter(s string) (imaging.ResampleFilter, error) {
+	filter, ok := resampleFilters[strings.ToLower(s)]
+	if !ok {
+		return imaging.ResampleFilter{}, fmt.Errorf("unsupported resample filter %q, expected lanczos, catmullrom, linear, box or nearest", s)
+	}
+	return filter, nil
+}
+
+// parseColor parses a hex color in #rgb, #rrggbb or #rrggbbaa form. The
+// leading # is optional.
+func parseColor(s string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// splitGlobRoot splits a root argument such as /photos/2023/**/IMG_*.jpg
+// into the directory before the first wildcard and the slash-separated
+// pattern after it. Plain directories are returned with an empty pattern.
+func splitGlobRoot(root string) (dir, pattern string) {
+	if !strings.ContainsAny(root, "*?[") {
+		return root, ""
+	}
+
+	segments := strings.Split(filepath.ToSlash(root), "/")
+	for i, segment := range segments {
+		if strings.ContainsAny(segment, "*?[") {
+			dir = strings.Join(segments[:i], "/")
+			if dir == "" && i > 0 {
+				dir = "/"
+			} else if dir == "" {
+				dir = "."
+			}
+			return filepath.FromSlash(dir), strings.Join(segments[i:], "/")
+		}
+	}
+	return root, ""
+}
+
+// matchGlob reports whether the slash-separated name matches pattern. On
+// top of path.Match syntax, a "**" segment matches any number of
+// directories, including none.
+func matchGlob(pattern, name string) bool {
+	return matchGlobSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlobSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// globMaxDepth returns how many directories deep a file matching pattern
+// can be, or -1 when the pattern contains "**" and any depth can match.
+func globMaxDepth(pattern string) int {
+	segments := strings.Split(pattern, "/")
+	for _, segment := range segments {
+		if segment == "**" {
+			return -1
+		}
+	}
+	return len(segments) - 1
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/sourcegraph/conc/pool"
+)
+
+func newHash(algo string) (func() hash.Hash, error) {
+	switch algo {
+	case "md5":
+		return md5.New, nil
+	case "sha256":
+		return sha256.New, nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %q", algo)
+	}
+}
+
+// hashFiles computes the content hash of each file, up to concurrency at
+// once, and stores it in FileInfo.Hash. Directories are skipped.
+func hashFiles(ctx context.Context, rootPath string, files []FileInfo, algo string, concurrency int) error {
+	newHasher, err := newHash(algo)
+	if err != nil {
+		return err
+	}
+
+	p := pool.New().WithErrors().WithContext(ctx).WithMaxGoroutines(concurrency)
+	for i := range files {
+		if files[i].IsDir {
+			continue
+		}
+		p.Go(func(ctx context.Context) error {
+			sum, err := hashFile(filepath.Join(rootPath, files[i].Name), newHasher())
+			if err != nil {
+				return err
+			}
+			files[i].Hash = algo + ":" + sum
+			return nil
+		})
+	}
+	return p.Wait()
+}
+
+func hashFile(path string, h hash.Hash) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash file %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
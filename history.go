@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// cropHistoryFile is the name of the crop history log in the output directory.
+const cropHistoryFile = ".crop-history.jsonl"
+
+// CropHistoryEntry is a crop that was applied to a source file.
+type CropHistoryEntry struct {
+	Filename  string    `json:"filename"`
+	Operation Operation `json:"operation"`
+	// Output is the slash-separated path of the output relative to the
+	// output root, which includes the session directory of timestamped
+	// outputs.
+	Output  string    `json:"output"`
+	SavedAt time.Time `json:"saved_at"`
+}
+
+// CropHistory appends executed crops to a JSONL log, so earlier framings of
+// a file can be looked up and reapplied.
+type CropHistory struct {
+	Path string
+	// Root is the directory outputs are recorded relative to: the output
+	// directory, above the session directories of timestamped outputs.
+	Root string
+
+	// modes are the permissions of the log when it's created, like those
+	// of the outputs next to it.
+	modes outputModes
+	mu    sync.Mutex
+}
+
+// Record appends entry to the log.
+func (h *CropHistory) Record(entry CropHistoryEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode crop history entry: %w", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := h.modes.openFile(h.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		return fmt.Errorf("failed to open crop history %s: %w", h.Path, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write crop history %s: %w", h.Path, err)
+	}
+	return nil
+}
+
+// readCropHistory returns the entries of the log at path for filename,
+// oldest first. A missing log has no entries.
+func readCropHistory(path, filename string) ([]CropHistoryEntry, error) {
+	entries := []CropHistoryEntry{}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open crop history %s: %w", path, err)
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		var entry CropHistoryEntry
+		// Skip lines that can't be parsed, e.g. one cut short by a crash.
+		if json.Unmarshal(line, &entry) == nil && entry.Filename == filename {
+			entries = append(entries, entry)
+		}
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read crop history %s: %w", path, err)
+		}
+	}
+}
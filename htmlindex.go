@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/rs/zerolog/log"
+)
+
+// htmlIndexFile is the name of the gallery page written to the output
+// directory when OperationExecutor.HTMLIndex is set.
+const htmlIndexFile = "index.html"
+
+// htmlIndexThumbnails is the directory inside the output directory the
+// gallery's thumbnails are written to.
+const htmlIndexThumbnails = "thumbnails"
+
+// htmlIndexThumbnailSize is the longest side of gallery thumbnails.
+const htmlIndexThumbnailSize = 400
+
+var htmlIndexTemplate = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2rem; color: #222; }
+h1 { font-size: 1.5rem; }
+ul { list-style: none; padding: 0; display: grid; grid-template-columns: repeat(auto-fill, minmax(200px, 1fr)); gap: 1rem; }
+li a { display: block; color: inherit; text-decoration: none; }
+img { width: 100%; height: 200px; object-fit: contain; background: #eee; }
+span { display: block; font-size: .8rem; color: #555; overflow-wrap: anywhere; }
+</style>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+<ul>
+{{- range .Images}}
+<li><a href="{{.URL}}"><img src="{{.ThumbnailURL}}" alt="{{.Name}}" loading="lazy"><span>{{.Name}}</span></a></li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+type htmlIndexImage struct {
+	Name         string
+	URL          string
+	ThumbnailURL string
+}
+
+// writeHTMLIndex writes index.html to outputDir, a static gallery of the
+// images in it that links to every image through a thumbnail, so the
+// directory can be shared as is. Thumbnails are written to a thumbnails
+// directory next to the page, and are only generated again when their
+// image changed.
+func writeHTMLIndex(ctx context.Context, outputDir string, opts WalkOptions, modes outputModes) error {
+	thumbDir := filepath.Join(outputDir, htmlIndexThumbnails)
+	opts.ExcludeDir = thumbDir
+	// Browsers show the images in the orientation their EXIF data asks
+	// for, and thumbnails are written without it.
+	opts.Orientation = OrientationEXIF
+	dir, err := walkImages(outputDir, opts)
+	if err != nil {
+		return fmt.Errorf("failed to list outputs for the gallery: %w", err)
+	}
+
+	images := make([]htmlIndexImage, 0, len(dir.Files))
+	for _, file := range dir.Files {
+		thumbName := file.Name + ".jpg"
+		if err := writeHTMLIndexThumbnail(ctx, filepath.Join(outputDir, file.Name), filepath.Join(thumbDir, thumbName), modes); err != nil {
+			return err
+		}
+		images = append(images, htmlIndexImage{
+			Name:         filepath.ToSlash(file.Name),
+			URL:          relativeURL(file.Name),
+			ThumbnailURL: relativeURL(filepath.Join(htmlIndexThumbnails, thumbName)),
+		})
+	}
+
+	var b bytes.Buffer
+	if err := htmlIndexTemplate.Execute(&b, struct {
+		Name   string
+		Images []htmlIndexImage
+	}{filepath.Base(outputDir), images}); err != nil {
+		return fmt.Errorf("failed to render gallery: %w", err)
+	}
+	if err := modes.writeFile(filepath.Join(outputDir, htmlIndexFile), b.Bytes()); err != nil {
+		return fmt.Errorf("failed to write gallery: %w", err)
+	}
+	log.Ctx(ctx).Info().Int("images", len(images)).Str("path", filepath.Join(outputDir, htmlIndexFile)).Msg("wrote gallery")
+	return nil
+}
+
+// writeHTMLIndexThumbnail writes the thumbnail of the image at path to
+// thumbPath, unless it's newer than the image.
+func writeHTMLIndexThumbnail(ctx context.Context, path, thumbPath string, modes outputModes) error {
+	if source, err := os.Stat(path); err == nil {
+		if thumb, err := os.Stat(thumbPath); err == nil && thumb.ModTime().After(source.ModTime()) {
+			return nil
+		}
+	}
+	img, _, err := thumbnail(ctx, path, htmlIndexThumbnailSize, OrientationEXIF, false)
+	if err != nil {
+		return err
+	}
+	if err := modes.mkdirAll(filepath.Dir(thumbPath)); err != nil {
+		return fmt.Errorf("failed to create thumbnail directory: %w", err)
+	}
+	var b bytes.Buffer
+	if err := imaging.Encode(&b, img, imaging.JPEG, imaging.JPEGQuality(85)); err != nil {
+		return fmt.Errorf("failed to encode thumbnail of %s: %w", path, err)
+	}
+	if err := modes.writeFile(thumbPath, b.Bytes()); err != nil {
+		return fmt.Errorf("failed to write thumbnail %s: %w", thumbPath, err)
+	}
+	return nil
+}
+
+// relativeURL returns the URL of the file at name, relative to the gallery
+// page. Every segment is escaped, and it's prefixed with "./" so a colon in
+// the first one isn't taken for a scheme.
+func relativeURL(name string) string {
+	segments := strings.Split(filepath.ToSlash(name), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return "./" + strings.Join(segments, "/")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// touch records that the app is in use, for IdleTimeout.
+func (a *WebApp) touch() {
+	a.lastActive.Store(time.Now().UnixNano())
+}
+
+// idleFor returns how long the app has gone without requests. Requests
+// being served and saves being executed keep it active.
+func (a *WebApp) idleFor() time.Duration {
+	if a.busy.Load() > 0 {
+		return 0
+	}
+	a.runningMu.Lock()
+	saving := len(a.running) > 0
+	a.runningMu.Unlock()
+	if saving {
+		return 0
+	}
+	return time.Since(time.Unix(0, a.lastActive.Load()))
+}
+
+// shutdownWhenIdle shuts the app down once it's been idle for IdleTimeout,
+// checking again whenever the last request was more recent than that. It
+// returns when ctx is done or the app is shut down otherwise.
+func (a *WebApp) shutdownWhenIdle(ctx context.Context) {
+	a.touch()
+	timer := time.NewTimer(a.config.IdleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.shutdownCh:
+			return
+		case <-timer.C:
+		}
+		idle := a.idleFor()
+		if idle >= a.config.IdleTimeout {
+			log.Ctx(ctx).Info().Dur("idle", idle).Msg("No requests for the idle timeout, shutting down")
+			a.Shutdown()
+			return
+		}
+		timer.Reset(a.config.IdleTimeout - idle)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// IndexBucket is the number of images that share a date or folder.
+type IndexBucket struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+type ImageIndex struct {
+	By      string        `json:"by"`
+	Date    string        `json:"date,omitempty"`
+	Total   int           `json:"total"`
+	Buckets []IndexBucket `json:"buckets"`
+}
+
+// indexImages counts the images under rootPath grouped by day, month or
+// folder. Dates come from the modification time, or from the EXIF capture
+// date when dateSource is "exif", which requires reading every header.
+// Folder keys are slash-separated paths usable with /api/ls?dir=.
+func indexImages(rootPath, by, dateSource string, opts WalkOptions) (ImageIndex, error) {
+	var layout string
+	switch by {
+	case "day":
+		layout = "2006-01-02"
+	case "month":
+		layout = "2006-01"
+	case "folder":
+	default:
+		return ImageIndex{}, fmt.Errorf("unsupported index grouping %q, expected day, month or folder", by)
+	}
+	switch dateSource {
+	case "", "modified", "exif":
+	default:
+		return ImageIndex{}, fmt.Errorf("unsupported date source %q, expected modified or exif", dateSource)
+	}
+
+	files, _, err := findImages(rootPath, opts)
+	if err != nil {
+		return ImageIndex{}, err
+	}
+	if by != "folder" && dateSource == "exif" {
+		readImageInfos(rootPath, files, opts)
+	}
+
+	counts := map[string]int{}
+	for _, file := range files {
+		var key string
+		switch {
+		case by == "folder":
+			key = filepath.ToSlash(filepath.Dir(file.Name))
+			if key == "." {
+				key = ""
+			}
+		case dateSource == "exif" && file.TakenAt != nil:
+			key = file.TakenAt.Format(layout)
+		case dateSource == "exif":
+			key = "unknown"
+		default:
+			key = file.ModifiedAt.Format(layout)
+		}
+		counts[key]++
+	}
+
+	index := ImageIndex{By: by, Total: len(files), Buckets: make([]IndexBucket, 0, len(counts))}
+	if by != "folder" {
+		index.Date = dateSource
+		if index.Date == "" {
+			index.Date = "modified"
+		}
+	}
+	for key, count := range counts {
+		index.Buckets = append(index.Buckets, IndexBucket{Key: key, Count: count})
+	}
+	sort.Slice(index.Buckets, func(i, j int) bool {
+		return index.Buckets[i].Key < index.Buckets[j].Key
+	})
+	return index, nil
+}
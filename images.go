@@ -1,22 +1,49 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"image"
+	"io"
 	"io/fs"
+	"maps"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/disintegration/imaging"
 	"github.com/rs/zerolog/log"
+	"github.com/sourcegraph/conc/pool"
 )
 
 type ImageInfo struct {
-	Width  int `json:"width"`
-	Height int `json:"height"`
+	// Width and Height are the dimensions of the image as displayed, i.e.
+	// after applying the EXIF orientation unless the orientation policy
+	// ignores it.
+	Width       int `json:"width"`
+	Height      int `json:"height"`
+	Orientation int `json:"orientation,omitempty"`
+}
+
+func newImageInfo(info jpegInfo, policy OrientationPolicy) ImageInfo {
+	orientation := info.EXIF.Orientation()
+	img := ImageInfo{
+		Width:       info.Width,
+		Height:      info.Height,
+		Orientation: orientation,
+	}
+	if policy.applies() && orientationSwapsAxes(orientation) {
+		img.Width, img.Height = img.Height, img.Width
+	}
+	return img
 }
 
 type FileInfo struct {
@@ -24,138 +51,861 @@ type FileInfo struct {
 	IsDir      bool      `json:"is_dir"`
 	SizeBytes  int64     `json:"size_bytes"`
 	ModifiedAt time.Time `json:"modified_at"`
-	URL        string    `json:"url"`
-	Image      ImageInfo `json:"image"`
+	// CreatedAt is the file's creation (birth) time, which isn't bumped
+	// when the file's content or metadata is rewritten. It's the
+	// modification time on platforms and file systems that don't record one.
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+	Image     ImageInfo `json:"image"`
+	// AspectClass buckets the displayed dimensions into square, landscape,
+	// portrait or panorama. It's empty when the dimensions can't be read.
+	AspectClass string `json:"aspect_class,omitempty"`
+	// TakenAt is the capture time recorded in the EXIF data, as the camera's
+	// wall clock time. It's nil when the image has no capture date.
+	TakenAt *time.Time `json:"taken_at,omitempty"`
+	// Camera is the camera make and model recorded in the EXIF data.
+	Camera string `json:"camera,omitempty"`
+	// Lens is the lens model recorded in the EXIF data.
+	Lens string `json:"lens,omitempty"`
+	// FocalLength is the focal length in millimeters recorded in the EXIF
+	// data, as opposed to its 35mm equivalent.
+	FocalLength float64 `json:"focal_length,omitempty"`
+	// Valid reports whether the whole image decodes. It's only set when
+	// images are validated while listing.
+	Valid *bool `json:"valid,omitempty"`
+	// Color is the average color of the image as "#rrggbb". It's only set
+	// when colors are computed while listing.
+	Color string `json:"color,omitempty"`
+	// Sharpness is an estimate of how sharp the image is, higher is sharper.
+	// It's only set when sharpness is computed while listing.
+	Sharpness *float64 `json:"sharpness,omitempty"`
+	// Hash is the content hash prefixed with the algorithm, e.g. "sha256:...".
+	// It's only computed when requested.
+	Hash string `json:"hash,omitempty"`
+	// Blank reports whether the image is nearly uniform, like a black or
+	// white frame. It's only set when blank images are detected while
+	// listing.
+	Blank *bool `json:"blank,omitempty"`
+	// Blurhash is a blurhash of the image, a short string that frontends
+	// render as a blurred placeholder while the image loads. It's only set
+	// when blurhashes are computed while listing.
+	Blurhash string `json:"blurhash,omitempty"`
+	// Sidecars are the metadata files next to the image with the same name,
+	// such as IMG_0001.xmp, relative to the root like Name.
+	Sidecars []string `json:"sidecars,omitempty"`
+	// Video reports whether the file is a video rather than an image. Its
+	// Image details, and those computed while listing, are of its poster.
+	Video bool `json:"video,omitempty"`
 }
 
 type Directory struct {
 	Name  string     `json:"name"`
 	Files []FileInfo `json:"files"`
+
+	// Navigation holds the position of a directory within the root when it
+	// was listed with listDirectory.
+	Navigation *Navigation `json:"navigation,omitempty"`
+	// Skipped counts the files that were left out of Files.
+	Skipped *SkippedFiles `json:"skipped,omitempty"`
+}
+
+// SkippedFiles counts the files left out of a listing, by reason. Files in
+// directories that aren't read, such as the output directory or those
+// below the maximum depth, aren't counted.
+type SkippedFiles struct {
+	Total int `json:"total"`
+	// Unsupported files don't have an image extension, or a video one when
+	// videos are listed.
+	Unsupported int `json:"unsupported"`
+	// Generated files look like crop outputs and generated files are skipped.
+	Generated int `json:"generated"`
+	// Filtered files don't match the listing pattern.
+	Filtered int `json:"filtered"`
+	// Recent files were modified more recently than the minimum age.
+	Recent int `json:"recent"`
+	// Missing files are in the file list but don't exist.
+	Missing int `json:"missing"`
+	// Corrupt is the number of images whose header can't be read, or that
+	// fail to decode when images are validated. They're still listed, so
+	// they can be inspected, and aren't part of Total.
+	Corrupt int `json:"corrupt"`
+}
+
+// Reasons files are left out of listings.
+type skipReason int
+
+const (
+	notSkipped skipReason = iota
+	skipUnsupported
+	skipGenerated
+	skipFiltered
+	skipRecent
+	skipMissing
+)
+
+func (s *SkippedFiles) add(reason skipReason) {
+	switch reason {
+	case notSkipped:
+		return
+	case skipUnsupported:
+		s.Unsupported++
+	case skipGenerated:
+		s.Generated++
+	case skipFiltered:
+		s.Filtered++
+	case skipRecent:
+		s.Recent++
+	case skipMissing:
+		s.Missing++
+	}
+	s.Total++
+}
+
+// countCorrupt counts the listed files whose image couldn't be read.
+func (s *SkippedFiles) countCorrupt(files []FileInfo) {
+	for _, file := range files {
+		if !file.IsDir && (file.Image.Width == 0 || file.Valid != nil && !*file.Valid) {
+			s.Corrupt++
+		}
+	}
+}
+
+type Navigation struct {
+	// Path is the directory's path relative to the root, empty for the root itself.
+	Path string `json:"path"`
+	// Parent is the path of the parent directory, nil for the root.
+	Parent      *string      `json:"parent"`
+	Breadcrumbs []Breadcrumb `json:"breadcrumbs"`
+}
+
+type Breadcrumb struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// WalkOptions controls how image directories are listed.
+type WalkOptions struct {
+	// Concurrency is the number of files whose headers are read in
+	// parallel. Zero uses the number of CPUs.
+	Concurrency int
+	// SkipGenerated leaves out files that look like crop outputs, i.e. whose
+	// name ends in a hex crop hash, so outputs inside the root aren't listed
+	// and processed again.
+	SkipGenerated bool
+	// Orientation decides whether listed dimensions follow the EXIF orientation.
+	Orientation OrientationPolicy
+	// MinAge leaves out files modified more recently than this, such as
+	// uploads that are still being written.
+	MinAge time.Duration
+	// Pattern restricts listing to files whose slash-separated path relative
+	// to the root matches this glob, where "**" matches any number of
+	// directories. When empty, every image is listed.
+	Pattern string
+	// Files, when set, is the listing: only the files in it are listed, and
+	// the root isn't walked to find them. The other options still apply.
+	Files *FileList
+	// ValidateImages fully decodes every listed image to catch files that
+	// are corrupt or truncated past their header, and sets FileInfo.Valid.
+	ValidateImages bool
+	// Colors decodes a downscaled copy of every listed image to set
+	// FileInfo.Color.
+	Colors bool
+	// Sharpness decodes a downscaled copy of every listed image to set
+	// FileInfo.Sharpness.
+	Sharpness bool
+	// Blurhash decodes a downscaled copy of every listed image to set
+	// FileInfo.Blurhash.
+	Blurhash bool
+	// DetectBlank decodes a downscaled copy of every listed image to set
+	// FileInfo.Blank.
+	DetectBlank bool
+	// LenientDecode retries images whose header or data the decoder rejects
+	// after repairing their header, like ImagingCropper.Lenient.
+	LenientDecode bool
+	// Videos, when set, lists videos along with images, described by the
+	// poster of their first frame it extracts. Videos are only listed in
+	// directory roots.
+	Videos *VideoPosters
+	// ExcludeDir is a directory that isn't listed, usually the output
+	// directory when it's inside the root. Directories are compared by
+	// their canonical path, so it's recognized however it's reached.
+	ExcludeDir string
+	// MaxDepth limits listing to this many directory levels: 1 is the root
+	// only, 2 includes its subdirectories, and so on. Deeper directories
+	// aren't read at all. Zero is unlimited.
+	MaxDepth int
+	// SquareTolerance is how far the ratio of the long side to the short
+	// side of an image can be above 1 for its aspect class to be square.
+	SquareTolerance float64
+	// PanoramaRatio is the ratio of the long side to the short side from
+	// which an image's aspect class is panorama. Zero uses 2.
+	PanoramaRatio float64
+}
+
+func (o WalkOptions) concurrency() int {
+	if o.Concurrency > 0 {
+		return o.Concurrency
+	}
+	return runtime.NumCPU()
+}
+
+// withinDepth reports whether the contents of the directory at relDir,
+// relative to the root, are within MaxDepth.
+func (o WalkOptions) withinDepth(relDir string) bool {
+	if o.MaxDepth <= 0 {
+		return true
+	}
+	depth := 1
+	if relDir != "." && relDir != "" {
+		depth += strings.Count(filepath.ToSlash(relDir), "/") + 1
+	}
+	return depth <= o.MaxDepth
+}
+
+// skips returns why the file at relPath, relative to the root, shouldn't
+// be listed, or notSkipped when it should.
+func (o WalkOptions) skips(relPath string) skipReason {
+	switch {
+	case !o.listable(relPath):
+		return skipUnsupported
+	case o.SkipGenerated && isGeneratedName(relPath):
+		return skipGenerated
+	case o.Pattern != "" && !matchGlob(o.Pattern, filepath.ToSlash(relPath)):
+		return skipFiltered
+	}
+	return notSkipped
+}
+
+// listable reports whether name has the extension of an image, or of a
+// video when videos are listed.
+func (o WalkOptions) listable(name string) bool {
+	return isImageFile(name) || o.Videos != nil && isVideoFile(name)
+}
+
+// excludedDir returns the canonical path of ExcludeDir, or an empty string
+// when nothing is excluded.
+func (o WalkOptions) excludedDir() string {
+	if o.ExcludeDir == "" {
+		return ""
+	}
+	return canonicalPath(o.ExcludeDir)
+}
+
+// canonicalPath returns path as an absolute path with symlinks resolved,
+// falling back to the absolute path when it doesn't exist.
+func canonicalPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	return abs
+}
+
+// settled reports whether a file modified at modTime is old enough to be listed.
+func (o WalkOptions) settled(modTime time.Time) bool {
+	return o.MinAge <= 0 || time.Since(modTime) >= o.MinAge
+}
+
+// generatedNamePattern matches the "-<hash>.<ext>" suffix of crop outputs
+// named with an MD5 or SHA-256 hex crop ID.
+var generatedNamePattern = regexp.MustCompile(`-([0-9a-f]{32}|[0-9a-f]{64})\.[A-Za-z]+$`)
+
+// isGeneratedName reports whether name looks like a crop output.
+func isGeneratedName(name string) bool {
+	return generatedNamePattern.MatchString(filepath.Base(name))
+}
+
+// imageExtensions are the extensions of listed images, which are all JPEGs.
+var imageExtensions = []string{".jpg", ".jpeg", ".jpe", ".jfif"}
+
+// typeExtension returns the extension c.Type sets the content type of name
+// by. Images are mapped to .jpg, because .jpe and .jfif aren't in the MIME
+// tables of every system and would be served as binary downloads.
+func typeExtension(name string) string {
+	if isImageFile(name) {
+		return ".jpg"
+	}
+	return filepath.Ext(name)
+}
+
+func isImageFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range imageExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveDir joins a slash-separated directory path from a request onto
+// rootPath, rejecting paths that would escape the root.
+func resolveDir(rootPath, dir string) (string, error) {
+	dir = filepath.FromSlash(strings.Trim(dir, "/"))
+	if dir == "" {
+		return rootPath, nil
+	}
+	if !filepath.IsLocal(dir) {
+		return "", fmt.Errorf("invalid directory %q", dir)
+	}
+	return filepath.Join(rootPath, dir), nil
+}
+
+// listDirectory lists the images and subdirectories directly inside dir,
+// which is relative to rootPath. Unlike walkImages it doesn't descend into
+// subdirectories, but returns them as entries so a UI can navigate into them.
+func listDirectory(rootPath, dir string, opts WalkOptions) (Directory, error) {
+	absDir, err := resolveDir(rootPath, dir)
+	if err != nil {
+		return Directory{}, err
+	}
+	entries, err := os.ReadDir(absDir)
+	if err != nil {
+		return Directory{}, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	relDir, err := filepath.Rel(rootPath, absDir)
+	if err != nil {
+		return Directory{}, fmt.Errorf("failed to get relative path: %w", err)
+	}
+	if relDir == "." {
+		relDir = ""
+	}
+	if !opts.withinDepth(relDir) {
+		return Directory{}, fmt.Errorf("directory %q is deeper than the maximum depth of %d", dir, opts.MaxDepth)
+	}
+
+	excluded := opts.excludedDir()
+	var dirs, files []FileInfo
+	var skipped SkippedFiles
+	sidecars := sidecarIndex{}
+	for _, entry := range entries {
+		if entry.IsDir() && !opts.Files.containsDir(filepath.Join(relDir, entry.Name())) {
+			continue
+		}
+		if !entry.IsDir() {
+			relPath := filepath.Join(relDir, entry.Name())
+			if !opts.Files.Contains(relPath) {
+				// Sidecars of listed images are attached to them even when
+				// they aren't listed themselves.
+				if isSidecarFile(relPath) {
+					sidecars.add(relPath)
+				}
+				continue
+			}
+			if reason := opts.skips(relPath); reason != notSkipped {
+				if reason == skipUnsupported && isSidecarFile(relPath) {
+					sidecars.add(relPath)
+				}
+				skipped.add(reason)
+				continue
+			}
+		}
+		if entry.IsDir() && excluded != "" && canonicalPath(filepath.Join(absDir, entry.Name())) == excluded {
+			continue
+		}
+		if entry.IsDir() && !opts.withinDepth(filepath.Join(relDir, entry.Name())) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return Directory{}, fmt.Errorf("failed to get file info: %w", err)
+		}
+		if !entry.IsDir() && !opts.settled(info.ModTime()) {
+			skipped.add(skipRecent)
+			continue
+		}
+		fi := FileInfo{
+			Name:       filepath.Join(relDir, entry.Name()),
+			IsDir:      entry.IsDir(),
+			SizeBytes:  info.Size(),
+			ModifiedAt: info.ModTime(),
+			CreatedAt:  createdAt(filepath.Join(absDir, entry.Name()), info),
+		}
+		if entry.IsDir() {
+			fi.SizeBytes = 0
+			dirs = append(dirs, fi)
+		} else {
+			files = append(files, fi)
+		}
+	}
+	sidecars.attach(files)
+	readImageInfos(rootPath, files, opts)
+	skipped.countCorrupt(files)
+
+	name := filepath.Base(absDir)
+	return Directory{
+		Name:       name,
+		Files:      append(dirs, files...),
+		Navigation: newNavigation(filepath.Base(rootPath), relDir),
+		Skipped:    &skipped,
+	}, nil
 }
 
-func walkImages(rootPath string) (Directory, error) {
-	extensions := []string{".jpg", ".jpeg"}
+func newNavigation(rootName, relDir string) *Navigation {
+	nav := &Navigation{
+		Path:        filepath.ToSlash(relDir),
+		Breadcrumbs: []Breadcrumb{{Name: rootName, Path: ""}},
+	}
+	if relDir == "" {
+		return nav
+	}
+
+	segments := strings.Split(filepath.ToSlash(relDir), "/")
+	for i, segment := range segments {
+		nav.Breadcrumbs = append(nav.Breadcrumbs, Breadcrumb{
+			Name: segment,
+			Path: strings.Join(segments[:i+1], "/"),
+		})
+	}
+	parent := strings.Join(segments[:len(segments)-1], "/")
+	nav.Parent = &parent
+	return nav
+}
+
+func walkImages(rootPath string, opts WalkOptions) (Directory, error) {
+	files, skipped, err := findImages(rootPath, opts)
+	if err != nil {
+		return Directory{}, err
+	}
+
+	readImageInfos(rootPath, files, opts)
+	skipped.countCorrupt(files)
+
+	return Directory{
+		Name:    filepath.Base(rootPath),
+		Files:   files,
+		Skipped: &skipped,
+	}, nil
+}
+
+// findImages walks rootPath recursively and returns the image files in it
+// with their file system metadata only, and counts of the files it left
+// out. Use readImageInfos to fill in the details read from the image
+// headers.
+func findImages(rootPath string, opts WalkOptions) ([]FileInfo, SkippedFiles, error) {
+	if opts.Files != nil {
+		return opts.Files.findImages(rootPath, opts)
+	}
 	var files []FileInfo
+	var skipped SkippedFiles
+	sidecars := sidecarIndex{}
+	maxDepth := -1
+	if opts.Pattern != "" {
+		maxDepth = globMaxDepth(opts.Pattern)
+	}
 
+	excluded := opts.excludedDir()
 	if err := filepath.WalkDir(rootPath, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
+		relPath, err := filepath.Rel(rootPath, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %w", err)
+		}
 		if d.IsDir() {
+			if excluded != "" && canonicalPath(path) == excluded || !opts.withinDepth(relPath) {
+				return filepath.SkipDir
+			}
+			// Don't descend below the deepest directory the pattern can match.
+			if maxDepth >= 0 && relPath != "." && strings.Count(filepath.ToSlash(relPath), "/") >= maxDepth {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
-		for _, ext := range extensions {
-			if strings.ToLower(filepath.Ext(path)) == ext {
-				info, err := d.Info()
-				if err != nil {
-					return fmt.Errorf("failed to get file info: %w", err)
-				}
-
-				relPath, err := filepath.Rel(rootPath, path)
-				if err != nil {
-					return fmt.Errorf("failed to get relative path: %w", err)
-				}
-
-				files = append(files, FileInfo{
-					Name:       relPath,
-					IsDir:      d.IsDir(),
-					SizeBytes:  info.Size(),
-					ModifiedAt: info.ModTime(),
-				})
+		if reason := opts.skips(relPath); reason != notSkipped {
+			if reason == skipUnsupported && isSidecarFile(relPath) {
+				sidecars.add(relPath)
 			}
+			skipped.add(reason)
+			return nil
 		}
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("failed to get file info: %w", err)
+		}
+		if !opts.settled(info.ModTime()) {
+			skipped.add(skipRecent)
+			return nil
+		}
+
+		files = append(files, FileInfo{
+			Name:       relPath,
+			IsDir:      d.IsDir(),
+			SizeBytes:  info.Size(),
+			ModifiedAt: info.ModTime(),
+			CreatedAt:  createdAt(path, info),
+		})
 		return nil
 	}); err != nil {
-		return Directory{}, err
+		return nil, SkippedFiles{}, err
 	}
+	sidecars.attach(files)
+	return files, skipped, nil
+}
 
-	for i := range files {
-		w, h, err := readJPEGDimensions(filepath.Join(rootPath, files[i].Name))
-		if err != nil {
-			log.Ctx(context.Background()).Error().Err(err).Str("filename", files[i].Name).Msg("cannot read image dimensions")
-			continue
+// createdAt returns the creation time of the file at path, falling back to
+// its modification time where the platform doesn't track creation times.
+func createdAt(path string, info fs.FileInfo) time.Time {
+	if t, ok := birthTime(path, info); ok {
+		return t
+	}
+	return info.ModTime()
+}
+
+// fileSorts are the orders /api/ls can sort files by. Directories always
+// come before files.
+var fileSorts = map[string]func(a, b FileInfo) int{
+	"name":     func(a, b FileInfo) int { return strings.Compare(a.Name, b.Name) },
+	"modified": func(a, b FileInfo) int { return a.ModifiedAt.Compare(b.ModifiedAt) },
+	"created":  func(a, b FileInfo) int { return a.CreatedAt.Compare(b.CreatedAt) },
+	"size":     func(a, b FileInfo) int { return cmp.Compare(a.SizeBytes, b.SizeBytes) },
+	"color":    func(a, b FileInfo) int { return compareColors(a.Color, b.Color) },
+	// Sharpest first, since that's the frame to keep from a burst.
+	"sharpness": func(a, b FileInfo) int { return compareSharpness(a.Sharpness, b.Sharpness) },
+}
+
+// sortFiles sorts files in place by one of fileSorts, oldest or smallest
+// first. Entries that compare equal keep their order.
+func sortFiles(files []FileInfo, by string) error {
+	compare, ok := fileSorts[by]
+	if !ok {
+		return fmt.Errorf("unsupported sort %q, expected name, modified, created, size, color or sharpness", by)
+	}
+	slices.SortStableFunc(files, func(a, b FileInfo) int {
+		if a.IsDir != b.IsDir {
+			if a.IsDir {
+				return -1
+			}
+			return 1
+		}
+		return compare(a, b)
+	})
+	return nil
+}
+
+// CameraFacet is the number of listed images taken with a camera.
+type CameraFacet struct {
+	// Camera is empty for images that don't record one.
+	Camera string `json:"camera"`
+	Count  int    `json:"count"`
+}
+
+// cameraFacets counts the images of files per camera, most used first.
+func cameraFacets(files []FileInfo) []CameraFacet {
+	return countFacets(files, func(file FileInfo) string { return file.Camera }, func(camera string, count int) CameraFacet {
+		return CameraFacet{Camera: camera, Count: count}
+	})
+}
+
+// LensFacet is the number of listed images taken with a lens.
+type LensFacet struct {
+	// Lens is empty for images that don't record one.
+	Lens  string `json:"lens"`
+	Count int    `json:"count"`
+}
+
+// lensFacets counts the images of files per lens, most used first.
+func lensFacets(files []FileInfo) []LensFacet {
+	return countFacets(files, func(file FileInfo) string { return file.Lens }, func(lens string, count int) LensFacet {
+		return LensFacet{Lens: lens, Count: count}
+	})
+}
+
+// FocalLengthFacet is the number of listed images taken at a focal length.
+type FocalLengthFacet struct {
+	// FocalLength is 0 for images that don't record one.
+	FocalLength float64 `json:"focal_length"`
+	Count       int     `json:"count"`
+}
+
+// focalLengthFacets counts the images of files per focal length, most used
+// first.
+func focalLengthFacets(files []FileInfo) []FocalLengthFacet {
+	return countFacets(files, func(file FileInfo) float64 { return file.FocalLength }, func(focal float64, count int) FocalLengthFacet {
+		return FocalLengthFacet{FocalLength: focal, Count: count}
+	})
+}
+
+// countFacets counts the images of files per key, and returns a facet for
+// each key, the most common first and ties in key order.
+func countFacets[K cmp.Ordered, F any](files []FileInfo, key func(FileInfo) K, facet func(K, int) F) []F {
+	counts := make(map[K]int)
+	for _, file := range files {
+		if !file.IsDir {
+			counts[key(file)]++
 		}
-		files[i].Image = ImageInfo{
-			Width:  w,
-			Height: h,
+	}
+	keys := slices.Collect(maps.Keys(counts))
+	slices.SortFunc(keys, func(a, b K) int {
+		if c := cmp.Compare(counts[b], counts[a]); c != 0 {
+			return c
 		}
+		return cmp.Compare(a, b)
+	})
+	facets := make([]F, len(keys))
+	for i, k := range keys {
+		facets[i] = facet(k, counts[k])
 	}
+	return facets
+}
 
-	return Directory{
-		Name:  filepath.Base(rootPath),
-		Files: files,
-	}, nil
+type jpegInfo struct {
+	Width  int
+	Height int
+	EXIF   *exifData
 }
 
-func readJPEGDimensions(filePath string) (width, height int, err error) {
+// readImageInfos fills in the image dimensions of files, reading up to
+// opts.Concurrency headers at once. Files whose header can't be read are logged
+// and left without dimensions. With opts.ValidateImages, every image is also
+// decoded in full to set its Valid field.
+func readImageInfos(rootPath string, files []FileInfo, opts WalkOptions) {
+	readImageInfosFrom(func(name string) (io.ReadSeekCloser, error) {
+		if opts.Videos != nil && isVideoFile(name) {
+			// Videos are read as their poster.
+			return opts.Videos.open(context.Background(), filepath.Join(rootPath, name))
+		}
+		f, err := os.Open(filepath.Join(rootPath, name))
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}, files, opts)
+}
+
+// readImageInfosFrom is like readImageInfos, but reads the files with open,
+// by their name relative to the root. Only forward seeks are made, so
+// streams that can only skip ahead are enough.
+func readImageInfosFrom(open func(name string) (io.ReadSeekCloser, error), files []FileInfo, opts WalkOptions) {
+	p := pool.New().WithMaxGoroutines(opts.concurrency())
+	for i := range files {
+		files[i].Video = !files[i].IsDir && opts.Videos != nil && isVideoFile(files[i].Name)
+		p.Go(func() {
+			// The scaled copy for the blurhash is oriented once the header
+			// has been read.
+			var blurhashImg image.Image
+			if opts.ValidateImages || opts.Colors || opts.Sharpness || opts.Blurhash || opts.DetectBlank {
+				// All need the decoded image, so it's decoded once for all.
+				img, err := decodeImageFrom(open, files[i].Name, opts.LenientDecode)
+				if opts.ValidateImages {
+					valid := err == nil
+					files[i].Valid = &valid
+				}
+				if err != nil {
+					log.Ctx(context.Background()).Warn().Err(err).Str("filename", files[i].Name).Msg("image is corrupt")
+				} else {
+					if opts.Colors {
+						files[i].Color = averageColor(img)
+					}
+					if opts.Sharpness {
+						score := sharpness(img)
+						files[i].Sharpness = &score
+					}
+					if opts.Blurhash {
+						blurhashImg = blurhashSource(img)
+					}
+					if opts.DetectBlank {
+						blank := isBlank(img)
+						files[i].Blank = &blank
+					}
+				}
+			}
+
+			info, err := readJPEGInfoFrom(open, files[i].Name)
+			if err != nil && opts.LenientDecode {
+				var lenientErr error
+				if info, lenientErr = readJPEGInfoLenientFrom(open, files[i].Name); lenientErr == nil {
+					log.Ctx(context.Background()).Warn().Err(err).Str("filename", files[i].Name).Msg("read malformed image header leniently")
+					err = nil
+				}
+			}
+			if err != nil {
+				log.Ctx(context.Background()).Error().Err(err).Str("filename", files[i].Name).Msg("cannot read image dimensions")
+				return
+			}
+			files[i].Image = newImageInfo(info, opts.Orientation)
+			files[i].AspectClass = opts.aspectClass(files[i].Image)
+			if blurhashImg != nil {
+				if opts.Orientation.applies() {
+					blurhashImg = applyOrientation(blurhashImg, info.EXIF.Orientation())
+				}
+				files[i].Blurhash = blurhash(blurhashImg)
+			}
+			if takenAt, ok := info.EXIF.TakenAt(); ok {
+				files[i].TakenAt = &takenAt
+			}
+			files[i].Camera = info.EXIF.Camera()
+			files[i].Lens = info.EXIF.Lens()
+			files[i].FocalLength = info.EXIF.FocalLength()
+		})
+	}
+	p.Wait()
+}
+
+// readAllFrom reads the whole file name with open.
+func readAllFrom(open func(name string) (io.ReadSeekCloser, error), name string) ([]byte, error) {
+	f, err := open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return data, nil
+}
+
+// decodeImageFile decodes the whole image at path, which fails for
+// truncated or corrupt image data even when the header is intact. With
+// lenient, images that fail are decoded again after repairing their header.
+func decodeImageFile(path string, lenient bool) (image.Image, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return decodeImageData(data, path, lenient)
+}
+
+// decodeImageFrom is like decodeImageFile, but reads the file name with open.
+func decodeImageFrom(open func(name string) (io.ReadSeekCloser, error), name string, lenient bool) (image.Image, error) {
+	data, err := readAllFrom(open, name)
+	if err != nil {
+		return nil, err
+	}
+	return decodeImageData(data, name, lenient)
+}
+
+// decodeImageData is like decodeImageFile, but decodes data read from path.
+func decodeImageData(data []byte, path string, lenient bool) (image.Image, error) {
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(false))
+	if err != nil && lenient {
+		if img, lenientErr := decodeLenient(data, false); lenientErr == nil {
+			log.Ctx(context.Background()).Warn().Err(err).Str("path", path).Msg("decoded malformed image leniently")
+			return img, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return img, nil
+}
+
+// readJPEGInfo reads the frame dimensions and EXIF metadata from the JPEG
+// header without decoding the image data.
+func readJPEGInfo(filePath string) (jpegInfo, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to open file: %w", err)
+		return jpegInfo{}, fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
+	return decodeJPEGInfo(file)
+}
 
+// readJPEGInfoFrom is like readJPEGInfo, but reads the file name with open.
+func readJPEGInfoFrom(open func(name string) (io.ReadSeekCloser, error), name string) (jpegInfo, error) {
+	f, err := open(name)
+	if err != nil {
+		return jpegInfo{}, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+	return decodeJPEGInfo(f)
+}
+
+// readJPEGInfoLenientFrom is like readJPEGInfoFrom, but reads the header
+// after repairing it with sanitizeJPEG.
+func readJPEGInfoLenientFrom(open func(name string) (io.ReadSeekCloser, error), name string) (jpegInfo, error) {
+	data, err := readAllFrom(open, name)
+	if err != nil {
+		return jpegInfo{}, err
+	}
+	sanitized, err := sanitizeJPEG(data)
+	if err != nil {
+		return jpegInfo{}, err
+	}
+	return decodeJPEGInfo(bytes.NewReader(sanitized))
+}
+
+// decodeJPEGInfo is like readJPEGInfo, but reads from an open file.
+func decodeJPEGInfo(file io.ReadSeeker) (jpegInfo, error) {
+	var info jpegInfo
 	var buf [2]byte
 
 	// Read the first two bytes (JPEG SOI marker)
-	_, err = file.Read(buf[:])
-	if err != nil {
-		return 0, 0, fmt.Errorf("failed to read SOI marker: %w", err)
+	if _, err := io.ReadFull(file, buf[:]); err != nil {
+		return jpegInfo{}, fmt.Errorf("failed to read SOI marker: %w", err)
 	}
 	if buf[0] != 0xFF || buf[1] != 0xD8 {
-		return 0, 0, errors.New("not a valid JPEG file")
+		return jpegInfo{}, errors.New("not a valid JPEG file")
 	}
 
 	for {
 		// Read the next marker
-		_, err = file.Read(buf[:])
-		if err != nil {
-			return 0, 0, err
+		if _, err := io.ReadFull(file, buf[:]); err != nil {
+			return jpegInfo{}, err
 		}
 		if buf[0] != 0xFF {
-			return 0, 0, errors.New("invalid JPEG format")
+			return jpegInfo{}, errors.New("invalid JPEG format")
 		}
 
 		// Skip padding bytes (0xFF)
 		for buf[1] == 0xFF {
-			_, err = file.Read(buf[1:2])
-			if err != nil {
-				return 0, 0, err
+			if _, err := io.ReadFull(file, buf[1:2]); err != nil {
+				return jpegInfo{}, err
 			}
 		}
+		marker := buf[1]
 
-		// Check for SOF0 (Start of Frame) marker which contains the dimensions
-		if buf[1] >= 0xC0 && buf[1] <= 0xC3 {
-			// Read the length of the segment
-			_, err = file.Read(buf[:])
-			if err != nil {
-				return 0, 0, err
-			}
-			length := binary.BigEndian.Uint16(buf[:])
+		// Standalone markers carry no length or payload
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			continue
+		}
+		// Start of scan: the frame header should have been seen by now
+		if marker == 0xDA {
+			return jpegInfo{}, errors.New("no frame header found before image data")
+		}
 
-			// Read the segment data
+		// Read the length of the segment
+		if _, err := io.ReadFull(file, buf[:]); err != nil {
+			return jpegInfo{}, err
+		}
+		length := binary.BigEndian.Uint16(buf[:])
+		if length < 2 {
+			return jpegInfo{}, errors.New("invalid JPEG segment length")
+		}
+
+		switch {
+		case marker >= 0xC0 && marker <= 0xC3:
+			// SOF (Start of Frame) marker contains the dimensions
 			segment := make([]byte, length-2)
-			_, err = file.Read(segment)
-			if err != nil {
-				return 0, 0, err
+			if _, err := io.ReadFull(file, segment); err != nil {
+				return jpegInfo{}, err
 			}
-
-			// Extract height and width
-			height = int(binary.BigEndian.Uint16(segment[1:3]))
-			width = int(binary.BigEndian.Uint16(segment[3:5]))
-			return width, height, nil
-		} else {
-			// Read the length of the segment
-			_, err = file.Read(buf[:])
-			if err != nil {
-				return 0, 0, err
+			if len(segment) < 5 {
+				return jpegInfo{}, errors.New("frame header too short")
 			}
-			length := binary.BigEndian.Uint16(buf[:])
-
+			info.Height = int(binary.BigEndian.Uint16(segment[1:3]))
+			info.Width = int(binary.BigEndian.Uint16(segment[3:5]))
+			return info, nil
+		case marker == 0xE1 && info.EXIF == nil:
+			// APP1 may hold the EXIF block, which always precedes the frame header
+			segment := make([]byte, length-2)
+			if _, err := io.ReadFull(file, segment); err != nil {
+				return jpegInfo{}, err
+			}
+			if exif, err := parseEXIF(segment); err == nil {
+				info.EXIF = exif
+			}
+		default:
 			// Skip the segment
-			_, err = file.Seek(int64(length-2), os.SEEK_CUR)
-			if err != nil {
-				return 0, 0, err
+			if _, err := file.Seek(int64(length-2), io.SeekCurrent); err != nil {
+				return jpegInfo{}, err
 			}
 		}
 	}
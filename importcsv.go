@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Units of the coordinates in a crop CSV.
+const (
+	// CSVRelative coordinates are fractions of the image size, like those
+	// of crop operations.
+	CSVRelative = "relative"
+	// CSVPixel coordinates are in pixels of the oriented image.
+	CSVPixel = "pixel"
+)
+
+type importCSVCmd struct {
+	RootDir string   `arg:"" help:"Root directory the CSV's filenames are relative to"`
+	CSVFile string   `arg:"" help:"CSV file with a header row and one crop per row, or - to read from stdin" default:"-"`
+	Columns []string `help:"Header names of the filename, x, y, width and height columns, in that order" default:"filename,x,y,w,h"`
+	Units   string   `help:"Units of the coordinates: relative to the image size (0.0 to 1.0) or pixel" enum:"relative,pixel" default:"relative"`
+
+	Log  logFlags  `embed:""`
+	Exec execFlags `embed:""`
+}
+
+func (cmd *importCSVCmd) Run() error {
+	closeLog, err := cmd.Log.setup()
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	ctx = log.Logger.WithContext(ctx)
+
+	executor, err := cmd.Exec.newExecutor(cmd.RootDir)
+	if err != nil {
+		return err
+	}
+	defer executor.Close()
+
+	r, err := openInput(cmd.CSVFile)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var dimensions func(filename string) (int, int, error)
+	if cmd.Units == CSVPixel {
+		dimensions = func(filename string) (int, int, error) {
+			if isRemoteSource(filename) {
+				return 0, 0, fmt.Errorf("pixel coordinates of remote source %s aren't supported", filename)
+			}
+			path, err := executor.sourcePath(filename)
+			if err != nil {
+				return 0, 0, err
+			}
+			return imageDimensions(path, executor.Orientation)
+		}
+	}
+
+	var readErr error
+	ops := func(yield func(Operation) bool) {
+		for op, err := range readCSVCrops(r, cmd.Columns, dimensions) {
+			if err != nil {
+				readErr = err
+				return
+			}
+			if !yield(op) {
+				return
+			}
+		}
+	}
+
+	execErr := executor.ExecSeq(ctx, ops)
+	return errors.Join(readErr, execErr)
+}
+
+// readCSVCrops decodes crop operations from a CSV with a header row, one
+// row at a time. columns names the filename, x, y, width and height
+// columns in the header, which are matched case-insensitively. Coordinates
+// are relative to the image size, unless dimensions is set, in which case
+// they're pixels of an image of the size it returns for the filename. Bad
+// rows are yielded as errors prefixed with their line number.
+func readCSVCrops(r io.Reader, columns []string, dimensions func(filename string) (int, int, error)) iter.Seq2[Operation, error] {
+	return func(yield func(Operation, error) bool) {
+		cr := csv.NewReader(r)
+		cr.TrimLeadingSpace = true
+		cr.ReuseRecord = true
+
+		header, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return
+		} else if err != nil {
+			yield(Operation{}, fmt.Errorf("failed to read CSV header: %w", err))
+			return
+		}
+		index, err := csvColumnIndex(header, columns)
+		if err != nil {
+			yield(Operation{}, err)
+			return
+		}
+
+		for {
+			record, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				yield(Operation{}, fmt.Errorf("failed to read CSV: %w", err))
+				return
+			}
+			line, _ := cr.FieldPos(0)
+			op, err := csvCrop(record, index, dimensions)
+			if err != nil {
+				err = fmt.Errorf("line %d: %w", line, err)
+			}
+			if !yield(op, err) {
+				return
+			}
+		}
+	}
+}
+
+// csvColumnIndex returns the positions of columns in header.
+func csvColumnIndex(header, columns []string) ([5]int, error) {
+	var index [5]int
+	if len(columns) != len(index) {
+		return index, fmt.Errorf("expected 5 columns (filename, x, y, width, height), got %d", len(columns))
+	}
+	for i, column := range columns {
+		index[i] = -1
+		for j, name := range header {
+			if strings.EqualFold(strings.TrimSpace(name), column) {
+				index[i] = j
+				break
+			}
+		}
+		if index[i] < 0 {
+			return index, fmt.Errorf("CSV header has no %q column", column)
+		}
+	}
+	return index, nil
+}
+
+// csvCrop builds the crop operation of one CSV row.
+func csvCrop(record []string, index [5]int, dimensions func(filename string) (int, int, error)) (Operation, error) {
+	filename := strings.TrimSpace(record[index[0]])
+	var values [4]float64
+	for i := range values {
+		field := strings.TrimSpace(record[index[i+1]])
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return Operation{}, fmt.Errorf("invalid coordinate %q of %s", field, filename)
+		}
+		values[i] = value
+	}
+
+	crop := Crop{X: values[0], Y: values[1], Width: values[2], Height: values[3]}
+	if dimensions != nil {
+		width, height, err := dimensions(filename)
+		if err != nil {
+			return Operation{}, err
+		}
+		crop.X /= float64(width)
+		crop.Width /= float64(width)
+		crop.Y /= float64(height)
+		crop.Height /= float64(height)
+	}
+	return Operation{Crop: &CropOperation{Filename: filename, Crop: crop}}, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// jfifDensityUnitDPI is the JFIF density unit for dots per inch.
+const jfifDensityUnitDPI = 1
+
+// withJFIFDensity returns the JPEG data with a JFIF APP0 segment that
+// records a density of dpi dots per inch, which print software uses to size
+// the image. Go's encoder writes no APP0 segment, so one is inserted after
+// the start marker; an existing JFIF segment has its density replaced.
+func withJFIFDensity(data []byte, dpi int) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return nil, errors.New("not a JPEG")
+	}
+	if dpi < 1 || dpi > 0xFFFF {
+		return nil, errors.New("density out of range")
+	}
+
+	// Replace the density of an existing segment in place.
+	if len(data) >= 18 && data[2] == 0xFF && data[3] == 0xE0 && bytes.Equal(data[6:11], []byte("JFIF\x00")) {
+		out := bytes.Clone(data)
+		out[13] = jfifDensityUnitDPI
+		binary.BigEndian.PutUint16(out[14:], uint16(dpi))
+		binary.BigEndian.PutUint16(out[16:], uint16(dpi))
+		return out, nil
+	}
+
+	segment := []byte{
+		0xFF, 0xE0, 0x00, 0x10, // APP0 marker and length
+		'J', 'F', 'I', 'F', 0x00, // identifier
+		0x01, 0x02, // version 1.02
+		jfifDensityUnitDPI,
+		0, 0, 0, 0, // X and Y density
+		0x00, 0x00, // no thumbnail
+	}
+	binary.BigEndian.PutUint16(segment[12:], uint16(dpi))
+	binary.BigEndian.PutUint16(segment[14:], uint16(dpi))
+
+	out := make([]byte, 0, len(data)+len(segment))
+	out = append(out, data[:2]...)
+	out = append(out, segment...)
+	return append(out, data[2:]...), nil
+}
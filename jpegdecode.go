@@ -0,0 +1,18 @@
+//go:build !turbojpeg || !cgo
+
+package main
+
+import (
+	"errors"
+	"image"
+)
+
+// jpegScaledDecode reports whether JPEGs can be decoded at a reduced scale.
+// The standard library decoder always decodes at full size.
+const jpegScaledDecode = false
+
+// decodeJPEGScaled needs libjpeg-turbo. Build with -tags turbojpeg to use
+// it.
+func decodeJPEGScaled(data []byte, denom int) (image.Image, error) {
+	return nil, errors.ErrUnsupported
+}
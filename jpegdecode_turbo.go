@@ -0,0 +1,101 @@
+//go:build turbojpeg && cgo
+
+package main
+
+/*
+#cgo LDFLAGS: -ljpeg
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <setjmp.h>
+#include <jpeglib.h>
+
+struct pickemall_jpeg_error {
+	struct jpeg_error_mgr pub;
+	jmp_buf jump;
+};
+
+// libjpeg exits the process on errors by default.
+static void pickemall_jpeg_error_exit(j_common_ptr cinfo) {
+	longjmp(((struct pickemall_jpeg_error *)cinfo->err)->jump, 1);
+}
+
+// pickemall_decode_jpeg decompresses a JPEG in memory at 1/denom of its
+// size into RGBA rows, which the caller frees. On failure it returns
+// nonzero and writes the error into message.
+static int pickemall_decode_jpeg(unsigned char *data, unsigned long size, int denom,
+		unsigned char **out, int *width, int *height, char *message) {
+	struct jpeg_decompress_struct cinfo;
+	struct pickemall_jpeg_error err;
+
+	*out = NULL;
+	cinfo.err = jpeg_std_error(&err.pub);
+	err.pub.error_exit = pickemall_jpeg_error_exit;
+	if (setjmp(err.jump)) {
+		(*cinfo.err->format_message)((j_common_ptr)&cinfo, message);
+		jpeg_destroy_decompress(&cinfo);
+		free(*out);
+		*out = NULL;
+		return 1;
+	}
+
+	jpeg_create_decompress(&cinfo);
+	jpeg_mem_src(&cinfo, data, size);
+	jpeg_read_header(&cinfo, TRUE);
+	cinfo.scale_num = 1;
+	cinfo.scale_denom = denom;
+	cinfo.out_color_space = JCS_EXT_RGBA;
+	jpeg_start_decompress(&cinfo);
+
+	size_t stride = (size_t)cinfo.output_width * 4;
+	*out = malloc(stride * cinfo.output_height);
+	if (*out == NULL) {
+		strcpy(message, "out of memory");
+		jpeg_destroy_decompress(&cinfo);
+		return 1;
+	}
+	*width = cinfo.output_width;
+	*height = cinfo.output_height;
+	while (cinfo.output_scanline < cinfo.output_height) {
+		JSAMPROW row = *out + (size_t)cinfo.output_scanline * stride;
+		jpeg_read_scanlines(&cinfo, &row, 1);
+	}
+	jpeg_finish_decompress(&cinfo);
+	jpeg_destroy_decompress(&cinfo);
+	return 0;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"unsafe"
+)
+
+// jpegScaledDecode reports whether JPEGs can be decoded at a reduced scale.
+const jpegScaledDecode = true
+
+// decodeJPEGScaled decodes the JPEG in data at 1/denom of its size, where
+// denom is 1, 2, 4 or 8, with libjpeg-turbo. Scaling happens in the DCT, so
+// the full-size image is never in memory and decoding takes a fraction of
+// the time. The EXIF orientation isn't applied.
+func decodeJPEGScaled(data []byte, denom int) (image.Image, error) {
+	if len(data) == 0 {
+		return nil, errors.New("can't decode an empty JPEG")
+	}
+
+	var out *C.uchar
+	var width, height C.int
+	message := (*C.char)(C.malloc(C.JMSG_LENGTH_MAX))
+	defer C.free(unsafe.Pointer(message))
+	if C.pickemall_decode_jpeg((*C.uchar)(unsafe.Pointer(&data[0])), C.ulong(len(data)), C.int(denom), &out, &width, &height, message) != 0 {
+		return nil, errors.New("failed to decode JPEG: " + C.GoString(message))
+	}
+	defer C.free(unsafe.Pointer(out))
+
+	// Decoded pixels are opaque, so they're the same in NRGBA.
+	img := image.NewNRGBA(image.Rect(0, 0, int(width), int(height)))
+	copy(img.Pix, unsafe.Slice((*byte)(unsafe.Pointer(out)), len(img.Pix)))
+	return img, nil
+}
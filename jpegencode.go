@@ -0,0 +1,25 @@
+//go:build !turbojpeg || !cgo
+
+package main
+
+import (
+	"image"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+// jpegEncoder names the JPEG encoder crops are encoded with.
+const jpegEncoder = "image/jpeg"
+
+// jpegSubsampling reports whether JPEGs can be encoded with chroma
+// subsampling other than 4:2:0. The standard library encoder always uses
+// 4:2:0.
+const jpegSubsampling = false
+
+// encodeJPEG encodes img as a JPEG of the given quality with the standard
+// library encoder, in 4:2:0 whatever the subsampling. Build with -tags
+// turbojpeg to use libjpeg-turbo instead.
+func encodeJPEG(w io.Writer, img image.Image, quality int, subsampling ChromaSubsampling) error {
+	return imaging.Encode(w, img, imaging.JPEG, imaging.JPEGQuality(quality))
+}
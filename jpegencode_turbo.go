@@ -0,0 +1,123 @@
+//go:build turbojpeg && cgo
+
+package main
+
+/*
+#cgo LDFLAGS: -ljpeg
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <setjmp.h>
+#include <jpeglib.h>
+
+struct pickemall_jpeg_error {
+	struct jpeg_error_mgr pub;
+	jmp_buf jump;
+};
+
+// libjpeg exits the process on errors by default.
+static void pickemall_jpeg_error_exit(j_common_ptr cinfo) {
+	longjmp(((struct pickemall_jpeg_error *)cinfo->err)->jump, 1);
+}
+
+// pickemall_encode_jpeg compresses rows of RGBX or gray pixels into a JPEG
+// in memory, which the caller frees, with the given sampling factors of
+// the luma component. On failure it returns nonzero and writes the error
+// into message.
+static int pickemall_encode_jpeg(unsigned char *pix, int width, int height, int stride, int gray, int quality,
+		int h_samp, int v_samp, unsigned char **out, unsigned long *out_size, char *message) {
+	struct jpeg_compress_struct cinfo;
+	struct pickemall_jpeg_error err;
+
+	*out = NULL;
+	*out_size = 0;
+	cinfo.err = jpeg_std_error(&err.pub);
+	err.pub.error_exit = pickemall_jpeg_error_exit;
+	if (setjmp(err.jump)) {
+		(*cinfo.err->format_message)((j_common_ptr)&cinfo, message);
+		jpeg_destroy_compress(&cinfo);
+		free(*out);
+		*out = NULL;
+		return 1;
+	}
+
+	jpeg_create_compress(&cinfo);
+	jpeg_mem_dest(&cinfo, out, out_size);
+	cinfo.image_width = width;
+	cinfo.image_height = height;
+	if (gray) {
+		cinfo.input_components = 1;
+		cinfo.in_color_space = JCS_GRAYSCALE;
+	} else {
+		cinfo.input_components = 4;
+		cinfo.in_color_space = JCS_EXT_RGBX;
+	}
+	jpeg_set_defaults(&cinfo);
+	jpeg_set_quality(&cinfo, quality, TRUE);
+	if (!gray) {
+		cinfo.comp_info[0].h_samp_factor = h_samp;
+		cinfo.comp_info[0].v_samp_factor = v_samp;
+	}
+	jpeg_start_compress(&cinfo, TRUE);
+	while (cinfo.next_scanline < cinfo.image_height) {
+		JSAMPROW row = pix + (size_t)cinfo.next_scanline * stride;
+		jpeg_write_scanlines(&cinfo, &row, 1);
+	}
+	jpeg_finish_compress(&cinfo);
+	jpeg_destroy_compress(&cinfo);
+	return 0;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"unsafe"
+)
+
+// jpegEncoder names the JPEG encoder crops are encoded with.
+const jpegEncoder = "libjpeg-turbo"
+
+// jpegSubsampling reports whether JPEGs can be encoded with chroma
+// subsampling other than 4:2:0.
+const jpegSubsampling = true
+
+// encodeJPEG encodes img as a JPEG of the given quality and chroma
+// subsampling with libjpeg-turbo, whose SIMD code is faster than the standard library encoder. Like it,
+// gray images are encoded as grayscale and transparent pixels are
+// composited over black.
+func encodeJPEG(w io.Writer, img image.Image, quality int, subsampling ChromaSubsampling) error {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return errors.New("can't encode an empty image")
+	}
+
+	var pix []byte
+	var stride, gray int
+	switch src := img.(type) {
+	case *image.Gray:
+		pix, stride, gray = src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y):], src.Stride, 1
+	case *image.RGBA:
+		pix, stride = src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y):], src.Stride
+	default:
+		// Premultiplied RGBA is the NRGBA of imaging composited over black.
+		rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+		pix, stride = rgba.Pix, rgba.Stride
+	}
+
+	h, v := subsampling.lumaSamplingFactors()
+	var out *C.uchar
+	var size C.ulong
+	message := (*C.char)(C.malloc(C.JMSG_LENGTH_MAX))
+	defer C.free(unsafe.Pointer(message))
+	if C.pickemall_encode_jpeg((*C.uchar)(unsafe.Pointer(&pix[0])), C.int(bounds.Dx()), C.int(bounds.Dy()), C.int(stride), C.int(gray), C.int(quality), C.int(h), C.int(v), &out, &size, message) != 0 {
+		return errors.New("failed to encode JPEG: " + C.GoString(message))
+	}
+	defer C.free(unsafe.Pointer(out))
+	_, err := w.Write(C.GoBytes(unsafe.Pointer(out), C.int(size)))
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+// sanitizeJPEG rebuilds a JPEG stream that the standard decoder rejects
+// into one it accepts, as far as the damage is in the header: bytes before
+// the start marker or between segments are skipped, segments with markers
+// the decoder doesn't know are dropped, and a missing end marker is added.
+// Scan data is kept as is.
+func sanitizeJPEG(data []byte) ([]byte, error) {
+	start := bytes.Index(data, []byte{0xFF, 0xD8})
+	if start < 0 {
+		return nil, errors.New("no JPEG start marker found")
+	}
+
+	out := []byte{0xFF, 0xD8}
+	for i := start + 2; i+1 < len(data); {
+		if data[i] != 0xFF {
+			// Garbage between segments.
+			i++
+			continue
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF:
+			i++
+			continue
+		case marker == 0x00 || marker == 0x01 || marker >= 0xD0 && marker <= 0xD7:
+			// Stuffed bytes and standalone markers don't belong before the
+			// scan.
+			i += 2
+			continue
+		case marker == 0xD9:
+			return nil, errors.New("no image data found before the end marker")
+		}
+
+		if i+4 > len(data) {
+			break
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end < i+4 || end > len(data) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		if marker == 0xDA {
+			// The scan runs to the end of the file.
+			out = append(out, data[i:]...)
+			if !bytes.HasSuffix(out, []byte{0xFF, 0xD9}) {
+				out = append(out, 0xFF, 0xD9)
+			}
+			return out, nil
+		}
+		if jpegDecoderMarker(marker) {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return nil, errors.New("no image data found")
+}
+
+// jpegDecoderMarker reports whether the standard decoder needs or
+// tolerates a segment with marker before the scan: baseline and
+// progressive frames, Huffman and quantization tables, restart intervals
+// and application segments, which hold the EXIF orientation.
+func jpegDecoderMarker(marker byte) bool {
+	switch {
+	case marker == 0xC0 || marker == 0xC1 || marker == 0xC2:
+		return true
+	case marker == 0xC4 || marker == 0xDB || marker == 0xDD:
+		return true
+	case marker >= 0xE0 && marker <= 0xEF:
+		return true
+	}
+	return false
+}
+
+// decodeLenient decodes a JPEG that failed to decode as is after
+// repairing it with sanitizeJPEG.
+func decodeLenient(data []byte, autoOrient bool) (image.Image, error) {
+	sanitized, err := sanitizeJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+	return imaging.Decode(bytes.NewReader(sanitized), imaging.AutoOrientation(autoOrient))
+}
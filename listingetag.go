@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// listingState summarizes what a listing is made of: the number of entries
+// and the latest modification time among them and their directories. Adding,
+// removing, renaming or editing a file changes it. Only file system
+// metadata is read, so it's much cheaper than the listing itself.
+type listingState struct {
+	entries int
+	latest  time.Time
+}
+
+func (s *listingState) add(info fs.FileInfo) {
+	s.entries++
+	if info.ModTime().After(s.latest) {
+		s.latest = info.ModTime()
+	}
+}
+
+// directoryState returns the state of the listing of dir, relative to
+// rootPath, like listDirectory.
+func directoryState(rootPath, dir string) (listingState, error) {
+	var state listingState
+	absDir, err := resolveDir(rootPath, dir)
+	if err != nil {
+		return state, err
+	}
+	info, err := os.Stat(absDir)
+	if err != nil {
+		return state, fmt.Errorf("failed to read directory: %w", err)
+	}
+	state.add(info)
+	entries, err := os.ReadDir(absDir)
+	if err != nil {
+		return state, fmt.Errorf("failed to read directory: %w", err)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return state, fmt.Errorf("failed to get file info: %w", err)
+		}
+		state.add(info)
+	}
+	return state, nil
+}
+
+// treeState returns the state of the listing of every image under
+// rootPath, like walkImages.
+func treeState(rootPath string, opts WalkOptions) (listingState, error) {
+	var state listingState
+	if opts.Files != nil {
+		for _, relPath := range opts.Files.paths {
+			if info, err := os.Stat(filepath.Join(rootPath, relPath)); err == nil {
+				state.add(info)
+			}
+		}
+		return state, nil
+	}
+	excluded := opts.excludedDir()
+	err := filepath.WalkDir(rootPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && excluded != "" && canonicalPath(path) == excluded {
+			return filepath.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("failed to get file info: %w", err)
+		}
+		state.add(info)
+		return nil
+	})
+	return state, err
+}
+
+// etag returns a weak ETag of the listing in state, as requested by
+// variant, e.g. its query string. Listings with files that are still too
+// recent for opts.MinAge change without anything being modified, and have
+// none.
+func (s listingState) etag(variant string, opts WalkOptions) (string, bool) {
+	if !opts.settled(s.latest) {
+		return "", false
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%d\x00%s", s.entries, s.latest.UnixNano(), variant)
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`, true
+}
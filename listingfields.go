@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// fileInfoField is a field of FileInfo as it appears in listings.
+type fileInfoField struct {
+	index     int
+	omitEmpty bool
+}
+
+// fileInfoFields maps the JSON names of the FileInfo fields to the fields,
+// so listings can be limited to some of them.
+var fileInfoFields = func() map[string]fileInfoField {
+	fields := map[string]fileInfoField{}
+	t := reflect.TypeFor[FileInfo]()
+	for i := range t.NumField() {
+		name, opts, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = fileInfoField{index: i, omitEmpty: slices.Contains(strings.Split(opts, ","), "omitempty")}
+	}
+	return fields
+}()
+
+// fileFields is the set of fields a listing is limited to, by their JSON
+// name. A nil set keeps every field.
+type fileFields map[string]fileInfoField
+
+// parseFileFields parses a comma-separated list of FileInfo fields, such
+// as "name,url,image". An empty list keeps every field.
+func parseFileFields(s string) (fileFields, error) {
+	if s == "" {
+		return nil, nil
+	}
+	fields := fileFields{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		field, ok := fileInfoFields[name]
+		if !ok {
+			names := make([]string, 0, len(fileInfoFields))
+			for name := range fileInfoFields {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			return nil, fmt.Errorf("unknown field %q, expected some of %s", name, strings.Join(names, ", "))
+		}
+		fields[name] = field
+	}
+	return fields, nil
+}
+
+// pick returns file with only the fields of the set, encoded like the
+// whole FileInfo would be. A nil set returns file as is.
+func (f fileFields) pick(file FileInfo) any {
+	if f == nil {
+		return file
+	}
+	v := reflect.ValueOf(file)
+	picked := make(map[string]any, len(f))
+	for name, field := range f {
+		value := v.Field(field.index)
+		if field.omitEmpty && isEmptyJSON(value) {
+			continue
+		}
+		picked[name] = value.Interface()
+	}
+	return picked
+}
+
+// isEmptyJSON reports whether encoding/json considers v empty, and leaves
+// it out of objects when its field is tagged omitempty.
+func isEmptyJSON(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Struct:
+		return false
+	}
+	return v.IsZero()
+}
+
+// pickAll is pick for every file of a listing.
+func (f fileFields) pickAll(files []FileInfo) any {
+	if f == nil {
+		return files
+	}
+	picked := make([]any, len(files))
+	for i, file := range files {
+		picked[i] = f.pick(file)
+	}
+	return picked
+}
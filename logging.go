@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+type logFlags struct {
+	Verbose        bool   `help:"Enable verbose logging" default:"false"`
+	LogFile        string `help:"Also write logs to this file" type:"path"`
+	LogFileMode    string `help:"How to open an existing log file: append or truncate" enum:"append,truncate" default:"append"`
+	LogFileMaxSize int64  `help:"Rotate the log file to <file>.1 on startup when it is larger than this many bytes (0 disables rotation)" default:"0"`
+	NoConsole      bool   `help:"Do not write logs to the console when --log-file is set"`
+}
+
+// setup configures the global logger and returns a function that releases
+// any resources (such as the log file) held by it.
+func (f logFlags) setup() (func(), error) {
+	level := zerolog.InfoLevel
+	if f.Verbose {
+		level = zerolog.DebugLevel
+	}
+
+	var writers []io.Writer
+	closer := func() {}
+	if f.LogFile != "" {
+		file, err := f.openLogFile()
+		if err != nil {
+			return nil, err
+		}
+		writers = append(writers, file)
+		closer = func() { _ = file.Close() }
+	}
+	if f.LogFile == "" || !f.NoConsole {
+		writers = append(writers, consoleWriter{zerolog.NewConsoleWriter(func(w *zerolog.ConsoleWriter) {
+			w.Out = terminal
+		})})
+	}
+	// Verbose runs are for reading every log line, which progress bars
+	// would hide.
+	terminal.interactive = isTerminal(os.Stdout) && !f.Verbose
+
+	log.Logger = zerolog.New(zerolog.MultiLevelWriter(writers...)).
+		With().Timestamp().Logger().
+		Level(level)
+	zerolog.DefaultContextLogger = &log.Logger
+
+	return closer, nil
+}
+
+func (f logFlags) openLogFile() (*os.File, error) {
+	if f.LogFileMaxSize > 0 {
+		if info, err := os.Stat(f.LogFile); err == nil && info.Size() > f.LogFileMaxSize {
+			if err := os.Rename(f.LogFile, f.LogFile+".1"); err != nil {
+				return nil, fmt.Errorf("failed to rotate log file %s: %w", f.LogFile, err)
+			}
+		}
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if f.LogFileMode == "truncate" {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	}
+	file, err := os.OpenFile(f.LogFile, flags, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file %s: %w", f.LogFile, err)
+	}
+	return file, nil
+}
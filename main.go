@@ -1,14 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/alecthomas/kong"
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
@@ -37,55 +41,205 @@ func run() error {
 }
 
 type serveCmd struct {
-	RootDir string `arg:"" help:"Root directory to serve files from"`
-	Open    bool   `help:"Open the browser automatically when the server starts" default:"true"`
-	JSON    bool   `help:"Output operations in JSON format without executing"`
-	Once    bool   `help:"Run the server once and exit after save" default:"true"`
-	Verbose bool   `help:"Enable verbose logging" default:"false"`
+	RootDir               string        `arg:"" help:"Root directory to serve files from, a zip archive to serve the images in, or a glob such as /photos/2023/**/IMG_*.jpg to serve only the matching files"`
+	Open                  bool          `help:"Open the browser automatically when the server starts" default:"true"`
+	OpenDelay             time.Duration `help:"Wait this long after the server starts before opening the browser; it's opened once the page loads in any case" default:"0s"`
+	JSON                  bool          `help:"Output operations in JSON format without executing"`
+	GroupOutput           bool          `help:"With --json, print one line per source file with all of its operations nested under it"`
+	ShellOut              bool          `help:"Print a shell script of cp and ImageMagick convert commands equivalent to the saved operations instead of executing them"`
+	Pending               string        `help:"Append saved operations to this JSONL file for later approval with apply-pending instead of executing them"`
+	Once                  bool          `help:"Run the server once and exit after save" default:"true"`
+	TimestampedOutput     bool          `help:"Write this run's outputs to a new timestamped directory inside the output directory, such as output/2024-01-15T10-30-00"`
+	ReadOnly              bool          `help:"Reject requests that would write or delete files, such as saving operations"`
+	PreviewMode           bool          `help:"Let clients try the whole workflow without writing anything: saves respond with the outputs they would produce instead of executing, and other writes are rejected"`
+	Headless              bool          `help:"Serve only the /api/* endpoints without the bundled frontend, for programmatic use; implies --open=false" aliases:"no-ui"`
+	Webhook               string        `help:"POST a JSON summary of each save (operation counts, root directory, timestamp) to this URL"`
+	Presets               string        `help:"JSON file of crop presets served to the frontend at /api/presets" type:"existingfile"`
+	DefaultOp             string        `help:"Operation type that filenames saved without an operation are expanded into: pick or metadata" enum:"pick,metadata" default:"pick"`
+	AllowedOps            []string      `help:"Only accept saves with these operation types, e.g. pick,crop (default: all types)"`
+	Placeholder           bool          `help:"Serve a gray placeholder labeled with the file name instead of 404 when a viewed image is missing, so the gallery layout stays intact"`
+	PlaceholderImage      string        `help:"Image served as the placeholder for missing images instead of the generated one; implies --placeholder" type:"existingfile"`
+	Prewarm               bool          `help:"Generate the thumbnails of every listed image in the background after the first listing, so sprite sheets are ready by the time they're scrolled to"`
+	ScaledDecode          bool          `help:"Decode large JPEGs at 1/2, 1/4 or 1/8 scale for thumbnails and previews that don't need full resolution; needs a build with -tags turbojpeg, and decodes at full size with a warning otherwise"`
+	MaxBandwidth          int64         `help:"Limit the bytes per second sent by image views and thumbnails, shared by all clients (default: no limit)" default:"0"`
+	MaxConcurrentRequests int           `help:"Serve at most this many image views, thumbnails and previews at once, queuing the rest, so scrolling through a large grid doesn't decode every image at once (default: no limit)" default:"0"`
+	SaveDebounce          time.Duration `help:"Wait until no save has arrived for this long and then run only the latest one, for frontends that auto-save on every change (default: run every save immediately)" default:"0s"`
+	IdleTimeout           time.Duration `help:"Shut the server down after no request has been served for this long, e.g. 30m, to free a shared machine from abandoned sessions (default: never)" default:"0s"`
+	RecordSession         string        `help:"Append every API request served and the operations of every save to this JSONL session log, for auditing and for reproducing the session's outputs with the replay command" type:"path"`
+	FileList              string        `help:"Text file of image paths relative to the root, one per line, to list instead of walking the root; saves are limited to these files" type:"existingfile"`
+
+	Log  logFlags  `embed:""`
+	Walk walkFlags `embed:""`
+	Exec execFlags `embed:""`
 }
 
 func (cmd *serveCmd) Run() error {
-	level := zerolog.InfoLevel
-	if cmd.Verbose {
-		level = zerolog.DebugLevel
+	closeLog, err := cmd.Log.setup()
+	if err != nil {
+		return err
 	}
-	log.Logger = log.Output(zerolog.NewConsoleWriter()).Level(level)
-	zerolog.DefaultContextLogger = &log.Logger
+	defer closeLog()
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
 	ctx = log.Logger.WithContext(ctx)
 
-	executor := &OperationExecutor{
-		BaseDir:   cmd.RootDir,
-		OutputDir: filepath.Join(cmd.RootDir, "output"),
-		Cropper:   NewImagingCropper(),
+	rootDir, pattern := splitGlobRoot(cmd.RootDir)
+	executor, err := cmd.Exec.newExecutor(rootDir)
+	if err != nil {
+		return err
+	}
+	defer executor.Close()
+	// Outputs of earlier timestamped runs are excluded from listings too.
+	outputRoot := executor.OutputDir
+	if cmd.TimestampedOutput {
+		// Seconds are enough to tell sessions apart, and the name sorts
+		// chronologically.
+		session := time.Now().Format("2006-01-02T15-04-05")
+		executor.OutputDir = filepath.Join(executor.OutputDir, session)
+		// Uploaded outputs are keyed relative to the output directory,
+		// so sessions are told apart by their prefix.
+		if s3, ok := executor.Output.(*S3Output); ok {
+			s3.Prefix += session + "/"
+		}
+	}
+	if cmd.ShellOut && (cmd.JSON || cmd.Pending != "") {
+		return fmt.Errorf("--shell-out can't be combined with --json or --pending")
+	}
+	for _, opType := range cmd.AllowedOps {
+		if !slices.Contains(operationTypes, opType) {
+			return fmt.Errorf("unknown operation type %q in --allowed-ops, expected one of %s", opType, strings.Join(operationTypes, ", "))
+		}
+	}
+
+	walk := cmd.Walk.options()
+	walk.Orientation = executor.Orientation
+	walk.Pattern = pattern
+	walk.ExcludeDir = outputRoot
+	walk.LenientDecode = cmd.Exec.LenientDecode
+	if cmd.Walk.Videos && executor.Archive != nil {
+		return fmt.Errorf("--videos needs a directory root, not an archive")
+	}
+	if walk.Videos, err = cmd.Walk.videoPosters(); err != nil {
+		return err
+	}
+	if cmd.FileList != "" {
+		if executor.Archive != nil || pattern != "" {
+			return fmt.Errorf("--file-list needs a directory root, not an archive or a glob")
+		}
+		if walk.Files, err = readFileList(cmd.FileList); err != nil {
+			return err
+		}
+		log.Ctx(ctx).Info().Str("path", cmd.FileList).Int("files", walk.Files.Len()).Msg("listing files from file list")
+	}
+
+	if executor.Archive != nil && (cmd.ShellOut || cmd.Prewarm || cmd.ScaledDecode) {
+		return fmt.Errorf("--shell-out, --prewarm and --scaled-decode need a directory root, not an archive")
+	}
+	if cmd.ScaledDecode && !jpegScaledDecode {
+		// Thumbnails and previews are still made, just from full-size decodes.
+		log.Ctx(ctx).Warn().Msg("--scaled-decode needs a build with -tags turbojpeg, decoding JPEGs at full size")
+		cmd.ScaledDecode = false
+	}
+	if cmd.IdleTimeout < 0 {
+		return fmt.Errorf("idle timeout must not be negative, got %s", cmd.IdleTimeout)
+	}
+	if cmd.MaxConcurrentRequests < 0 {
+		return fmt.Errorf("max concurrent requests must not be negative, got %d", cmd.MaxConcurrentRequests)
+	}
+	if cmd.PlaceholderImage != "" && !isImageFile(cmd.PlaceholderImage) {
+		return fmt.Errorf("placeholder %s is not a supported image", cmd.PlaceholderImage)
+	}
+
+	var presets []CropPreset
+	if cmd.Presets != "" {
+		if presets, err = loadCropPresets(cmd.Presets); err != nil {
+			return err
+		}
+	}
+
+	var webhook *WebhookNotifier
+	if cmd.Webhook != "" {
+		webhook = &WebhookNotifier{URL: cmd.Webhook}
+		defer webhook.Wait()
+	}
+
+	var session *SessionRecorder
+	if cmd.RecordSession != "" {
+		if session, err = openSessionRecorder(cmd.RecordSession, executor.modes()); err != nil {
+			return err
+		}
+		defer session.Close()
+	}
+
+	// Image requests decode under the same limit as operations.
+	var decodes decodeSemaphore
+	if cropper, ok := executor.Cropper.(*ImagingCropper); ok {
+		decodes = cropper.Decodes
 	}
 
 	app := NewWebApp(Config{
-		RootDir: cmd.RootDir,
+		RootDir:               rootDir,
+		Archive:               executor.Archive,
+		OutputDir:             executor.OutputDir,
+		HistoryPath:           filepath.Join(outputRoot, cropHistoryFile),
+		ReadOnly:              cmd.ReadOnly,
+		PreviewMode:           cmd.PreviewMode,
+		Headless:              cmd.Headless,
+		Walk:                  walk,
+		Presets:               presets,
+		SaveDebounce:          cmd.SaveDebounce,
+		IdleTimeout:           cmd.IdleTimeout,
+		DefaultOp:             cmd.DefaultOp,
+		MaxBandwidth:          cmd.MaxBandwidth,
+		MaxConcurrentRequests: cmd.MaxConcurrentRequests,
+		Decodes:               decodes,
+		Session:               session,
+		Prewarm:               cmd.Prewarm,
+		ScaledDecode:          cmd.ScaledDecode,
+		Placeholder:           cmd.Placeholder || cmd.PlaceholderImage != "",
+		PlaceholderImage:      cmd.PlaceholderImage,
+		AllowedOps:            cmd.AllowedOps,
+		Executor:              executor,
 		OnBeforeShutdown: func() {
 			log.Ctx(ctx).Info().Msg("Shutting down web application...")
 		},
 		OnReady: func(addr string) {
-			log.Ctx(ctx).Info().Msgf("Server started at %s", addr)
-			if cmd.Open {
-				if err := openBrowser(addr); err != nil {
-					log.Error().Err(err).Msg("Failed to open browser")
-				}
+			log.Ctx(ctx).Info().Str("output", executor.OutputDir).Msgf("Server started at %s", addr)
+			if cmd.Open && !cmd.Headless {
+				// The hook runs before requests are served, so waiting for
+				// the page here would never end.
+				go func() {
+					if err := openBrowserWhenReady(ctx, addr, cmd.OpenDelay); err != nil && ctx.Err() == nil {
+						log.Error().Err(err).Msg("Failed to open browser")
+					}
+				}()
 			}
 		},
-		OnSave: func(ops Operations) {
-			if cmd.JSON {
+		OnSave: func(ctx context.Context, ops Operations) {
+			if webhook != nil {
+				webhook.Notify(ctx, newSaveSummary(rootDir, ops))
+			}
+			if cmd.ShellOut {
+				if err := executor.WriteShellScript(ctx, os.Stdout, slices.Values(ops)); err != nil {
+					log.Ctx(ctx).Error().Err(err).Msg("Failed to write shell script")
+				}
+			} else if cmd.JSON && cmd.GroupOutput {
+				printJSONL(groupOperations(ops))
+			} else if cmd.JSON {
 				printJSONL(ops)
-			} else {
-				if err := executor.Exec(ctx, ops); err != nil {
-					log.Ctx(ctx).Error().Err(err).Msg("Failed to execute operations")
+			} else if cmd.Pending != "" {
+				if err := appendOperations(cmd.Pending, ops); err != nil {
+					log.Ctx(ctx).Error().Err(err).Msg("Failed to store pending operations")
 				}
+			} else {
+				executeSave(ctx, executor, ops)
 			}
 
-			if cmd.Once {
+			// A cancelled save keeps the server running, so the batch can be
+			// fixed and saved again.
+			if cmd.Once && ctx.Err() == nil {
 				cancel()
 			}
 		},
@@ -99,16 +253,56 @@ func (cmd *serveCmd) Run() error {
 }
 
 type cliArgs struct {
-	Version kong.VersionFlag `help:"Show version information"`
-	Serve   serveCmd         `cmd:"" default:"withargs"`
+	Version      kong.VersionFlag `help:"Show version information"`
+	Serve        serveCmd         `cmd:"" default:"withargs"`
+	PickAll      pickAllCmd       `cmd:"" help:"Pick every image under a directory without starting the web UI"`
+	Apply        applyCmd         `cmd:"" help:"Execute operations from a JSONL file, such as the output of --json"`
+	ApplyPending applyPendingCmd  `cmd:"" help:"Execute the operations stored by serve --pending and remove them from the pending file"`
+	Daemon       daemonCmd        `cmd:"" help:"Execute batches of operations dropped into a queue directory as they arrive, until stopped"`
+	Replay       replayCmd        `cmd:"" help:"Execute the saves of a session recorded by serve --record-session again, in order"`
+	ImportCSV    importCSVCmd     `cmd:"" name:"import-csv" help:"Execute crops read from a CSV of filenames and rectangles, such as the output of a detection model"`
+	Validate     validateCmd      `cmd:"" help:"Check a JSONL operations file for malformed operations"`
+	Selftest     selftestCmd      `cmd:"" help:"Run synthetic images of every supported format through the crop pipeline"`
+}
+
+// operationGroup holds the operations of a save that apply to one source file.
+type operationGroup struct {
+	Filename   string     `json:"filename"`
+	Operations Operations `json:"operations"`
 }
 
+// groupOperations groups ops by source file. Groups are ordered by the first
+// operation on each file, and operations keep their order within a group.
+func groupOperations(ops Operations) []operationGroup {
+	var groups []operationGroup
+	indexes := make(map[string]int)
+	for _, op := range ops {
+		i, ok := indexes[op.Filename()]
+		if !ok {
+			i = len(groups)
+			indexes[op.Filename()] = i
+			groups = append(groups, operationGroup{Filename: op.Filename()})
+		}
+		groups[i].Operations = append(groups[i].Operations, op)
+	}
+	return groups
+}
+
+// printJSONL writes each item as a JSON line to stdout. Lines are flushed
+// one at a time with a single write each, so a consumer reading a pipe
+// line by line sees every item as soon as it's printed and never a
+// partial line.
 func printJSONL[T any](data []T) {
-	enc := json.NewEncoder(os.Stdout)
+	w := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(w)
 	for _, item := range data {
 		if err := enc.Encode(item); err != nil {
 			log.Error().Err(err).Msg("Failed to encode item to JSON")
 			continue
 		}
+		if err := w.Flush(); err != nil {
+			log.Error().Err(err).Msg("Failed to write JSON line")
+			return
+		}
 	}
 }
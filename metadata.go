@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// exifTagNames names the common tags in metadata dumps. Other tags are
+// named by their hex ID, such as "0xa420".
+var exifTagNames = map[uint16]string{
+	0x010f: "Make",
+	0x0110: "Model",
+	0x0112: "Orientation",
+	0x011a: "XResolution",
+	0x011b: "YResolution",
+	0x0128: "ResolutionUnit",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x013b: "Artist",
+	0x8298: "Copyright",
+	0x829a: "ExposureTime",
+	0x829d: "FNumber",
+	0x8822: "ExposureProgram",
+	0x8827: "ISOSpeedRatings",
+	0x9003: "DateTimeOriginal",
+	0x9004: "DateTimeDigitized",
+	0x9201: "ShutterSpeedValue",
+	0x9202: "ApertureValue",
+	0x9204: "ExposureBiasValue",
+	0x9207: "MeteringMode",
+	0x9209: "Flash",
+	0x920a: "FocalLength",
+	0xa002: "PixelXDimension",
+	0xa003: "PixelYDimension",
+	0xa405: "FocalLengthIn35mmFilm",
+	0xa434: "LensModel",
+	0x0000: "GPSVersionID",
+	0x0001: "GPSLatitudeRef",
+	0x0002: "GPSLatitude",
+	0x0003: "GPSLongitudeRef",
+	0x0004: "GPSLongitude",
+	0x0005: "GPSAltitudeRef",
+	0x0006: "GPSAltitude",
+	0x0007: "GPSTimeStamp",
+	0x001d: "GPSDateStamp",
+}
+
+// exifJSON is the structure metadata operations write.
+type exifJSON struct {
+	IFD0 map[string]any `json:"ifd0,omitempty"`
+	Exif map[string]any `json:"exif,omitempty"`
+	GPS  map[string]any `json:"gps,omitempty"`
+}
+
+// MarshalJSON writes a rational as "num/den", which keeps values such as
+// exposure times exact.
+func (r exifRational) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%d/%d", r.Num, r.Den))
+}
+
+// exifMetadataJSON returns the EXIF tags of the image read from src as
+// indented JSON. Images without EXIF, including every non-JPEG, give an
+// empty object.
+func exifMetadataJSON(src io.ReadSeeker) ([]byte, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(src, soi[:]); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	var dump exifJSON
+	if bytes.Equal(soi[:], []byte{0xFF, 0xD8}) {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to rewind image: %w", err)
+		}
+		info, err := decodeJPEGInfo(src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read exif: %w", err)
+		}
+		if info.EXIF != nil {
+			dump = exifJSON{
+				IFD0: namedExifTags(info.EXIF.IFD0),
+				Exif: namedExifTags(info.EXIF.Exif),
+				GPS:  namedExifTags(info.EXIF.GPS),
+			}
+		}
+	}
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode exif: %w", err)
+	}
+	return data, nil
+}
+
+// namedExifTags keys tags by name. Pointers to sub-IFDs are left out,
+// their tags are dumped in their own section.
+func namedExifTags(tags map[uint16]any) map[string]any {
+	if len(tags) == 0 {
+		return nil
+	}
+	named := make(map[string]any, len(tags))
+	for tag, value := range tags {
+		if tag == exifTagExifIFDPtr || tag == exifTagGPSIFDPtr {
+			continue
+		}
+		name, ok := exifTagNames[tag]
+		if !ok {
+			name = fmt.Sprintf("0x%04x", tag)
+		}
+		named[name] = value
+	}
+	return named
+}
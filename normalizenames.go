@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// letterFolds spells accented Latin letters, and those written with more
+// than one, in plain ASCII for normalized names.
+var letterFolds = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'ç': "c", 'ć': "c", 'č': "c", 'ď': "d", 'đ': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ğ': "g", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'į': "i", 'ı': "i",
+	'ł': "l", 'ľ': "l", 'ñ': "n", 'ń': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ő': "o",
+	'ř': "r", 'ś': "s", 'ş': "s", 'š': "s", 'ș': "s", 'ť': "t", 'ţ': "t", 'ț': "t",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'þ': "th", 'ð': "d",
+}
+
+// normalizeName returns name lowercased and reduced to ASCII letters,
+// digits, dashes and dots, for systems that don't take anything else, such
+// as "my-photo-1.jpg" for "My Photo (1).JPG". Accented letters lose their
+// accents, and runs of anything else become a single dash. It's
+// deterministic, but different names can normalize to the same one.
+func normalizeName(name string) string {
+	var parts []string
+	for _, part := range strings.Split(name, ".") {
+		var b strings.Builder
+		dash := false
+		for _, r := range strings.ToLower(part) {
+			switch {
+			case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) || r == '_':
+				b.WriteRune(r)
+				dash = false
+			case letterFolds[r] != "":
+				b.WriteString(letterFolds[r])
+				dash = false
+			case !dash && b.Len() > 0:
+				b.WriteByte('-')
+				dash = true
+			}
+		}
+		if part := strings.TrimSuffix(b.String(), "-"); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return "image"
+	}
+	return strings.Join(parts, ".")
+}
+
+// outputSubdir returns the directory dir of a source, relative to the root,
+// as it's mirrored in the output directory: with every segment normalized
+// when NormalizeNames is set.
+func (r OperationExecutor) outputSubdir(dir string) string {
+	if !r.NormalizeNames || dir == "." {
+		return dir
+	}
+	segments := strings.Split(filepath.ToSlash(dir), "/")
+	for i, segment := range segments {
+		segments[i] = normalizeName(segment)
+	}
+	return filepath.FromSlash(strings.Join(segments, "/"))
+}
@@ -2,14 +2,28 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"context"
-	"crypto/md5"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
 	"io"
+	"iter"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/sourcegraph/conc/pool"
@@ -17,19 +31,63 @@ import (
 
 type Operations = []Operation
 
+// operationTypes lists the type names of every supported operation.
+var operationTypes = []string{"crop", "pick", "resize", "responsive", "straighten", "autocrop", "metadata", "animation"}
+
 type Operation struct {
-	Crop *CropOperation
-	Pick *PickOperation
+	Crop       *CropOperation
+	Pick       *PickOperation
+	Resize     *ResizeOperation
+	Responsive *ResponsiveOperation
+	Straighten *StraightenOperation
+	AutoCrop   *AutoCropOperation
+	Metadata   *MetadataOperation
+	Animation  *AnimationOperation
+	// Priority orders the operations of a batch: higher priorities are
+	// started first, e.g. to get quick picks out before slow crops.
+	// Operations with equal priority keep their order.
+	Priority int
+	// Label groups the outputs of operations made for the same purpose,
+	// e.g. "hero" or "social", into a subdirectory of that name, so one
+	// session can produce several sets.
+	Label string
+	// OutputDir is a slash-separated path inside the output directory to
+	// write the output under instead of its root, e.g. to sort the picks of
+	// a save into "keep/portraits" and "maybe".
+	OutputDir string
+	// Meta is free-form data from the client, such as captions or notes,
+	// that's stored with the output without being interpreted.
+	Meta map[string]any
+
+	// ordinal is the position of a pick among the picks of its batch,
+	// starting at 1, which names it when picks are renamed.
+	ordinal int
+	// conflict numbers the output of an operation that would write the same
+	// output as an earlier one of its batch, from 2, when such conflicts
+	// are renamed.
+	conflict int
+	// planned is the result of planning the operation, kept once its
+	// outputs are claimed, so it isn't planned again when it's executed.
+	planned *operationPlan
+}
+
+// operationPlan is what OperationExecutor.plan returned for an operation.
+type operationPlan struct {
+	op       Operation
+	destPath string
+	err      error
 }
 
 // unmarshal
 func (o *Operation) UnmarshalJSON(data []byte) error {
-	var op struct {
-		Type string `json:"type"`
-	}
+	var op operationEnvelope
 	if err := json.Unmarshal(data, &op); err != nil {
 		return fmt.Errorf("failed to unmarshal operation: %w", err)
 	}
+	o.Priority = op.Priority
+	o.Label = op.Label
+	o.OutputDir = op.OutputDir
+	o.Meta = op.Meta
 
 	switch op.Type {
 	case "crop":
@@ -44,12 +102,321 @@ func (o *Operation) UnmarshalJSON(data []byte) error {
 			return fmt.Errorf("failed to unmarshal pick operation: %w", err)
 		}
 		o.Pick = &pick
+	case "resize":
+		var resize ResizeOperation
+		if err := json.Unmarshal(data, &resize); err != nil {
+			return fmt.Errorf("failed to unmarshal resize operation: %w", err)
+		}
+		o.Resize = &resize
+	case "responsive":
+		var responsive ResponsiveOperation
+		if err := json.Unmarshal(data, &responsive); err != nil {
+			return fmt.Errorf("failed to unmarshal responsive operation: %w", err)
+		}
+		o.Responsive = &responsive
+	case "straighten":
+		var straighten StraightenOperation
+		if err := json.Unmarshal(data, &straighten); err != nil {
+			return fmt.Errorf("failed to unmarshal straighten operation: %w", err)
+		}
+		o.Straighten = &straighten
+	case "autocrop":
+		var autoCrop AutoCropOperation
+		if err := json.Unmarshal(data, &autoCrop); err != nil {
+			return fmt.Errorf("failed to unmarshal autocrop operation: %w", err)
+		}
+		o.AutoCrop = &autoCrop
+	case "metadata":
+		var metadata MetadataOperation
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			return fmt.Errorf("failed to unmarshal metadata operation: %w", err)
+		}
+		o.Metadata = &metadata
+	case "animation":
+		var animation AnimationOperation
+		if err := json.Unmarshal(data, &animation); err != nil {
+			return fmt.Errorf("failed to unmarshal animation operation: %w", err)
+		}
+		o.Animation = &animation
 	default:
 		return fmt.Errorf("unknown operation %q", op.Type)
 	}
 	return nil
 }
 
+func (o Operation) MarshalJSON() ([]byte, error) {
+	envelope := operationEnvelope{
+		Type:      o.Type(),
+		Priority:  o.Priority,
+		Label:     o.Label,
+		OutputDir: o.OutputDir,
+		Meta:      o.Meta,
+	}
+	switch {
+	case o.Crop != nil:
+		return json.Marshal(struct {
+			operationEnvelope
+			*CropOperation
+		}{envelope, o.Crop})
+	case o.Pick != nil:
+		return json.Marshal(struct {
+			operationEnvelope
+			*PickOperation
+		}{envelope, o.Pick})
+	case o.Resize != nil:
+		return json.Marshal(struct {
+			operationEnvelope
+			*ResizeOperation
+		}{envelope, o.Resize})
+	case o.Responsive != nil:
+		return json.Marshal(struct {
+			operationEnvelope
+			*ResponsiveOperation
+		}{envelope, o.Responsive})
+	case o.Straighten != nil:
+		return json.Marshal(struct {
+			operationEnvelope
+			*StraightenOperation
+		}{envelope, o.Straighten})
+	case o.AutoCrop != nil:
+		return json.Marshal(struct {
+			operationEnvelope
+			*AutoCropOperation
+		}{envelope, o.AutoCrop})
+	case o.Metadata != nil:
+		return json.Marshal(struct {
+			operationEnvelope
+			*MetadataOperation
+		}{envelope, o.Metadata})
+	case o.Animation != nil:
+		return json.Marshal(struct {
+			operationEnvelope
+			*AnimationOperation
+		}{envelope, o.Animation})
+	default:
+		return nil, fmt.Errorf("empty operation")
+	}
+}
+
+// operationEnvelope holds the JSON fields shared by every operation type,
+// which are embedded next to the fields of its type.
+type operationEnvelope struct {
+	Type      string         `json:"type"`
+	Priority  int            `json:"priority,omitempty"`
+	Label     string         `json:"label,omitempty"`
+	OutputDir string         `json:"output_dir,omitempty"`
+	Meta      map[string]any `json:"meta,omitempty"`
+}
+
+// Type returns the name of the operation type, as used in the "type" JSON field.
+func (o Operation) Type() string {
+	switch {
+	case o.Crop != nil:
+		return "crop"
+	case o.Pick != nil:
+		return "pick"
+	case o.Resize != nil:
+		return "resize"
+	case o.Responsive != nil:
+		return "responsive"
+	case o.Straighten != nil:
+		return "straighten"
+	case o.AutoCrop != nil:
+		return "autocrop"
+	case o.Metadata != nil:
+		return "metadata"
+	case o.Animation != nil:
+		return "animation"
+	default:
+		return ""
+	}
+}
+
+// Filename returns the source filename of the operation.
+func (o Operation) Filename() string {
+	switch {
+	case o.Crop != nil:
+		return o.Crop.Filename
+	case o.Pick != nil:
+		return o.Pick.Filename
+	case o.Resize != nil:
+		return o.Resize.Filename
+	case o.Responsive != nil:
+		return o.Responsive.Filename
+	case o.Straighten != nil:
+		return o.Straighten.Filename
+	case o.AutoCrop != nil:
+		return o.AutoCrop.Filename
+	case o.Metadata != nil:
+		return o.Metadata.Filename
+	case o.Animation != nil && len(o.Animation.Filenames) > 0:
+		return o.Animation.Filenames[0]
+	default:
+		return ""
+	}
+}
+
+// Filenames returns every source filename of the operation: the frames of
+// animations, or the one of Filename.
+func (o Operation) Filenames() []string {
+	if o.Animation != nil {
+		return o.Animation.Filenames
+	}
+	return []string{o.Filename()}
+}
+
+// original returns the pick of the source of a crop or autocrop that
+// CropKeepsOriginal adds, with the crop's label so it lands next to the
+// crop, and its metadata, which describes the same image.
+func (o Operation) original() Operation {
+	return Operation{Pick: &PickOperation{Filename: o.Filename()}, Label: o.Label, OutputDir: o.OutputDir, Meta: o.Meta}
+}
+
+// originalKey identifies the output of original. Labels can't contain
+// slashes, so it's unambiguous.
+func (o Operation) originalKey() string {
+	return path.Join(o.OutputDir, o.Label) + "/" + o.Filename()
+}
+
+// Validate checks that the operation is complete and its values are in range.
+func (o Operation) Validate() error {
+	if err := validateLabel(o.Label); err != nil {
+		return err
+	}
+	if err := validateOutputDir(o.OutputDir); err != nil {
+		return err
+	}
+	switch {
+	case o.Crop != nil:
+		if o.Crop.Filename == "" {
+			return errors.New("crop operation is missing a filename")
+		}
+		if err := o.Crop.Format.Validate(); err != nil {
+			return err
+		}
+		if o.Crop.Quality < 0 || o.Crop.Quality > 100 {
+			return fmt.Errorf("crop quality must be between 1 and 100, got %d", o.Crop.Quality)
+		}
+		if o.Crop.MaxFileSize < 0 {
+			return fmt.Errorf("crop max file size must not be negative, got %d", o.Crop.MaxFileSize)
+		}
+		if o.Crop.Bleed < 0 || o.Crop.Bleed >= 1 {
+			return fmt.Errorf("crop bleed must be between 0 and 1, got %v", o.Crop.Bleed)
+		}
+		if math.Abs(o.Crop.Rotate) >= 45 {
+			return fmt.Errorf("crop rotation must be between -45 and 45 degrees, got %v", o.Crop.Rotate)
+		}
+		return o.Crop.Crop.Validate()
+	case o.Pick != nil:
+		if o.Pick.Filename == "" {
+			return errors.New("pick operation is missing a filename")
+		}
+		return nil
+	case o.Resize != nil:
+		if o.Resize.Filename == "" {
+			return errors.New("resize operation is missing a filename")
+		}
+		if o.Resize.Width <= 0 || o.Resize.Height <= 0 {
+			return fmt.Errorf("invalid resize dimensions: width=%d, height=%d", o.Resize.Width, o.Resize.Height)
+		}
+		if o.Resize.Background != "" {
+			if _, err := parseColor(o.Resize.Background); err != nil {
+				return err
+			}
+		}
+		return o.Resize.Format.Validate()
+	case o.Responsive != nil:
+		if o.Responsive.Filename == "" {
+			return errors.New("responsive operation is missing a filename")
+		}
+		if len(o.Responsive.Widths) == 0 {
+			return errors.New("responsive operation has no widths")
+		}
+		for i, width := range o.Responsive.Widths {
+			if width <= 0 {
+				return fmt.Errorf("invalid responsive width %d", width)
+			}
+			if slices.Contains(o.Responsive.Widths[:i], width) {
+				return fmt.Errorf("responsive width %d is listed twice", width)
+			}
+		}
+		if o.Responsive.Quality < 0 || o.Responsive.Quality > 100 {
+			return fmt.Errorf("responsive quality must be between 1 and 100, got %d", o.Responsive.Quality)
+		}
+		return o.Responsive.Format.Validate()
+	case o.Straighten != nil:
+		if o.Straighten.Filename == "" {
+			return errors.New("straighten operation is missing a filename")
+		}
+		if math.Abs(o.Straighten.Angle) >= 45 {
+			return fmt.Errorf("straighten angle must be between -45 and 45 degrees, got %v", o.Straighten.Angle)
+		}
+		return o.Straighten.Format.Validate()
+	case o.AutoCrop != nil:
+		if o.AutoCrop.Filename == "" {
+			return errors.New("autocrop operation is missing a filename")
+		}
+		if o.AutoCrop.Aspect <= 0 {
+			return fmt.Errorf("invalid autocrop aspect ratio: %v", o.AutoCrop.Aspect)
+		}
+		switch o.AutoCrop.Focus {
+		case "", FocusCenter, FocusFace, FocusSaliency:
+		default:
+			return fmt.Errorf("unsupported autocrop focus %q, expected center, face or saliency", o.AutoCrop.Focus)
+		}
+		if o.AutoCrop.Quality < 0 || o.AutoCrop.Quality > 100 {
+			return fmt.Errorf("autocrop quality must be between 1 and 100, got %d", o.AutoCrop.Quality)
+		}
+		return o.AutoCrop.Format.Validate()
+	case o.Metadata != nil:
+		if o.Metadata.Filename == "" {
+			return errors.New("metadata operation is missing a filename")
+		}
+		return nil
+	case o.Animation != nil:
+		if len(o.Animation.Filenames) < 2 {
+			return fmt.Errorf("animation needs at least 2 frames, got %d", len(o.Animation.Filenames))
+		}
+		if slices.Contains(o.Animation.Filenames, "") {
+			return errors.New("animation frame is missing a filename")
+		}
+		// GIFs count delays in hundredths of a second.
+		if o.Animation.Delay != 0 && (o.Animation.Delay < 10 || o.Animation.Delay > 655350) {
+			return fmt.Errorf("animation delay must be between 10 and 655350 milliseconds, got %d", o.Animation.Delay)
+		}
+		if o.Animation.Size != 0 && (o.Animation.Size < 16 || o.Animation.Size > maxAnimationSize) {
+			return fmt.Errorf("animation size must be between 16 and %d pixels, got %d", maxAnimationSize, o.Animation.Size)
+		}
+		return nil
+	default:
+		return errors.New("empty operation")
+	}
+}
+
+// validateLabel checks that label can name a directory of the output. An
+// empty label is unset.
+func validateLabel(label string) error {
+	if label == "" {
+		return nil
+	}
+	if label == "." || label == ".." || strings.ContainsAny(label, `/\`) || strings.TrimSpace(label) != label {
+		return fmt.Errorf("invalid label %q, expected a single directory name", label)
+	}
+	return nil
+}
+
+// validateOutputDir checks that dir is a relative, slash-separated path
+// that stays inside the output directory. An empty dir is unset.
+func validateOutputDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if strings.Contains(dir, `\`) || !filepath.IsLocal(filepath.FromSlash(dir)) {
+		return fmt.Errorf("invalid output dir %q, expected a relative path inside the output directory", dir)
+	}
+	return nil
+}
+
 type Crop struct {
 	// X is the x-coordinate of the top-left corner of the crop rectangle, relative to the image width (0.0 to 1.0).
 	X float64 `json:"x"`
@@ -62,36 +429,371 @@ type Crop struct {
 }
 
 func (c Crop) String() string {
-	return fmt.Sprintf("crop(x=%.2f,y=%.2f,w=%.2f,h=%.2f)", c.X, c.Y, c.Width, c.Height)
+	return c.format(defaultCropIDPrecision)
 }
 
-func (c Crop) ID() string {
-	m := md5.New()
-	_, err := m.Write([]byte(c.String()))
-	if err != nil {
-		log.Error().Err(err).Msg("failed to hash crop string")
-		return ""
+// format returns the string form of the crop with its coordinates rounded
+// to this many decimals.
+func (c Crop) format(precision int) string {
+	return fmt.Sprintf("crop(x=%.*f,y=%.*f,w=%.*f,h=%.*f)", precision, c.X, precision, c.Y, precision, c.Width, precision, c.Height)
+}
+
+// Validate checks that the crop rectangle is non-empty and starts within the image.
+func (c Crop) Validate() error {
+	if c.Width <= 0 || c.Height <= 0 {
+		return fmt.Errorf("invalid crop dimensions: w=%v, h=%v", c.Width, c.Height)
+	}
+	if c.X < 0 || c.X >= 1 || c.Y < 0 || c.Y >= 1 {
+		return fmt.Errorf("crop origin out of range: x=%v, y=%v", c.X, c.Y)
 	}
-	return fmt.Sprintf("%x", m.Sum(nil))
+	return nil
+}
+
+// ID returns the hex MD5 of the crop's string form. It's used to give each
+// distinct crop of a file its own output name.
+func (c Crop) ID() string {
+	return CropIDConfig{}.ID(c)
 }
 
 type CropOperation struct {
 	Filename string `json:"filename"`
 	Crop     Crop   `json:"crop"`
+	// Format overrides the cropper's output format for this operation.
+	Format OutputFormat `json:"format,omitempty"`
+	// Quality overrides the cropper's JPEG quality for this operation.
+	Quality int `json:"quality,omitempty"`
+	// MaxFileSize overrides the cropper's max file size in bytes for this
+	// operation. The quality is lowered as far as needed to fit it.
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+	// Bleed grows the crop outward on every side by this fraction of its
+	// shorter side, to give printers a bleed area around the visible crop.
+	// The grown rectangle is clamped to the image, so there's less bleed on
+	// sides that touch an edge.
+	Bleed float64 `json:"bleed,omitempty"`
+	// Rotate rotates the image counter-clockwise by this many degrees
+	// before it's cropped, to level tilted scans in the same pass. Crop is
+	// then relative to the rotated image, which is enlarged to hold all of
+	// it with the corners left empty filled black, like rotation previews
+	// without crop show it.
+	Rotate float64 `json:"rotate,omitempty"`
 }
 
 type PickOperation struct {
 	Filename string `json:"filename"`
+	// Favorite routes the pick to the executor's favorites directory, for
+	// first-pass selections that will be refined later.
+	Favorite bool `json:"favorite,omitempty"`
+}
+
+// ResizeOperation scales an image to fit in a Width x Height box, padding
+// the rest of the box with the Background color so every output has
+// exactly the requested dimensions.
+type ResizeOperation struct {
+	Filename string `json:"filename"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	// Background is a hex color such as "#ffffff". When empty, the
+	// executor's default pad color is used.
+	Background string `json:"background,omitempty"`
+	// Format overrides the cropper's output format for this operation.
+	Format OutputFormat `json:"format,omitempty"`
+}
+
+// ResponsiveOperation scales an image to each of Widths, keeping its aspect
+// ratio, for the srcset of responsive web images. The source is decoded once
+// for all of them, and every width gets its own output.
+type ResponsiveOperation struct {
+	Filename string `json:"filename"`
+	// Widths are the widths in pixels of the outputs. Widths past the
+	// source's are written at its size, since upscaling adds no detail.
+	Widths []int `json:"widths"`
+	// Format overrides the cropper's output format for this operation.
+	Format OutputFormat `json:"format,omitempty"`
+	// Quality overrides the cropper's JPEG quality for this operation.
+	Quality int `json:"quality,omitempty"`
+}
+
+// StraightenOperation rotates an image by a small angle to level it, then
+// crops away the empty corners the rotation leaves behind.
+type StraightenOperation struct {
+	Filename string `json:"filename"`
+	// Angle is the counter-clockwise rotation in degrees.
+	Angle float64 `json:"angle"`
+	// Format overrides the cropper's output format for this operation.
+	Format OutputFormat `json:"format,omitempty"`
+}
+
+// Focus values for AutoCropOperation.
+const (
+	FocusCenter   = "center"
+	FocusFace     = "face"
+	FocusSaliency = "saliency"
+)
+
+// AutoCropOperation crops the largest rectangle with the given aspect ratio
+// out of an image, placing it automatically instead of from a rectangle
+// picked in the UI.
+type AutoCropOperation struct {
+	Filename string `json:"filename"`
+	// Aspect is the width/height ratio of the crop, e.g. 0.8 for 4:5.
+	Aspect float64 `json:"aspect"`
+	// Focus is what the crop is centered on: "center" (the default), "face"
+	// for the largest detected face, falling back to the center when no
+	// face is found, or "saliency" for the region with the most detail.
+	Focus string `json:"focus,omitempty"`
+	// Format overrides the cropper's output format for this operation.
+	Format OutputFormat `json:"format,omitempty"`
+	// Quality overrides the cropper's JPEG quality for this operation.
+	Quality int `json:"quality,omitempty"`
+}
+
+// MetadataOperation writes the EXIF tags of an image as JSON, named after
+// the image and placed like a pick of it, so it sits next to the picked file.
+type MetadataOperation struct {
+	Filename string `json:"filename"`
+}
+
+// AnimationOperation assembles images into an animated GIF with a frame per
+// image, in the order they're listed, such as the stills of a burst or a
+// timelapse. Frames are scaled to fit in a Size x Size box, and centered on
+// a black canvas of the first frame's size when their sizes differ.
+type AnimationOperation struct {
+	// Filenames are the frames of the animation, in order.
+	Filenames []string `json:"filenames"`
+	// Delay is how long each frame is shown in milliseconds, rounded to a
+	// hundredth of a second. Zero shows frames for defaultAnimationDelay.
+	Delay int `json:"delay,omitempty"`
+	// Size is the longest side of the animation in pixels. Zero is
+	// defaultAnimationSize.
+	Size int `json:"size,omitempty"`
+}
+
+// defaultOperationTypes are the operation types that need nothing but a
+// filename, and so can be used as the default operation.
+var defaultOperationTypes = []string{"pick", "metadata"}
+
+// defaultOperation returns an operation of type opType on filename. An
+// empty opType means pick.
+func defaultOperation(opType, filename string) (Operation, error) {
+	if filename == "" {
+		return Operation{}, errors.New("empty filename")
+	}
+	switch opType {
+	case "", "pick":
+		return Operation{Pick: &PickOperation{Filename: filename}}, nil
+	case "metadata":
+		return Operation{Metadata: &MetadataOperation{Filename: filename}}, nil
+	default:
+		return Operation{}, fmt.Errorf("operation type %q can't be used as the default, expected one of %s", opType, strings.Join(defaultOperationTypes, ", "))
+	}
 }
 
 type Cropper interface {
-	Crop(ctx context.Context, r io.Reader, w io.Writer, crop Crop) error
+	Crop(ctx context.Context, r io.Reader, w io.Writer, op CropOperation) error
+}
+
+// CropTimings is how long each phase of a crop took.
+type CropTimings struct {
+	// Wait is the time spent waiting for a free decode slot.
+	Wait   time.Duration
+	Decode time.Duration
+	Crop   time.Duration
+	Encode time.Duration
+}
+
+// TimedCropper is implemented by croppers that can report how long each
+// phase of a crop took.
+type TimedCropper interface {
+	CropTimed(ctx context.Context, r io.Reader, w io.Writer, op CropOperation) (CropTimings, error)
+}
+
+// Resizer is implemented by croppers that can also produce padded resizes.
+type Resizer interface {
+	FitPadded(ctx context.Context, r io.Reader, w io.Writer, op ResizeOperation, background color.Color) error
+}
+
+// ResponsiveResizer is implemented by croppers that can scale an image to
+// several widths in one decode. The output of op.Widths[i] is written to
+// ws[i].
+type ResponsiveResizer interface {
+	ResizeWidths(ctx context.Context, r io.Reader, ws []io.Writer, op ResponsiveOperation) error
+}
+
+// Downscaler is implemented by croppers that can shrink images to fit in a
+// maxDimension x maxDimension box.
+type Downscaler interface {
+	Downscale(ctx context.Context, r io.Reader, w io.Writer, filename string, maxDimension int, format OutputFormat) error
+}
+
+// Straightener is implemented by croppers that can rotate and inset-crop images.
+type Straightener interface {
+	Straighten(ctx context.Context, r io.Reader, w io.Writer, op StraightenOperation) error
+}
+
+// Animator is implemented by croppers that can assemble animations. Each
+// frame is read from the source open returns for it, which is closed
+// before the next one is opened.
+type Animator interface {
+	Animate(ctx context.Context, open func(filename string) (io.ReadCloser, error), w io.Writer, op AnimationOperation) error
+}
+
+// AutoCropper is implemented by croppers that can place crops automatically.
+type AutoCropper interface {
+	AutoCrop(ctx context.Context, r io.Reader, w io.Writer, op AutoCropOperation) error
 }
 
 type OperationExecutor struct {
 	BaseDir   string
 	OutputDir string
-	Cropper   Cropper
+	// OutputPrefix is an optional relative path inside OutputDir that all
+	// outputs are written under.
+	OutputPrefix string
+	Cropper      Cropper
+	// FavoritesDir is the directory inside the output directory that favorite
+	// picks are written to. Defaults to "favorites".
+	FavoritesDir string
+	// Concurrency is the number of operations executed in parallel. Zero
+	// uses the number of CPUs.
+	Concurrency int
+	// Sequential executes operations one at a time in the order they were
+	// given, ignoring Concurrency and their priorities, so logs and outputs
+	// are reproducible.
+	Sequential bool
+	// FailFast stops a batch at the first operation that fails: the rest
+	// aren't started and those still running are cancelled. By default the
+	// other operations still run.
+	FailFast bool
+	// Flatten writes picked files directly into the output directory instead
+	// of mirroring their source subdirectories.
+	Flatten bool
+	// NormalizeNames lowercases the names of outputs, and of the source
+	// subdirectories mirrored for them, and reduces them to ASCII letters,
+	// digits, dashes and dots with normalizeName. Outputs of different
+	// sources that end up with the same name are numbered when they're in
+	// the same batch; outputs of earlier batches are replaced as usual.
+	NormalizeNames bool
+	// CropIDs controls how the crop suffix in output filenames is derived.
+	CropIDs CropIDConfig
+	// Provenance writes a <output>.json sidecar next to each crop that records
+	// the source dimensions and the crop rectangle.
+	Provenance bool
+	// Remote fetches sources given as http(s) URLs. When nil, only local
+	// sources are allowed.
+	Remote *RemoteFetcher
+	// Archive is the zip archive local sources are read from, when the root
+	// is one instead of BaseDir.
+	Archive *sourceArchive
+	// PadColor fills the padding of resize operations that don't set a background.
+	PadColor color.Color
+	// Incremental skips operations whose output already exists and is newer
+	// than their local source and its directory settings, so re-running an
+	// export only processes new or changed files.
+	Incremental bool
+	// Index writes an index.json to the output directory after a successful
+	// run, listing each output with its dimensions and source.
+	Index bool
+	// HTMLIndex writes an index.html gallery of the images in the output
+	// directory after a successful run.
+	HTMLIndex bool
+	// PreserveFormat encodes crops, resizes and straightens in the format of
+	// their source (JPEG or PNG) when the operation doesn't set one, instead
+	// of the cropper's format.
+	PreserveFormat bool
+	// History records every executed crop against its source file.
+	History *CropHistory
+	// Orientation decides whether source dimensions recorded in provenance
+	// sidecars and the export index follow the EXIF orientation. It should
+	// match the cropper's policy.
+	Orientation OrientationPolicy
+	// ZipByType writes outputs into one archive per operation type, such as
+	// crops.zip and picks.zip, instead of individual files.
+	ZipByType bool
+	// TempDir is where outputs are staged before being moved into place.
+	// When empty, they're staged next to their destination, which keeps the
+	// final rename on the same file system.
+	TempDir string
+	// MinCropSize is the smallest crop width and height, relative to the
+	// image, that is executed. Smaller crops are most likely accidental
+	// drags in the UI. Zero disables the check.
+	MinCropSize float64
+	// IgnoreTinyCrops skips crops below MinCropSize with a warning instead of
+	// failing them.
+	IgnoreTinyCrops bool
+
+	// Rename names picks after their position in the batch instead of their
+	// source file. When nil, picks keep their names.
+	Rename *RenamePattern
+	// CropKeepsOriginal also picks the source of every crop and autocrop,
+	// so the output has both the full frame and the crop.
+	CropKeepsOriginal bool
+	// MaxOutputSize caps the total bytes of outputs written by a run. The
+	// output that would go past it isn't written, and the remaining
+	// operations are skipped. Zero means no limit.
+	MaxOutputSize int64
+	// ResumableCopy stages picks of local files in a partial copy that's
+	// kept when the copy fails, so a later run continues where it stopped
+	// instead of copying the whole file again.
+	ResumableCopy bool
+	// MaxPickDimension caps the width and height of picks. Larger sources
+	// are decoded and downscaled to fit instead of being copied. Zero copies
+	// every pick as is.
+	MaxPickDimension int
+	// IncludeSidecars copies the sidecars of picked images, such as their
+	// .xmp files, next to them.
+	IncludeSidecars bool
+	// Companions are the lowercase extensions, with their dot, of
+	// files copied along with picked images that have the same stem, such
+	// as ".mov" for the videos of live photos.
+	Companions []string
+	// SlowOpThreshold logs a warning for every operation that takes longer
+	// than this to execute. Zero disables the warning.
+	SlowOpThreshold time.Duration
+	// Progress draws a progress bar of each run on the terminal, which
+	// stands in for the log lines of every operation.
+	Progress bool
+	// OnConflict decides what happens to operations that would write the
+	// same output as an earlier one of their batch. Empty overwrites it
+	// with a warning, like ConflictOverwrite.
+	OnConflict ConflictPolicy
+	// DedupeSimilar skips the operations of sources whose perceptual hash
+	// is within SimilarDistance bits of that of another source of the
+	// batch, keeping one of each group of near duplicates: the first, or
+	// the one with the most pixels with DedupeKeepLargest.
+	DedupeSimilar     bool
+	SimilarDistance   int
+	DedupeKeepLargest bool
+
+	// FileMode and DirMode are the permissions of the outputs and the
+	// directories created for them, regardless of the umask. Zero keeps
+	// 0644 and 0755, reduced by the umask.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// total is the number of operations of the current run, when it's
+	// known up front, for the progress bar.
+	total int
+	// Checkpoint records the operations that completed, and skips those an
+	// earlier run recorded, so an interrupted batch can be resumed. Nil
+	// records nothing.
+	Checkpoint *Checkpoint
+	// Output stores outputs instead of writing them to OutputDir, such as
+	// an S3Output uploading them to a bucket. Their paths are still planned
+	// under OutputDir.
+	Output OutputBackend
+
+	// zips holds the archives of the current run when ZipByType is set.
+	zips *zipArchives
+	// budget tracks the output size of the current run against MaxOutputSize.
+	budget *outputBudget
+}
+
+// Close releases the sources of the executor, i.e. the archive they're read
+// from when there is one.
+func (r OperationExecutor) Close() error {
+	if r.Archive != nil {
+		return r.Archive.Close()
+	}
+	return nil
 }
 
 func (r OperationExecutor) Exec(ctx context.Context, ops []Operation) error {
@@ -100,94 +802,1214 @@ func (r OperationExecutor) Exec(ctx context.Context, ops []Operation) error {
 		return nil
 	}
 
-	pooler := pool.New().WithErrors().WithContext(ctx).WithMaxGoroutines(runtime.NumCPU())
+	// Start higher priorities first. The pool runs them concurrently, so
+	// this orders when they start, not when they finish. Picks are numbered
+	// before, so renamed picks follow the order they were given in.
+	ops = slices.Clone(ops)
+	if r.DedupeSimilar {
+		// Picks are numbered after the skipped ones are left out, so
+		// their names have no gaps.
+		ops = slices.Collect(r.dedupeSimilar(ctx, slices.Values(ops)))
+		r.DedupeSimilar = false
+	}
+	numberPicks(ops)
+	if !r.Sequential {
+		slices.SortStableFunc(ops, func(a, b Operation) int {
+			return cmp.Compare(b.Priority, a.Priority)
+		})
+	}
+	if r.OnConflict == ConflictError {
+		// The whole batch is known, so it fails before anything is
+		// written.
+		claims := newOutputClaims(r.OnConflict)
+		for i := range ops {
+			var err error
+			if ops[i], _, err = claims.claim(ctx, r, ops[i]); err != nil {
+				return err
+			}
+		}
+	}
+	r.total = len(ops)
+	return r.ExecSeq(ctx, slices.Values(ops))
+}
 
-	if err := os.MkdirAll(r.OutputDir, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory %s: %w", r.OutputDir, err)
+// ExecSeq executes operations as they are produced by ops. Operations are
+// pulled from the sequence only when a worker is free, so arbitrarily long
+// sequences can be executed with bounded memory.
+func (r OperationExecutor) ExecSeq(ctx context.Context, ops iter.Seq[Operation]) error {
+	concurrency := r.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
 	}
-	for _, op := range ops {
-		pooler.Go(func(ctx context.Context) error {
-			if err := r.executeOperation(ctx, op); err != nil {
-				log.Ctx(ctx).Error().Err(err).
-					Interface("op", op).
-					Msg("failed to execute operation")
+	if r.Sequential {
+		concurrency = 1
+	}
+	// With FailFast, the first failure cancels poolCtx, which stops
+	// dispatching the rest of the sequence and cancels the operations
+	// still running.
+	poolCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pooler := pool.New().WithErrors().WithContext(poolCtx).WithMaxGoroutines(concurrency)
+
+	// Outputs stored elsewhere leave no trace of the run in OutputDir.
+	if r.Output == nil {
+		if err := r.modes().mkdirAll(r.OutputDir); err != nil {
+			return fmt.Errorf("failed to create output directory %s: %w", r.OutputDir, err)
+		}
+	}
+	if r.ZipByType {
+		r.zips = newZipArchives(r.OutputDir, r.modes())
+	}
+	r.budget = newOutputBudget(r.MaxOutputSize)
+	if r.DedupeSimilar {
+		ops = r.dedupeSimilar(ctx, ops)
+	}
+	var progress *progressBar
+	if r.Progress {
+		progress = newProgressBar(r.total)
+	}
+
+	var mu sync.Mutex
+	var index []exportIndexEntry
+	// originals holds the sources already picked for CropKeepsOriginal, so
+	// several crops of a file with the same label copy it once.
+	originals := make(map[string]bool)
+	picks := 0
+	addToIndex := func(op Operation, destPath string) error {
+		for _, output := range r.outputPaths(op, destPath) {
+			entry, err := newExportIndexEntry(r.OutputDir, output, op, r.Orientation)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			index = append(index, entry)
+			mu.Unlock()
+		}
+		return nil
+	}
+	var resumed atomic.Int64
+	run := func(ctx context.Context, op Operation) error {
+		var checkpointID string
+		if r.Checkpoint != nil {
+			var err error
+			if checkpointID, err = checkpointIDOf(op); err != nil {
 				return err
 			}
-			return nil
+			if r.Checkpoint.Done(checkpointID) {
+				resumed.Add(1)
+				log.Ctx(ctx).Info().Str("filename", op.Filename()).Str("type", op.Type()).Msg("skipping, completed by an earlier run")
+				if !r.Index {
+					return nil
+				}
+				// The outputs of the earlier run still belong in the index.
+				op, destPath, err := r.plan(op)
+				if err != nil || destPath == "" {
+					return err
+				}
+				return addToIndex(op, destPath)
+			}
+		}
+
+		start := time.Now()
+		destPath, err := r.executeOperation(ctx, op)
+		if elapsed := time.Since(start); r.SlowOpThreshold > 0 && elapsed > r.SlowOpThreshold {
+			log.Ctx(ctx).Warn().
+				Str("filename", op.Filename()).
+				Str("type", op.Type()).
+				Dur("elapsed", elapsed).
+				Msg("slow operation")
+		}
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).
+				Interface("op", op).
+				Msg("failed to execute operation")
+			return err
+		}
+		if r.History != nil && destPath != "" && (op.Crop != nil || op.AutoCrop != nil) {
+			if err := r.recordHistory(op, destPath); err != nil {
+				return err
+			}
+		}
+		if r.Index && destPath != "" {
+			if err := addToIndex(op, destPath); err != nil {
+				return err
+			}
+		}
+		return r.Checkpoint.Record(checkpointID, op)
+	}
+	// cancelled is set when ctx is cancelled before every operation was
+	// started, so the run doesn't pass for complete.
+	cancelled := false
+	// Operations are claimed as they're pulled, in order, so which of two
+	// conflicting ones is renamed or skipped doesn't depend on timing.
+	claims := newOutputClaims(r.OnConflict)
+	var conflictErr error
+	for op := range ops {
+		if poolCtx.Err() != nil {
+			cancelled = ctx.Err() != nil
+			break
+		}
+		if r.budget.Exceeded() {
+			break
+		}
+		if op.Pick != nil && op.ordinal == 0 {
+			// The sequence is pulled in order, so numbering as it's read
+			// is stable.
+			picks++
+			op.ordinal = picks
+		}
+		op, ok, err := claims.claim(ctx, r, op)
+		if err != nil {
+			conflictErr = err
+			break
+		}
+		if !ok {
+			progress.advance(false)
+			continue
+		}
+		pooler.Go(func(ctx context.Context) (err error) {
+			defer func() {
+				progress.advance(err != nil)
+				if err != nil && r.FailFast {
+					cancel()
+				}
+			}()
+			if r.budget.Exceeded() {
+				return nil
+			}
+			if err := run(ctx, op); err != nil {
+				return err
+			}
+			if !r.CropKeepsOriginal || (op.Crop == nil && op.AutoCrop == nil) {
+				return nil
+			}
+			mu.Lock()
+			picked := originals[op.originalKey()]
+			originals[op.originalKey()] = true
+			mu.Unlock()
+			if picked {
+				return nil
+			}
+			return run(ctx, op.original())
 		})
 	}
 
-	if err := pooler.Wait(); err != nil {
+	err := errors.Join(pooler.Wait(), conflictErr)
+	progress.finish()
+	if n := resumed.Load(); n > 0 {
+		log.Ctx(ctx).Info().Int64("skipped", n).Str("checkpoint", r.Checkpoint.path).Msg("resumed past operations completed by an earlier run")
+	}
+	if cancelled {
+		err = errors.Join(err, ctx.Err())
+	}
+	if r.zips != nil {
+		err = errors.Join(err, r.zips.Close())
+	}
+	if r.budget != nil {
+		log.Ctx(ctx).Info().
+			Int64("written", r.budget.used.Load()).
+			Int64("limit", r.budget.limit).
+			Msg("output size")
+		if r.budget.Exceeded() {
+			err = fmt.Errorf("stopped after writing %d of the %d bytes allowed by the output size limit, remaining operations were skipped: %w", r.budget.used.Load(), r.budget.limit, err)
+		}
+	}
+	if err != nil {
 		log.Ctx(ctx).Error().
 			Err(err).
 			Msg("finished with errors")
 		return err
 	}
 
+	if r.Index {
+		if err := writeExportIndex(r.OutputDir, index, r.modes()); err != nil {
+			return err
+		}
+	}
+	if r.HTMLIndex {
+		return writeHTMLIndex(ctx, r.OutputDir, WalkOptions{Concurrency: r.Concurrency}, r.modes())
+	}
 	return nil
 }
 
-func (r OperationExecutor) executeOperation(ctx context.Context, op Operation) error {
+// executeOperation executes op and returns the path of its output, which
+// is empty when the operation produces none.
+func (r OperationExecutor) executeOperation(ctx context.Context, op Operation) (string, error) {
+	if r.IgnoreTinyCrops && r.isTinyCrop(op) {
+		log.Ctx(ctx).Warn().Str("filename", op.Filename()).Stringer("crop", op.Crop.Crop).Msg("ignoring tiny crop, likely a misclick")
+		return "", nil
+	}
+	op, destPath, err := r.plan(op)
+	if err != nil {
+		return "", err
+	}
+	if destPath == "" {
+		return "", nil
+	}
+	outputs := r.outputPaths(op, destPath)
+	if r.Incremental && r.isUpToDate(op.Filenames(), outputs...) {
+		log.Ctx(ctx).Info().Str("filename", op.Filename()).Str("output", destPath).Msg("skipping, output is up to date")
+		return destPath, nil
+	}
+	// Outputs that are new are reported, so undoing the save removes
+	// them. Overwritten files can't be restored and aren't reported.
+	var missing map[string]bool
+	if r.writesFiles() {
+		if err := r.modes().mkdirAll(filepath.Dir(destPath)); err != nil {
+			return "", fmt.Errorf("failed to create directory for %s: %w", destPath, err)
+		}
+		var files []string
+		for _, output := range outputs {
+			files = append(files, outputFiles(output)...)
+		}
+		missing = missingFiles(files)
+	}
+
 	if op.Crop != nil {
-		return r.executeCrop(ctx, *op.Crop)
+		err = r.executeCrop(ctx, *op.Crop, destPath)
 	} else if op.Pick != nil {
-		return r.executePick(ctx, *op.Pick)
+		err = r.executePick(ctx, *op.Pick, destPath)
+	} else if op.Resize != nil {
+		err = r.executeResize(ctx, *op.Resize, destPath)
+	} else if op.Responsive != nil {
+		err = r.executeResponsive(ctx, *op.Responsive, outputs)
+	} else if op.Straighten != nil {
+		err = r.executeStraighten(ctx, *op.Straighten, destPath)
+	} else if op.AutoCrop != nil {
+		err = r.executeAutoCrop(ctx, *op.AutoCrop, destPath)
+	} else if op.Metadata != nil {
+		err = r.executeMetadata(ctx, *op.Metadata, destPath)
+	} else if op.Animation != nil {
+		err = r.executeAnimation(ctx, *op.Animation, destPath)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(op.Meta) > 0 {
+		if err := r.writeMeta(ctx, op, destPath); err != nil {
+			return "", err
+		}
+	}
+	for _, output := range outputs {
+		for _, path := range outputFiles(output) {
+			if _, err := os.Stat(path); err == nil && missing[path] {
+				reportOutput(ctx, path)
+			}
+		}
+	}
+	return destPath, nil
+}
+
+// writeMeta writes the client metadata of op to a <output>.meta.json
+// sidecar next to its output.
+func (r OperationExecutor) writeMeta(ctx context.Context, op Operation, destPath string) error {
+	data, err := json.MarshalIndent(op.Meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata of %s: %w", op.Filename(), err)
+	}
+	if err := r.writeOutput(ctx, op.Type(), destPath+".meta.json", bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write metadata file: %w", err)
 	}
 	return nil
 }
 
-func (r OperationExecutor) executeCrop(ctx context.Context, op CropOperation) error {
+// plan validates op and returns it as it will be executed, along with the
+// path of its output. It has no side effects.
+func (r OperationExecutor) plan(op Operation) (Operation, string, error) {
+	if op.planned != nil {
+		return op.planned.op, op.planned.destPath, op.planned.err
+	}
+	if err := op.Validate(); err != nil {
+		return op, "", err
+	}
+	if op.Pick == nil {
+		for _, filename := range op.Filenames() {
+			if isVideoFile(sourceName(filename)) {
+				return op, "", fmt.Errorf("%s is a video, which can only be picked, not used by %s operations", filename, op.Type())
+			}
+		}
+	}
+	// Archives are read-only roots, so they have no directory settings.
+	if filename := op.Filename(); !isRemoteSource(filename) && filepath.IsLocal(filename) && r.Archive == nil {
+		settings, err := loadDirSettings(r.BaseDir, filepath.Dir(filename))
+		if err != nil {
+			return op, "", err
+		}
+		op = settings.apply(op)
+	}
+	if r.isTinyCrop(op) {
+		if r.IgnoreTinyCrops {
+			return op, "", nil
+		}
+		return op, "", fmt.Errorf("crop of %s is only %.1f%% x %.1f%% of the image, which looks like an accidental selection; draw a larger one or lower --min-crop-size",
+			op.Crop.Filename, op.Crop.Crop.Width*100, op.Crop.Crop.Height*100)
+	}
+	if r.PreserveFormat {
+		op = r.withSourceFormat(op)
+	}
+	destPath, err := r.destinationPath(op)
+	return op, destPath, err
+}
+
+// isTinyCrop reports whether op is a crop narrower or shorter than
+// MinCropSize.
+func (r OperationExecutor) isTinyCrop(op Operation) bool {
+	if op.Crop == nil || r.MinCropSize <= 0 {
+		return false
+	}
+	return op.Crop.Crop.Width < r.MinCropSize || op.Crop.Crop.Height < r.MinCropSize
+}
+
+// PlannedOutput is where an operation would write its output.
+type PlannedOutput struct {
+	Operation Operation `json:"operation"`
+	// Output is the slash-separated path relative to the output directory.
+	Output string `json:"output,omitempty"`
+	// Outputs lists every output, Output included, of operations that
+	// produce several, like responsive resizes.
+	Outputs []string `json:"outputs,omitempty"`
+	// Exists tells whether an output is already at Output, or at any of
+	// Outputs, and would be overwritten. It's nil when the output backend
+	// can't tell.
+	Exists *bool `json:"exists,omitempty"`
+	// Duplicate is set when an earlier operation of the batch writes to the
+	// same Output.
+	Duplicate bool `json:"duplicate,omitempty"`
+	// Clamped is set when the operation is a crop that extends past its
+	// image and would be shrunk to fit.
+	Clamped *CropClamp `json:"clamped,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// outputExists reports whether the output at path, named name relative to
+// the output directory, is already stored, and false for known when the
+// output backend can't tell.
+func (r OperationExecutor) outputExists(name, path string) (exists, known bool) {
+	if r.Output == nil {
+		_, err := os.Stat(path)
+		return err == nil, true
+	}
+	checker, ok := r.Output.(outputChecker)
+	if !ok {
+		return false, false
+	}
+	exists, err := checker.Exists(context.Background(), name)
+	if err != nil {
+		log.Warn().Err(err).Str("output", name).Msg("failed to check whether output exists")
+		return false, false
+	}
+	return exists, true
+}
+
+// Plan returns the output each of ops would produce without executing
+// anything, flagging outputs that already exist or collide within the batch.
+func (r OperationExecutor) Plan(ops []Operation) []PlannedOutput {
+	planned := make([]PlannedOutput, 0, len(ops))
+	seen := map[string]bool{}
+	ops = slices.Clone(ops)
+	numberPicks(ops)
+	if r.OnConflict == ConflictRename {
+		claims := newOutputClaims(r.OnConflict)
+		for i := range ops {
+			ops[i], _, _ = claims.claim(context.Background(), r, ops[i])
+		}
+	}
+	for _, op := range ops {
+		entry := PlannedOutput{Operation: op}
+		op, destPath, err := r.plan(op)
+		if err == nil && destPath != "" {
+			entry.Clamped, err = r.plannedCropClamp(op)
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		} else if destPath != "" {
+			outputs := r.outputPaths(op, destPath)
+			anyExists, allKnown := false, true
+			for _, output := range outputs {
+				relPath, err := filepath.Rel(r.OutputDir, output)
+				if err != nil {
+					relPath = output
+				}
+				entry.Outputs = append(entry.Outputs, filepath.ToSlash(relPath))
+				exists, known := r.outputExists(filepath.ToSlash(relPath), output)
+				anyExists = anyExists || exists
+				allKnown = allKnown && known
+			}
+			if anyExists || allKnown {
+				entry.Exists = &anyExists
+			}
+			entry.Output = entry.Outputs[0]
+			if len(outputs) == 1 {
+				entry.Outputs = nil
+			}
+			entry.Duplicate = seen[destPath]
+			seen[destPath] = true
+		}
+		planned = append(planned, entry)
+	}
+	return planned
+}
+
+// plannedCropClamp returns how a crop would be clamped to its image, or nil
+// when it fits or op isn't a crop. Only the dimensions of the source are
+// read. Crops of remote or archived sources and of croppers other than
+// ImagingCropper aren't checked.
+func (r OperationExecutor) plannedCropClamp(op Operation) (*CropClamp, error) {
+	cropper, ok := r.Cropper.(*ImagingCropper)
+	if !ok || op.Crop == nil || isRemoteSource(op.Crop.Filename) || r.Archive != nil {
+		return nil, nil
+	}
+	sourcePath, err := r.sourcePath(op.Crop.Filename)
+	if err != nil {
+		return nil, err
+	}
+	width, height, err := imageDimensions(sourcePath, cropper.Orientation)
+	if err != nil {
+		return nil, err
+	}
+	ctx, clamps := withCropClamps(context.Background())
+	if _, err := cropper.cropRect(ctx, *op.Crop, op.Crop.bounds(width, height)); err != nil {
+		return nil, fmt.Errorf("failed to crop %s: %w", op.Crop.Filename, err)
+	}
+	if list := clamps.list(); len(list) > 0 {
+		return &list[0], nil
+	}
+	return nil, nil
+}
+
+// destinationPath returns the path the output of op is written to. Picks
+// keep their path relative to the base directory unless Flatten is set,
+// while crops are named after the source file and the crop rectangle. All
+// outputs are placed under the optional OutputPrefix inside the output
+// directory, and under the operation's own OutputDir inside that. Names
+// that would exceed the platform's path limits are truncated, keeping their
+// extension and crop suffix.
+func (r OperationExecutor) destinationPath(op Operation) (string, error) {
+	if filename := op.Filename(); !isRemoteSource(filename) && !filepath.IsLocal(filename) {
+		return "", fmt.Errorf("invalid source filename %q", filename)
+	}
+
+	outputDir := filepath.Join(r.OutputDir, r.OutputPrefix, filepath.FromSlash(op.OutputDir), op.Label)
+	var stem, suffix string
+	// siblings are the suffixes of the other outputs of op.
+	var siblings []string
+	switch {
+	case op.Crop != nil:
+		stem = filepath.Base(sourceName(op.Crop.Filename))
+		id, err := r.cropID(*op.Crop)
+		if err != nil {
+			return "", err
+		}
+		suffix = "-" + id
+		if op.Crop.Bleed > 0 {
+			suffix += "-bleed" + strconv.FormatFloat(op.Crop.Bleed, 'f', -1, 64)
+		}
+		if op.Crop.Rotate != 0 {
+			suffix += "-rot" + strconv.FormatFloat(op.Crop.Rotate, 'f', -1, 64)
+		}
+		suffix += r.cropExtension(op.Crop.Format)
+	case op.Pick != nil:
+		name := sourceName(op.Pick.Filename)
+		if op.Pick.Favorite {
+			outputDir = filepath.Join(outputDir, r.favoritesDir())
+		}
+		if !r.Flatten {
+			outputDir = filepath.Join(outputDir, r.outputSubdir(filepath.Dir(name)))
+		}
+		base := filepath.Base(name)
+		suffix = filepath.Ext(base)
+		stem = strings.TrimSuffix(base, suffix)
+		// Picks made for CropKeepsOriginal aren't numbered and keep their name.
+		if r.Rename != nil && op.ordinal > 0 {
+			stem = r.Rename.Name(op.ordinal)
+		}
+	case op.Metadata != nil:
+		name := sourceName(op.Metadata.Filename)
+		if !r.Flatten {
+			outputDir = filepath.Join(outputDir, r.outputSubdir(filepath.Dir(name)))
+		}
+		stem = filepath.Base(name)
+		suffix = ".exif.json"
+	case op.Resize != nil:
+		stem = filepath.Base(sourceName(op.Resize.Filename))
+		suffix = fmt.Sprintf("-%dx%d%s", op.Resize.Width, op.Resize.Height, r.cropExtension(op.Resize.Format))
+	case op.Responsive != nil:
+		// This is the output of the first width, the others are named
+		// like it by outputPaths.
+		stem = filepath.Base(sourceName(op.Responsive.Filename))
+		ext := r.cropExtension(op.Responsive.Format)
+		suffix = responsiveSuffix(op.Responsive.Widths[0], ext)
+		for _, width := range op.Responsive.Widths[1:] {
+			siblings = append(siblings, responsiveSuffix(width, ext))
+		}
+	case op.Straighten != nil:
+		stem = filepath.Base(sourceName(op.Straighten.Filename))
+		suffix = fmt.Sprintf("-straight%s%s", strconv.FormatFloat(op.Straighten.Angle, 'f', -1, 64), r.cropExtension(op.Straighten.Format))
+	case op.Animation != nil:
+		// Animations of the same first frame are told apart by the rest of
+		// their frames and settings.
+		stem = filepath.Base(sourceName(op.Animation.Filenames[0]))
+		id := crc32.ChecksumIEEE(fmt.Appendf(nil, "%q %d %d", op.Animation.Filenames, op.Animation.Delay, op.Animation.Size))
+		suffix = fmt.Sprintf("-anim-%08x.gif", id)
+	case op.AutoCrop != nil:
+		focus := op.AutoCrop.Focus
+		if focus == "" {
+			focus = FocusCenter
+		}
+		stem = filepath.Base(sourceName(op.AutoCrop.Filename))
+		suffix = fmt.Sprintf("-%s%s%s", focus, strconv.FormatFloat(op.AutoCrop.Aspect, 'f', -1, 64), r.cropExtension(op.AutoCrop.Format))
+	default:
+		return "", nil
+	}
+	if r.NormalizeNames {
+		stem = normalizeName(stem)
+		suffix = strings.ToLower(suffix)
+		for i, sibling := range siblings {
+			siblings[i] = strings.ToLower(sibling)
+		}
+	}
+	if op.conflict > 0 {
+		stem += "-" + strconv.Itoa(op.conflict)
+	}
+	return fitOutputPath(outputDir, stem, suffix, siblings...)
+}
+
+// outputPaths returns the paths of every output of op, given the path of
+// its output from destinationPath. Responsive operations have one per
+// width, named like destPath; other operations only have destPath.
+func (r OperationExecutor) outputPaths(op Operation, destPath string) []string {
+	if op.Responsive == nil || destPath == "" {
+		return []string{destPath}
+	}
+	ext := filepath.Ext(destPath)
+	prefix := strings.TrimSuffix(destPath, responsiveSuffix(op.Responsive.Widths[0], ext))
+	paths := make([]string, len(op.Responsive.Widths))
+	for i, width := range op.Responsive.Widths {
+		paths[i] = prefix + responsiveSuffix(width, ext)
+	}
+	return paths
+}
+
+// responsiveSuffix is the suffix of the output of a responsive operation
+// for width, such as -640w.jpg, after the w descriptor of srcset.
+func responsiveSuffix(width int, ext string) string {
+	return fmt.Sprintf("-%dw%s", width, ext)
+}
+
+// cropID returns the crop suffix of op's output name, identifying its
+// source as configured by the CropIDs scope.
+func (r OperationExecutor) cropID(op CropOperation) (string, error) {
+	var source string
+	switch r.CropIDs.Scope {
+	case "path":
+		source = filepath.ToSlash(op.Filename)
+	case "content":
+		if isRemoteSource(op.Filename) {
+			// Hashing would mean downloading it here, the URL is as unique.
+			source = op.Filename
+			break
+		}
+		var sum string
+		var err error
+		if r.Archive != nil {
+			sum, err = r.Archive.hash(op.Filename, sha256.New())
+		} else {
+			sum, err = hashFile(filepath.Join(r.BaseDir, op.Filename), sha256.New())
+		}
+		if err != nil {
+			return "", err
+		}
+		source = "sha256:" + sum
+	}
+	return r.CropIDs.SourceID(op.Crop, source), nil
+}
+
+func (r OperationExecutor) executeCrop(ctx context.Context, op CropOperation, croppedPath string) error {
 	log.Ctx(ctx).Info().Str("filename", op.Filename).Msg("cropping")
-	sourcePath := filepath.Join(r.BaseDir, op.Filename)
-	f, err := os.Open(sourcePath)
+	start := time.Now()
+	f, err := r.openSource(ctx, op.Filename)
 	if err != nil {
-		return fmt.Errorf("failed to open file %s: %w", sourcePath, err)
+		return err
+	}
+	defer f.Close()
+	open := time.Since(start)
+
+	var b bytes.Buffer
+	var timings CropTimings
+	if timed, ok := r.Cropper.(TimedCropper); ok {
+		timings, err = timed.CropTimed(ctx, f, &b, op)
+	} else {
+		err = r.Cropper.Crop(ctx, f, &b, op)
+	}
+	if err != nil {
+		return err
+	}
+
+	start = time.Now()
+	size := b.Len()
+	if err := r.writeOutput(ctx, "crop", croppedPath, &b); err != nil {
+		return fmt.Errorf("failed to write cropped file: %w", err)
+	}
+	log.Ctx(ctx).Info().
+		Str("filename", op.Filename).
+		Str("output", croppedPath).
+		Int("size", size).
+		Msg("wrote output")
+	log.Ctx(ctx).Debug().
+		Str("filename", op.Filename).
+		Dur("open", open).
+		Dur("wait", timings.Wait).
+		Dur("decode", timings.Decode).
+		Dur("crop", timings.Crop).
+		Dur("encode", timings.Encode).
+		Dur("write", time.Since(start)).
+		Msg("crop timings")
+
+	if r.Provenance {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind %s: %w", op.Filename, err)
+		}
+		data, err := cropProvenanceJSON(f, op, r.Orientation)
+		if err != nil {
+			return err
+		}
+		if err := r.writeOutput(ctx, "crop", croppedPath+".json", bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("failed to write provenance file: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r OperationExecutor) executeResize(ctx context.Context, op ResizeOperation, resizedPath string) error {
+	log.Ctx(ctx).Info().Str("filename", op.Filename).Msg("resizing")
+	resizer, ok := r.Cropper.(Resizer)
+	if !ok {
+		return fmt.Errorf("cropper %T does not support resizing", r.Cropper)
+	}
+
+	background := r.PadColor
+	if op.Background != "" {
+		c, err := parseColor(op.Background)
+		if err != nil {
+			return err
+		}
+		background = c
+	}
+	if background == nil {
+		background = color.White
+	}
+
+	f, err := r.openSource(ctx, op.Filename)
+	if err != nil {
+		return err
 	}
 	defer f.Close()
 	var b bytes.Buffer
-	if err := r.Cropper.Crop(ctx, f, &b, op.Crop); err != nil {
+	if err := resizer.FitPadded(ctx, f, &b, op, background); err != nil {
+		return err
+	}
+
+	if err := r.writeOutput(ctx, "resize", resizedPath, &b); err != nil {
+		return fmt.Errorf("failed to write resized file: %w", err)
+	}
+	return nil
+}
+
+func (r OperationExecutor) executeResponsive(ctx context.Context, op ResponsiveOperation, paths []string) error {
+	log.Ctx(ctx).Info().Str("filename", op.Filename).Ints("widths", op.Widths).Msg("resizing to widths")
+	resizer, ok := r.Cropper.(ResponsiveResizer)
+	if !ok {
+		return fmt.Errorf("cropper %T does not support responsive resizing", r.Cropper)
+	}
+
+	f, err := r.openSource(ctx, op.Filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufs := make([]bytes.Buffer, len(op.Widths))
+	ws := make([]io.Writer, len(bufs))
+	for i := range bufs {
+		ws[i] = &bufs[i]
+	}
+	if err := resizer.ResizeWidths(ctx, f, ws, op); err != nil {
 		return err
 	}
 
-	newName := fmt.Sprintf("%s-%s.jpg", filepath.Base(op.Filename), op.Crop.ID())
-	croppedPath := filepath.Join(r.OutputDir, newName)
-	wf, err := os.Create(croppedPath)
+	for i, path := range paths {
+		if err := r.writeOutput(ctx, "responsive", path, &bufs[i]); err != nil {
+			return fmt.Errorf("failed to write resized file: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r OperationExecutor) executeStraighten(ctx context.Context, op StraightenOperation, straightenedPath string) error {
+	log.Ctx(ctx).Info().Str("filename", op.Filename).Float64("angle", op.Angle).Msg("straightening")
+	straightener, ok := r.Cropper.(Straightener)
+	if !ok {
+		return fmt.Errorf("cropper %T does not support straightening", r.Cropper)
+	}
+
+	f, err := r.openSource(ctx, op.Filename)
 	if err != nil {
-		return fmt.Errorf("failed to create cropped file %s: %w", newName, err)
+		return err
+	}
+	defer f.Close()
+	var b bytes.Buffer
+	if err := straightener.Straighten(ctx, f, &b, op); err != nil {
+		return err
+	}
+
+	if err := r.writeOutput(ctx, "straighten", straightenedPath, &b); err != nil {
+		return fmt.Errorf("failed to write straightened file: %w", err)
+	}
+	return nil
+}
+
+func (r OperationExecutor) executeAutoCrop(ctx context.Context, op AutoCropOperation, croppedPath string) error {
+	log.Ctx(ctx).Info().Str("filename", op.Filename).Str("focus", op.Focus).Msg("auto cropping")
+	autoCropper, ok := r.Cropper.(AutoCropper)
+	if !ok {
+		return fmt.Errorf("cropper %T does not support auto cropping", r.Cropper)
+	}
+
+	f, err := r.openSource(ctx, op.Filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var b bytes.Buffer
+	if err := autoCropper.AutoCrop(ctx, f, &b, op); err != nil {
+		return err
+	}
+
+	if err := r.writeOutput(ctx, "autocrop", croppedPath, &b); err != nil {
+		return fmt.Errorf("failed to write cropped file: %w", err)
+	}
+	return nil
+}
+
+func (r OperationExecutor) executeMetadata(ctx context.Context, op MetadataOperation, destPath string) error {
+	log.Ctx(ctx).Info().Str("filename", op.Filename).Msg("extracting metadata")
+	f, err := r.openSource(ctx, op.Filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := exifMetadataJSON(f)
+	if err != nil {
+		return fmt.Errorf("failed to extract metadata of %s: %w", op.Filename, err)
+	}
+	if err := r.writeOutput(ctx, "metadata", destPath, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write metadata file: %w", err)
+	}
+	return nil
+}
+
+func (r OperationExecutor) executeAnimation(ctx context.Context, op AnimationOperation, destPath string) error {
+	log.Ctx(ctx).Info().Str("filename", op.Filenames[0]).Int("frames", len(op.Filenames)).Msg("animating")
+	animator, ok := r.Cropper.(Animator)
+	if !ok {
+		return fmt.Errorf("cropper %T does not support animations", r.Cropper)
+	}
+
+	open := func(filename string) (io.ReadCloser, error) {
+		return r.openSource(ctx, filename)
+	}
+	var b bytes.Buffer
+	if err := animator.Animate(ctx, open, &b, op); err != nil {
+		return err
 	}
-	defer wf.Close()
-	if _, err := b.WriteTo(wf); err != nil {
-		return fmt.Errorf("failed to write cropped data to file %s: %w", newName, err)
+
+	if err := r.writeOutput(ctx, "animation", destPath, &b); err != nil {
+		return fmt.Errorf("failed to write animation: %w", err)
 	}
 	return nil
 }
 
-func (r OperationExecutor) executePick(ctx context.Context, op PickOperation) error {
+func (r OperationExecutor) recordHistory(op Operation, destPath string) error {
+	relPath, err := filepath.Rel(r.History.Root, destPath)
+	if err != nil {
+		return fmt.Errorf("failed to get relative path: %w", err)
+	}
+	return r.History.Record(CropHistoryEntry{
+		Filename:  op.Filename(),
+		Operation: op,
+		Output:    filepath.ToSlash(relPath),
+		SavedAt:   time.Now().UTC(),
+	})
+}
+
+// withSourceFormat returns op with its output format set to the format of
+// its source file, unless the operation already sets one or the source
+// isn't in a supported output format.
+func (r OperationExecutor) withSourceFormat(op Operation) Operation {
+	format, err := r.sourceFormat(op.Filename())
+	if err != nil {
+		return op
+	}
+	switch {
+	case op.Crop != nil && op.Crop.Format == "":
+		crop := *op.Crop
+		crop.Format = format
+		op.Crop = &crop
+	case op.Resize != nil && op.Resize.Format == "":
+		resize := *op.Resize
+		resize.Format = format
+		op.Resize = &resize
+	case op.Responsive != nil && op.Responsive.Format == "":
+		responsive := *op.Responsive
+		responsive.Format = format
+		op.Responsive = &responsive
+	case op.Straighten != nil && op.Straighten.Format == "":
+		straighten := *op.Straighten
+		straighten.Format = format
+		op.Straighten = &straighten
+	case op.AutoCrop != nil && op.AutoCrop.Format == "":
+		autoCrop := *op.AutoCrop
+		autoCrop.Format = format
+		op.AutoCrop = &autoCrop
+	}
+	return op
+}
+
+// isUpToDate reports whether every one of destPaths exists and was
+// modified after every source file. Remote sources are never considered up
+// to date since their modification time isn't known.
+func (r OperationExecutor) isUpToDate(filenames []string, destPaths ...string) bool {
+	for _, filename := range filenames {
+		if isRemoteSource(filename) {
+			return false
+		}
+		source, err := r.statSource(filename)
+		if err != nil {
+			return false
+		}
+		// Directory settings change the quality and format of crops
+		// without changing the output name, so editing them makes the
+		// outputs of their folder stale too.
+		changed := source.ModTime()
+		if r.Archive == nil && filepath.IsLocal(filename) {
+			if settings := dirSettingsModTime(r.BaseDir, filepath.Dir(filename)); settings.After(changed) {
+				changed = settings
+			}
+		}
+		for _, destPath := range destPaths {
+			dest, err := os.Stat(destPath)
+			if err != nil || !dest.ModTime().After(changed) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (r OperationExecutor) favoritesDir() string {
+	if r.FavoritesDir != "" {
+		return r.FavoritesDir
+	}
+	return "favorites"
+}
+
+// cropExtension returns the extension for cropped files. An explicit
+// per-operation format wins, otherwise the cropper is asked when it knows
+// the format it encodes to.
+func (r OperationExecutor) cropExtension(format OutputFormat) string {
+	if format != "" {
+		return format.Extension()
+	}
+	if c, ok := r.Cropper.(interface{ Extension() string }); ok {
+		return c.Extension()
+	}
+	return ".jpg"
+}
+
+func (r OperationExecutor) executePick(ctx context.Context, op PickOperation, savePath string) error {
 	log.Ctx(ctx).Info().Str("filename", op.Filename).Msg("picking")
-	sourcePath := filepath.Join(r.BaseDir, op.Filename)
-	savePath := filepath.Join(r.OutputDir, op.Filename)
-	if err := copyFile(sourcePath, savePath); err != nil {
+	if err := r.copyPick(ctx, op, savePath); err != nil {
+		return err
+	}
+	// Entries added to archives and uploads have no file to measure.
+	if r.writesFiles() {
+		r.logOutputSize(ctx, op.Filename, savePath)
+	}
+	if r.IncludeSidecars {
+		if err := r.copySidecars(ctx, op.Filename, savePath); err != nil {
+			return err
+		}
+	}
+	return r.copyCompanions(ctx, op.Filename, savePath)
+}
+
+// logOutputSize logs the size of the output at path made from filename, so
+// outputs that came out unexpectedly large or small stand out.
+func (r OperationExecutor) logOutputSize(ctx context.Context, filename, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("output", path).Msg("failed to stat output")
+		return
+	}
+	log.Ctx(ctx).Info().
+		Str("filename", filename).
+		Str("output", path).
+		Int64("size", info.Size()).
+		Msg("wrote output")
+}
+
+// copyPick writes the source of op to savePath, downscaling it when it's
+// larger than MaxPickDimension.
+func (r OperationExecutor) copyPick(ctx context.Context, op PickOperation, savePath string) error {
+	// Videos are always copied as they are.
+	if r.MaxPickDimension > 0 && !isVideoFile(sourceName(op.Filename)) {
+		if downscaled, err := r.downscalePick(ctx, op, savePath); err != nil || downscaled {
+			return err
+		}
+	}
+	if r.ResumableCopy && r.writesFiles() && !isRemoteSource(op.Filename) && r.Archive == nil {
+		sourcePath, err := r.sourcePath(op.Filename)
+		if err != nil {
+			return err
+		}
+		if err := copyFileResumable(ctx, sourcePath, savePath, r.TempDir, r.budget, r.modes()); err != nil {
+			return fmt.Errorf("failed to pick file %s: %w", op.Filename, err)
+		}
+		return nil
+	}
+	f, err := r.openSource(ctx, op.Filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := r.writeOutput(ctx, "pick", savePath, f); err != nil {
 		return fmt.Errorf("failed to pick file %s: %w", op.Filename, err)
 	}
 	return nil
 }
 
-func copyFile(sourcePath, destPath string) error {
-	sourceFile, err := os.Open(sourcePath)
+// downscalePick writes the source of op, downscaled to MaxPickDimension, to
+// savePath when it's larger than that, and reports whether it did. Only the
+// header is read from sources within the limit, which are left to be copied,
+// like sources that aren't images it can decode or encode, such as videos.
+func (r OperationExecutor) downscalePick(ctx context.Context, op PickOperation, savePath string) (bool, error) {
+	f, err := r.openSource(ctx, op.Filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		log.Ctx(ctx).Debug().Err(err).Str("filename", op.Filename).Msg("not an image that can be downscaled, copying it")
+		return false, nil
+	}
+	if max(config.Width, config.Height) <= r.MaxPickDimension {
+		return false, nil
+	}
+
+	downscaler, ok := r.Cropper.(Downscaler)
+	if !ok {
+		return false, fmt.Errorf("cropper %T does not support downscaling", r.Cropper)
+	}
+	// The pick keeps the name, and so the format, of its source.
+	format, err := extensionFormat(sourceName(op.Filename))
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("filename", op.Filename).Msg("can't downscale to the maximum pick dimension, copying it at full size")
+		return false, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, fmt.Errorf("failed to rewind %s: %w", op.Filename, err)
+	}
+	var b bytes.Buffer
+	if err := downscaler.Downscale(ctx, f, &b, op.Filename, r.MaxPickDimension, format); err != nil {
+		return false, err
+	}
+	if err := r.writeOutput(ctx, "pick", savePath, &b); err != nil {
+		return false, fmt.Errorf("failed to pick file %s: %w", op.Filename, err)
+	}
+	log.Ctx(ctx).Info().
+		Str("filename", op.Filename).
+		Int("width", config.Width).
+		Int("height", config.Height).
+		Int("max", r.MaxPickDimension).
+		Msg("downscaled pick larger than the maximum dimension")
+	return true, nil
+}
+
+// writeOutput stores an output of an operation of type opType at destPath
+// with the output backend, or adds it to the type's archive when outputs
+// are zipped. Both name it by its path relative to the output directory.
+func (r OperationExecutor) writeOutput(ctx context.Context, opType, destPath string, rd io.Reader) error {
+	relPath, err := filepath.Rel(r.OutputDir, destPath)
 	if err != nil {
-		return fmt.Errorf("failed to open source file %s: %w", sourcePath, err)
+		return fmt.Errorf("failed to get relative path: %w", err)
+	}
+	if r.zips != nil {
+		return r.zips.Add(opType, relPath, rd)
+	}
+	return r.output().Write(ctx, filepath.ToSlash(relPath), rd)
+}
+
+// output returns the backend outputs are stored with, which writes them to
+// OutputDir unless another one is set.
+func (r OperationExecutor) output() OutputBackend {
+	if r.Output != nil {
+		return r.Output
+	}
+	return fileOutput{dir: r.OutputDir, tempDir: r.TempDir, budget: r.budget, modes: r.modes()}
+}
+
+func (r OperationExecutor) modes() outputModes {
+	return outputModes{file: r.FileMode, dir: r.DirMode}
+}
+
+// writesFiles reports whether outputs are written as files to OutputDir,
+// rather than added to archives or stored elsewhere, so they can be
+// measured, compared against their sources and removed again.
+func (r OperationExecutor) writesFiles() bool {
+	return r.zips == nil && r.Output == nil
+}
+
+// sourcePath resolves a local operation filename against BaseDir, rejecting
+// names that would escape it.
+func (r OperationExecutor) sourcePath(filename string) (string, error) {
+	if !filepath.IsLocal(filename) {
+		return "", fmt.Errorf("invalid source filename %q", filename)
+	}
+	return filepath.Join(r.BaseDir, filename), nil
+}
+
+// openSource opens the source of an operation, downloading it first when
+// it's a URL and remote sources are enabled.
+func (r OperationExecutor) openSource(ctx context.Context, filename string) (io.ReadSeekCloser, error) {
+	if isRemoteSource(filename) {
+		if r.Remote == nil {
+			return nil, fmt.Errorf("remote source %s not allowed, enable remote sources with --allow-remote", filename)
+		}
+		return r.Remote.Fetch(ctx, filename)
 	}
-	defer sourceFile.Close()
 
-	destFile, err := os.Create(destPath)
+	if r.Archive != nil {
+		return r.Archive.Open(filename)
+	}
+	sourcePath, err := r.sourcePath(filename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(sourcePath)
 	if err != nil {
-		return fmt.Errorf("failed to create destination file %s: %w", destPath, err)
+		return nil, fmt.Errorf("failed to open file %s: %w", sourcePath, err)
 	}
-	defer destFile.Close()
+	return f, nil
+}
 
-	if _, err := io.Copy(destFile, sourceFile); err != nil {
-		return fmt.Errorf("failed to copy file from %s to %s: %w", sourcePath, destPath, err)
+// sourceFormat returns the format of a source. Local sources are told by
+// their decoded header, so a PNG saved as .jpg stays a PNG. Remote sources
+// are only downloaded to be executed, and are told by their extension.
+func (r OperationExecutor) sourceFormat(filename string) (OutputFormat, error) {
+	if isRemoteSource(filename) {
+		return extensionFormat(sourceName(filename))
+	}
+	f, err := r.openSource(context.Background(), filename)
+	if err != nil {
+		return "", err
 	}
+	defer f.Close()
+	_, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to read image format of %s: %w", filename, err)
+	}
+	return ParseOutputFormat(format)
+}
 
+// statSource returns the file info of a local source.
+func (r OperationExecutor) statSource(filename string) (os.FileInfo, error) {
+	if r.Archive != nil {
+		return r.Archive.Stat(filename)
+	}
+	sourcePath, err := r.sourcePath(filename)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(sourcePath)
+}
+
+// sourceName returns the name used to derive the output name of a source:
+// the filename itself for local files or the last URL segment for remote ones.
+func sourceName(filename string) string {
+	if isRemoteSource(filename) {
+		return remoteSourceName(filename)
+	}
+	return filename
+}
+
+// writeFile writes r to destPath atomically. The contents are staged in a
+// temporary file in tempDir, or next to destPath when tempDir is empty, and
+// then moved into place, so a crash never leaves a half-written output.
+func writeFile(destPath, tempDir string, r io.Reader, budget *outputBudget, modes outputModes) error {
+	if tempDir == "" {
+		tempDir = filepath.Dir(destPath)
+	}
+	tmp, err := os.CreateTemp(tempDir, ".pickemall-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %w", destPath, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write file %s: %w", destPath, err)
+	}
+	// The staged file is removed if it doesn't fit, so it never reaches
+	// the output.
+	if err := budget.reserve(n); err != nil {
+		tmp.Close()
+		return fmt.Errorf("not writing %s: %w", destPath, err)
+	}
+	if err := tmp.Chmod(modes.fileMode()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions of %s: %w", destPath, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", destPath, err)
+	}
+
+	if err := os.Rename(tmp.Name(), destPath); err != nil {
+		// The temp dir may be on another file system, where renames fail.
+		return moveFile(tmp.Name(), destPath, modes)
+	}
 	return nil
 }
+
+// moveFile moves sourcePath to destPath when they may be on different file
+// systems. It's copied to a temporary file next to destPath, which is then
+// renamed into place, so destPath is never left half-written either.
+func moveFile(sourcePath, destPath string, modes outputModes) error {
+	src, err := os.Open(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", sourcePath, err)
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(destPath), ".pickemall-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %w", destPath, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write file %s: %w", destPath, err)
+	}
+	if err := tmp.Chmod(modes.fileMode()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions of %s: %w", destPath, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", destPath, err)
+	}
+	if err := os.Rename(tmp.Name(), destPath); err != nil {
+		return fmt.Errorf("failed to move file into place at %s: %w", destPath, err)
+	}
+	return os.Remove(sourcePath)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+// OrientationPolicy controls whether the EXIF orientation of JPEGs is
+// applied. It's used consistently for listed dimensions, viewed images and
+// crops, so crop coordinates picked in the UI match the image they're
+// applied to.
+type OrientationPolicy string
+
+const (
+	// OrientationEXIF rotates images as their EXIF orientation says, like
+	// browsers do. It's the default.
+	OrientationEXIF OrientationPolicy = "exif"
+	// OrientationIgnore treats every image as stored, ignoring its EXIF
+	// orientation.
+	OrientationIgnore OrientationPolicy = "ignore"
+)
+
+func ParseOrientationPolicy(s string) (OrientationPolicy, error) {
+	switch OrientationPolicy(s) {
+	case "", OrientationEXIF:
+		return OrientationEXIF, nil
+	case OrientationIgnore:
+		return OrientationIgnore, nil
+	default:
+		return "", fmt.Errorf("unsupported orientation policy %q, expected exif or ignore", s)
+	}
+}
+
+// applies reports whether the EXIF orientation should be applied. The zero
+// value applies it.
+func (p OrientationPolicy) applies() bool {
+	return p != OrientationIgnore
+}
+
+// applyOrientation transforms img, as stored, the way the EXIF orientation
+// orientation says it should be displayed.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+// clearOrientation sets the EXIF orientation tag of the JPEG in data to 1
+// (as stored) in place, so viewers show the image without rotating it. It
+// reports whether a tag was found.
+func clearOrientation(data []byte) bool {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return false
+	}
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return false
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			pos++
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			pos += 2
+			continue
+		}
+		if marker == 0xDA {
+			return false
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return false
+		}
+		payload := data[pos+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(payload, []byte(exifHeaderSignature)) {
+			return clearTIFFOrientation(payload[len(exifHeaderSignature):])
+		}
+		pos = end
+	}
+	return false
+}
+
+// clearTIFFOrientation sets the orientation tag in IFD0 of a TIFF block to 1.
+func clearTIFFOrientation(tiff []byte) bool {
+	if len(tiff) < 8 {
+		return false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return false
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset+2 > len(tiff) {
+		return false
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := range count {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return false
+		}
+		// Orientation is a single SHORT stored inline in the value field.
+		if order.Uint16(tiff[entry:]) == exifTagOrientation && order.Uint16(tiff[entry+2:]) == 3 {
+			order.PutUint16(tiff[entry+8:], 1)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+)
+
+// OutputBackend stores the outputs of operations. Output paths are planned
+// under the executor's OutputDir either way, and backends receive them
+// relative to it.
+type OutputBackend interface {
+	// Write stores the contents of r as the output name, a slash-separated
+	// path relative to the output directory, replacing any earlier output
+	// with that name.
+	Write(ctx context.Context, name string, r io.Reader) error
+}
+
+// outputChecker is implemented by backends that can tell whether an output
+// is already stored, so plans can flag the outputs they'd replace.
+type outputChecker interface {
+	// Exists reports whether the output name, a slash-separated path
+	// relative to the output directory, is stored.
+	Exists(ctx context.Context, name string) (bool, error)
+}
+
+// fileOutput is the default backend, which writes outputs as files in the
+// output directory.
+type fileOutput struct {
+	dir     string
+	tempDir string
+	budget  *outputBudget
+	modes   outputModes
+}
+
+func (o fileOutput) Write(ctx context.Context, name string, r io.Reader) error {
+	return writeFile(filepath.Join(o.dir, filepath.FromSlash(name)), o.tempDir, r, o.budget, o.modes)
+}
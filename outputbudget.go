@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// errOutputBudgetExceeded is returned for outputs that would take the total
+// output size of a run past its limit.
+var errOutputBudgetExceeded = errors.New("output size limit reached")
+
+// outputBudget tracks the bytes written by the concurrent operations of a
+// run against a limit. A nil budget is unlimited.
+type outputBudget struct {
+	limit    int64
+	used     atomic.Int64
+	exceeded atomic.Bool
+}
+
+// newOutputBudget returns a budget of limit bytes, or nil (no limit) when
+// limit is not positive.
+func newOutputBudget(limit int64) *outputBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &outputBudget{limit: limit}
+}
+
+// reserve claims n bytes for an output, or fails with
+// errOutputBudgetExceeded if they don't fit in what's left. Once an output
+// doesn't fit, the budget stays exceeded, even if smaller outputs would.
+func (b *outputBudget) reserve(n int64) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		used := b.used.Load()
+		if used+n > b.limit {
+			b.exceeded.Store(true)
+			return fmt.Errorf("%w: %d more bytes would bring the output to %d bytes, over the limit of %d", errOutputBudgetExceeded, n, used+n, b.limit)
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			return nil
+		}
+	}
+}
+
+// Exceeded reports whether an output has been refused.
+func (b *outputBudget) Exceeded() bool {
+	return b != nil && b.exceeded.Load()
+}
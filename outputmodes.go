@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Default permissions of outputs, which are reduced by the umask like
+// those of any new file.
+const (
+	defaultFileMode os.FileMode = 0644
+	defaultDirMode  os.FileMode = 0755
+)
+
+// outputModes are the permissions outputs and the directories holding them
+// are created with. Modes that are set are applied regardless of the umask,
+// so group-writable modes stick on shared servers; zero ones default to
+// defaultFileMode and defaultDirMode. Only files and directories that are
+// created get them, since changing the mode of those owned by someone else
+// fails.
+type outputModes struct {
+	file os.FileMode
+	dir  os.FileMode
+}
+
+// parseMode parses an octal permission mode such as 0664. An empty mode is
+// zero, which keeps the default.
+func parseMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("invalid permission mode %q, expected octal permissions such as 0664", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+func (m outputModes) fileMode() os.FileMode {
+	if m.file == 0 {
+		return defaultFileMode
+	}
+	return m.file
+}
+
+// mkdirAll creates path and its missing parents with the directory mode.
+func (m outputModes) mkdirAll(path string) error {
+	if m.dir == 0 {
+		return os.MkdirAll(path, defaultDirMode)
+	}
+	var missing []string
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		missing = append(missing, dir)
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	if err := os.MkdirAll(path, m.dir); err != nil {
+		return err
+	}
+	for _, dir := range missing {
+		if err := os.Chmod(dir, m.dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// create creates or truncates the file at path, like os.Create, with the
+// file mode when it's a new file.
+func (m outputModes) create(path string) (*os.File, error) {
+	return m.openFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+// openFile opens the file at path like os.OpenFile, with the file mode
+// when flag creates it.
+func (m outputModes) openFile(path string, flag int) (*os.File, error) {
+	_, statErr := os.Stat(path)
+	f, err := os.OpenFile(path, flag, m.fileMode())
+	if err != nil {
+		return nil, err
+	}
+	if m.file != 0 && os.IsNotExist(statErr) {
+		if err := f.Chmod(m.file); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// writeFile writes data to the file at path, like os.WriteFile, with the
+// file mode when it's a new file.
+func (m outputModes) writeFile(path string, data []byte) error {
+	f, err := m.create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+)
+
+// pathLimits returns the maximum length in bytes of a single path component
+// and of a whole path on the current platform.
+func pathLimits() (maxName, maxPath int) {
+	switch runtime.GOOS {
+	case "windows":
+		return 255, 259 // MAX_PATH minus the terminating NUL
+	case "darwin":
+		return 255, 1023
+	default: // "linux", "freebsd", "openbsd", "netbsd"
+		return 255, 4095
+	}
+}
+
+// fitOutputPath joins dir and stem+suffix, truncating stem when the file
+// name or the whole path would exceed the platform limits. The suffix, which
+// holds the crop hash and the extension, is always preserved. If even an
+// empty-ish stem doesn't fit, the directory itself is too deep and an error
+// is returned. siblings are the suffixes of other outputs that share the
+// stem, such as the other widths of a responsive operation, and stem is
+// truncated so that it fits with the longest of them too.
+func fitOutputPath(dir, stem, suffix string, siblings ...string) (string, error) {
+	maxName, maxPath := pathLimits()
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve output directory %s: %w", dir, err)
+	}
+
+	room := min(maxName, maxPath-len(absDir)-1)
+	longest := suffix
+	for _, sibling := range siblings {
+		if len(sibling) > len(longest) {
+			longest = sibling
+		}
+	}
+	name := stem + suffix
+	if len(stem+longest) <= room {
+		return filepath.Join(dir, name), nil
+	}
+
+	keep := room - len(longest)
+	if keep < 1 {
+		return "", fmt.Errorf("output path for %s under %s exceeds the %d byte path limit, use --flatten to write outputs without their source subdirectories", name, absDir, maxPath)
+	}
+	truncated := truncateUTF8(stem, keep) + suffix
+	log.Warn().Str("name", name).Str("truncated", truncated).Msg("output file name too long, truncating")
+	return filepath.Join(dir, truncated), nil
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[:n]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
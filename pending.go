@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+
+	"github.com/rs/zerolog/log"
+)
+
+// appendOperations appends ops as JSON lines to the file at path, creating
+// it when needed.
+func appendOperations(path string, ops Operations) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open pending file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	// Encode everything first so a failure doesn't leave half a batch behind.
+	var data []byte
+	for _, op := range ops {
+		line, err := json.Marshal(op)
+		if err != nil {
+			return fmt.Errorf("failed to encode operation: %w", err)
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("failed to write pending file %s: %w", path, err)
+	}
+	return nil
+}
+
+type applyPendingCmd struct {
+	RootDir     string `arg:"" help:"Root directory the operations' filenames are relative to"`
+	PendingFile string `arg:"" help:"Pending operations file written by serve --pending"`
+
+	Log  logFlags  `embed:""`
+	Exec execFlags `embed:""`
+}
+
+// Run executes the approved pending operations and removes them from the
+// pending file. The file is moved aside while it runs, so operations saved
+// in the meantime go to a fresh pending file instead of being lost.
+func (cmd *applyPendingCmd) Run() error {
+	closeLog, err := cmd.Log.setup()
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	ctx = log.Logger.WithContext(ctx)
+
+	executor, err := cmd.Exec.newExecutor(cmd.RootDir)
+	if err != nil {
+		return err
+	}
+	defer executor.Close()
+
+	applyingPath := cmd.PendingFile + ".applying"
+	if _, err := os.Stat(applyingPath); err == nil {
+		return fmt.Errorf("%s is left over from an earlier failed run, apply it with the apply command or remove it first", applyingPath)
+	}
+	if err := os.Rename(cmd.PendingFile, applyingPath); errors.Is(err, fs.ErrNotExist) {
+		log.Ctx(ctx).Info().Str("file", cmd.PendingFile).Msg("no pending operations")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to claim pending file %s: %w", cmd.PendingFile, err)
+	}
+
+	r, err := os.Open(applyingPath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", applyingPath, err)
+	}
+	var readErr error
+	ops := func(yield func(Operation) bool) {
+		for op, err := range readOperations(r) {
+			if err != nil {
+				readErr = err
+				return
+			}
+			if !yield(op) {
+				return
+			}
+		}
+	}
+	execErr := executor.ExecSeq(ctx, ops)
+	r.Close()
+
+	if err := errors.Join(readErr, execErr); err != nil {
+		// Put the batch back for another try, unless new operations were
+		// saved in the meantime.
+		if _, statErr := os.Stat(cmd.PendingFile); errors.Is(statErr, fs.ErrNotExist) {
+			if renameErr := os.Rename(applyingPath, cmd.PendingFile); renameErr == nil {
+				return err
+			}
+		}
+		return fmt.Errorf("%w (the operations are kept in %s)", err, applyingPath)
+	}
+	if err := os.Remove(applyingPath); err != nil {
+		return fmt.Errorf("failed to remove applied operations %s: %w", applyingPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+)
+
+type pickAllCmd struct {
+	RootDir string   `arg:"" help:"Root directory to pick files from"`
+	Include []string `help:"Only pick files whose relative path or name matches one of these glob patterns"`
+	Exclude []string `help:"Skip files whose relative path or name matches one of these glob patterns"`
+	JSON    bool     `help:"Output operations in JSON format without executing"`
+
+	Log  logFlags  `embed:""`
+	Walk walkFlags `embed:""`
+	Exec execFlags `embed:""`
+}
+
+func (cmd *pickAllCmd) Run() error {
+	closeLog, err := cmd.Log.setup()
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	ctx = log.Logger.WithContext(ctx)
+
+	executor, err := cmd.Exec.newExecutor(cmd.RootDir)
+	if err != nil {
+		return err
+	}
+	defer executor.Close()
+
+	walk := cmd.Walk.options()
+	walk.ExcludeDir = executor.OutputDir
+	walk.LenientDecode = cmd.Exec.LenientDecode
+	if cmd.Walk.Videos && executor.Archive != nil {
+		return fmt.Errorf("--videos needs a directory root, not an archive")
+	}
+	if walk.Videos, err = cmd.Walk.videoPosters(); err != nil {
+		return err
+	}
+	var dir Directory
+	if executor.Archive != nil {
+		dir, err = executor.Archive.walkImages(walk)
+	} else {
+		dir, err = walkImages(cmd.RootDir, walk)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to walk dir: %w", err)
+	}
+	if skipped := dir.Skipped; skipped.Total > 0 || skipped.Corrupt > 0 {
+		log.Ctx(ctx).Info().
+			Int("skipped", skipped.Total).
+			Int("unsupported", skipped.Unsupported).
+			Int("generated", skipped.Generated).
+			Int("filtered", skipped.Filtered).
+			Int("recent", skipped.Recent).
+			Int("corrupt", skipped.Corrupt).
+			Msg("Skipped files")
+	}
+
+	var ops Operations
+	for _, file := range dir.Files {
+		if !matchesFilters(file.Name, cmd.Include, cmd.Exclude) {
+			log.Ctx(ctx).Debug().Str("filename", file.Name).Msg("skipping filtered file")
+			continue
+		}
+		ops = append(ops, Operation{Pick: &PickOperation{Filename: file.Name}})
+	}
+
+	if cmd.JSON {
+		printJSONL(ops)
+		return nil
+	}
+	return executor.Exec(ctx, ops)
+}
+
+// matchesFilters reports whether name passes the include and exclude glob
+// patterns. Patterns are tried against both the relative path and the base
+// name, so "*.jpg" and "2023/*.jpg" both work as expected. An empty include
+// list matches everything.
+func matchesFilters(name string, include, exclude []string) bool {
+	for _, pattern := range exclude {
+		if matchesPattern(pattern, name) {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, pattern := range include {
+		if matchesPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesPattern(pattern, name string) bool {
+	if ok, _ := filepath.Match(pattern, name); ok {
+		return true
+	}
+	ok, _ := filepath.Match(pattern, filepath.Base(name))
+	return ok
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+
+	"github.com/disintegration/imaging"
+)
+
+// placeholderHeader is set on /api/view responses that stand in for a
+// missing image, so clients can tell them from the real thing.
+const placeholderHeader = "X-Placeholder"
+
+// Size of generated placeholders, a common 4:3 thumbnail size.
+const (
+	placeholderWidth  = 640
+	placeholderHeight = 480
+)
+
+// generatedPlaceholder returns a JPEG of a gray box labeled with name, for
+// images that went missing while they were being browsed.
+func generatedPlaceholder(name string) ([]byte, error) {
+	img := drawLabel(imaging.New(placeholderWidth, placeholderHeight, color.NRGBA{R: 200, G: 200, B: 200, A: 255}), name)
+	var b bytes.Buffer
+	if err := imaging.Encode(&b, img, imaging.JPEG, imaging.JPEGQuality(80)); err != nil {
+		return nil, fmt.Errorf("failed to encode placeholder: %w", err)
+	}
+	return b.Bytes(), nil
+}
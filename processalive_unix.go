@@ -0,0 +1,17 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// processAlive reports whether a process with the given PID is running on
+// this machine.
+func processAlive(pid int) bool {
+	// Signal 0 checks that the process exists without signalling it. It
+	// may belong to another user, which is denied but still running.
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,17 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// processAlive reports whether a process with the given PID is running on
+// this machine.
+func processAlive(pid int) bool {
+	// Opening a process fails once it has exited.
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// progressBarWidth is the number of cells of the bar itself.
+const progressBarWidth = 30
+
+// progressRedraw is the shortest time between two redraws of a progress
+// bar, so quick operations don't flood the terminal.
+const progressRedraw = 100 * time.Millisecond
+
+// terminal is where console logs are written. Progress bars are drawn on
+// it too, so log lines are printed above the bar instead of through it.
+var terminal = &terminalWriter{out: os.Stdout}
+
+type terminalWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+	// interactive is set when out is a terminal progress bars can be drawn
+	// on.
+	interactive bool
+	// status is the progress bar drawn on the last line, if any.
+	status string
+}
+
+func (t *terminalWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.status == "" {
+		return t.out.Write(p)
+	}
+	fmt.Fprint(t.out, "\r\x1b[K")
+	n, err := t.out.Write(p)
+	fmt.Fprint(t.out, t.status)
+	return n, err
+}
+
+// setStatus draws status on the last line, replacing the previous one.
+func (t *terminalWriter) setStatus(status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status = status
+	fmt.Fprint(t.out, "\r\x1b[K", status)
+}
+
+// endStatus draws status on the last line for good, so logs continue below
+// it.
+func (t *terminalWriter) endStatus(status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status = ""
+	fmt.Fprint(t.out, "\r\x1b[K", status, "\n")
+}
+
+func (t *terminalWriter) showingStatus() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status != ""
+}
+
+// consoleWriter writes logs to the terminal. While a progress bar is shown,
+// lines below warnings are dropped, since the bar stands in for them.
+type consoleWriter struct {
+	zerolog.ConsoleWriter
+}
+
+func (w consoleWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if level < zerolog.WarnLevel && terminal.showingStatus() {
+		return len(p), nil
+	}
+	return w.Write(p)
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressBar counts the finished operations of a run and draws the count,
+// throughput and ETA on the terminal.
+type progressBar struct {
+	mu sync.Mutex
+	// total is the number of operations of the run, or zero when it isn't
+	// known up front, which leaves out the bar and ETA.
+	total  int
+	done   int
+	failed int
+	start  time.Time
+	drawn  time.Time
+}
+
+func newProgressBar(total int) *progressBar {
+	b := &progressBar{total: total, start: time.Now()}
+	terminal.setStatus(b.render(b.start))
+	return b
+}
+
+// advance counts a finished operation, and redraws the bar unless it was
+// just drawn. A nil bar does nothing.
+func (b *progressBar) advance(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done++
+	if failed {
+		b.failed++
+	}
+	now := time.Now()
+	if now.Sub(b.drawn) < progressRedraw && b.done != b.total {
+		return
+	}
+	b.drawn = now
+	terminal.setStatus(b.render(now))
+}
+
+// finish draws the final state of the bar and leaves it in place.
+func (b *progressBar) finish() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	terminal.endStatus(b.render(time.Now()))
+}
+
+func (b *progressBar) render(now time.Time) string {
+	var s strings.Builder
+	elapsed := now.Sub(b.start)
+	rate := float64(b.done) / elapsed.Seconds()
+	if b.total > 0 {
+		filled := progressBarWidth * b.done / b.total
+		fmt.Fprintf(&s, "[%s%s] %d/%d ops", strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), b.done, b.total)
+	} else {
+		fmt.Fprintf(&s, "%d ops", b.done)
+	}
+	if b.failed > 0 {
+		fmt.Fprintf(&s, ", %d failed", b.failed)
+	}
+	if b.done == 0 || elapsed <= 0 {
+		return s.String()
+	}
+	fmt.Fprintf(&s, "  %.1f ops/s", rate)
+	if b.total > 0 && b.done < b.total {
+		eta := time.Duration(float64(b.total-b.done) / rate * float64(time.Second))
+		fmt.Fprintf(&s, "  ETA %s", eta.Round(time.Second))
+	} else if b.done == b.total {
+		fmt.Fprintf(&s, "  in %s", elapsed.Round(100*time.Millisecond))
+	}
+	return s.String()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// cropProvenance records how a cropped output was derived from its source,
+// so the crop can be recomputed against the original later.
+type cropProvenance struct {
+	Source string `json:"source"`
+	// SourceWidth and SourceHeight are the dimensions of the source as
+	// displayed, i.e. after applying its EXIF orientation.
+	SourceWidth  int  `json:"source_width"`
+	SourceHeight int  `json:"source_height"`
+	Crop         Crop `json:"crop"`
+	// Pixels is the crop rectangle in source pixels, before clamping to the
+	// image bounds.
+	Pixels pixelRect `json:"pixels"`
+	// Bleed is the operation's bleed. Pixels doesn't include it.
+	Bleed float64 `json:"bleed,omitempty"`
+	// Rotate is the operation's rotation. Pixels are in the rotated image
+	// when it's set.
+	Rotate float64 `json:"rotate,omitempty"`
+}
+
+type pixelRect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"w"`
+	Height int `json:"h"`
+}
+
+// cropProvenanceJSON returns the sidecar JSON that describes op, the crop
+// of the source image read from src, with the source dimensions oriented
+// according to policy.
+func cropProvenanceJSON(src io.ReadSeeker, op CropOperation, policy OrientationPolicy) ([]byte, error) {
+	info, err := decodeJPEGInfo(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source dimensions of %s: %w", op.Filename, err)
+	}
+	img := newImageInfo(info, policy)
+	crop := op.Crop
+	bounds := op.bounds(img.Width, img.Height)
+
+	provenance := cropProvenance{
+		Source:       filepath.ToSlash(op.Filename),
+		SourceWidth:  img.Width,
+		SourceHeight: img.Height,
+		Crop:         crop,
+		Bleed:        op.Bleed,
+		Rotate:       op.Rotate,
+		Pixels: pixelRect{
+			X:      int(crop.X * float64(bounds.Dx())),
+			Y:      int(crop.Y * float64(bounds.Dy())),
+			Width:  int(crop.Width * float64(bounds.Dx())),
+			Height: int(crop.Height * float64(bounds.Dy())),
+		},
+	}
+
+	data, err := json.MarshalIndent(provenance, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode provenance: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// RemoteFetcher downloads operation sources given as http(s) URLs.
+type RemoteFetcher struct {
+	// AllowedHosts restricts fetching to these host names. When empty, any
+	// host is allowed.
+	AllowedHosts []string
+	// Timeout bounds each download, including reading the body.
+	Timeout time.Duration
+	// MaxSize is the largest body in bytes that will be accepted.
+	MaxSize int64
+	// Username and Password are sent as basic auth credentials with every
+	// download when Username is set. They're never logged.
+	Username string
+	Password string
+	// Client sends the requests. Its CheckRedirect is replaced, so every
+	// redirect is checked like the URL it was fetched for. When nil, a
+	// client with Timeout is used.
+	Client *http.Client
+}
+
+// maxRemoteRedirects is how many redirects a download follows.
+const maxRemoteRedirects = 10
+
+func isRemoteSource(filename string) bool {
+	return strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://")
+}
+
+// remoteSourceName returns a file name for a remote source, taken from the
+// last segment of its URL path.
+func remoteSourceName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "download"
+	}
+	if name := path.Base(u.Path); name != "/" && name != "." {
+		return name
+	}
+	return u.Hostname()
+}
+
+// Fetch downloads rawURL into memory. The body is buffered so it can be
+// seeked like a local file, which is safe because its size is capped.
+func (f *RemoteFetcher) Fetch(ctx context.Context, rawURL string) (io.ReadSeekCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source url: %w", err)
+	}
+	if err := f.checkURL(u); err != nil {
+		return nil, err
+	}
+
+	if f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if f.Username != "" {
+		req.SetBasicAuth(f.Username, f.Password)
+	}
+	res, err := f.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", u.Redacted(), err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: unexpected status %s", u.Redacted(), res.Status)
+	}
+	if f.MaxSize > 0 && res.ContentLength > f.MaxSize {
+		return nil, fmt.Errorf("remote source %s is %d bytes, larger than the %d byte limit", u.Redacted(), res.ContentLength, f.MaxSize)
+	}
+
+	body := io.Reader(res.Body)
+	if f.MaxSize > 0 {
+		body = io.LimitReader(res.Body, f.MaxSize+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", u.Redacted(), err)
+	}
+	if f.MaxSize > 0 && int64(len(data)) > f.MaxSize {
+		return nil, fmt.Errorf("remote source %s is larger than the %d byte limit", u.Redacted(), f.MaxSize)
+	}
+	return nopSeekCloser{bytes.NewReader(data)}, nil
+}
+
+// checkURL checks that u may be downloaded: that it's http(s) and its host
+// is allowed.
+func (f *RemoteFetcher) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported source url scheme %q", u.Scheme)
+	}
+	if len(f.AllowedHosts) > 0 && !slices.Contains(f.AllowedHosts, u.Hostname()) {
+		return fmt.Errorf("host %q is not in the list of allowed remote hosts", u.Hostname())
+	}
+	return nil
+}
+
+// client returns the client downloads are made with. Redirects are checked
+// like the URLs of sources, so an allowed host can't send a download to
+// one that isn't, such as a cloud metadata service, and the credentials
+// are only sent to the host that was asked for.
+func (f *RemoteFetcher) client() *http.Client {
+	client := &http.Client{Timeout: f.Timeout}
+	if f.Client != nil {
+		copied := *f.Client
+		client = &copied
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRemoteRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRemoteRedirects)
+		}
+		if err := f.checkURL(req.URL); err != nil {
+			return fmt.Errorf("refusing redirect to %s: %w", req.URL.Redacted(), err)
+		}
+		if req.URL.Host != via[0].URL.Host {
+			req.Header.Del("Authorization")
+		}
+		return nil
+	}
+	return client
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
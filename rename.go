@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// renameCounter matches the counter of a rename pattern: {n}, or {n:3} for
+// a counter zero-padded to 3 digits.
+var renameCounter = regexp.MustCompile(`\{n(?::(\d+))?\}`)
+
+// RenamePattern names picked files by their position in a batch, such as
+// "wedding-{n:3}" for wedding-001.jpg, wedding-002.jpg and so on. The
+// source's extension is kept.
+type RenamePattern struct {
+	pattern string
+	// Start is the number of the first pick.
+	Start int
+}
+
+// ParseRenamePattern checks that pattern has a counter and makes a valid
+// file name.
+func ParseRenamePattern(pattern string, start int) (*RenamePattern, error) {
+	if !renameCounter.MatchString(pattern) {
+		return nil, fmt.Errorf("rename pattern %q has no {n} counter", pattern)
+	}
+	if strings.ContainsAny(pattern, `/\`) {
+		return nil, fmt.Errorf("rename pattern %q must be a file name, not a path", pattern)
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("rename start must not be negative, got %d", start)
+	}
+	return &RenamePattern{pattern: pattern, Start: start}, nil
+}
+
+// Name returns the file name, without extension, of the pick at ordinal
+// position (1 for the first pick of a batch).
+func (p *RenamePattern) Name(ordinal int) string {
+	n := p.Start + ordinal - 1
+	return renameCounter.ReplaceAllStringFunc(p.pattern, func(counter string) string {
+		width := 0
+		if m := renameCounter.FindStringSubmatch(counter); m[1] != "" {
+			width, _ = strconv.Atoi(m[1])
+		}
+		return fmt.Sprintf("%0*d", width, n)
+	})
+}
+
+// numberPicks sets the ordinal position of every pick in ops that doesn't
+// have one yet, continuing after the highest one already set.
+func numberPicks(ops []Operation) {
+	next := 1
+	for _, op := range ops {
+		next = max(next, op.ordinal+1)
+	}
+	for i := range ops {
+		if ops[i].Pick != nil && ops[i].ordinal == 0 {
+			ops[i].ordinal = next
+			next++
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+)
+
+// partialCopyPath returns where a resumable copy to destPath is staged. The
+// name is derived from destPath, so a later run finds the partial copy
+// again, and outputs staged in a shared --temp-dir don't collide.
+func partialCopyPath(destPath, tempDir string) string {
+	if tempDir == "" {
+		tempDir = filepath.Dir(destPath)
+	}
+	sum := sha256.Sum256([]byte(destPath))
+	return filepath.Join(tempDir, ".pickemall-"+hex.EncodeToString(sum[:8])+".partial")
+}
+
+// copyFileResumable copies the local file sourcePath to destPath, continuing
+// a partial copy left behind by an earlier, interrupted attempt instead of
+// starting over. Unlike writeFile, the staged file is kept when the copy
+// fails. The finished copy is verified against a checksum of the source,
+// and when a resumed copy doesn't match, it's copied again from the start.
+func copyFileResumable(ctx context.Context, sourcePath, destPath, tempDir string, budget *outputBudget, modes outputModes) error {
+	partialPath := partialCopyPath(destPath, tempDir)
+	// The source is hashed after copying, so a failing link interrupts
+	// a copy that makes progress rather than the hash.
+	var sourceSum string
+	for attempt := 0; ; attempt++ {
+		resumedAt, err := continueCopy(sourcePath, partialPath)
+		if err != nil {
+			return fmt.Errorf("failed to write file %s: %w", destPath, err)
+		}
+		if resumedAt > 0 {
+			log.Ctx(ctx).Info().Str("path", destPath).Int64("offset", resumedAt).Msg("resumed partial copy")
+		}
+
+		if sourceSum == "" {
+			if sourceSum, err = hashFile(sourcePath, sha256.New()); err != nil {
+				return err
+			}
+		}
+		sum, err := hashFile(partialPath, sha256.New())
+		if err != nil {
+			return err
+		}
+		if sum == sourceSum {
+			break
+		}
+		// A partial copy that doesn't match was most likely left by a source
+		// that changed since, so its head is stale too.
+		if err := os.Remove(partialPath); err != nil {
+			return fmt.Errorf("failed to remove partial copy %s: %w", partialPath, err)
+		}
+		if resumedAt == 0 || attempt > 0 {
+			return fmt.Errorf("copy of %s doesn't match its source checksum", destPath)
+		}
+		log.Ctx(ctx).Warn().Str("path", destPath).Msg("resumed copy doesn't match its source checksum, copying again")
+	}
+
+	info, err := os.Stat(partialPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat partial copy %s: %w", partialPath, err)
+	}
+	if err := budget.reserve(info.Size()); err != nil {
+		os.Remove(partialPath)
+		return fmt.Errorf("not writing %s: %w", destPath, err)
+	}
+	if err := os.Chmod(partialPath, modes.fileMode()); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %w", destPath, err)
+	}
+	if err := os.Rename(partialPath, destPath); err != nil {
+		// The temp dir may be on another file system, where renames fail.
+		return moveFile(partialPath, destPath, modes)
+	}
+	return nil
+}
+
+// continueCopy appends to partialPath whatever of sourcePath it doesn't
+// have yet, and returns the offset the copy continued from. A partial copy
+// larger than the source can't be a prefix of it and is started over.
+func continueCopy(sourcePath, partialPath string) (int64, error) {
+	src, err := os.Open(sourcePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file %s: %w", sourcePath, err)
+	}
+	defer src.Close()
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat file %s: %w", sourcePath, err)
+	}
+
+	dst, err := os.OpenFile(partialPath, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+	dstInfo, err := dst.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	offset := dstInfo.Size()
+	if offset > srcInfo.Size() {
+		if err := dst.Truncate(0); err != nil {
+			return 0, err
+		}
+		offset = 0
+	}
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := dst.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		return 0, err
+	}
+	return offset, dst.Close()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+	"slices"
+
+	"github.com/disintegration/imaging"
+)
+
+// straighten rotates img counter-clockwise by angle degrees and crops the
+// result to the largest axis-aligned rectangle that contains no corners
+// left empty by the rotation.
+func straighten(img image.Image, angle float64) image.Image {
+	if angle == 0 {
+		return img
+	}
+	b := img.Bounds()
+	rotated := imaging.Rotate(img, angle, color.Transparent)
+	w, h := rotatedInscribedSize(float64(b.Dx()), float64(b.Dy()), angle*math.Pi/180)
+	return imaging.CropCenter(rotated, max(1, int(w)), max(1, int(h)))
+}
+
+// rotationPreview opens the image at path scaled down to fit in a size x
+// size box, and rotates it counter-clockwise by angle degrees. With crop, the
+// empty corners are cropped away like a straighten operation does;
+// otherwise they're filled with black. Scaling comes first, so previews stay
+// fast enough to follow a slider.
+func rotationPreview(ctx context.Context, path string, policy OrientationPolicy, angle float64, size int, crop, scaled bool) (image.Image, error) {
+	img, _, err := thumbnail(ctx, path, size, policy, scaled)
+	if err != nil {
+		return nil, err
+	}
+	if crop {
+		return straighten(img, angle), nil
+	}
+	return imaging.Rotate(img, angle, color.Black), nil
+}
+
+// rotatedInscribedSize returns the size of the largest-area axis-aligned
+// rectangle that fits inside a w x h rectangle rotated by angle radians.
+func rotatedInscribedSize(w, h, angle float64) (float64, float64) {
+	if w <= 0 || h <= 0 {
+		return 0, 0
+	}
+	widthIsLonger := w >= h
+	long, short := w, h
+	if !widthIsLonger {
+		long, short = h, w
+	}
+
+	sin, cos := math.Abs(math.Sin(angle)), math.Abs(math.Cos(angle))
+	if short <= 2*sin*cos*long || math.Abs(sin-cos) < 1e-10 {
+		// Half constrained: two corners of the rectangle touch the longer side
+		x := 0.5 * short
+		if widthIsLonger {
+			return x / sin, x / cos
+		}
+		return x / cos, x / sin
+	}
+	// Fully constrained: the rectangle touches all four sides
+	cos2 := cos*cos - sin*sin
+	return (w*cos - h*sin) / cos2, (h*cos - w*sin) / cos2
+}
+
+// bounds returns the bounds op is cropped from, of its width x height
+// source once it's rotated by op.Rotate.
+func (op CropOperation) bounds(width, height int) image.Rectangle {
+	if op.Rotate == 0 {
+		return image.Rect(0, 0, width, height)
+	}
+	w, h := rotatedSize(width, height, op.Rotate)
+	return image.Rect(0, 0, w, h)
+}
+
+// rotatedSize returns the size of a width x height image rotated by angle
+// degrees the way imaging.Rotate sizes it, so crops of rotated images can
+// be planned without decoding them.
+func rotatedSize(width, height int, angle float64) (int, int) {
+	sin, cos := math.Sincos(math.Pi * angle / 180)
+	// The corners, as pixel centers, rotated around the top left one.
+	w, h := float64(width-1), float64(height-1)
+	xs := []float64{0, w * cos, w*cos - h*sin, -h * sin}
+	ys := []float64{0, w * sin, w*sin + h*cos, h * cos}
+	size := func(coords []float64) int {
+		n := slices.Max(coords) - slices.Min(coords) + 1
+		if n-math.Floor(n) > 0.1 {
+			n++
+		}
+		return int(n)
+	}
+	return size(xs), size(ys)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// S3Output uploads outputs to an S3 bucket, or a bucket of an S3
+// compatible store such as MinIO, instead of writing them to the output
+// directory. Requests are signed with AWS Signature Version 4.
+type S3Output struct {
+	Bucket string
+	// Prefix is prepended to the key of every output, e.g. "deliveries/"
+	// to upload them under that folder of the bucket.
+	Prefix string
+	Region string
+	// Endpoint is the URL of an S3 compatible store. Buckets are addressed
+	// by path on it, as those stores expect. When empty, outputs are
+	// uploaded to AWS.
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is sent along with temporary credentials.
+	SessionToken string
+	// Client sends the uploads. When nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// ParseS3URL splits an s3://bucket/prefix URL into its bucket and key
+// prefix. The prefix is empty or ends with a slash.
+func ParseS3URL(raw string) (bucket, prefix string, err error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("invalid S3 URL %q, expected s3://bucket or s3://bucket/prefix", raw)
+	}
+	prefix = strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return u.Host, prefix, nil
+}
+
+func (o *S3Output) Write(ctx context.Context, name string, r io.Reader) error {
+	key := o.Prefix + name
+	size, body, err := sizedBody(r)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, o.objectURL(key), body)
+	if err != nil {
+		return fmt.Errorf("failed to create upload request for %s: %w", key, err)
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if o.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", o.SessionToken)
+	}
+	// The payload is left out of the signature, since hashing it would
+	// take reading every output twice.
+	o.sign(req, "UNSIGNED-PAYLOAD", time.Now())
+
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to s3://%s: %w", key, o.Bucket, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to upload %s to s3://%s: %w", key, o.Bucket, readS3Error(resp))
+	}
+	return nil
+}
+
+// Exists implements outputChecker by asking for the object's metadata.
+func (o *S3Output) Exists(ctx context.Context, name string) (bool, error) {
+	key := o.Prefix + name
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, o.objectURL(key), nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request for %s: %w", key, err)
+	}
+	if o.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", o.SessionToken)
+	}
+	o.sign(req, emptyPayloadHash, time.Now())
+
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to check %s in s3://%s: %w", key, o.Bucket, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to check %s in s3://%s: %w", key, o.Bucket, readS3Error(resp))
+	}
+}
+
+// emptyPayloadHash is the SHA-256 of an empty payload, which signs
+// requests without a body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// objectURL returns the URL of the object key, addressing the bucket by
+// host on AWS and by path on other endpoints.
+func (o *S3Output) objectURL(key string) string {
+	if o.Endpoint == "" {
+		return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", o.Bucket, o.Region, escapeS3Key(key))
+	}
+	return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(o.Endpoint, "/"), o.Bucket, escapeS3Key(key))
+}
+
+// escapeS3Key escapes every segment of key, as both the URL and the
+// canonical request of the signature expect.
+func escapeS3Key(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = escapeS3(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// escapeS3 escapes everything but the unreserved characters of RFC 3986,
+// which is stricter than url.PathEscape and what signatures are computed
+// over.
+func escapeS3(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sign adds the Signature Version 4 authorization of req, made at now,
+// covering its host and every header set on it.
+func (o *S3Output) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + o.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + req.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+o.SecretAccessKey), date)
+	key = hmacSHA256(key, o.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		o.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalQuery returns the query sorted by name and escaped for a
+// signature.
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, escapeS3(name)+"="+escapeS3(value))
+		}
+	}
+	slices.Sort(params)
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sizedBody returns the size of r along with a body to upload it with.
+// Uploads need their size up front, which seekable readers tell without
+// being read; anything else is read into memory. The body isn't closed by
+// the upload, so closing the source is left to whoever opened it.
+func sizedBody(r io.Reader) (int64, io.Reader, error) {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len()), r, nil
+	case io.Seeker:
+		pos, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, nil, err
+		}
+		end, err := v.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, nil, err
+		}
+		if _, err := v.Seek(pos, io.SeekStart); err != nil {
+			return 0, nil, err
+		}
+		return end - pos, io.NopCloser(r), nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	return int64(len(data)), bytes.NewReader(data), nil
+}
+
+// readS3Error returns the error of a failed request, with the code and
+// message of the XML error S3 responds with when there's one.
+func readS3Error(resp *http.Response) error {
+	var body struct {
+		Code    string
+		Message string
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &body) != nil || body.Code == "" {
+		return errors.New(resp.Status)
+	}
+	return fmt.Errorf("%s: %s (%s)", body.Code, body.Message, resp.Status)
+}
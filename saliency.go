@@ -0,0 +1,72 @@
+package main
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// saliencySize is the longest side images are scaled down to before their
+// most interesting region is searched, which keeps the search fast.
+const saliencySize = 256
+
+// salientCenter returns the center of the crop with the given aspect ratio
+// that holds the most edge energy of img. Edges are a cheap stand-in for
+// what's interesting: subjects have detail, while skies, walls and
+// out-of-focus backgrounds are flat. Images without edges are centered.
+func salientCenter(img image.Image, aspect float64) image.Point {
+	bounds := img.Bounds()
+	gray := imaging.Grayscale(imaging.Fit(img, saliencySize, saliencySize, imaging.Linear))
+	w, h := gray.Bounds().Dx(), gray.Bounds().Dy()
+	if w < 3 || h < 3 {
+		return rectCenter(bounds)
+	}
+	at := func(x, y int) float64 {
+		return float64(gray.Pix[y*gray.Stride+x*4])
+	}
+
+	// sums is the summed-area table of the absolute Laplacian, so the
+	// energy of any window takes four lookups.
+	stride := w + 1
+	sums := make([]float64, stride*(h+1))
+	for y := range h {
+		for x := range w {
+			var energy float64
+			if x > 0 && y > 0 && x < w-1 && y < h-1 {
+				energy = math.Abs(4*at(x, y) - at(x-1, y) - at(x+1, y) - at(x, y-1) - at(x, y+1))
+			}
+			sums[(y+1)*stride+x+1] = energy + sums[y*stride+x+1] + sums[(y+1)*stride+x] - sums[y*stride+x]
+		}
+	}
+
+	window := aspectCrop(gray.Bounds(), aspect, image.Point{})
+	ww, wh := window.Dx(), window.Dy()
+	centerX, centerY := (w-ww)/2, (h-wh)/2
+	bestX, bestY, best := centerX, centerY, -1.0
+	for y := 0; y+wh <= h; y++ {
+		for x := 0; x+ww <= w; x++ {
+			energy := sums[(y+wh)*stride+x+ww] - sums[y*stride+x+ww] - sums[(y+wh)*stride+x] + sums[y*stride+x]
+			// Ties, such as in flat images, go to the window closest to
+			// the center.
+			closer := abs(x-centerX)+abs(y-centerY) < abs(bestX-centerX)+abs(bestY-centerY)
+			if energy > best || energy == best && closer {
+				bestX, bestY, best = x, y, energy
+			}
+		}
+	}
+
+	scaleX := float64(bounds.Dx()) / float64(w)
+	scaleY := float64(bounds.Dy()) / float64(h)
+	return image.Pt(
+		bounds.Min.X+int((float64(bestX)+float64(ww)/2)*scaleX),
+		bounds.Min.Y+int((float64(bestY)+float64(wh)/2)*scaleY),
+	)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// saveDebouncer coalesces saves that arrive in quick succession, such as
+// those of a frontend that auto-saves on every change. Only the latest batch
+// is run, once no save has arrived for the debounce delay. Runs never
+// overlap.
+type saveDebouncer struct {
+	delay time.Duration
+	run   func(ops Operations)
+	// saves is held from the first save of a batch until the batch has run.
+	saves *sync.WaitGroup
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	pending Operations
+	// batch numbers the timers, so a timer that fired just as it was
+	// replaced by a newer save can tell it's stale.
+	batch int
+
+	// running serializes runs, so a batch that fires while the previous
+	// one is still executing waits for it.
+	running sync.Mutex
+}
+
+func newSaveDebouncer(delay time.Duration, saves *sync.WaitGroup, run func(ops Operations)) *saveDebouncer {
+	return &saveDebouncer{delay: delay, run: run, saves: saves}
+}
+
+// Save schedules ops to run after the debounce delay, replacing any batch
+// that hasn't run yet.
+func (d *saveDebouncer) Save(ops Operations) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.pending = ops
+	if d.timer != nil && d.timer.Stop() {
+		d.timer.Reset(d.delay)
+		return
+	}
+	d.saves.Add(1)
+	d.batch++
+	batch := d.batch
+	d.timer = time.AfterFunc(d.delay, func() { d.fire(batch) })
+}
+
+// Flush runs the pending batch right away instead of waiting for the
+// delay. It's called on shutdown so the last save isn't lost.
+func (d *saveDebouncer) Flush() {
+	d.mu.Lock()
+	if d.timer == nil || !d.timer.Stop() {
+		d.mu.Unlock()
+		return
+	}
+	batch := d.batch
+	d.mu.Unlock()
+	d.fire(batch)
+}
+
+// Cancel drops the batch waiting for the delay, and reports whether there
+// was one. A batch that's already running isn't affected.
+func (d *saveDebouncer) Cancel() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer == nil || !d.timer.Stop() {
+		return false
+	}
+	d.timer = nil
+	d.pending = nil
+	d.saves.Done()
+	return true
+}
+
+func (d *saveDebouncer) fire(batch int) {
+	defer d.saves.Done()
+
+	d.mu.Lock()
+	if batch != d.batch {
+		// A newer save replaced this batch after the timer had fired.
+		d.mu.Unlock()
+		return
+	}
+	ops := d.pending
+	d.pending = nil
+	d.timer = nil
+	d.mu.Unlock()
+
+	d.running.Lock()
+	defer d.running.Unlock()
+	d.run(ops)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+type selftestCmd struct{}
+
+// selftestInputs are the source formats the pipeline is expected to decode.
+var selftestInputs = []struct {
+	Name   string
+	Format imaging.Format
+}{
+	{"jpeg", imaging.JPEG},
+	{"png", imaging.PNG},
+	{"gif", imaging.GIF},
+	{"tiff", imaging.TIFF},
+	{"bmp", imaging.BMP},
+}
+
+func (cmd *selftestCmd) Run() error {
+	ctx := context.Background()
+	cropper := NewImagingCropper()
+
+	fmt.Printf("JPEG encoder: %s\n\n", jpegEncoder)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "INPUT\tOUTPUT\tSTEP\tRESULT\tTIME")
+
+	failed := 0
+	for _, input := range selftestInputs {
+		src, err := syntheticImage(input.Format)
+		if err != nil {
+			failed++
+			fmt.Fprintf(tw, "%s\t-\tgenerate\tFAIL: %v\t-\n", input.Name, err)
+			continue
+		}
+
+		for _, output := range supportedOutputFormats {
+			steps := []struct {
+				name  string
+				run   func(w *bytes.Buffer) error
+				wantW int
+				wantH int
+			}{
+				{"crop", func(w *bytes.Buffer) error {
+					return cropper.Crop(ctx, bytes.NewReader(src), w, CropOperation{
+						Crop:   Crop{X: 0.25, Y: 0.25, Width: 0.5, Height: 0.5},
+						Format: output,
+					})
+				}, 32, 24},
+				{"resize", func(w *bytes.Buffer) error {
+					return cropper.FitPadded(ctx, bytes.NewReader(src), w, ResizeOperation{
+						Width:  40,
+						Height: 40,
+						Format: output,
+					}, color.White)
+				}, 40, 40},
+			}
+
+			for _, step := range steps {
+				var out bytes.Buffer
+				start := time.Now()
+				err := step.run(&out)
+				elapsed := time.Since(start)
+				if err == nil {
+					err = checkImage(out.Bytes(), step.wantW, step.wantH)
+				}
+
+				result := "ok"
+				if err != nil {
+					failed++
+					result = "FAIL: " + err.Error()
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", input.Name, output, step.name, result, elapsed.Round(time.Microsecond))
+			}
+		}
+	}
+
+	start := time.Now()
+	result := "ok"
+	if err := checkConcurrentCrops(ctx); err != nil {
+		failed++
+		result = "FAIL: " + err.Error()
+	}
+	fmt.Fprintf(tw, "jpeg\tjpeg\tconcurrent crop x%d\t%s\t%s\n", selftestConcurrentCrops, result, time.Since(start).Round(time.Microsecond))
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// selftestConcurrentCrops is how many crops checkConcurrentCrops runs at once.
+const selftestConcurrentCrops = 64
+
+// checkConcurrentCrops runs many crops in parallel on a single cropper, the
+// way the executor's workers share one, and checks that each gives the same
+// output as a crop run on its own. Different crops are mixed so that state
+// leaking from one call into another shows up as a mismatch.
+func checkConcurrentCrops(ctx context.Context) error {
+	src, err := syntheticImage(imaging.JPEG)
+	if err != nil {
+		return err
+	}
+	cropper := NewImagingCropper()
+	cropper.Decodes = newDecodeSemaphore(4)
+
+	crops := []Crop{
+		{X: 0, Y: 0, Width: 0.5, Height: 0.5},
+		{X: 0.25, Y: 0.25, Width: 0.5, Height: 0.75},
+		{X: 0.5, Y: 0.1, Width: 0.5, Height: 0.25},
+	}
+	want := make([][]byte, len(crops))
+	for i, crop := range crops {
+		var b bytes.Buffer
+		if err := cropper.Crop(ctx, bytes.NewReader(src), &b, CropOperation{Crop: crop}); err != nil {
+			return err
+		}
+		want[i] = b.Bytes()
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, selftestConcurrentCrops)
+	for i := range selftestConcurrentCrops {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var b bytes.Buffer
+			if err := cropper.Crop(ctx, bytes.NewReader(src), &b, CropOperation{Crop: crops[i%len(crops)]}); err != nil {
+				errs[i] = err
+				return
+			}
+			if !bytes.Equal(b.Bytes(), want[i%len(crops)]) {
+				errs[i] = fmt.Errorf("crop %d differs from the same crop run alone", i)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// syntheticImage returns a 64x48 gradient encoded in format.
+func syntheticImage(format imaging.Format) ([]byte, error) {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 4), G: uint8(y * 5), B: 128, A: 255})
+		}
+	}
+	var b bytes.Buffer
+	if err := imaging.Encode(&b, img, format); err != nil {
+		return nil, fmt.Errorf("failed to encode: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+func checkImage(data []byte, wantW, wantH int) error {
+	img, err := imaging.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("output does not decode: %w", err)
+	}
+	if b := img.Bounds(); b.Dx() != wantW || b.Dy() != wantH {
+		return fmt.Errorf("output is %dx%d, expected %dx%d", b.Dx(), b.Dy(), wantW, wantH)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Kinds of session log entries.
+const (
+	sessionRequest = "request"
+	sessionSave    = "save"
+)
+
+// sessionEntry is a line of a session log: an API request that was served,
+// or the operations of a save that was executed.
+type sessionEntry struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// Method, Path, Query, Status and Duration describe requests.
+	Method   string  `json:"method,omitempty"`
+	Path     string  `json:"path,omitempty"`
+	Query    string  `json:"query,omitempty"`
+	Status   int     `json:"status,omitempty"`
+	Duration float64 `json:"duration_ms,omitempty"`
+	// Operations are those of saves, as they were executed.
+	Operations Operations `json:"operations,omitempty"`
+}
+
+// SessionRecorder appends the API requests of a session, and the
+// operations of its saves, to a JSONL log, to audit the session or replay
+// its saves with the replay command.
+type SessionRecorder struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openSessionRecorder opens the session log at path for appending, so a
+// session that's continued after a restart extends it.
+func openSessionRecorder(path string, modes outputModes) (*SessionRecorder, error) {
+	f, err := modes.openFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session log %s: %w", path, err)
+	}
+	return &SessionRecorder{path: path, f: f}, nil
+}
+
+func (s *SessionRecorder) record(entry sessionEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode session entry: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write session log %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// RecordRequest records a request that was served with the given status.
+// A nil recorder records nothing.
+func (s *SessionRecorder) RecordRequest(c *fiber.Ctx, status int, took time.Duration) error {
+	if s == nil {
+		return nil
+	}
+	return s.record(sessionEntry{
+		Time:     time.Now(),
+		Kind:     sessionRequest,
+		Method:   c.Method(),
+		Path:     c.Path(),
+		Query:    string(c.Request().URI().QueryString()),
+		Status:   status,
+		Duration: float64(took.Microseconds()) / 1000,
+	})
+}
+
+// RecordSave records the operations of a save that's executed. A nil
+// recorder records nothing.
+func (s *SessionRecorder) RecordSave(ops Operations) error {
+	if s == nil {
+		return nil
+	}
+	return s.record(sessionEntry{Time: time.Now(), Kind: sessionSave, Operations: ops})
+}
+
+// Close closes the log.
+func (s *SessionRecorder) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// recordSession records every API request served, with the status it was
+// answered with.
+func (a *WebApp) recordSession(c *fiber.Ctx) error {
+	if !strings.HasPrefix(c.Path(), "/api/") {
+		return c.Next()
+	}
+	start := time.Now()
+	err := c.Next()
+	status := c.Response().StatusCode()
+	if err != nil {
+		// The error handler hasn't set the status yet.
+		status = http.StatusInternalServerError
+		var fe *fiber.Error
+		if errors.As(err, &fe) {
+			status = fe.Code
+		}
+	}
+	if recordErr := a.config.Session.RecordRequest(c, status, time.Since(start)); recordErr != nil {
+		log.Ctx(c.UserContext()).Warn().Err(recordErr).Msg("Failed to record request")
+	}
+	return err
+}
+
+type replayCmd struct {
+	RootDir    string `arg:"" help:"Root directory the recorded operations' filenames are relative to"`
+	SessionLog string `arg:"" help:"Session log written by serve --record-session" type:"existingfile"`
+
+	Log  logFlags  `embed:""`
+	Exec execFlags `embed:""`
+}
+
+// Run executes the saves of a recorded session in the order they were
+// made, one batch per save like serve executed them, so the session's
+// outputs are reproduced. Recorded requests other than saves are skipped.
+// A save that fails is logged and the rest are still replayed.
+func (cmd *replayCmd) Run() error {
+	closeLog, err := cmd.Log.setup()
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	ctx = log.Logger.WithContext(ctx)
+
+	executor, err := cmd.Exec.newExecutor(cmd.RootDir)
+	if err != nil {
+		return err
+	}
+	defer executor.Close()
+	f, err := os.Open(cmd.SessionLog)
+	if err != nil {
+		return fmt.Errorf("failed to open session log: %w", err)
+	}
+	defer f.Close()
+
+	var errs []error
+	saves := 0
+	br := bufio.NewReader(f)
+	for lineNo := 1; ctx.Err() == nil; lineNo++ {
+		line, readErr := br.ReadBytes('\n')
+		if !isBlankOrComment(line) {
+			var entry sessionEntry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %w", lineNo, err))
+			} else if entry.Kind == sessionSave {
+				saves++
+				log.Ctx(ctx).Info().Int("save", saves).Time("recorded", entry.Time).Int("operations", len(entry.Operations)).Msg("replaying save")
+				if err := executor.Exec(ctx, entry.Operations); err != nil {
+					log.Ctx(ctx).Error().Err(err).Int("save", saves).Msg("replayed save failed")
+					errs = append(errs, fmt.Errorf("save %d on line %d: %w", saves, lineNo, err))
+				}
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			errs = append(errs, fmt.Errorf("failed to read session log: %w", readErr))
+			break
+		}
+	}
+	log.Ctx(ctx).Info().Int("saves", saves).Msg("replayed session")
+	return errors.Join(append(errs, ctx.Err())...)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"cmp"
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// sharpnessSize is the longest side images are scaled down to before their
+// sharpness is estimated. It keeps the estimate fast, and makes scores of
+// images with different resolutions comparable.
+const sharpnessSize = 512
+
+// sharpness estimates how sharp img is as the variance of the Laplacian of
+// its grayscale version: in-focus images have strong edges, which the
+// Laplacian amplifies, while blurred ones vary little from pixel to pixel.
+// Scores are only meaningful relative to each other, e.g. between frames of
+// a burst.
+func sharpness(img image.Image) float64 {
+	gray := imaging.Grayscale(imaging.Fit(img, sharpnessSize, sharpnessSize, imaging.Linear))
+	w, h := gray.Bounds().Dx(), gray.Bounds().Dy()
+	if w < 3 || h < 3 {
+		return 0
+	}
+	at := func(x, y int) float64 {
+		return float64(gray.Pix[y*gray.Stride+x*4])
+	}
+
+	var sum, sumSquares float64
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			v := 4*at(x, y) - at(x-1, y) - at(x+1, y) - at(x, y-1) - at(x, y+1)
+			sum += v
+			sumSquares += v * v
+		}
+	}
+	n := float64((w - 2) * (h - 2))
+	mean := sum / n
+	return math.Round((sumSquares/n-mean*mean)*100) / 100
+}
+
+// compareSharpness orders sharpness scores from the sharpest down, followed
+// by missing ones.
+func compareSharpness(a, b *float64) int {
+	switch {
+	case a == nil || b == nil:
+		return -cmp.Compare(boolInt(a != nil), boolInt(b != nil))
+	default:
+		return cmp.Compare(*b, *a)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"iter"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// WriteShellScript writes a POSIX shell script to w that does what
+// executing ops would: cp for picks and ImageMagick's convert for crops,
+// with the crop geometry computed in pixels the way the cropper would.
+// Operations without a shell equivalent, such as resizes and remote
+// sources, are listed as comments. Nothing is executed or written besides
+// the script.
+func (r OperationExecutor) WriteShellScript(ctx context.Context, w io.Writer, ops iter.Seq[Operation]) error {
+	if r.ZipByType {
+		return fmt.Errorf("--output-zip-by-type can't be written as a shell script")
+	}
+	cropper, ok := r.Cropper.(*ImagingCropper)
+	if !ok {
+		return fmt.Errorf("cropper %T doesn't support shell scripts", r.Cropper)
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "#!/bin/sh")
+	fmt.Fprintln(bw, "set -e")
+
+	var errs []error
+	dirs := map[string]bool{}
+	originals := map[string]bool{}
+	picks := 0
+	emit := func(op Operation) {
+		if r.IgnoreTinyCrops && r.isTinyCrop(op) {
+			fmt.Fprintf(bw, "# ignored: tiny crop of %s\n", op.Filename())
+			return
+		}
+		command, destPath, err := r.shellCommand(ctx, cropper, op)
+		if err != nil {
+			errs = append(errs, err)
+			fmt.Fprintf(bw, "# error: %s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+			return
+		}
+		if command == "" {
+			fmt.Fprintf(bw, "# skipped: %s of %s has no shell equivalent\n", op.Type(), op.Filename())
+			return
+		}
+		if dir := filepath.Dir(destPath); !dirs[dir] {
+			dirs[dir] = true
+			fmt.Fprintf(bw, "mkdir -p %s\n", shellQuote(dir))
+		}
+		fmt.Fprintln(bw, command)
+	}
+	for op := range ops {
+		if op.Pick != nil && op.ordinal == 0 {
+			picks++
+			op.ordinal = picks
+		}
+		emit(op)
+		if r.CropKeepsOriginal && op.Crop != nil && !originals[op.originalKey()] {
+			originals[op.originalKey()] = true
+			emit(op.original())
+		}
+	}
+	return errors.Join(append(errs, bw.Flush())...)
+}
+
+// shellCommand returns the shell command that executes op and the absolute
+// path of its output. The command is empty for operations without a shell
+// equivalent.
+func (r OperationExecutor) shellCommand(ctx context.Context, cropper *ImagingCropper, op Operation) (string, string, error) {
+	op, destPath, err := r.plan(op)
+	if err != nil || destPath == "" || isRemoteSource(op.Filename()) {
+		return "", "", err
+	}
+	if destPath, err = filepath.Abs(destPath); err != nil {
+		return "", "", err
+	}
+	sourcePath, err := r.sourcePath(op.Filename())
+	if err != nil {
+		return "", "", err
+	}
+	if sourcePath, err = filepath.Abs(sourcePath); err != nil {
+		return "", "", err
+	}
+
+	switch {
+	case op.Pick != nil:
+		if r.MaxPickDimension > 0 {
+			width, height, err := imageDimensions(sourcePath, cropper.Orientation)
+			if err != nil {
+				return "", "", err
+			}
+			if max(width, height) > r.MaxPickDimension {
+				args := []string{"convert", shellQuote(sourcePath)}
+				if cropper.Orientation.applies() {
+					args = append(args, "-auto-orient")
+				}
+				args = append(args, "-resize", fmt.Sprintf("%dx%d", r.MaxPickDimension, r.MaxPickDimension))
+				if ext := strings.ToLower(filepath.Ext(destPath)); ext == ".jpg" || ext == ".jpeg" {
+					args = append(args, "-quality", fmt.Sprint(cropper.Quality))
+				}
+				args = append(args, shellQuote(destPath))
+				return strings.Join(args, " "), destPath, nil
+			}
+		}
+		return fmt.Sprintf("cp -- %s %s", shellQuote(sourcePath), shellQuote(destPath)), destPath, nil
+	case op.Crop != nil:
+		width, height, err := imageDimensions(sourcePath, cropper.Orientation)
+		if err != nil {
+			return "", "", err
+		}
+		bounds := op.Crop.bounds(width, height)
+		rect, err := cropper.cropRect(ctx, *op.Crop, bounds)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to crop %s: %w", op.Crop.Filename, err)
+		}
+		args := []string{"convert", shellQuote(sourcePath)}
+		if cropper.Orientation.applies() {
+			args = append(args, "-auto-orient")
+		}
+		if op.Crop.Rotate != 0 {
+			// ImageMagick rotates clockwise, and may size the rotated
+			// image a pixel off from the built-in cropper.
+			args = append(args, "-background", "black", "-rotate", strconv.FormatFloat(-op.Crop.Rotate, 'f', -1, 64), "+repage")
+		}
+		args = append(args, "-crop", fmt.Sprintf("%dx%d+%d+%d", rect.Dx(), rect.Dy(), rect.Min.X, rect.Min.Y), "+repage")
+		if cropper.Fill != nil && !rect.In(bounds) {
+			// Crops only extend past the right and bottom edges, which
+			// -extent pads from the top left corner.
+			fill := color.NRGBAModel.Convert(cropper.Fill).(color.NRGBA)
+			args = append(args, "-background", shellQuote(fmt.Sprintf("#%02x%02x%02x%02x", fill.R, fill.G, fill.B, fill.A)), "-extent", fmt.Sprintf("%dx%d", rect.Dx(), rect.Dy()))
+		}
+		if ext := strings.ToLower(filepath.Ext(destPath)); ext == ".jpg" || ext == ".jpeg" {
+			args = append(args, "-quality", fmt.Sprint(cmp.Or(op.Crop.Quality, cropper.Quality)))
+			if maxSize := cmp.Or(op.Crop.MaxFileSize, cropper.MaxFileSize); maxSize > 0 {
+				// ImageMagick searches for the quality itself, which lands
+				// on about the same one.
+				args = append(args, "-define", fmt.Sprintf("jpeg:extent=%d", maxSize))
+			}
+		}
+		args = append(args, shellQuote(destPath))
+		return strings.Join(args, " "), destPath, nil
+	}
+	return "", "", nil
+}
+
+// shellQuote quotes s as a single word for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
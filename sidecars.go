@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// sidecarExtensions are the extensions of files that hold metadata of the
+// image with the same name, such as the edits of RAW converters in .xmp
+// files or the metadata of photo exports in .json files.
+var sidecarExtensions = []string{".xmp", ".json"}
+
+// sidecarNames returns the names the sidecars of the image at name can
+// have: next to its stem, like IMG_0001.xmp, or its whole name, like
+// IMG_0001.JPG.xmp.
+func sidecarNames(name string) []string {
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	var names []string
+	for _, ext := range sidecarExtensions {
+		names = append(names, stem+ext, name+ext)
+	}
+	return names
+}
+
+// sidecarIndex holds the files of a listing that aren't images, by their
+// lowercased relative path, to find the sidecars of the images among them
+// regardless of case.
+type sidecarIndex map[string]string
+
+func (idx sidecarIndex) add(relPath string) {
+	idx[strings.ToLower(relPath)] = relPath
+}
+
+// attach sets the sidecars of files to those in the index.
+func (idx sidecarIndex) attach(files []FileInfo) {
+	for i := range files {
+		if files[i].IsDir {
+			continue
+		}
+		for _, name := range sidecarNames(strings.ToLower(files[i].Name)) {
+			if sidecar, ok := idx[name]; ok {
+				files[i].Sidecars = append(files[i].Sidecars, sidecar)
+			}
+		}
+	}
+}
+
+// isSidecarFile reports whether name has a sidecar extension, so listings
+// only index the files that can be one.
+func isSidecarFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range sidecarExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// copySidecars copies the sidecars of the picked source filename next to
+// its output at savePath, named after it, so IMG_0001.xmp of a pick saved
+// as wedding-001.jpg becomes wedding-001.xmp. Remote sources have none.
+func (r OperationExecutor) copySidecars(ctx context.Context, filename, savePath string) error {
+	if isRemoteSource(filename) {
+		return nil
+	}
+	saveStem := strings.TrimSuffix(savePath, filepath.Ext(savePath))
+	for _, name := range sidecarNames(filename) {
+		ext := filepath.Ext(name)
+		// Listings match sidecars regardless of case, file systems may not.
+		for _, sidecar := range []string{name, strings.TrimSuffix(name, ext) + strings.ToUpper(ext)} {
+			info, err := r.statSource(sidecar)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			destPath := saveStem + filepath.Ext(sidecar)
+			if strings.HasPrefix(sidecar, filename+".") {
+				destPath = savePath + filepath.Ext(sidecar)
+			}
+			if err := r.copyAlongside(ctx, "sidecar", filename, sidecar, destPath); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// copyCompanions copies the companions of the picked source filename next
+// to its output at savePath, named after it like sidecars are: files with
+// the same stem and one of Companions, such as IMG_0001.MOV of a
+// live photo or IMG_0001.CR2 of a RAW+JPEG pair. Remote sources have none.
+func (r OperationExecutor) copyCompanions(ctx context.Context, filename, savePath string) error {
+	if isRemoteSource(filename) {
+		return nil
+	}
+	stem := strings.TrimSuffix(filename, filepath.Ext(filename))
+	saveStem := strings.TrimSuffix(savePath, filepath.Ext(savePath))
+	for _, ext := range r.Companions {
+		if strings.EqualFold(ext, filepath.Ext(filename)) || (r.IncludeSidecars && slices.Contains(sidecarExtensions, ext)) {
+			continue
+		}
+		for _, companion := range []string{stem + ext, stem + strings.ToUpper(ext)} {
+			info, err := r.statSource(companion)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if err := r.copyAlongside(ctx, "companion", filename, companion, saveStem+filepath.Ext(companion)); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// parseCompanionExtensions normalizes extensions such as "MOV" or ".txt"
+// to lowercase with a leading dot.
+func parseCompanionExtensions(exts []string) ([]string, error) {
+	var normalized []string
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext == "" || strings.ContainsAny(ext, `./\`) {
+			return nil, fmt.Errorf("invalid companion extension %q, expected an extension such as mov", ext)
+		}
+		if !slices.Contains(normalized, "."+ext) {
+			normalized = append(normalized, "."+ext)
+		}
+	}
+	return normalized, nil
+}
+
+// copyAlongside copies file, a sidecar or companion of the picked source
+// filename, to destPath.
+func (r OperationExecutor) copyAlongside(ctx context.Context, kind, filename, file, destPath string) error {
+	missing := missingFiles([]string{destPath})
+	f, err := r.openSource(ctx, file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := r.writeOutput(ctx, "pick", destPath, f); err != nil {
+		return fmt.Errorf("failed to copy %s %s: %w", kind, file, err)
+	}
+	// Like outputs, new sidecars and companions are removed when the save
+	// is undone.
+	if missing[destPath] && r.writesFiles() {
+		reportOutput(ctx, destPath)
+	}
+	log.Ctx(ctx).Info().Str("filename", filename).Str(kind, file).Str("output", destPath).Msg("copied " + kind)
+	return nil
+}
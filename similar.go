@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"image"
+	"iter"
+	"math/bits"
+	"runtime"
+	"slices"
+
+	"github.com/disintegration/imaging"
+	"github.com/rs/zerolog/log"
+	"github.com/sourcegraph/conc/pool"
+)
+
+// similarHashSize is the longest side images are scaled down to before
+// they're hashed. It's the smallest size that keeps decoding cheap with
+// scaled JPEG decodes, while the hash is computed on far fewer pixels.
+const similarHashSize = 64
+
+// perceptualHash returns the difference hash of img: a bit for each pair of
+// horizontally adjacent pixels of a 9x8 grayscale copy, set when the left
+// one is brighter. Similar images have hashes that differ in few bits,
+// regardless of their size, compression or small edits.
+func perceptualHash(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Lanczos))
+	var hash uint64
+	for y := range 8 {
+		row := small.Pix[y*small.Stride:]
+		for x := range 8 {
+			hash <<= 1
+			if row[x*4] > row[(x+1)*4] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// similarSource is a source of a batch, as it's compared to the others.
+type similarSource struct {
+	filename string
+	hash     uint64
+	// pixels is the area of the original image, to tell which of two near
+	// duplicates is the largest.
+	pixels int
+	// keptAs is the source it's a near duplicate of and skipped for, if any.
+	keptAs *similarSource
+}
+
+// dedupeSimilar returns ops without the operations of sources that are near
+// duplicates of an earlier source of the batch, by perceptual hash. Of each
+// group of near duplicates, the first source is kept, or the largest one
+// with DedupeKeepLargest. The whole sequence is read and its sources hashed
+// before the first operation is returned. Sources that can't be hashed,
+// such as remote ones or those of archives, are always kept, and so are
+// animations, whose frames are meant to look alike.
+func (r OperationExecutor) dedupeSimilar(ctx context.Context, ops iter.Seq[Operation]) iter.Seq[Operation] {
+	return func(yield func(Operation) bool) {
+		batch := slices.Collect(ops)
+		sources := map[string]*similarSource{}
+		var order []*similarSource
+		for _, op := range batch {
+			filename := op.Filename()
+			if op.Animation != nil || isRemoteSource(filename) || r.Archive != nil || sources[filename] != nil {
+				continue
+			}
+			if _, err := r.sourcePath(filename); err != nil {
+				continue
+			}
+			source := &similarSource{filename: filename}
+			sources[filename] = source
+			order = append(order, source)
+		}
+		r.hashSources(ctx, order)
+
+		var kept []*similarSource
+		for _, source := range order {
+			if source.pixels == 0 {
+				continue
+			}
+			i := slices.IndexFunc(kept, func(k *similarSource) bool {
+				return bits.OnesCount64(k.hash^source.hash) <= r.SimilarDistance
+			})
+			switch {
+			case i < 0:
+				kept = append(kept, source)
+			case r.DedupeKeepLargest && source.pixels > kept[i].pixels:
+				// The larger source takes the place of the one kept so far,
+				// along with the sources skipped for it.
+				for _, other := range order {
+					if other.keptAs == kept[i] {
+						other.keptAs = source
+					}
+				}
+				kept[i].keptAs = source
+				kept[i] = source
+			default:
+				source.keptAs = kept[i]
+			}
+		}
+
+		logged := map[string]bool{}
+		for _, op := range batch {
+			source := sources[op.Filename()]
+			if source != nil && source.keptAs != nil && op.Animation == nil {
+				if !logged[source.filename] {
+					logged[source.filename] = true
+					log.Ctx(ctx).Info().
+						Str("filename", source.filename).
+						Str("kept", source.keptAs.filename).
+						Int("distance", bits.OnesCount64(source.hash^source.keptAs.hash)).
+						Msg("skipping, a near duplicate of another source of the batch")
+				}
+				continue
+			}
+			if !yield(op) {
+				return
+			}
+		}
+	}
+}
+
+// hashSources computes the perceptual hash and size of each source,
+// decoding them concurrently. Sources that fail to decode are left unhashed
+// and logged, and their operations fail on their own when they're executed.
+func (r OperationExecutor) hashSources(ctx context.Context, sources []*similarSource) {
+	concurrency := r.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	var decodes decodeSemaphore
+	if cropper, ok := r.Cropper.(*ImagingCropper); ok {
+		decodes = cropper.Decodes
+	}
+	p := pool.New().WithMaxGoroutines(concurrency)
+	for _, source := range sources {
+		p.Go(func() {
+			release, err := decodes.acquire(ctx)
+			if err != nil {
+				return
+			}
+			defer release()
+			path, _ := r.sourcePath(source.filename)
+			thumb, original, err := thumbnail(ctx, path, similarHashSize, r.Orientation, true)
+			if err != nil {
+				log.Ctx(ctx).Debug().Err(err).Str("filename", source.filename).Msg("failed to hash source, keeping it")
+				return
+			}
+			source.hash = perceptualHash(thumb)
+			source.pixels = original.X * original.Y
+		})
+	}
+	p.Wait()
+}
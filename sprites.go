@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/disintegration/imaging"
+	"github.com/rs/zerolog/log"
+	"github.com/sourcegraph/conc/pool"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// SpriteTile is the position of one thumbnail inside a sprite sheet.
+type SpriteTile struct {
+	Filename string `json:"filename"`
+	X        int    `json:"x"`
+	Y        int    `json:"y"`
+	Width    int    `json:"w"`
+	Height   int    `json:"h"`
+}
+
+// SpriteSheet is a page of thumbnails composited into a single image.
+type SpriteSheet struct {
+	// Image is the sheet as a JPEG data URL.
+	Image  string       `json:"image"`
+	Width  int          `json:"width"`
+	Height int          `json:"height"`
+	Tiles  []SpriteTile `json:"tiles"`
+	// Total is the number of images across all pages.
+	Total int `json:"total"`
+}
+
+// defaultSpriteSize is the default cell size of sprite sheets, which is
+// also the size of prewarmed thumbnails.
+const defaultSpriteSize = 160
+
+// Label modes for sprite sheet thumbnails.
+const (
+	LabelNone = ""
+	LabelName = "name"
+	LabelSize = "size"
+)
+
+const (
+	labelPad = 2
+	// labelGlyphWidth is the advance of every glyph in basicfont.Face7x13.
+	labelGlyphWidth = 7
+)
+
+// thumbnail decodes the image at path and scales it to fit in a size x size
+// box, oriented according to policy. It also returns the dimensions of the
+// original image. With scaled, large JPEGs are decoded at a reduced scale
+// that's still at least size, when the decoder supports it.
+func thumbnail(ctx context.Context, path string, size int, policy OrientationPolicy, scaled bool) (image.Image, image.Point, error) {
+	if scaled && jpegScaledDecode {
+		img, original, err := scaledThumbnail(path, size, policy)
+		if err == nil {
+			return img, original, nil
+		}
+		log.Ctx(ctx).Debug().Err(err).Str("path", path).Msg("Scaled decode failed, decoding at full size")
+	}
+	img, err := imaging.Open(path, imaging.AutoOrientation(policy.applies()))
+	if err != nil {
+		return nil, image.Point{}, fmt.Errorf("failed to open image %s: %w", path, err)
+	}
+	return imaging.Fit(img, size, size, imaging.Lanczos), img.Bounds().Size(), nil
+}
+
+// scaledThumbnail is like thumbnail, but decodes the JPEG at path at the
+// smallest scale of 1/2, 1/4 or 1/8 that still fills a size x size box.
+func scaledThumbnail(path string, size int, policy OrientationPolicy) (image.Image, image.Point, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, image.Point{}, fmt.Errorf("failed to open image %s: %w", path, err)
+	}
+	jpeg, err := decodeJPEGInfo(bytes.NewReader(data))
+	if err != nil {
+		return nil, image.Point{}, fmt.Errorf("failed to read header of %s: %w", path, err)
+	}
+	denom := decodeScale(max(jpeg.Width, jpeg.Height), size)
+	if denom == 1 {
+		return nil, image.Point{}, fmt.Errorf("%s is too small to decode at a reduced scale", path)
+	}
+	img, err := decodeJPEGScaled(data, denom)
+	if err != nil {
+		return nil, image.Point{}, err
+	}
+	info := newImageInfo(jpeg, policy)
+	if policy.applies() {
+		img = applyOrientation(img, info.Orientation)
+	}
+	return imaging.Fit(img, size, size, imaging.Lanczos), image.Pt(info.Width, info.Height), nil
+}
+
+// decodeScale returns the largest of 8, 4 and 2 that an image whose longest
+// side is side can be divided by and still be at least size, or 1 when it
+// can't be scaled down.
+func decodeScale(side, size int) int {
+	for _, denom := range []int{8, 4, 2} {
+		// Scaled decoders round partial blocks up.
+		if (side+denom-1)/denom >= size {
+			return denom
+		}
+	}
+	return 1
+}
+
+// drawLabel burns text onto a translucent strip at the bottom of img,
+// cutting it short when it doesn't fit the width.
+func drawLabel(img image.Image, text string) *image.NRGBA {
+	out := imaging.Clone(img)
+	bounds := out.Bounds()
+	face := basicfont.Face7x13
+	stripHeight := face.Height + labelPad*2
+	if bounds.Dy() < stripHeight || bounds.Dx() < labelGlyphWidth+labelPad*2 {
+		return out
+	}
+
+	maxChars := (bounds.Dx() - labelPad*2) / labelGlyphWidth
+	if runes := []rune(text); len(runes) > maxChars {
+		text = string(runes[:maxChars-1]) + "~"
+	}
+
+	strip := image.Rect(bounds.Min.X, bounds.Max.Y-stripHeight, bounds.Max.X, bounds.Max.Y)
+	draw.Draw(out, strip, image.NewUniform(color.NRGBA{A: 160}), image.Point{}, draw.Over)
+	d := font.Drawer{
+		Dst:  out,
+		Src:  image.White,
+		Face: face,
+		Dot:  fixed.P(strip.Min.X+labelPad, strip.Max.Y-labelPad-face.Descent),
+	}
+	d.DrawString(text)
+	return out
+}
+
+// buildSpriteSheet composites thumbnails of files (names relative to
+// rootPath) into a square-ish grid of size x size cells. Each thumbnail is
+// centered in its cell and the returned tiles give its exact rectangle.
+// Thumbnails are taken from cache, and label burns the file name
+// (LabelName), or the name and original dimensions (LabelSize), onto each
+// thumbnail. Images that fail to decode
+// are left out of the sheet.
+func buildSpriteSheet(ctx context.Context, rootPath string, files []string, total, size int, label string, opts WalkOptions, cache *thumbnailCache) (SpriteSheet, error) {
+	thumbs := make([]image.Image, len(files))
+	p := pool.New().WithMaxGoroutines(opts.concurrency())
+	for i, name := range files {
+		p.Go(func() {
+			thumb, original, err := cache.get(ctx, filepath.Join(rootPath, name), size, opts.Orientation)
+			if err != nil {
+				log.Ctx(ctx).Warn().Err(err).Str("filename", name).Msg("Failed to create thumbnail")
+				return
+			}
+			switch label {
+			case LabelName:
+				thumb = drawLabel(thumb, filepath.Base(name))
+			case LabelSize:
+				thumb = drawLabel(thumb, fmt.Sprintf("%s %dx%d", filepath.Base(name), original.X, original.Y))
+			}
+			thumbs[i] = thumb
+		})
+	}
+	p.Wait()
+
+	columns := max(1, int(math.Ceil(math.Sqrt(float64(len(files))))))
+	rows := max(1, (len(files)+columns-1)/columns)
+	sheet := imaging.New(columns*size, rows*size, color.Black)
+
+	tiles := make([]SpriteTile, 0, len(files))
+	for i, thumb := range thumbs {
+		if thumb == nil {
+			continue
+		}
+		bounds := thumb.Bounds()
+		x := (i%columns)*size + (size-bounds.Dx())/2
+		y := (i/columns)*size + (size-bounds.Dy())/2
+		sheet = imaging.Paste(sheet, thumb, image.Pt(x, y))
+		tiles = append(tiles, SpriteTile{
+			Filename: files[i],
+			X:        x,
+			Y:        y,
+			Width:    bounds.Dx(),
+			Height:   bounds.Dy(),
+		})
+	}
+
+	var b bytes.Buffer
+	if err := imaging.Encode(&b, sheet, imaging.JPEG, imaging.JPEGQuality(80)); err != nil {
+		return SpriteSheet{}, fmt.Errorf("failed to encode sprite sheet: %w", err)
+	}
+	return SpriteSheet{
+		Image:  "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(b.Bytes()),
+		Width:  sheet.Bounds().Dx(),
+		Height: sheet.Bounds().Dy(),
+		Tiles:  tiles,
+		Total:  total,
+	}, nil
+}
@@ -18,6 +18,7 @@ const cropperApp = () => ({
     busy: false,
     aspectRatios: ASPECT_RATIOS,
     operations: [],
+    label: "",
     isFullScreen: false,
     hasOverlay: false,
     async setCustomAspectRatio() {
@@ -149,6 +150,7 @@ const cropperApp = () => ({
 
         const newOp = new Operation({
             type: "crop",
+            label: this.label,
             crop: this.cropData,
             image: {
                 ...this.currentImage,
@@ -171,6 +173,7 @@ const cropperApp = () => ({
     async onPickImage() {
         let newOp = new Operation({
             type: "pick",
+            label: this.label,
             image: this.currentImage,
         });
         if (this.operations.find(op => op.equals(newOp))) {
@@ -232,15 +235,21 @@ const cropperApp = () => ({
         const payload = this.operations.map(op => ({
             type: op.type,
             filename: op.image.name,
+            label: op.label || undefined,
             crop: op.crop,
         }));
         await this.spin(async () => {
-            await fetchJSON('/api/save', {
+            const result = await fetchJSON('/api/save', {
                 method: 'POST',
                 body: JSON.stringify({
                     operations: payload,
                 }),
             });
+            if (result?.executed === false) {
+                const outputs = (result.planned ?? []).map(p => p.output || p.error).join('\n');
+                alert(`Preview mode, nothing was saved. These outputs would have been written:\n${outputs}`);
+                return;
+            }
             await this.shutdown();
         })
     },
@@ -290,10 +299,12 @@ class Operation {
      * @param {string} params.type - Type of operation (e.g., "crop", "pick")
      * @param {ImageInfo} params.image - Image object with a URL
      * @param {CropData} params.crop - Crop data with x, y, w, h properties
+     * @param {string} [params.label] - Label that groups the output into a subdirectory
      */
-    constructor({type, image, crop}) {
+    constructor({type, image, crop, label = ""}) {
         this.id = crypto.randomUUID();
         this.type = type;
+        this.label = label.trim();
         this.image = image;
         this.crop = crop;
     }
@@ -307,6 +318,7 @@ class Operation {
         }
 
         return this.type === other.type &&
+            this.label === other.label &&
             this.image.url === other.image.url &&
             JSON.stringify(this.crop) === JSON.stringify(other.crop);
     }
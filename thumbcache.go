@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/rs/zerolog/log"
+	"github.com/sourcegraph/conc/pool"
+)
+
+// thumbnailCacheSize is the most bytes of encoded thumbnails kept in memory.
+// At the default sprite size a thumbnail is around 10 KB, so it holds tens
+// of thousands.
+const thumbnailCacheSize = 256 << 20
+
+// prewarmBackoff is how long prewarming waits before checking again whether
+// foreground requests are done.
+const prewarmBackoff = 100 * time.Millisecond
+
+// thumbnailKey identifies a thumbnail. The modification time and size of the
+// file are part of it, so edited files get a new thumbnail.
+type thumbnailKey struct {
+	path     string
+	size     int
+	policy   OrientationPolicy
+	modTime  int64
+	fileSize int64
+}
+
+type cachedThumbnail struct {
+	key thumbnailKey
+	// data is the thumbnail as a JPEG.
+	data     []byte
+	original image.Point
+}
+
+// thumbnailCache keeps the most recently used thumbnails as JPEGs, up to a
+// total size, evicting the least recently used ones beyond it.
+type thumbnailCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	bytes    int
+	entries  map[thumbnailKey]*list.Element
+	// order holds the entries, most recently used first.
+	order *list.List
+	// scaledDecode generates thumbnails with scaled decoding.
+	scaledDecode bool
+	// decodes caps how many thumbnails are generated at once, along with
+	// whatever else shares it.
+	decodes decodeSemaphore
+	// posters generates the thumbnails of videos from their poster, when
+	// videos are listed.
+	posters *VideoPosters
+}
+
+func newThumbnailCache(maxBytes int, scaledDecode bool, decodes decodeSemaphore, posters *VideoPosters) *thumbnailCache {
+	return &thumbnailCache{
+		maxBytes:     maxBytes,
+		scaledDecode: scaledDecode,
+		decodes:      decodes,
+		posters:      posters,
+		entries:      map[thumbnailKey]*list.Element{},
+		order:        list.New(),
+	}
+}
+
+// get returns the thumbnail of the image at path, scaled to fit in a size x
+// size box and oriented according to policy, and the dimensions of the
+// original image. It's generated and cached when it isn't cached, or when
+// the file changed since.
+func (c *thumbnailCache) get(ctx context.Context, path string, size int, policy OrientationPolicy) (image.Image, image.Point, error) {
+	key, err := newThumbnailKey(path, size, policy)
+	if err != nil {
+		return nil, image.Point{}, err
+	}
+	thumb, ok := c.lookup(key)
+	if !ok {
+		if thumb, err = c.generate(ctx, key); err != nil {
+			return nil, image.Point{}, err
+		}
+	}
+	img, err := imaging.Decode(bytes.NewReader(thumb.data))
+	if err != nil {
+		return nil, image.Point{}, fmt.Errorf("failed to decode thumbnail of %s: %w", path, err)
+	}
+	return img, thumb.original, nil
+}
+
+// warm generates the thumbnail of the image at path unless it's cached.
+func (c *thumbnailCache) warm(ctx context.Context, path string, size int, policy OrientationPolicy) error {
+	key, err := newThumbnailKey(path, size, policy)
+	if err != nil {
+		return err
+	}
+	if _, ok := c.lookup(key); ok {
+		return nil
+	}
+	_, err = c.generate(ctx, key)
+	return err
+}
+
+func newThumbnailKey(path string, size int, policy OrientationPolicy) (thumbnailKey, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return thumbnailKey{}, fmt.Errorf("failed to stat file %s: %w", path, err)
+	}
+	return thumbnailKey{
+		path:     path,
+		size:     size,
+		policy:   policy,
+		modTime:  info.ModTime().UnixNano(),
+		fileSize: info.Size(),
+	}, nil
+}
+
+func (c *thumbnailCache) generate(ctx context.Context, key thumbnailKey) (*cachedThumbnail, error) {
+	release, err := c.decodes.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var img image.Image
+	var original image.Point
+	if c.posters != nil && isVideoFile(key.path) {
+		img, original, err = c.posters.thumbnail(ctx, key.path, key.size)
+	} else {
+		img, original, err = thumbnail(ctx, key.path, key.size, key.policy, c.scaledDecode)
+	}
+	release()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := imaging.Encode(&b, img, imaging.JPEG, imaging.JPEGQuality(90)); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail of %s: %w", key.path, err)
+	}
+	thumb := &cachedThumbnail{key: key, data: b.Bytes(), original: original}
+	c.add(thumb)
+	return thumb, nil
+}
+
+func (c *thumbnailCache) lookup(key thumbnailKey) (*cachedThumbnail, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cachedThumbnail), true
+}
+
+func (c *thumbnailCache) add(thumb *cachedThumbnail) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[thumb.key]; ok {
+		// Generated concurrently by another request.
+		return
+	}
+	c.entries[thumb.key] = c.order.PushFront(thumb)
+	c.bytes += len(thumb.data)
+	for c.bytes > c.maxBytes && c.order.Len() > 1 {
+		oldest := c.order.Back()
+		evicted := c.order.Remove(oldest).(*cachedThumbnail)
+		delete(c.entries, evicted.key)
+		c.bytes -= len(evicted.data)
+	}
+}
+
+// prewarmThumbnails fills cache with the thumbnails of files, relative to
+// rootPath, at the given size, a few at a time. Whenever busy is above
+// zero, i.e. foreground requests are being served, it waits for them to
+// finish first. It returns when every thumbnail is cached or ctx is done.
+func prewarmThumbnails(ctx context.Context, cache *thumbnailCache, rootPath string, files []FileInfo, size int, opts WalkOptions, busy *atomic.Int32) {
+	start := time.Now()
+	p := pool.New().WithContext(ctx).WithMaxGoroutines(max(1, opts.concurrency()/2))
+	for _, file := range files {
+		p.Go(func(ctx context.Context) error {
+			for busy.Load() > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(prewarmBackoff):
+				}
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err := cache.warm(ctx, filepath.Join(rootPath, file.Name), size, opts.Orientation); err != nil {
+				log.Ctx(ctx).Warn().Err(err).Str("filename", file.Name).Msg("Failed to prewarm thumbnail")
+			}
+			return nil
+		})
+	}
+	if err := p.Wait(); err != nil {
+		log.Ctx(ctx).Debug().Err(err).Msg("Stopped prewarming thumbnails")
+		return
+	}
+	log.Ctx(ctx).Info().Int("files", len(files)).Dur("elapsed", time.Since(start)).Msg("Prewarmed thumbnails")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// undoDepth is the most saves /api/undo can reverse. Older ones are
+// forgotten.
+const undoDepth = 100
+
+type producedOutputsKey struct{}
+
+// producedOutputs collects the files created while executing operations
+// under a context, so the save they belong to can be undone.
+type producedOutputs struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+// withProducedOutputs returns a context that collects the outputs reported
+// under it.
+func withProducedOutputs(ctx context.Context) (context.Context, *producedOutputs) {
+	outputs := &producedOutputs{}
+	return context.WithValue(ctx, producedOutputsKey{}, outputs), outputs
+}
+
+// reportOutput adds path to the collector of ctx, if it has one.
+func reportOutput(ctx context.Context, path string) {
+	outputs, ok := ctx.Value(producedOutputsKey{}).(*producedOutputs)
+	if !ok {
+		return
+	}
+	outputs.mu.Lock()
+	defer outputs.mu.Unlock()
+	outputs.paths = append(outputs.paths, path)
+}
+
+func (o *producedOutputs) list() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.paths
+}
+
+// outputFiles returns the files an operation writing destPath may create:
+// the output itself and its provenance and metadata sidecars.
+func outputFiles(destPath string) []string {
+	return []string{destPath, destPath + ".json", destPath + ".meta.json"}
+}
+
+// missingFiles returns which of paths don't exist.
+func missingFiles(paths []string) map[string]bool {
+	missing := map[string]bool{}
+	for _, path := range paths {
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			missing[path] = true
+		}
+	}
+	return missing
+}
+
+// undoStack holds the files created by every save of a session, latest
+// last, so they can be removed one save at a time.
+type undoStack struct {
+	mu    sync.Mutex
+	saves [][]string
+}
+
+// push records the outputs of a save. Saves that created nothing aren't
+// recorded, so undoing never appears to do nothing.
+func (s *undoStack) push(outputs []string) {
+	if len(outputs) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saves = append(s.saves, outputs)
+	if len(s.saves) > undoDepth {
+		s.saves = s.saves[len(s.saves)-undoDepth:]
+	}
+}
+
+// pop removes the latest save and returns its outputs, and the number of
+// saves left to undo.
+func (s *undoStack) pop() ([]string, int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.saves) == 0 {
+		return nil, 0, false
+	}
+	outputs := s.saves[len(s.saves)-1]
+	s.saves = s.saves[:len(s.saves)-1]
+	return outputs, len(s.saves), true
+}
+
+// removeOutputs deletes outputs, along with the directories under
+// outputDir they leave empty, and returns the paths of the ones it deleted
+// relative to outputDir. Outputs that are already gone are skipped.
+func removeOutputs(outputDir string, outputs []string) ([]string, error) {
+	removed := []string{}
+	var errs []error
+	for _, path := range outputs {
+		if err := os.Remove(path); errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove output %s: %w", path, err))
+			continue
+		}
+		if rel, err := filepath.Rel(outputDir, path); err == nil {
+			removed = append(removed, filepath.ToSlash(rel))
+		}
+		for dir := filepath.Dir(path); isSubdir(outputDir, dir); dir = filepath.Dir(dir) {
+			// Fails on directories that still have files, which are kept.
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// isSubdir reports whether dir is below parent, and not parent itself.
+func isSubdir(parent, dir string) bool {
+	rel, err := filepath.Rel(parent, dir)
+	return err == nil && rel != "." && filepath.IsLocal(rel)
+}
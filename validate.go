@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type validateCmd struct {
+	OperationsFile string `arg:"" help:"JSONL file with one operation per line, or - to read from stdin" default:"-"`
+}
+
+func (cmd *validateCmd) Run() error {
+	r, err := openInput(cmd.OperationsFile)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var valid, invalid int
+	for line, err := range readOperationLines(r) {
+		if err != nil {
+			invalid++
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		if err := line.Operation.Validate(); err != nil {
+			invalid++
+			fmt.Fprintf(os.Stderr, "line %d: %v\n", line.Line, err)
+			continue
+		}
+		valid++
+	}
+
+	fmt.Fprintf(os.Stderr, "%d valid, %d invalid operations\n", valid, invalid)
+	if invalid > 0 {
+		return fmt.Errorf("found %d invalid operations", invalid)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+// videoExtensions are the extensions of videos, which are listed with a
+// poster of their first frame when videos are enabled.
+var videoExtensions = []string{".mp4", ".mov", ".m4v", ".webm", ".mkv", ".avi"}
+
+func isVideoFile(name string) bool {
+	return slices.Contains(videoExtensions, strings.ToLower(filepath.Ext(name)))
+}
+
+// posterCacheSize is the most bytes of posters kept in memory. Posters are
+// full size, so it holds a few hundred of those of HD videos.
+const posterCacheSize = 64 << 20
+
+// posterKey identifies a poster. Like thumbnails, posters of videos that
+// changed since they were extracted are extracted again.
+type posterKey struct {
+	path     string
+	modTime  int64
+	fileSize int64
+}
+
+type cachedPoster struct {
+	key  posterKey
+	data []byte
+}
+
+// VideoPosters extracts the first frame of videos with ffmpeg, as a JPEG
+// poster that stands in for the video in listings, views and sprites. The
+// most recently used posters are cached.
+type VideoPosters struct {
+	// FFmpeg is the ffmpeg executable.
+	FFmpeg string
+
+	mu      sync.Mutex
+	bytes   int
+	entries map[posterKey]*list.Element
+	// order holds the entries, most recently used first.
+	order *list.List
+}
+
+// newVideoPosters returns posters extracted with the ffmpeg executable,
+// which is looked up in PATH unless it's a path, so a missing ffmpeg is
+// reported up front rather than for every video.
+func newVideoPosters(ffmpeg string) (*VideoPosters, error) {
+	path, err := exec.LookPath(ffmpeg)
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg is needed to list videos: %w", err)
+	}
+	return &VideoPosters{FFmpeg: path, entries: map[posterKey]*list.Element{}, order: list.New()}, nil
+}
+
+// Poster returns the first frame of the video at path as a JPEG. It's
+// rotated like players show the video.
+func (v *VideoPosters) Poster(ctx context.Context, path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file %s: %w", path, err)
+	}
+	key := posterKey{path: path, modTime: info.ModTime().UnixNano(), fileSize: info.Size()}
+	v.mu.Lock()
+	if elem, ok := v.entries[key]; ok {
+		v.order.MoveToFront(elem)
+		v.mu.Unlock()
+		return elem.Value.(*cachedPoster).data, nil
+	}
+	v.mu.Unlock()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, v.FFmpeg, "-nostdin", "-v", "error", "-i", path, "-frames:v", "1", "-f", "image2pipe", "-c:v", "mjpeg", "-q:v", "2", "-")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to extract poster of %s: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("failed to extract poster of %s: it has no video frames", path)
+	}
+	v.add(&cachedPoster{key: key, data: stdout.Bytes()})
+	return stdout.Bytes(), nil
+}
+
+func (v *VideoPosters) add(poster *cachedPoster) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.entries[poster.key]; ok || len(poster.data) > posterCacheSize {
+		return
+	}
+	v.entries[poster.key] = v.order.PushFront(poster)
+	v.bytes += len(poster.data)
+	for v.bytes > posterCacheSize {
+		oldest := v.order.Back()
+		evicted := v.order.Remove(oldest).(*cachedPoster)
+		delete(v.entries, evicted.key)
+		v.bytes -= len(evicted.data)
+	}
+}
+
+// open opens the poster of the video at path, like a file, for the
+// functions that read images with an open function.
+func (v *VideoPosters) open(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	data, err := v.Poster(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return nopSeekCloser{bytes.NewReader(data)}, nil
+}
+
+// thumbnail is like thumbnail for the poster of the video at path. The
+// dimensions are those of the video.
+func (v *VideoPosters) thumbnail(ctx context.Context, path string, size int) (image.Image, image.Point, error) {
+	data, err := v.Poster(ctx, path)
+	if err != nil {
+		return nil, image.Point{}, err
+	}
+	img, err := imaging.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, image.Point{}, fmt.Errorf("failed to decode poster of %s: %w", path, err)
+	}
+	return imaging.Fit(img, size, size, imaging.Lanczos), img.Bounds().Size(), nil
+}
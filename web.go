@@ -1,19 +1,33 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"embed"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/disintegration/imaging"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/filesystem"
+	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/rs/zerolog/log"
 )
 
@@ -22,32 +36,283 @@ var staticFS embed.FS
 var isDebug = os.Getenv("DEBUG") == "1"
 
 type Config struct {
-	RootDir          string
+	RootDir string
+	// Archive is the zip archive RootDir points at, when the root is one.
+	// Listings and /api/view read from it, and endpoints that need a
+	// directory root are rejected.
+	Archive *sourceArchive
+	// OutputDir is where operations write their outputs. It's needed by the
+	// endpoints that manage exported files.
+	OutputDir string
+	// HistoryPath is the crop history log /api/history reads, which is
+	// shared by every session of timestamped outputs. When empty, files
+	// have no history.
+	HistoryPath string
+	// ReadOnly rejects every request that would write or delete files.
+	ReadOnly bool
+	// PreviewMode answers saves with the outputs they would produce, from
+	// OnPlan, without executing them, and rejects every other request that
+	// would write or delete files.
+	PreviewMode bool
+	// Headless serves only the API, without the bundled frontend.
+	Headless bool
+	// Walk controls listing. Its orientation policy also applies to /api/view.
+	Walk WalkOptions
+	// Presets are the crop presets served at /api/presets.
+	Presets          []CropPreset
 	OnBeforeShutdown func()
 	OnReady          func(addr string)
-	OnSave           func(ops Operations)
+	// Executor executes saves and plans them when OnSave and OnPlan aren't
+	// set. Its Cropper does the image work, so tests can save through the
+	// app without real images by setting one that fakes it.
+	Executor *OperationExecutor
+	// OnSave executes the operations of a save. ctx is cancelled when the
+	// save is cancelled with /api/cancel. It defaults to executing them
+	// with Executor.
+	OnSave func(ctx context.Context, ops Operations)
+	// OnPlan returns the outputs ops would produce without executing them.
+	// It defaults to planning them with Executor.
+	OnPlan func(ops Operations) []PlannedOutput
+	// AllowedOps restricts saves to these operation types. When empty, every
+	// type is allowed.
+	AllowedOps []string
+	// SaveDebounce delays running OnSave until no save has arrived for this
+	// long, and then runs only the latest batch. Zero runs every save
+	// immediately.
+	SaveDebounce time.Duration
+	// DefaultOp is the operation type that filenames posted to /api/save
+	// without an operation are expanded into: pick (the default) or
+	// metadata.
+	DefaultOp string
+	// Placeholder serves a stand-in for images that are missing from the
+	// root, instead of 404, so a gallery keeps its layout when files are
+	// moved mid-session. It's the image at PlaceholderImage, or a generated
+	// gray box labeled with the file name when that's empty.
+	Placeholder      bool
+	PlaceholderImage string
+	// MaxBandwidth caps the bytes per second sent by /api/view and
+	// /api/sprite, shared by all clients. Zero means no limit.
+	MaxBandwidth int64
+	// Prewarm generates the sprite thumbnails of every listed image in the
+	// background after the first listing, so they're cached by the time the
+	// frontend scrolls to them. It yields to requests being served.
+	Prewarm bool
+	// ScaledDecode decodes large JPEGs at a reduced scale for sprite
+	// thumbnails and rotation previews, which don't need full resolution.
+	ScaledDecode bool
+	// MaxConcurrentRequests caps how many requests that read or decode
+	// images are served at once. The rest wait for their turn. Other API
+	// requests aren't limited. Zero means no limit.
+	MaxConcurrentRequests int
+	// Decodes caps how many images requests decode at once, for previews,
+	// comparisons and sprite thumbnails. It's the semaphore of the
+	// executor's cropper, so browsing and saves share the limit. Nil means
+	// no limit.
+	Decodes decodeSemaphore
+	// Session records the API requests served and the saves executed, when
+	// set.
+	Session *SessionRecorder
+	// IdleTimeout shuts the app down once no request has been served and
+	// no save executed for this long. Zero keeps it running.
+	IdleTimeout time.Duration
 }
 
+// saveDrainTimeout is how long the app waits on shutdown for saves that are
+// still executing operations.
+const saveDrainTimeout = time.Minute
+
 type WebApp struct {
 	config       Config
 	shutdownCh   chan struct{}
 	shutdownOnce sync.Once
+	// saves tracks OnSave calls in progress, so shutdown doesn't cut off
+	// outputs that are being written.
+	saves sync.WaitGroup
+	// debouncer coalesces saves when SaveDebounce is set.
+	debouncer *saveDebouncer
+	// running holds the cancel functions of the saves being executed, for
+	// /api/cancel.
+	running   map[int]context.CancelFunc
+	runningMu sync.Mutex
+	nextRun   int
+	// bandwidth throttles image responses when MaxBandwidth is set.
+	bandwidth *bandwidthLimiter
+	// thumbnails caches the thumbnails of sprite sheets.
+	thumbnails  *thumbnailCache
+	prewarmOnce sync.Once
+	// busy is the number of requests being served, which prewarming waits
+	// for.
+	busy atomic.Int32
+	// lastActive is when the last request started or finished, in Unix
+	// nanoseconds, for IdleTimeout.
+	lastActive atomic.Int64
+	// imageSlots holds a token per image request being served when
+	// MaxConcurrentRequests is set.
+	imageSlots chan struct{}
+	// undo holds the outputs of every save, for /api/undo.
+	undo undoStack
+	// started is part of listing ETags, so listings cached before a
+	// restart, possibly with other flags, aren't reused.
+	started time.Time
 }
 
 func NewWebApp(config Config) *WebApp {
-	return &WebApp{
+	if executor := config.Executor; executor != nil {
+		if config.OnSave == nil {
+			config.OnSave = func(ctx context.Context, ops Operations) {
+				executeSave(ctx, executor, ops)
+			}
+		}
+		if config.OnPlan == nil {
+			config.OnPlan = executor.Plan
+		}
+	}
+	a := &WebApp{
 		config:     config,
 		shutdownCh: make(chan struct{}),
+		bandwidth:  newBandwidthLimiter(config.MaxBandwidth),
+		running:    map[int]context.CancelFunc{},
+		thumbnails: newThumbnailCache(thumbnailCacheSize, config.ScaledDecode, config.Decodes, config.Walk.Videos),
+		started:    time.Now(),
+	}
+	if config.MaxConcurrentRequests > 0 {
+		a.imageSlots = make(chan struct{}, config.MaxConcurrentRequests)
+	}
+	return a
+}
+
+// executeSave executes the operations of a save with executor, logging
+// whether they failed or were cancelled, since saves have no caller to
+// return errors to once they're accepted.
+func executeSave(ctx context.Context, executor *OperationExecutor, ops Operations) {
+	if err := executor.Exec(ctx, ops); errors.Is(err, context.Canceled) {
+		log.Ctx(ctx).Warn().Msg("Save was cancelled")
+	} else if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to execute operations")
 	}
 }
 
+// runSave executes ops with OnSave, under a context derived from ctx that
+// cancelSaves cancels, and records the files it creates for /api/undo. It
+// returns the crops that were shrunk to fit their image.
+func (a *WebApp) runSave(ctx context.Context, ops Operations) []CropClamp {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ctx, clamps := withCropClamps(ctx)
+	ctx, outputs := withProducedOutputs(ctx)
+
+	a.runningMu.Lock()
+	id := a.nextRun
+	a.nextRun++
+	a.running[id] = cancel
+	a.runningMu.Unlock()
+	defer func() {
+		a.runningMu.Lock()
+		delete(a.running, id)
+		a.runningMu.Unlock()
+	}()
+
+	if err := a.config.Session.RecordSave(ops); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Failed to record save")
+	}
+	a.config.OnSave(ctx, ops)
+	a.undo.push(outputs.list())
+	return clamps.list()
+}
+
+// cancelSaves cancels every save being executed and returns how many there
+// were. Operations that have started finish or stop at their next
+// cancellation check, and no further ones are started.
+func (a *WebApp) cancelSaves() int {
+	a.runningMu.Lock()
+	defer a.runningMu.Unlock()
+	for _, cancel := range a.running {
+		cancel()
+	}
+	return len(a.running)
+}
+
 func (a *WebApp) Shutdown() {
 	a.shutdownOnce.Do(func() {
 		close(a.shutdownCh)
 	})
 }
 
+const ndjsonContentType = "application/x-ndjson"
+
+// previewModeHeader is set on /api/save responses in preview mode, where
+// nothing was executed.
+const previewModeHeader = "X-Preview-Mode"
+
+// wantsNDJSON reports whether the client asked for newline-delimited JSON,
+// with format=ndjson or by accepting application/x-ndjson.
+func wantsNDJSON(c *fiber.Ctx) bool {
+	if format := c.Query("format"); format != "" {
+		return format == "ndjson"
+	}
+	return c.Accepts(fiber.MIMEApplicationJSON, ndjsonContentType) == ndjsonContentType
+}
+
+// requireWritable rejects requests that would modify files when the app is read-only.
+func (a *WebApp) requireWritable(c *fiber.Ctx) error {
+	if a.config.ReadOnly {
+		return fiber.NewError(http.StatusForbidden, "server is read-only")
+	}
+	if a.config.PreviewMode {
+		return fiber.NewError(http.StatusForbidden, "server is in preview mode, nothing is written")
+	}
+	return c.Next()
+}
+
+// requireDirectoryRoot rejects requests to endpoints that read the root as
+// a directory when it's an archive.
+func (a *WebApp) requireDirectoryRoot(c *fiber.Ctx) error {
+	if a.config.Archive != nil {
+		return fiber.NewError(http.StatusNotImplemented, "not supported when serving an archive")
+	}
+	return c.Next()
+}
+
+// limitImageRequests queues image requests beyond MaxConcurrentRequests
+// until one that's being served is done, so bursts of them don't decode
+// every image at once.
+func (a *WebApp) limitImageRequests(c *fiber.Ctx) error {
+	if a.imageSlots == nil {
+		return c.Next()
+	}
+	a.imageSlots <- struct{}{}
+	defer func() { <-a.imageSlots }()
+	return c.Next()
+}
+
+// limitDecodes holds a slot of Decodes while a request that decodes images
+// is served, queuing it while the slots are taken by other requests or by
+// operations that are executing.
+func (a *WebApp) limitDecodes(c *fiber.Ctx) error {
+	release, err := a.config.Decodes.acquire(c.UserContext())
+	if err != nil {
+		return err
+	}
+	defer release()
+	return c.Next()
+}
+
+// requireSavable is requireWritable for saves, which are answered with
+// their plan in preview mode instead of being rejected.
+func (a *WebApp) requireSavable(c *fiber.Ctx) error {
+	if a.config.PreviewMode && !a.config.ReadOnly {
+		return c.Next()
+	}
+	return a.requireWritable(c)
+}
+
 func (a *WebApp) Run(ctx context.Context) error {
+	if a.config.SaveDebounce > 0 && a.config.OnSave != nil {
+		a.debouncer = newSaveDebouncer(a.config.SaveDebounce, &a.saves, func(ops Operations) {
+			a.runSave(ctx, ops)
+		})
+	}
+
 	webapp := fiber.New(fiber.Config{
 		Immutable:             true,
 		DisableStartupMessage: true,
@@ -57,16 +322,50 @@ func (a *WebApp) Run(ctx context.Context) error {
 				Str("path", c.Path()).
 				Str("method", c.Method()).
 				Msg("Request failed")
+			code, message := http.StatusInternalServerError, "Internal Server Error"
 			var fiberErr *fiber.Error
 			if errors.As(err, &fiberErr) {
 				if fiberErr.Code == http.StatusNotFound && c.Path() == "/favicon.ico" {
 					return nil
 				}
-				return c.Status(fiberErr.Code).JSON(fiber.Map{"error": fiberErr.Message})
+				code, message = fiberErr.Code, fiberErr.Message
 			}
-			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Internal Server Error"})
+			// People opening a URL directly get a page, the frontend's
+			// fetch calls keep getting JSON.
+			if wantsHTML(c) {
+				return sendErrorPage(c, code, message)
+			}
+			return c.Status(code).JSON(fiber.Map{"error": message})
+		},
+	})
+
+	webapp.Use(recover.New(recover.Config{
+		EnableStackTrace: true,
+		StackTraceHandler: func(c *fiber.Ctx, e any) {
+			log.Ctx(c.Context()).Error().
+				Interface("panic", e).
+				Str("path", c.Path()).
+				Str("stack", string(debug.Stack())).
+				Msg("Recovered from panic")
 		},
+	}))
+
+	webapp.Use(func(c *fiber.Ctx) error {
+		a.touch()
+		a.busy.Add(1)
+		defer func() {
+			a.busy.Add(-1)
+			a.touch()
+		}()
+		return c.Next()
 	})
+	if a.config.Session != nil {
+		webapp.Use(a.recordSession)
+	}
+
+	// Prewarming stops on shutdown rather than holding it up.
+	prewarmCtx, stopPrewarm := context.WithCancel(ctx)
+	defer stopPrewarm()
 
 	webapp.Hooks().OnListen(func(listen fiber.ListenData) error {
 		if fn := a.config.OnReady; fn != nil {
@@ -75,11 +374,16 @@ func (a *WebApp) Run(ctx context.Context) error {
 		return nil
 	})
 
+	if a.config.IdleTimeout > 0 {
+		go a.shutdownWhenIdle(ctx)
+	}
+
 	go func() {
 		select {
 		case <-ctx.Done():
 		case <-a.shutdownCh:
 		}
+		stopPrewarm()
 		if fn := a.config.OnBeforeShutdown; fn != nil {
 			fn()
 		}
@@ -88,43 +392,555 @@ func (a *WebApp) Run(ctx context.Context) error {
 		}
 	}()
 
-	filesRoot := http.Dir(a.config.RootDir)
-	webapp.Get("/api/view", func(c *fiber.Ctx) error {
+	var filesRoot http.FileSystem = http.Dir(a.config.RootDir)
+	if a.config.Archive != nil {
+		filesRoot = a.config.Archive.httpFS()
+	}
+	webapp.Get("/api/view", a.limitImageRequests, func(c *fiber.Ctx) error {
 		filePath := c.Query("file")
-		return filesystem.SendFile(c, filesRoot, filePath)
+		if err := a.checkListable(filepath.FromSlash(filePath)); err != nil {
+			return err
+		}
+		if a.config.Walk.Videos != nil && isVideoFile(filePath) {
+			return a.sendPoster(c, filePath)
+		}
+		if a.config.Placeholder && isImageFile(filePath) {
+			if f, err := filesRoot.Open(filePath); errors.Is(err, fs.ErrNotExist) {
+				return a.sendPlaceholder(c, filePath)
+			} else if err == nil {
+				f.Close()
+			}
+		}
+		if a.config.Walk.Orientation.applies() || !isImageFile(filePath) {
+			if a.bandwidth != nil {
+				return a.sendThrottledFile(c, filesRoot, filePath)
+			}
+			if err := filesystem.SendFile(c, filesRoot, filePath); err != nil {
+				return err
+			}
+			c.Type(typeExtension(filePath))
+			return nil
+		}
+
+		// Browsers apply the EXIF orientation, so clear it to show the
+		// image as stored, matching the listed dimensions and crops.
+		f, err := filesRoot.Open(filePath)
+		if err != nil {
+			return fiber.ErrNotFound
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return fmt.Errorf("failed to read image: %w", err)
+		}
+		clearOrientation(data)
+		c.Type(typeExtension(filePath))
+		return a.send(c, data)
 	})
 
 	webapp.Get("/api/ls", func(c *fiber.Ctx) error {
-		dir, err := walkImages(a.config.RootDir)
+		fields, err := parseFileFields(c.Query("fields"))
 		if err != nil {
-			return fmt.Errorf("failed to walk dir: %w", err)
+			return fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+
+		// Listings are revalidated with a cheap summary of the file system
+		// instead of being listed again when nothing changed.
+		var state listingState
+		if a.config.Archive != nil {
+			state = a.config.Archive.state()
+		} else if c.Context().QueryArgs().Has("dir") {
+			state, err = directoryState(a.config.RootDir, c.Query("dir"))
+		} else {
+			state, err = treeState(a.config.RootDir, a.config.Walk)
+		}
+		// Errors are reported by the listing below.
+		if err == nil {
+			variant := fmt.Sprintf("%d\x00%s\x00%s", a.started.UnixNano(), c.Request().URI().QueryString(), c.Get(fiber.HeaderAccept))
+			if etag, ok := state.etag(variant, a.config.Walk); ok {
+				c.Set(fiber.HeaderETag, etag)
+				c.Set(fiber.HeaderCacheControl, "no-cache")
+				if c.Fresh() {
+					return c.SendStatus(http.StatusNotModified)
+				}
+			}
+		}
+
+		var dir Directory
+		if c.Context().QueryArgs().Has("dir") {
+			if a.config.Archive != nil {
+				dir, err = a.config.Archive.listDirectory(c.Query("dir"), a.config.Walk)
+			} else {
+				dir, err = listDirectory(a.config.RootDir, c.Query("dir"), a.config.Walk)
+			}
+			if err != nil {
+				return fiber.NewError(http.StatusBadRequest, err.Error())
+			}
+		} else if a.config.Archive != nil {
+			if dir, err = a.config.Archive.walkImages(a.config.Walk); err != nil {
+				return fmt.Errorf("failed to walk dir: %w", err)
+			}
+		} else {
+			dir, err = walkImages(a.config.RootDir, a.config.Walk)
+			if err != nil {
+				return fmt.Errorf("failed to walk dir: %w", err)
+			}
+			if a.config.Prewarm {
+				a.prewarmOnce.Do(func() {
+					// Videos are listed too, but have no thumbnails.
+					files := slices.DeleteFunc(slices.Clone(dir.Files), func(file FileInfo) bool {
+						return !isImageFile(file.Name)
+					})
+					go prewarmThumbnails(prewarmCtx, a.thumbnails, a.config.RootDir, files, defaultSpriteSize, a.config.Walk, &a.busy)
+				})
+			}
+		}
+
+		// Facets are counted before filtering, so every camera, lens and
+		// focal length stays selectable in a filter dropdown.
+		cameras := cameraFacets(dir.Files)
+		lenses := lensFacets(dir.Files)
+		focalLengths := focalLengthFacets(dir.Files)
+		if c.Context().QueryArgs().Has("camera") {
+			camera := c.Query("camera")
+			dir.Files = slices.DeleteFunc(dir.Files, func(file FileInfo) bool {
+				return !file.IsDir && file.Camera != camera
+			})
+		}
+		if c.Context().QueryArgs().Has("lens") {
+			lens := c.Query("lens")
+			dir.Files = slices.DeleteFunc(dir.Files, func(file FileInfo) bool {
+				return !file.IsDir && file.Lens != lens
+			})
+		}
+		if c.Context().QueryArgs().Has("focal") {
+			// An empty value selects the images without one, like camera=.
+			var focal float64
+			if s := c.Query("focal"); s != "" {
+				if focal, err = strconv.ParseFloat(strings.TrimSuffix(s, "mm"), 64); err != nil || focal <= 0 || math.IsInf(focal, 0) {
+					return fiber.NewError(http.StatusBadRequest, "focal must be a focal length in millimeters, such as 50")
+				}
+				focal = math.Round(focal*10) / 10
+			}
+			dir.Files = slices.DeleteFunc(dir.Files, func(file FileInfo) bool {
+				return !file.IsDir && file.FocalLength != focal
+			})
+		}
+
+		if c.Context().QueryArgs().Has("blank") {
+			if !a.config.Walk.DetectBlank {
+				return fiber.NewError(http.StatusBadRequest, "filtering blank images requires --detect-blank")
+			}
+			blank, err := strconv.ParseBool(c.Query("blank"))
+			if err != nil {
+				return fiber.NewError(http.StatusBadRequest, "blank must be true or false")
+			}
+			// Images that failed to decode have no verdict, and are only
+			// kept when blanks are hidden.
+			dir.Files = slices.DeleteFunc(dir.Files, func(file FileInfo) bool {
+				return !file.IsDir && (file.Blank != nil && *file.Blank) != blank
+			})
+		}
+
+		if by := c.Query("sort"); by != "" {
+			if err := sortFiles(dir.Files, by); err != nil {
+				return fiber.NewError(http.StatusBadRequest, err.Error())
+			}
+		}
+
+		if algo := c.Query("hash"); algo != "" {
+			if _, err := newHash(algo); err != nil {
+				return fiber.NewError(http.StatusBadRequest, err.Error())
+			}
+			if a.config.Archive != nil {
+				return fiber.NewError(http.StatusNotImplemented, "hashes are not supported when serving an archive")
+			}
+			if err := hashFiles(c.Context(), a.config.RootDir, dir.Files, algo, a.config.Walk.concurrency()); err != nil {
+				return fmt.Errorf("failed to hash files: %w", err)
+			}
 		}
 
 		for i := range dir.Files {
-			dir.Files[i].URL = "/api/view?file=" + url.QueryEscape(dir.Files[i].Name)
+			if !dir.Files[i].IsDir {
+				dir.Files[i].URL = "/api/view?file=" + url.QueryEscape(dir.Files[i].Name)
+			}
+		}
+
+		if wantsCSV(c) {
+			c.Set(fiber.HeaderContentType, csvContentType)
+			c.Attachment(filepath.Base(a.config.RootDir) + ".csv")
+			return writeListingCSV(c.Response().BodyWriter(), dir.Files)
+		}
+		if wantsNDJSON(c) {
+			c.Set(fiber.HeaderContentType, ndjsonContentType)
+			enc := json.NewEncoder(c.Response().BodyWriter())
+			for _, file := range dir.Files {
+				if err := enc.Encode(fields.pick(file)); err != nil {
+					return fmt.Errorf("failed to encode file: %w", err)
+				}
+			}
+			return nil
 		}
 
 		var response struct {
-			Name  string     `json:"name"`
-			Files []FileInfo `json:"files"`
+			Name string `json:"name"`
+			// Files holds FileInfos, or only the requested fields of each.
+			Files      any         `json:"files"`
+			Navigation *Navigation `json:"navigation,omitempty"`
+			// Cameras counts the listed images per camera, before the camera
+			// filter is applied.
+			Cameras []CameraFacet `json:"cameras"`
+			// Lenses and FocalLengths count the listed images per lens and
+			// per focal length, before the lens and focal filters are
+			// applied.
+			Lenses       []LensFacet        `json:"lenses"`
+			FocalLengths []FocalLengthFacet `json:"focal_lengths"`
+			// Skipped counts the files left out of the listing, before the
+			// camera filter is applied.
+			Skipped *SkippedFiles `json:"skipped,omitempty"`
 		}
 		response.Name = dir.Name
-		response.Files = dir.Files
+		response.Files = fields.pickAll(dir.Files)
+		response.Navigation = dir.Navigation
+		response.Cameras = cameras
+		response.Lenses = lenses
+		response.FocalLengths = focalLengths
+		response.Skipped = dir.Skipped
 
 		return c.JSON(response)
 	})
 
-	webapp.Post("/api/save", func(c *fiber.Ctx) error {
+	webapp.Get("/api/preview/rotate", a.requireDirectoryRoot, a.limitImageRequests, a.limitDecodes, func(c *fiber.Ctx) error {
+		name := filepath.FromSlash(c.Query("file"))
+		if !filepath.IsLocal(name) || !isImageFile(name) {
+			return fiber.NewError(http.StatusBadRequest, "invalid image filename")
+		}
+		if err := a.checkListable(name); err != nil {
+			return err
+		}
+		angle, err := strconv.ParseFloat(c.Query("angle", "0"), 64)
+		if err != nil || math.IsNaN(angle) || math.IsInf(angle, 0) {
+			return fiber.NewError(http.StatusBadRequest, "angle must be a number of degrees")
+		}
+		crop := c.QueryBool("crop", false)
+		if crop && math.Abs(angle) >= 45 {
+			return fiber.NewError(http.StatusBadRequest, "cropped previews need an angle between -45 and 45 degrees, like straighten operations")
+		}
+		size := c.QueryInt("size", 1024)
+		if size < 16 || size > 4096 {
+			return fiber.NewError(http.StatusBadRequest, "size must be between 16 and 4096")
+		}
+
+		img, err := rotationPreview(c.UserContext(), filepath.Join(a.config.RootDir, name), a.config.Walk.Orientation, angle, size, crop, a.config.ScaledDecode)
+		if errors.Is(err, fs.ErrNotExist) {
+			return fiber.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		var b bytes.Buffer
+		if err := imaging.Encode(&b, img, imaging.JPEG, imaging.JPEGQuality(80)); err != nil {
+			return fmt.Errorf("failed to encode preview: %w", err)
+		}
+		c.Type("jpg")
+		return a.send(c, b.Bytes())
+	})
+
+	webapp.Get("/api/compare", a.requireDirectoryRoot, a.limitImageRequests, a.limitDecodes, func(c *fiber.Ctx) error {
+		var paths []string
+		for _, key := range []string{"a", "b"} {
+			name := filepath.FromSlash(c.Query(key))
+			if !filepath.IsLocal(name) || !isImageFile(name) {
+				return fiber.NewError(http.StatusBadRequest, fmt.Sprintf("invalid image filename in %s", key))
+			}
+			if err := a.checkListable(name); err != nil {
+				return err
+			}
+			paths = append(paths, filepath.Join(a.config.RootDir, name))
+		}
+		layout := c.Query("layout", CompareSideBySide)
+		if layout != CompareSideBySide && layout != CompareStacked {
+			return fiber.NewError(http.StatusBadRequest, "layout must be side or stack")
+		}
+		size := c.QueryInt("size", 1024)
+		if size < 16 || size > 4096 {
+			return fiber.NewError(http.StatusBadRequest, "size must be between 16 and 4096")
+		}
+
+		img, err := comparison(paths[0], paths[1], a.config.Walk.Orientation, layout, size)
+		if errors.Is(err, fs.ErrNotExist) {
+			return fiber.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		var b bytes.Buffer
+		if err := imaging.Encode(&b, img, imaging.JPEG, imaging.JPEGQuality(90)); err != nil {
+			return fmt.Errorf("failed to encode comparison: %w", err)
+		}
+		c.Type("jpg")
+		return a.send(c, b.Bytes())
+	})
+
+	webapp.Get("/api/sprite", a.requireDirectoryRoot, a.limitImageRequests, func(c *fiber.Ctx) error {
+		size := c.QueryInt("size", defaultSpriteSize)
+		page := c.QueryInt("page", 0)
+		perPage := c.QueryInt("per_page", 100)
+		if size < 16 || size > 512 {
+			return fiber.NewError(http.StatusBadRequest, "size must be between 16 and 512")
+		}
+		if page < 0 || perPage < 1 || perPage > 400 {
+			return fiber.NewError(http.StatusBadRequest, "page must not be negative and per_page must be between 1 and 400")
+		}
+		label := c.Query("label")
+		if label != LabelNone && label != LabelName && label != LabelSize {
+			return fiber.NewError(http.StatusBadRequest, "label must be name or size")
+		}
+
+		files, _, err := findImages(a.config.RootDir, a.config.Walk)
+		if err != nil {
+			return fmt.Errorf("failed to walk dir: %w", err)
+		}
+		if c.Context().QueryArgs().Has("dir") {
+			absDir, err := resolveDir(a.config.RootDir, c.Query("dir"))
+			if err != nil {
+				return fiber.NewError(http.StatusBadRequest, err.Error())
+			}
+			relDir, err := filepath.Rel(a.config.RootDir, absDir)
+			if err != nil {
+				return fmt.Errorf("failed to get relative path: %w", err)
+			}
+			if relDir != "." {
+				files = slices.DeleteFunc(files, func(file FileInfo) bool {
+					return !strings.HasPrefix(file.Name, relDir+string(filepath.Separator))
+				})
+			}
+		}
+
+		// Pages past the end are empty. Bounding the page first keeps a
+		// huge one from overflowing the multiplication.
+		start := min(page, len(files)/perPage+1) * perPage
+		start = min(start, len(files))
+		end := min(start+perPage, len(files))
+		names := make([]string, 0, end-start)
+		for _, file := range files[start:end] {
+			names = append(names, file.Name)
+		}
+		sheet, err := buildSpriteSheet(c.UserContext(), a.config.RootDir, names, len(files), size, label, a.config.Walk, a.thumbnails)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(sheet)
+		if err != nil {
+			return fmt.Errorf("failed to encode sprite sheet: %w", err)
+		}
+		c.Type("json")
+		return a.send(c, data)
+	})
+
+	webapp.Get("/api/history", func(c *fiber.Ctx) error {
+		filename := c.Query("file")
+		if filename == "" {
+			return fiber.NewError(http.StatusBadRequest, "missing file")
+		}
+		if a.config.HistoryPath == "" {
+			return c.JSON([]CropHistoryEntry{})
+		}
+		entries, err := readCropHistory(a.config.HistoryPath, filename)
+		if err != nil {
+			return err
+		}
+		return c.JSON(entries)
+	})
+
+	webapp.Get("/api/presets", func(c *fiber.Ctx) error {
+		presets := a.config.Presets
+		if presets == nil {
+			presets = []CropPreset{}
+		}
+		return c.JSON(presets)
+	})
+
+	webapp.Get("/api/dir-settings", a.requireDirectoryRoot, func(c *fiber.Ctx) error {
+		absDir, err := resolveDir(a.config.RootDir, c.Query("dir"))
+		if err != nil {
+			return fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+		relDir, err := filepath.Rel(a.config.RootDir, absDir)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %w", err)
+		}
+		settings, err := loadDirSettings(a.config.RootDir, relDir)
+		if err != nil {
+			return err
+		}
+		return c.JSON(settings)
+	})
+
+	webapp.Get("/api/tree", a.requireDirectoryRoot, func(c *fiber.Ctx) error {
+		tree, err := buildDirTree(a.config.RootDir, a.config.Walk)
+		if err != nil {
+			return fmt.Errorf("failed to build dir tree: %w", err)
+		}
+		return c.JSON(tree)
+	})
+
+	webapp.Get("/api/index", a.requireDirectoryRoot, func(c *fiber.Ctx) error {
+		index, err := indexImages(a.config.RootDir, c.Query("by", "month"), c.Query("date"), a.config.Walk)
+		if err != nil {
+			return fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(index)
+	})
+
+	webapp.Post("/api/save", a.requireSavable, func(c *fiber.Ctx) error {
+		ops, err := a.parseOperations(c)
+		if err != nil {
+			return err
+		}
+		if len(a.config.AllowedOps) > 0 {
+			for _, op := range ops {
+				if !slices.Contains(a.config.AllowedOps, op.Type()) {
+					return fiber.NewError(http.StatusForbidden, fmt.Sprintf("operation type %q is not allowed", op.Type()))
+				}
+			}
+		}
+		if a.config.Walk.Files != nil {
+			for _, op := range ops {
+				for _, filename := range op.Filenames() {
+					if !isRemoteSource(filename) && !a.config.Walk.Files.Contains(filepath.FromSlash(filename)) {
+						return fiber.NewError(http.StatusForbidden, fmt.Sprintf("%s is not in the file list", filename))
+					}
+				}
+			}
+		}
+
+		if a.config.PreviewMode {
+			var planned []PlannedOutput
+			if a.config.OnPlan != nil {
+				planned = a.config.OnPlan(ops)
+			}
+			log.Ctx(ctx).Info().Int("operations", len(ops)).Msg("Previewed save without executing it")
+			c.Set(previewModeHeader, "true")
+			return c.JSON(fiber.Map{"executed": false, "planned": planned})
+		}
+
+		if a.config.OnSave == nil {
+			return fiber.NewError(http.StatusNotImplemented, "saving is not configured")
+		}
+		if a.debouncer != nil {
+			a.debouncer.Save(ops)
+			return c.SendStatus(http.StatusAccepted)
+		}
+		a.saves.Add(1)
+		defer a.saves.Done()
+		// Crops shrunk to fit are saved, but reported, so frontends can
+		// surface coordinate bugs.
+		if clamps := a.runSave(ctx, ops); len(clamps) > 0 {
+			c.Set(cropClampedHeader, strconv.Itoa(len(clamps)))
+			return c.JSON(fiber.Map{"clamped": clamps})
+		}
+		return c.SendStatus(http.StatusNoContent)
+	})
+	webapp.Post("/api/cancel", func(c *fiber.Ctx) error {
+		cancelled := a.cancelSaves()
+		if a.debouncer != nil && a.debouncer.Cancel() {
+			cancelled++
+		}
+		if cancelled > 0 {
+			log.Ctx(ctx).Warn().Int("saves", cancelled).Msg("Cancelled saves")
+		}
+		return c.JSON(fiber.Map{"cancelled": cancelled})
+	})
+	webapp.Post("/api/undo", a.requireWritable, func(c *fiber.Ctx) error {
+		outputs, remaining, ok := a.undo.pop()
+		if !ok {
+			return fiber.NewError(http.StatusConflict, "nothing to undo")
+		}
+		removed, err := removeOutputs(a.config.OutputDir, outputs)
+		if err != nil {
+			return err
+		}
+		log.Ctx(ctx).Info().Int("removed", len(removed)).Int("remaining", remaining).Msg("Undid save")
+		return c.JSON(fiber.Map{"removed": removed, "remaining": remaining})
+	})
+	webapp.Post("/api/download-zip", a.requireDirectoryRoot, func(c *fiber.Ctx) error {
 		var request struct {
-			Operations []Operation `json:"operations"`
+			Filenames []string `json:"filenames" form:"filenames"`
+		}
+		if err := c.BodyParser(&request); err != nil {
+			return err
+		}
+		if len(request.Filenames) == 0 {
+			return fiber.NewError(http.StatusBadRequest, "no filenames to download")
+		}
+		// Everything is checked up front, since the status can't change
+		// once the archive has started streaming.
+		var names []string
+		seen := map[string]bool{}
+		for _, filename := range request.Filenames {
+			name := filepath.FromSlash(filename)
+			if !filepath.IsLocal(name) {
+				return fiber.NewError(http.StatusBadRequest, fmt.Sprintf("invalid filename %q", filename))
+			}
+			if err := a.checkListable(name); err != nil {
+				return err
+			}
+			info, err := os.Stat(filepath.Join(a.config.RootDir, name))
+			if err != nil || !info.Mode().IsRegular() || !a.config.Walk.settled(info.ModTime()) {
+				return fiber.NewError(http.StatusNotFound, fmt.Sprintf("file %q not found", filename))
+			}
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
 		}
 
+		c.Set(fiber.HeaderContentType, "application/zip")
+		c.Attachment(filepath.Base(a.config.RootDir) + ".zip")
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			if err := writeZipDownload(w, a.config.RootDir, names, a.bandwidth.Reader); err != nil {
+				log.Ctx(ctx).Error().Err(err).Msg("Failed to stream zip download")
+			}
+		})
+		return nil
+	})
+	webapp.Post("/api/plan", func(c *fiber.Ctx) error {
+		ops, err := a.parseOperations(c)
+		if err != nil {
+			return err
+		}
+
+		if a.config.OnPlan == nil {
+			return fiber.NewError(http.StatusNotImplemented, "planning is not configured")
+		}
+		return c.JSON(a.config.OnPlan(ops))
+	})
+	webapp.Post("/api/output/delete", a.requireWritable, func(c *fiber.Ctx) error {
+		var request struct {
+			Filename string `json:"filename"`
+		}
 		if err := c.BodyParser(&request); err != nil {
 			return err
 		}
 
-		a.config.OnSave(request.Operations)
+		name := filepath.FromSlash(request.Filename)
+		if a.config.OutputDir == "" || !filepath.IsLocal(name) {
+			return fiber.NewError(http.StatusBadRequest, "invalid output filename")
+		}
+		path := filepath.Join(a.config.OutputDir, name)
+		info, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return fiber.ErrNotFound
+		} else if err != nil {
+			return fmt.Errorf("failed to stat output file: %w", err)
+		}
+		if info.IsDir() {
+			return fiber.NewError(http.StatusBadRequest, "cannot delete a directory")
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to delete output file: %w", err)
+		}
 
+		log.Ctx(c.Context()).Info().Str("filename", request.Filename).Msg("Deleted output file")
 		return c.SendStatus(http.StatusNoContent)
 	})
 	webapp.Post("/api/shutdown", func(c *fiber.Ctx) error {
@@ -132,7 +948,12 @@ func (a *WebApp) Run(ctx context.Context) error {
 		return nil
 	})
 
-	if isDebug {
+	if a.config.Headless {
+		log.Debug().Msg("Headless mode enabled, not serving the frontend")
+		webapp.Get("/", func(c *fiber.Ctx) error {
+			return c.Status(http.StatusNotFound).SendString("pickemall is running headless; only /api/* is served\n")
+		})
+	} else if isDebug {
 		log.Debug().Msg("Debug mode enabled, serving static files from './static' directory")
 		webapp.Static("/", "static")
 	} else {
@@ -154,5 +975,132 @@ func (a *WebApp) Run(ctx context.Context) error {
 		return fmt.Errorf("server error: %w", err)
 	}
 
+	if a.debouncer != nil {
+		a.debouncer.Flush()
+	}
+	a.waitForSaves(ctx)
 	return nil
 }
+
+// parseOperations reads the operations of a save or plan request. Besides
+// full operations, the body may list bare filenames, which are expanded
+// into operations of the DefaultOp type for minimal frontends.
+func (a *WebApp) parseOperations(c *fiber.Ctx) (Operations, error) {
+	var request struct {
+		Operations []Operation `json:"operations"`
+		Filenames  []string    `json:"filenames"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return nil, err
+	}
+	for _, filename := range request.Filenames {
+		op, err := defaultOperation(a.config.DefaultOp, filename)
+		if err != nil {
+			return nil, fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+		request.Operations = append(request.Operations, op)
+	}
+	return request.Operations, nil
+}
+
+// send writes data as the response body, throttled when a bandwidth limit
+// is set.
+func (a *WebApp) send(c *fiber.Ctx, data []byte) error {
+	if a.bandwidth == nil {
+		return c.Send(data)
+	}
+	return c.SendStream(a.bandwidth.Reader(bytes.NewReader(data)), len(data))
+}
+
+// checkListable checks that the file name, relative to the root, is one
+// listings could show, so endpoints that read files by name don't expose
+// the rest of the root: other files, those left out by the listing
+// options, or outputs. It returns the error to respond with when it isn't.
+func (a *WebApp) checkListable(name string) error {
+	if !filepath.IsLocal(name) {
+		return fiber.NewError(http.StatusBadRequest, fmt.Sprintf("invalid filename %q", filepath.ToSlash(name)))
+	}
+	notFound := fiber.NewError(http.StatusNotFound, fmt.Sprintf("file %q not found", filepath.ToSlash(name)))
+	walk := a.config.Walk
+	if walk.skips(name) != notSkipped || !walk.Files.Contains(name) || !walk.withinDepth(filepath.Dir(name)) {
+		return notFound
+	}
+	if excluded := walk.excludedDir(); excluded != "" {
+		path := canonicalPath(filepath.Join(a.config.RootDir, name))
+		if strings.HasPrefix(path, excluded+string(filepath.Separator)) {
+			return notFound
+		}
+	}
+	return nil
+}
+
+// sendPoster responds to a view of the video name with its poster, since
+// the frontend shows every listed file as an image.
+func (a *WebApp) sendPoster(c *fiber.Ctx, name string) error {
+	name = filepath.FromSlash(name)
+	if err := a.checkListable(name); err != nil {
+		return err
+	}
+	poster, err := a.config.Walk.Videos.Poster(c.UserContext(), filepath.Join(a.config.RootDir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fiber.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	c.Type("jpg")
+	return a.send(c, poster)
+}
+
+// sendPlaceholder responds to a view of the missing image name with the
+// configured placeholder, marked with placeholderHeader and not cached, so
+// the real image shows up once it's back.
+func (a *WebApp) sendPlaceholder(c *fiber.Ctx, name string) error {
+	var data []byte
+	var err error
+	if a.config.PlaceholderImage != "" {
+		data, err = os.ReadFile(a.config.PlaceholderImage)
+		c.Type(typeExtension(a.config.PlaceholderImage))
+	} else {
+		data, err = generatedPlaceholder(name)
+		c.Type("jpg")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load placeholder: %w", err)
+	}
+	c.Set(placeholderHeader, "missing")
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return a.send(c, data)
+}
+
+// sendThrottledFile serves a file from root like filesystem.SendFile, but
+// throttled. Range requests aren't supported and get the whole file.
+func (a *WebApp) sendThrottledFile(c *fiber.Ctx, root http.FileSystem, name string) error {
+	f, err := root.Open(name)
+	if err != nil {
+		return fiber.ErrNotFound
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return fiber.ErrNotFound
+	}
+	c.Type(typeExtension(name))
+	// The body is streamed after the handler returns, and the stream
+	// closes the file when it's done.
+	return c.SendStream(a.bandwidth.Reader(f), int(info.Size()))
+}
+
+// waitForSaves blocks until in-flight saves finish or saveDrainTimeout
+// passes, whichever comes first.
+func (a *WebApp) waitForSaves(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		a.saves.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(saveDrainTimeout):
+		log.Ctx(ctx).Warn().Dur("timeout", saveDrainTimeout).Msg("Timed out waiting for saves to finish")
+	}
+}
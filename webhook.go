@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// webhookTimeout bounds each webhook delivery.
+const webhookTimeout = 10 * time.Second
+
+// saveSummary is the JSON body POSTed to the webhook on each save.
+type saveSummary struct {
+	RootDir    string         `json:"root_dir"`
+	Timestamp  time.Time      `json:"timestamp"`
+	Operations int            `json:"operations"`
+	Counts     map[string]int `json:"counts"`
+}
+
+func newSaveSummary(rootDir string, ops Operations) saveSummary {
+	counts := map[string]int{}
+	for _, op := range ops {
+		counts[op.Type()]++
+	}
+	return saveSummary{
+		RootDir:    rootDir,
+		Timestamp:  time.Now().UTC(),
+		Operations: len(ops),
+		Counts:     counts,
+	}
+}
+
+// WebhookNotifier POSTs save summaries to a URL in the background.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+
+	wg sync.WaitGroup
+}
+
+// Notify sends summary without blocking the caller. Failures are logged.
+func (n *WebhookNotifier) Notify(ctx context.Context, summary saveSummary) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		if err := n.send(context.WithoutCancel(ctx), summary); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to deliver webhook")
+		}
+	}()
+}
+
+// Wait blocks until every notification in flight has been delivered or has
+// failed, so they aren't cut off when the process exits.
+func (n *WebhookNotifier) Wait() {
+	n.wg.Wait()
+}
+
+func (n *WebhookNotifier) send(ctx context.Context, summary saveSummary) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook body: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %s", resp.Status)
+	}
+	return nil
+}
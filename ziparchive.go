@@ -0,0 +1,98 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// zipArchives writes outputs into one zip archive per operation type, such
+// as crops.zip and picks.zip in the output directory. Archives are created
+// on their first output and replace any archive from an earlier run.
+type zipArchives struct {
+	dir   string
+	modes outputModes
+
+	mu       sync.Mutex
+	archives map[string]*zipArchive
+}
+
+type zipArchive struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *zip.Writer
+}
+
+func newZipArchives(dir string, modes outputModes) *zipArchives {
+	return &zipArchives{dir: dir, modes: modes, archives: map[string]*zipArchive{}}
+}
+
+// zipArchiveName returns the archive file name for an operation type.
+func zipArchiveName(opType string) string {
+	if opType == "metadata" {
+		return "metadata.zip"
+	}
+	return opType + "s.zip"
+}
+
+// Add writes the contents of r to the archive of opType as name, a path
+// relative to the output directory.
+func (z *zipArchives) Add(opType, name string, r io.Reader) error {
+	archive, err := z.archive(opType)
+	if err != nil {
+		return err
+	}
+
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	w, err := archive.w.CreateHeader(&zip.FileHeader{
+		Name:     filepath.ToSlash(name),
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add %s to %s: %w", name, zipArchiveName(opType), err)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("failed to write %s to %s: %w", name, zipArchiveName(opType), err)
+	}
+	return nil
+}
+
+func (z *zipArchives) archive(opType string) (*zipArchive, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if archive, ok := z.archives[opType]; ok {
+		return archive, nil
+	}
+
+	path := filepath.Join(z.dir, zipArchiveName(opType))
+	f, err := z.modes.create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive %s: %w", path, err)
+	}
+	archive := &zipArchive{file: f, w: zip.NewWriter(f)}
+	z.archives[opType] = archive
+	return archive, nil
+}
+
+// Close finishes every archive. The archives are unusable until it's called.
+func (z *zipArchives) Close() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	var errs []error
+	for opType, archive := range z.archives {
+		if err := archive.w.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to finish %s: %w", zipArchiveName(opType), err))
+		}
+		if err := archive.file.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close %s: %w", zipArchiveName(opType), err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// writeZipDownload writes a zip archive of the named files, relative to
+// rootDir, to w. Files are read and written one at a time, so memory use
+// doesn't depend on their size. Images barely compress, so entries are
+// stored as is, which keeps the download as fast as the disk. throttle
+// wraps the reader of every file, e.g. to limit bandwidth.
+func writeZipDownload(w io.Writer, rootDir string, names []string, throttle func(io.Reader) io.Reader) error {
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		if err := addZipDownloadEntry(zw, rootDir, name, throttle); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func addZipDownloadEntry(zw *zip.Writer, rootDir, name string, throttle func(io.Reader) io.Reader) error {
+	path := filepath.Join(rootDir, name)
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file %s: %w", path, err)
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return fmt.Errorf("failed to add %s to zip: %w", name, err)
+	}
+	header.Name = filepath.ToSlash(name)
+	header.Method = zip.Store
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return fmt.Errorf("failed to add %s to zip: %w", name, err)
+	}
+	if _, err := io.Copy(entry, throttle(f)); err != nil {
+		return fmt.Errorf("failed to add %s to zip: %w", name, err)
+	}
+	return nil
+}